@@ -39,6 +39,24 @@ const (
 	// ActionDelete ("delete" in the API) denotes permission to delete secret
 	// versions, either individually or entirely.
 	ActionDelete = Action("delete")
+
+	// ActionRename ("rename" in the API) denotes permission to move all the
+	// versions of a secret to a new name. It is required for both the old and
+	// the new name of the secret.
+	ActionRename = Action("rename")
+
+	// ActionSetPrincipals ("set-principals" in the API) denotes permission to
+	// set the list of principals allowed to access a secret.
+	ActionSetPrincipals = Action("set-principals")
+
+	// ActionUndelete ("undelete" in the API) denotes permission to restore a
+	// secret that was soft-deleted, while it is still retained.
+	ActionUndelete = Action("undelete")
+
+	// ActionAdmin ("admin" in the API) denotes permission to override the
+	// protection of an immutable secret, to delete or rename it. A version
+	// that was ever active cannot be deleted even with this permission.
+	ActionAdmin = Action("admin")
 )
 
 // Secret is a secret name pattern that can optionally contain '*' wildcard
@@ -2,11 +2,19 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // Package audit provides an audit log writer for access to secrets.
+//
+// The log is a sequence of JSON objects, one per line, each encoding an
+// [Entry]. Tools that consume the log can decode it using the Entry type.
 package audit
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net/netip"
@@ -35,6 +43,15 @@ type Principal struct {
 	Tags []string `json:"tags,omitempty"`
 }
 
+// Name returns a short human-readable name for p: the user login name if p
+// is a user, or else its hostname.
+func (p Principal) Name() string {
+	if p.User != "" {
+		return p.User
+	}
+	return p.Hostname
+}
+
 // Entry is an audit log entry.
 type Entry struct {
 	// ID is the entry's ID.
@@ -60,6 +77,43 @@ type Entry struct {
 	// upon. Set for acl.ActionGet, acl.ActionPut,
 	// acl.ActionSetActive.
 	SecretVersion api.SecretVersion `json:"secretVersion,omitempty"`
+	// NewSecret is the name to which the secret is being moved. Set
+	// for acl.ActionRename. For acl.ActionPut, it is set when the
+	// secret is being made an alias, to the name of its target.
+	NewSecret string `json:"newSecret,omitempty"`
+	// Fingerprint is a fingerprint of the secret value involved, as
+	// computed by Fingerprint. Set for acl.ActionPut,
+	// acl.ActionCreateVersion and acl.ActionActivate, unless the
+	// server is configured to omit fingerprints. The value itself is
+	// never recorded.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Reason explains why the action was denied, if it was denied by
+	// an authorization hook rather than by ACLs. For a version deleted
+	// automatically, such as one pruned by a put, it explains why.
+	Reason string `json:"reason,omitempty"`
+	// RequestID is the ID of the API request that caused the action, as
+	// reported to the client in the api.RequestIDHeader header. It is
+	// empty for actions not caused by an API request.
+	RequestID string `json:"requestID,omitempty"`
+}
+
+// fingerprintLen is the number of bytes of the SHA-256 digest of a secret
+// value kept in its fingerprint.
+const fingerprintLen = 12
+
+// Fingerprint returns a fingerprint of a secret value for use in audit
+// entries: a hex-encoded prefix of its SHA-256 digest. Equal values have
+// equal fingerprints, so they can be used to correlate which value was
+// involved in an action, but the value cannot be recovered from it.
+//
+// As with any unsalted hash, a fingerprint can be used to confirm a guess
+// at a value. For that reason, the server reports fingerprints in audit
+// queries only to callers that may get the secret concerned. For low-entropy
+// values, such as short passwords, consider disabling fingerprints, since
+// anyone who can read the audit log file can still check guesses.
+func Fingerprint(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:fingerprintLen])
 }
 
 // Writer is an audit log writer.
@@ -71,7 +125,7 @@ type Writer struct {
 // New returns a Writer that outputs audit log entries to w as JSON
 // objects. If w also implements io.Closer, Writer.Close closes w. If
 // w also implements a Sync method with the same signature as os.File,
-// Writer.Sync calls w.Sync.
+// Writer.Sync calls w.Sync, and reports its error from every write.
 func New(w io.Writer) *Writer {
 	return &Writer{
 		w:   w,
@@ -128,3 +182,50 @@ func (l *Writer) WriteEntries(entries ...*Entry) error {
 	}
 	return l.Sync()
 }
+
+// Query selects entries from an audit log. A zero Query matches all entries.
+type Query struct {
+	// Since, if non-zero, matches only entries written at or after this time.
+	Since time.Time
+	// Secret, if non-empty, matches only entries acting on this secret,
+	// either as Secret or as NewSecret.
+	Secret string
+}
+
+// Match reports whether e is selected by q.
+func (q Query) Match(e *Entry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if q.Secret != "" && e.Secret != q.Secret && e.NewSecret != q.Secret {
+		return false
+	}
+	return true
+}
+
+// Scan reads audit log entries from r in the order they were written, and
+// calls f for each. If f reports an error, Scan stops and returns that error.
+//
+// Each entry is one line. A final line without a newline is ignored, since
+// it may be an entry that is still being written.
+func Scan(r io.Reader, f func(*Entry) error) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("decoding audit entry: %w", err)
+		}
+		if err := f(&e); err != nil {
+			return err
+		}
+	}
+}
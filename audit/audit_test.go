@@ -7,11 +7,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/types/api"
 )
 
 func TestWriter(t *testing.T) {
@@ -81,6 +88,73 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestScan(t *testing.T) {
+	var buf bytes.Buffer
+	w := audit.New(&buf)
+
+	entries := []*audit.Entry{
+		{Action: "put", Secret: "foo", SecretVersion: 1},
+		{Action: "get", Secret: "bar", SecretVersion: 1},
+		{Action: "rename", Secret: "bar", NewSecret: "foo"},
+	}
+	if err := w.WriteEntries(entries...); err != nil {
+		t.Fatalf("writing audit log entries: %v", err)
+	}
+	log := buf.Bytes()
+
+	scan := func(q audit.Query) []*audit.Entry {
+		t.Helper()
+		var got []*audit.Entry
+		if err := audit.Scan(bytes.NewReader(log), func(e *audit.Entry) error {
+			if q.Match(e) {
+				got = append(got, e)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		return got
+	}
+	opt := cmp.Comparer(addrEqual)
+
+	if diff := cmp.Diff(scan(audit.Query{}), entries, opt); diff != "" {
+		t.Errorf("Scan all (-got+want):\n%s", diff)
+	}
+	if diff := cmp.Diff(scan(audit.Query{Secret: "foo"}), []*audit.Entry{entries[0], entries[2]}, opt); diff != "" {
+		t.Errorf("Scan foo (-got+want):\n%s", diff)
+	}
+	if got := scan(audit.Query{Since: entries[2].Time.Add(time.Second)}); len(got) != 0 {
+		t.Errorf("Scan future: got %d entries, want 0", len(got))
+	}
+
+	// An error from the callback stops the scan.
+	var n int
+	errStop := errors.New("stop")
+	if err := audit.Scan(bytes.NewReader(log), func(*audit.Entry) error {
+		n++
+		return errStop
+	}); !errors.Is(err, errStop) || n != 1 {
+		t.Errorf("Scan: got (%d, %v), want (1, %v)", n, err, errStop)
+	}
+
+	// A corrupted log reports an error.
+	if err := audit.Scan(strings.NewReader("{\"id\":1}\n{bogus\n"), func(*audit.Entry) error {
+		return nil
+	}); err == nil {
+		t.Error("Scan corrupted: got nil, want error")
+	}
+
+	// An unterminated final entry, still being written, is skipped.
+	partial := append(bytes.Clone(log), `{"action":"get","sec`...)
+	n = 0
+	if err := audit.Scan(bytes.NewReader(partial), func(*audit.Entry) error {
+		n++
+		return nil
+	}); err != nil || n != len(entries) {
+		t.Errorf("Scan partial: got (%d, %v), want (%d, nil)", n, err, len(entries))
+	}
+}
+
 type testWriter struct {
 	bytes.Buffer
 	syncErr        error
@@ -91,3 +165,164 @@ func (t *testWriter) Sync() error  { t.synced = true; return t.syncErr }
 func (t *testWriter) Close() error { t.closed = true; return nil }
 
 func addrEqual(x, y netip.Addr) bool { return x == y }
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w, err := audit.NewFileWithOptions(path, audit.FileOptions{MaxBytes: 1000})
+	if err != nil {
+		t.Fatalf("NewFileWithOptions: %v", err)
+	}
+
+	// Write entries concurrently, enough to rotate the log many times.
+	const numWriters, perWriter = 4, 25
+	var wg sync.WaitGroup
+	for i := range numWriters {
+		wg.Go(func() {
+			for j := range perWriter {
+				e := &audit.Entry{Action: "get", Secret: fmt.Sprintf("secret-%d", i), SecretVersion: api.SecretVersion(j + 1)}
+				if err := w.WriteEntries(e); err != nil {
+					t.Errorf("WriteEntries: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Every entry is present exactly once, complete and in order, and no
+	// file exceeds the size limit.
+	scanAll := func() map[string]api.SecretVersion {
+		t.Helper()
+		last := make(map[string]api.SecretVersion)
+		for _, name := range audit.LogFiles(path) {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			} else if len(data) > 1000 {
+				t.Errorf("File %s has %d bytes, want at most 1000", name, len(data))
+			}
+			if err := audit.Scan(bytes.NewReader(data), func(e *audit.Entry) error {
+				if prev, ok := last[e.Secret]; ok && e.SecretVersion != prev+1 {
+					t.Errorf("Entry for %s: got version %v after %v", e.Secret, e.SecretVersion, prev)
+				}
+				last[e.Secret] = e.SecretVersion
+				return nil
+			}); err != nil {
+				t.Errorf("Scan %s: %v", name, err)
+			}
+		}
+		return last
+	}
+	last := scanAll()
+	for i := range numWriters {
+		if got := last[fmt.Sprintf("secret-%d", i)]; got != perWriter {
+			t.Errorf("Last entry for secret-%d: got version %v, want %v", i, got, perWriter)
+		}
+	}
+	if n := len(audit.LogFiles(path)); n < 5 {
+		t.Fatalf("LogFiles: got %d files, want at least 5", n)
+	}
+
+	// With a limit on the number of files, the oldest are pruned at the next
+	// rotation.
+	w, err = audit.NewFileWithOptions(path, audit.FileOptions{MaxBytes: 1000, MaxFiles: 3})
+	if err != nil {
+		t.Fatalf("NewFileWithOptions: %v", err)
+	}
+	defer w.Close()
+	for range 10 {
+		if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: "pruned"}); err != nil {
+			t.Fatalf("WriteEntries: %v", err)
+		}
+	}
+	want := []string{path + ".3", path + ".2", path + ".1", path}
+	if diff := cmp.Diff(audit.LogFiles(path), want); diff != "" {
+		t.Errorf("LogFiles (-got, +want):\n%s", diff)
+	}
+	if _, err := os.Stat(path + ".4"); err == nil {
+		t.Errorf("File %s.4 was not pruned", path)
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// A non-empty directory where the oldest rotated file should be cannot
+	// be removed, so rotating with MaxFiles 1 fails.
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	w, err := audit.NewFileWithOptions(path, audit.FileOptions{MaxBytes: 100, MaxFiles: 1})
+	if err != nil {
+		t.Fatalf("NewFileWithOptions: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: "first"}); err != nil {
+		t.Fatalf("WriteEntries first: %v", err)
+	}
+	if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: "second"}); err == nil {
+		t.Error("WriteEntries second: got nil, want rotation error")
+	}
+
+	// The entry is written to the current file despite the error.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	var got []string
+	if err := audit.Scan(f, func(e *audit.Entry) error {
+		got = append(got, e.Secret)
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if diff := cmp.Diff(got, []string{"first", "second"}); diff != "" {
+		t.Errorf("Entries (-got, +want):\n%s", diff)
+	}
+}
+
+func TestOpenLogFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w, err := audit.NewFileWithOptions(path, audit.FileOptions{MaxBytes: 500})
+	if err != nil {
+		t.Fatalf("NewFileWithOptions: %v", err)
+	}
+	defer w.Close()
+
+	// Read the log repeatedly while it is written and rotated. Each read
+	// sees a prefix of the entries, in order, with none missing or repeated.
+	const numEntries = 300
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range numEntries {
+			if err := w.WriteEntries(&audit.Entry{Action: "get", Secret: "s", SecretVersion: api.SecretVersion(i + 1)}); err != nil {
+				t.Errorf("WriteEntries: %v", err)
+				return
+			}
+		}
+	})
+	for range 50 {
+		files, err := audit.OpenLogFiles(path)
+		if err != nil {
+			t.Fatalf("OpenLogFiles: %v", err)
+		}
+		var last api.SecretVersion
+		for _, f := range files {
+			if err := audit.Scan(f, func(e *audit.Entry) error {
+				if e.SecretVersion != last+1 {
+					return fmt.Errorf("got entry %v after %v", e.SecretVersion, last)
+				}
+				last = e.SecretVersion
+				return nil
+			}); err != nil {
+				t.Errorf("Scan %s: %v", f.Name(), err)
+			}
+			f.Close()
+		}
+	}
+	wg.Wait()
+}
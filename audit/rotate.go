@@ -0,0 +1,245 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// FileOptions are optional settings for an audit log file. A zero value is
+// ready for use, and writes a single file that grows without limit.
+type FileOptions struct {
+	// MaxBytes, if positive, is the size in bytes at which the file is
+	// rotated. Before an entry that would make the file larger than this is
+	// written, the file is renamed to path.1, the file previously called
+	// path.1 is renamed to path.2, and so on, and a new file is started at
+	// path. An entry larger than MaxBytes is written to a file of its own.
+	MaxBytes int64
+
+	// MaxFiles, if positive, is the number of rotated files to keep. Older
+	// files are removed when the log is rotated. If zero or negative, all
+	// rotated files are kept. It has no effect unless MaxBytes is positive.
+	MaxFiles int
+}
+
+// NewFileWithOptions is as NewFile, but applies the specified options.
+//
+// Rotation does not lose entries: the file is synced before it is renamed,
+// and the renamed files and the new file are linked into the directory
+// before further entries are written. If the process stops partway through a
+// rotation, every entry written so far is in one of the files, and the next
+// call to NewFileWithOptions creates the file at path if it is missing.
+func NewFileWithOptions(path string, opts FileOptions) (*Writer, error) {
+	if opts.MaxBytes <= 0 {
+		return NewFile(path)
+	}
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return New(&rotatingFile{path: path, opts: opts, f: f, size: fi.Size()}), nil
+}
+
+// LogFiles reports the paths of the files of the audit log at path, oldest
+// first: any files rotated out of it by a Writer from NewFileWithOptions,
+// followed by path itself. Files that do not exist are omitted.
+func LogFiles(path string) []string {
+	var out []string
+	if _, err := os.Stat(path); err == nil {
+		out = append(out, path)
+	}
+	for i := 1; ; i++ {
+		name := rotatedName(path, i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		out = append(out, name)
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// maxOpenAttempts is the number of times OpenLogFiles tries to open a
+// consistent set of files before giving up.
+const maxOpenAttempts = 10
+
+// OpenLogFiles opens the files of the audit log at path for reading, oldest
+// first, as reported by LogFiles. A Writer may rotate the log while the files
+// are being opened, renaming them; OpenLogFiles then tries again, so that the
+// files it reports are the complete log as of one moment, with no file
+// missing or repeated. Entries written afterward may not be included. The
+// caller must close the files.
+func OpenLogFiles(path string) ([]*os.File, error) {
+	for range maxOpenAttempts {
+		files, ok, err := openLogFiles(path)
+		if err != nil || ok {
+			return files, err
+		}
+	}
+	return nil, errors.New("audit log is rotating too often to read")
+}
+
+// openLogFiles opens the files reported by LogFiles(path), and reports
+// whether they were not renamed while being opened. If they were, or if an
+// error occurs, the files are closed.
+func openLogFiles(path string) (_ []*os.File, ok bool, _ error) {
+	listed := LogFiles(path)
+	names := listed
+	if len(names) == 0 {
+		names = []string{path} // report the error for the missing log
+	}
+	files := make([]*os.File, 0, len(names))
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, name := range names {
+		f, err := os.Open(name)
+		if errors.Is(err, fs.ErrNotExist) && name != path {
+			closeAll()
+			return nil, false, nil // rotated away since it was listed
+		} else if err != nil {
+			closeAll()
+			return nil, false, err
+		}
+		files = append(files, f)
+	}
+
+	// Check that each name still refers to the file opened for it, and that
+	// no file has been added.
+	if !slices.Equal(LogFiles(path), listed) {
+		closeAll()
+		return nil, false, nil
+	}
+	for i, f := range files {
+		fi, err := f.Stat()
+		if err != nil {
+			closeAll()
+			return nil, false, err
+		}
+		if ni, err := os.Stat(names[i]); err != nil || !os.SameFile(fi, ni) {
+			closeAll()
+			return nil, false, nil
+		}
+	}
+	return files, true, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// rotatedName returns the name of the ith file rotated out of the log at path.
+func rotatedName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// rotatingFile is an io.Writer that appends to a file, and rotates it when it
+// reaches a size limit. Each call to Write is written to a single file, so as
+// long as each entry is written with a single call, no entry is split across
+// files.
+type rotatingFile struct {
+	path string
+	opts FileOptions
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64 // current size of f
+}
+
+// Write appends p to the current file, rotating it first if p would make it
+// too large. If rotation fails, p is still written to the current file, so
+// that the entry is not lost, and the rotation error is reported after it.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rerr error
+	if r.size > 0 && r.size+int64(len(p)) > r.opts.MaxBytes {
+		if err := r.rotateLocked(); err != nil {
+			rerr = fmt.Errorf("rotating audit log: %w", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, rerr
+}
+
+// rotateLocked renames the current file and its rotated predecessors, removes
+// the oldest if there are too many, and starts a new file. If it fails, the
+// current file remains open, so that Write can still append the entry.
+func (r *rotatingFile) rotateLocked() error {
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+	last := 0
+	for {
+		if _, err := os.Stat(rotatedName(r.path, last+1)); err != nil {
+			break
+		}
+		last++
+	}
+	for i := last; i >= 1; i-- {
+		old := rotatedName(r.path, i)
+		if r.opts.MaxFiles > 0 && i >= r.opts.MaxFiles {
+			if err := os.Remove(old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		} else if err := os.Rename(old, rotatedName(r.path, i+1)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, rotatedName(r.path, 1)); err != nil {
+		return err
+	}
+	f, err := openLogFile(r.path)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(r.path)); err != nil {
+		f.Close()
+		return err
+	}
+	r.f.Close()
+	r.f, r.size = f, 0
+	return nil
+}
+
+// syncDir commits the entries of the directory at path to stable storage.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Sync commits the current file to stable storage.
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Sync()
+}
+
+// Close closes the current file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -81,9 +81,11 @@
 // # Other Operations
 //
 // Programs that need to create, update, or delete secrets and secret versions
-// may use a [Client] to directly call the full [setec HTTP API]. In this case,
-// the caller is responsible for handling retries in case the secrets service
-// is temporarily unavailable.
+// may use a [Client] to directly call the full [setec HTTP API]. The Client
+// retries read-only calls and [Client.Put] when they fail with transient
+// errors according to its [RetryPolicy], but does not retry other calls that
+// modify secrets. The caller is responsible for handling retries of those
+// calls in case the secrets service is temporarily unavailable.
 //
 // [Bootstrapping and Availability]: https://github.com/tailscale/setec?tab=readme-ov-file#bootstrapping-and-availability
 // [setec HTTP API]: https://github.com/tailscale/setec/blob/main/docs/api.md
@@ -91,13 +93,23 @@ package setec
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/types/api"
 )
 
@@ -108,69 +120,294 @@ var _ VersioningStoreClient = &Client{}
 // If you're just consuming secrets, you probably want to use a Store
 // instead.
 type Client struct {
-	// Server is the URL of the secrets server to talk to.
+	// Server is the URL of the secrets server to talk to. A bare hostname,
+	// optionally with a port, is also accepted; see [ParseServerURL].
 	Server string
 	// DoHTTP is the function to use to make HTTP requests. If nil,
-	// http.DefaultClient.Do is used.
+	// HTTPClient is used instead.
 	DoHTTP func(*http.Request) (*http.Response, error)
+	// HTTPClient is the HTTP client used to make requests when DoHTTP is
+	// nil. Use it to configure the transport, timeouts, and connection reuse.
+	// Note that a client Timeout also applies to calls that wait for
+	// changes, such as Watch. If nil, a shared default client is used.
+	HTTPClient *http.Client
+	// Retry is the policy for retrying read-only calls and puts that fail
+	// with a transient error. If nil, DefaultRetryPolicy is used.
+	Retry *RetryPolicy
+	// MaxValueBytes is the largest secret value the client will attempt to
+	// upload. Larger values are rejected locally with api.ErrValueTooLarge
+	// without contacting the server. If zero, api.DefaultMaxValueBytes is
+	// used; if negative, no local check is made and the server's limit
+	// applies. The limit configured on a server is reported by Info.
+	MaxValueBytes int
+	// ValueCache, if non-nil, is a local cache of active secret values used
+	// by Get. See [ValueCache] for details. If nil, values are not cached.
+	ValueCache *ValueCache
+	// Timeout, if positive, is the default time limit for each request to
+	// the server. It applies only when the context passed to a method has no
+	// deadline of its own; an explicit deadline always takes precedence.
+	// Each retry of a read-only call gets a fresh timeout. Timeout does not
+	// apply to Watch, which holds its request open until ctx ends. An error
+	// for a request that runs out of time says so, and wraps
+	// [context.DeadlineExceeded].
+	Timeout time.Duration
+	// PinnedCertFingerprints, if non-empty, are the SHA-256 fingerprints of
+	// the certificates the server may present (see [CertFingerprint]). A
+	// call fails with ErrCertificateMismatch unless the leaf certificate of
+	// the server matches one of them. This is optional hardening on top of
+	// the usual TLS certificate validation, which still applies.
+	//
+	// The certificate is checked during the TLS handshake, before any
+	// request is sent, so requests cannot reach an unpinned server. To do
+	// so, the transport of HTTPClient, if set, must be an *http.Transport,
+	// and DoHTTP must not be set; otherwise every call fails.
+	PinnedCertFingerprints [][]byte
+	// RequestID, if non-empty, is sent as the ID of each request to the
+	// server (see [api.RequestIDHeader]), and must satisfy
+	// [api.ValidRequestID]. The server records it in the audit log entries
+	// for the request. Since a Client is a value, a caller can set it on a
+	// copy to identify a single call. If empty, each call is assigned a new
+	// random ID, shared by its retries. Errors reported by the server
+	// include the ID of the request.
+	RequestID string
+}
+
+// withTimeout returns a context governed by the default timeout of c, if it
+// has one and ctx does not already have a deadline. The caller must call the
+// returned cancel function when the request is complete.
+func (c Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			return context.WithTimeout(ctx, c.Timeout)
+		}
+	}
+	return ctx, func() {}
 }
 
-func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RESP, error) {
+// checkValueSize reports an error wrapping api.ErrValueTooLarge if value is
+// larger than the limit configured for c.
+func (c Client) checkValueSize(value []byte) error {
+	return c.checkValueLength(int64(len(value)))
+}
+
+// checkValueLength is as checkValueSize, for a value of n bytes.
+func (c Client) checkValueLength(n int64) error {
+	limit := c.MaxValueBytes
+	if limit == 0 {
+		limit = api.DefaultMaxValueBytes
+	}
+	if limit > 0 && n > int64(limit) {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d", api.ErrValueTooLarge, n, limit)
+	}
+	return nil
+}
+
+func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (_ RESP, err error) {
 	var resp RESP
 
+	rctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	// This must run before cancel, which would make rctx report an error.
+	defer func() {
+		if err != nil && rctx.Err() != nil && ctx.Err() == nil {
+			err = fmt.Errorf("server did not respond within %v: %w", c.Timeout, err)
+		}
+	}()
+	r, err := newRequest(rctx, c, path, req)
+	if err != nil {
+		return resp, err
+	}
+	httpResp, err := c.doHTTP(r)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+
+	bs, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	if err := json.Unmarshal(bs, &resp); err != nil {
+		return resp, fmt.Errorf("unmarshaling response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// ParseServerURL checks and normalizes the address of a setec server. It
+// accepts an http or https URL, such as "https://setec.example.ts.net", or a
+// bare hostname with an optional port, such as "setec.example.ts.net:8443",
+// for which the scheme defaults to https. Trailing slashes are removed, so
+// the result can be joined with an API path.
+func ParseServerURL(s string) (string, error) {
+	const want = `use a hostname like "setec.example.ts.net" or a URL like "https://setec.example.ts.net"`
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("no server address is set; %s", want)
+	}
+	raw := s
+	if !strings.Contains(s, "://") {
+		raw = "https://" + s
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid server address %q; %s", s, want)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", fmt.Errorf("invalid server address %q: unsupported scheme %q; %s", s, u.Scheme, want)
+	case u.Hostname() == "":
+		return "", fmt.Errorf("invalid server address %q: missing hostname; %s", s, want)
+	case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+		return "", fmt.Errorf("invalid server address %q: unexpected user, query, or fragment; %s", s, want)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// newRequest constructs an HTTP request to call the API method at path on the
+// server, with req as its JSON-encoded body.
+func newRequest[REQ any](ctx context.Context, c Client, path string, req REQ) (*http.Request, error) {
 	bs, err := json.Marshal(req)
 	if err != nil {
-		return resp, fmt.Errorf("marshaling request: %w", err)
+		return nil, fmt.Errorf("marshaling request: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/%s", strings.TrimSuffix(c.Server, "/"), strings.TrimPrefix(path, "/"))
+	base, err := ParseServerURL(c.Server)
+	if err != nil {
+		return nil, err
+	}
+	url := base + "/" + strings.TrimPrefix(path, "/")
 
 	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bs))
 	if err != nil {
-		return resp, fmt.Errorf("constructing HTTP request: %w", err)
+		return nil, fmt.Errorf("constructing HTTP request: %w", err)
 	}
 	r.Header.Set("Content-Type", "application/json")
 	// See the comment in server/server.go for what this does.
 	r.Header.Set("Sec-X-Tailscale-No-Browsers", "setec")
+	if c.RequestID != "" && !api.ValidRequestID(c.RequestID) {
+		return nil, fmt.Errorf("invalid request ID %q", c.RequestID)
+	}
+	r.Header.Set(api.RequestIDHeader, cmp.Or(c.RequestID, api.NewRequestID()))
+	return r, nil
+}
+
+// defaultHTTPClient is the HTTP client used by a Client with neither DoHTTP
+// nor HTTPClient set. It keeps more idle connections per host than the
+// standard default, since clients usually talk to a single server.
+var defaultHTTPClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.MaxIdleConnsPerHost = 16
+		return t
+	}(),
+}
 
+// doHTTP sends r to the server. If the server reports a status other than 200
+// OK, doHTTP closes the response body and reports an error.
+func (c Client) doHTTP(r *http.Request) (*http.Response, error) {
 	do := c.DoHTTP
-	if do == nil {
-		do = http.DefaultClient.Do
+	if len(c.PinnedCertFingerprints) != 0 {
+		// Check the pins before the request is sent, so that it cannot reach
+		// a server that does not match them.
+		if do != nil {
+			return nil, errors.New("cannot check pinned certificates with DoHTTP")
+		} else if r.URL.Scheme != "https" {
+			return nil, fmt.Errorf("%w: connection does not use TLS", ErrCertificateMismatch)
+		}
+		hc, err := pinnedHTTPClient(cmp.Or(c.HTTPClient, defaultHTTPClient), c.PinnedCertFingerprints)
+		if err != nil {
+			return nil, err
+		}
+		do = hc.Do
+	} else if do == nil {
+		do = cmp.Or(c.HTTPClient, defaultHTTPClient).Do
 	}
 	httpResp, err := do(r)
 	if err != nil {
-		return resp, fmt.Errorf("making HTTP request: %w", err)
+		err = fmt.Errorf("making HTTP request: %w", err)
+		if r.Context().Err() == nil && !errors.Is(err, ErrCertificateMismatch) {
+			err = transientError{err}
+		}
+		return nil, err
 	}
-	defer httpResp.Body.Close()
-
 	if code := httpResp.StatusCode; code != http.StatusOK {
+		defer httpResp.Body.Close()
 		errBs, err := io.ReadAll(httpResp.Body)
 		if err != nil {
-			return resp, fmt.Errorf("reading error response body (HTTP status %d): %w", code, err)
+			return nil, fmt.Errorf("reading error response body (HTTP status %d): %w", code, err)
 		}
-		switch code {
-		case http.StatusNotFound:
-			return resp, api.ErrNotFound
-		case http.StatusForbidden:
-			return resp, api.ErrAccessDenied
-		case http.StatusNotModified:
-			return resp, api.ErrValueNotChanged
-		case http.StatusPreconditionFailed:
-			return resp, api.ErrVersionClaimed
+		err = statusError(code, httpResp.Header.Get(api.ErrorCodeHeader), errBs)
+		if id := cmp.Or(httpResp.Header.Get(api.RequestIDHeader), r.Header.Get(api.RequestIDHeader)); id != "" {
+			err = requestIDError{err: err, id: id}
 		}
-		return resp, fmt.Errorf("request returned status %d: %q", code, string(bytes.TrimSpace(errBs)))
+		return nil, err
 	}
+	return httpResp, nil
+}
 
-	bs, err = io.ReadAll(httpResp.Body)
-	if err != nil {
-		return resp, err
-	}
+// requestIDError is an error reported by the server for the request with
+// the given ID. It wraps the error, so that errors.Is and errors.As see
+// through it.
+type requestIDError struct {
+	err error
+	id  string
+}
 
-	if err := json.Unmarshal(bs, &resp); err != nil {
-		return resp, fmt.Errorf("unmarshaling response: %w", err)
-	}
+func (e requestIDError) Error() string { return fmt.Sprintf("%v (request ID %s)", e.err, e.id) }
+func (e requestIDError) Unwrap() error { return e.err }
 
-	return resp, nil
+// statusError returns the error corresponding to an HTTP status code other
+// than 200 OK reported by the server, with the given error code, if any, and
+// response body. A known error code takes precedence over the status.
+func statusError(code int, errCode string, body []byte) error {
+	if err := api.ErrorForCode(errCode); err != nil {
+		if errors.Is(err, api.ErrRateLimited) {
+			return transientError{err}
+		}
+		// Keep any detail the server reported after the error message.
+		msg := string(bytes.TrimSpace(body))
+		if detail, ok := strings.CutPrefix(msg, err.Error()); ok && detail != "" {
+			return fmt.Errorf("%w%s", err, detail)
+		}
+		return err
+	}
+	switch code {
+	case http.StatusNotFound:
+		return api.ErrNotFound
+	case http.StatusForbidden:
+		return api.ErrAccessDenied
+	case http.StatusNotModified:
+		return api.ErrValueNotChanged
+	case http.StatusPreconditionFailed:
+		return api.ErrVersionClaimed
+	case http.StatusGone:
+		return api.ErrExpired
+	case http.StatusConflict:
+		return api.ErrAlreadyExists
+	case http.StatusUnprocessableEntity:
+		return api.ErrTemplate
+	case http.StatusRequestEntityTooLarge:
+		return api.ErrValueTooLarge
+	case http.StatusNotImplemented:
+		return api.ErrAuditUnavailable
+	case http.StatusMethodNotAllowed:
+		return api.ErrReadOnly
+	case http.StatusFailedDependency:
+		return api.ErrBrokenAlias
+	case http.StatusLocked:
+		return api.ErrAliasTarget
+	case http.StatusTooManyRequests:
+		return transientError{api.ErrRateLimited}
+	}
+	err := fmt.Errorf("request returned status %d: %q", code, string(bytes.TrimSpace(body)))
+	if code >= 500 {
+		return transientError{err}
+	}
+	return err
 }
 
 // List fetches a list of secret names and associated metadata for all those
@@ -178,66 +415,594 @@ func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RES
 // secret values themselves. If the caller does not have "info" access to any
 // secrets, List reports zero values without error.
 func (c Client) List(ctx context.Context) ([]*api.SecretInfo, error) {
-	return do[[]*api.SecretInfo](ctx, c, "/api/list", api.ListRequest{})
+	return c.ListPrefix(ctx, "")
+}
+
+// ListPrefix is as [Client.List], but reports only secrets whose names begin
+// with prefix. The filtering is done by the server. An empty prefix matches
+// all secrets.
+func (c Client) ListPrefix(ctx context.Context, prefix string) ([]*api.SecretInfo, error) {
+	return c.ListWithOptions(ctx, ListOptions{Prefix: prefix})
+}
+
+// ListOptions are optional settings for [Client.ListWithOptions]. A zero
+// value is ready for use and reports all secrets.
+type ListOptions struct {
+	// Prefix, if non-empty, restricts the results to secrets whose names
+	// begin with this string.
+	Prefix string
+
+	// Selector, if non-empty, restricts the results to secrets having all
+	// the specified labels with the specified values.
+	Selector map[string]string
+
+	// Writable, if true, restricts the results to secrets the caller is
+	// allowed to put new values for, taking into account all the
+	// restrictions the server applies to writes.
+	Writable bool
 }
 
-// Get fetches the current active secret value for name.
+// ListWithOptions is as [Client.List], but reports only secrets matching
+// opts. The filtering is done by the server.
+func (c Client) ListWithOptions(ctx context.Context, opts ListOptions) ([]*api.SecretInfo, error) {
+	return doRetry[[]*api.SecretInfo](ctx, c, "/api/list", api.ListRequest{
+		Prefix:   opts.Prefix,
+		Selector: opts.Selector,
+		Writable: opts.Writable,
+	})
+}
+
+// Get fetches the current active secret value for name. If c has a
+// ValueCache, Get may report a recently cached value instead of contacting
+// the server, and concurrent calls for the same secret share a single
+// request to the server.
 //
 // Access requirement: "get"
 func (c Client) Get(ctx context.Context, name string) (*api.SecretValue, error) {
-	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
-		Name:    name,
-		Version: api.SecretVersionDefault,
+	if v, ok := c.ValueCache.lookup(c.Server, name); ok {
+		return v, nil
+	}
+	return c.ValueCache.fetch(ctx, c.Server, name, func(ctx context.Context) (*api.SecretValue, error) {
+		return doRetry[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
+			Name:    name,
+			Version: api.SecretVersionDefault,
+		})
 	})
 }
 
+// GetWait is as [Client.Get], but if the secret does not exist yet, or the
+// server cannot be reached, it polls until the secret appears or ctx ends,
+// rather than failing immediately. Polls are spaced by the backoff of the
+// client's [RetryPolicy]. Other errors, such as [api.ErrAccessDenied], are
+// reported immediately. If ctx ends first, the error from the last complete
+// attempt is reported. To bound the wait, use a context with a timeout.
+//
+// Access requirement: "get"
+func (c Client) GetWait(ctx context.Context, name string) (*api.SecretValue, error) {
+	var last error
+	for attempt := 1; ctx.Err() == nil; attempt++ {
+		sv, err := c.Get(ctx, name)
+		if err == nil {
+			return sv, nil
+		} else if ctx.Err() != nil {
+			break // the context ended during the attempt
+		} else if !errors.Is(err, api.ErrNotFound) && !isTransient(err) {
+			return nil, err
+		}
+		last = err
+		sleepFor(ctx, c.Retry.delay(attempt))
+	}
+	if last == nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("waiting for %q: %w", name, last)
+}
+
+// GetResolved fetches the current active secret value for name. If the value
+// is a template, the server expands its references to other secrets with
+// their active values, so the result is the fully assembled value. It
+// reports [api.ErrTemplate] if the references form a cycle, are nested too
+// deeply, or expand to more than [api.MaxTemplateSize] bytes. The value cache
+// is not used.
+//
+// Access requirement: "get", for name and each secret it refers to
+func (c Client) GetResolved(ctx context.Context, name string) (*api.SecretValue, error) {
+	return doRetry[*api.SecretValue](ctx, c, "/api/get-resolved", api.ResolveRequest{
+		Name: name,
+	})
+}
+
+// GetMany fetches the current active secret values for each of the specified
+// names in a single request to the server.
+//
+// The result map contains an entry for each secret that was successfully
+// fetched. If any of the secrets could not be fetched, GetMany also reports an
+// error of concrete type [GetManyError] describing the failure for each of
+// those names; the values that were fetched are still returned. Other errors,
+// for example if the server could not be reached, are reported with a nil map.
+//
+// Access requirement: "get" for each name
+func (c Client) GetMany(ctx context.Context, names []string) (map[string]*api.SecretValue, error) {
+	rsp, err := doRetry[map[string]*api.GetManyResult](ctx, c, "/api/get-many", api.GetManyRequest{
+		Names: names,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*api.SecretValue, len(rsp))
+	gerr := make(GetManyError)
+	for _, name := range names {
+		res, ok := rsp[name]
+		if !ok || res == nil {
+			gerr[name] = errors.New("missing from server response")
+		} else if res.Value == nil {
+			gerr[name] = statusError(res.Status, res.Code, nil)
+		} else {
+			out[name] = res.Value
+		}
+	}
+	if len(gerr) != 0 {
+		return out, gerr
+	}
+	return out, nil
+}
+
+// GetManyError is the concrete type of the error reported by [Client.GetMany]
+// when one or more of the requested secrets could not be fetched. It maps the
+// name of each such secret to the error for that secret.
+type GetManyError map[string]error
+
+func (e GetManyError) Error() string {
+	names := slices.Sorted(maps.Keys(e))
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%q: %v", name, e[name])
+	}
+	return "get secrets failed: " + strings.Join(msgs, ", ")
+}
+
+// ErrValueNotChanged is reported by [Client.GetIfChanged] when the active
+// version of the secret is the one the caller already has. It is the same
+// value as [api.ErrValueNotChanged].
+var ErrValueNotChanged = api.ErrValueNotChanged
+
+// Errors reported by Client methods, for use with [errors.Is]. Each is the
+// same value as the corresponding error in package api, and others from
+// that package, such as [api.ErrExpired], may be reported as well. The
+// server reports which error occurred with a code in each error response,
+// so these do not depend on matching error strings.
+var (
+	// ErrSecretNotFound is reported when the named secret does not exist.
+	// It wraps [api.ErrNotFound]. Servers too old to report error codes
+	// report only api.ErrNotFound.
+	ErrSecretNotFound = api.ErrSecretNotFound
+
+	// ErrVersionNotFound is reported when the requested version of a secret
+	// does not exist. It wraps [api.ErrNotFound], as for ErrSecretNotFound.
+	ErrVersionNotFound = api.ErrVersionNotFound
+
+	// ErrAccessDenied is reported when the caller is not permitted to
+	// perform the requested operation.
+	ErrAccessDenied = api.ErrAccessDenied
+
+	// ErrNotModified is reported when the requested value has not changed.
+	// It is the same value as ErrValueNotChanged.
+	ErrNotModified = api.ErrValueNotChanged
+)
+
 // GetIfChanged fetches a secret value by name, if the active version on the
 // server is different from oldVersion. If the active version on the server is
-// the same as oldVersion, it reports api.ErrValueNotChanged without returning
-// a secret. As a special case, if oldVersion == 0 then GetIfVersion behaves as
+// the same as oldVersion, it reports [ErrValueNotChanged] without returning a
+// secret. As a special case, if oldVersion == 0 then GetIfChanged behaves as
 // Get and retrieves the current active version.
 //
+// The server reports an unchanged value with a 304 Not Modified status, which
+// the client maps to ErrValueNotChanged, so callers can test for it with
+// errors.Is. Any other error means that the check itself failed. A polling
+// loop should therefore keep its current value on ErrValueNotChanged, replace
+// it on success, and treat other errors as failures:
+//
+//	v, err := c.GetIfChanged(ctx, name, cur.Version)
+//	if errors.Is(err, setec.ErrValueNotChanged) {
+//	   // cur is still the active value
+//	} else if err != nil {
+//	   // the check failed; cur may be stale
+//	} else {
+//	   cur = v
+//	}
+//
 // Access requirement: "get"
 func (c Client) GetIfChanged(ctx context.Context, name string, oldVersion api.SecretVersion) (*api.SecretValue, error) {
 	if oldVersion == api.SecretVersionDefault {
 		return c.Get(ctx, name)
 	}
-	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
+	return doRetry[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
 		Name:            name,
 		Version:         oldVersion,
 		UpdateIfChanged: true,
 	})
 }
 
+// Watch watches for changes to the active value of the named secret. It
+// returns a channel that delivers the current active value, followed by the
+// new active value each time the active version changes on the server.
+//
+// Watch holds open a streaming request to the server until ctx ends, at which
+// point the request is terminated and the channel is closed. The channel is
+// also closed if the stream fails, for example if the server shuts down or
+// the secret is deleted; the caller may call Watch again to resume.
+//
+// Access requirement: "get"
+func (c Client) Watch(ctx context.Context, name string) (<-chan *api.SecretValue, error) {
+	r, err := newRequest(ctx, c, "/api/watch", api.WatchRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := c.doHTTP(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *api.SecretValue)
+	go func() {
+		defer close(ch)
+		defer httpResp.Body.Close()
+
+		dec := json.NewDecoder(httpResp.Body)
+		for {
+			var sv api.SecretValue
+			if err := dec.Decode(&sv); err != nil {
+				return // stream ended or failed
+			}
+			select {
+			case ch <- &sv:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
 // GetVersion fetches a secret value by name and version. If version == 0,
 // GetVersion retrieves the current active version.
 //
 // Access requirement: "get"
 func (c Client) GetVersion(ctx context.Context, name string, version api.SecretVersion) (*api.SecretValue, error) {
-	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
+	return doRetry[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
 		Name:    name,
 		Version: version,
 	})
 }
 
+// GetAtMost fetches the active value of a secret, if its version is at most
+// maxVersion, and otherwise the value of version maxVersion. This lets a
+// program that does not yet support newer values of a secret keep using an
+// older one while newer programs use the active value. If the active version
+// is newer and maxVersion does not exist, GetAtMost reports an error wrapping
+// [api.ErrNotFound].
+//
+// Access requirement: "get"
+func (c Client) GetAtMost(ctx context.Context, name string, maxVersion api.SecretVersion) (*api.SecretValue, error) {
+	if maxVersion <= 0 {
+		return nil, fmt.Errorf("invalid maximum version %v", maxVersion)
+	}
+	sv, err := c.Get(ctx, name)
+	if err != nil || sv.Version <= maxVersion {
+		return sv, err
+	}
+	return c.GetVersion(ctx, name, maxVersion)
+}
+
 // Info fetches metadata for a given secret name.
 //
 // Access requirement: "info"
 func (c Client) Info(ctx context.Context, name string) (*api.SecretInfo, error) {
-	return do[*api.SecretInfo](ctx, c, "/api/info", api.InfoRequest{
+	return doRetry[*api.SecretInfo](ctx, c, "/api/info", api.InfoRequest{
 		Name: name,
 	})
 }
 
+// VersionStatus describes whether a version of a secret is present, and
+// whether it is the active version. See [Client.VersionStatus].
+type VersionStatus int
+
+const (
+	VersionAbsent   VersionStatus = iota // the version does not exist
+	VersionInactive                      // the version exists, but is not active
+	VersionActive                        // the version is the active version
+)
+
+func (v VersionStatus) String() string {
+	switch v {
+	case VersionAbsent:
+		return "absent"
+	case VersionInactive:
+		return "inactive"
+	case VersionActive:
+		return "active"
+	}
+	return fmt.Sprintf("VersionStatus(%d)", int(v))
+}
+
+// VersionStatus reports whether the specified version of the secret called
+// name is present, and whether it is active. A version that never existed,
+// or has been deleted, is reported as [VersionAbsent]. If the secret itself
+// does not exist, VersionStatus reports [api.ErrNotFound].
+//
+// Access requirement: "info"
+func (c Client) VersionStatus(ctx context.Context, name string, version api.SecretVersion) (VersionStatus, error) {
+	info, err := c.Info(ctx, name)
+	if err != nil {
+		return VersionAbsent, err
+	}
+	switch {
+	case !slices.Contains(info.Versions, version):
+		return VersionAbsent, nil
+	case info.ActiveVersion == version:
+		return VersionActive, nil
+	default:
+		return VersionInactive, nil
+	}
+}
+
+// WaitActive polls the server until version is the active version of the
+// secret called name, or ctx ends. This lets a program wait for a new value
+// to be activated elsewhere, for example to gate one step of a rotation on
+// the previous one. Polls are spaced by the backoff of the client's
+// [RetryPolicy]. If the secret does not exist yet, or the server cannot be
+// reached, WaitActive keeps polling; other errors are reported immediately.
+// If ctx ends first, WaitActive reports an error wrapping the context error.
+// To bound the wait, use a context with a timeout.
+//
+// Access requirement: "info"
+func (c Client) WaitActive(ctx context.Context, name string, version api.SecretVersion) error {
+	if version <= 0 {
+		return fmt.Errorf("invalid version %v", version)
+	}
+	for attempt := 1; ; attempt++ {
+		info, err := c.Info(ctx, name)
+		if err == nil && info.ActiveVersion == version {
+			return nil
+		} else if ctx.Err() != nil {
+			return fmt.Errorf("waiting for %q version %v to become active: %w", name, version, ctx.Err())
+		} else if err != nil && !errors.Is(err, api.ErrNotFound) && !isTransient(err) {
+			return err
+		}
+		sleepFor(ctx, c.Retry.delay(attempt))
+	}
+}
+
 // Put creates a secret called name, with the given value. If a secret called
 // name already exist, the value is saved as a new inactive version.
 //
+// The name is checked by [api.CheckSecretName] before it is sent to the
+// server, and Put reports an error wrapping [api.ErrInvalidName] if it is
+// not valid.
+//
 // Access requirement: "put"
 func (c Client) Put(ctx context.Context, name string, value []byte) (version api.SecretVersion, err error) {
-	return do[api.SecretVersion](ctx, c, "/api/put", api.PutRequest{
-		Name:  name,
-		Value: value,
-	})
+	return c.PutWithOptions(ctx, name, value, PutOptions{})
+}
+
+// PutOptions are optional settings for [Client.PutWithOptions]. A zero value
+// is ready for use and provides default behavior.
+type PutOptions struct {
+	// ExpiresAt, if non-zero, is the time after which the server will no
+	// longer serve the value of the new version. Attempts to get an expired
+	// version report [api.ErrExpired].
+	ExpiresAt time.Time
+
+	// Labels, if non-empty, are added to the labels of the secret as
+	// described by [Client.SetLabels].
+	Labels map[string]string
+
+	// Activate, if true, makes the new version active in the same update.
+	// This requires "activate" permission in addition to "put".
+	Activate bool
+
+	// Template, if true, marks the new version as a template whose
+	// references to other secrets are expanded by [Client.GetResolved]. The
+	// server reports [api.ErrTemplate] if the template is malformed or refers
+	// back to the secret itself. See [api.TemplateRefs] for the syntax.
+	Template bool
+
+	// IdempotencyKey, if non-empty, identifies the put so that retrying it
+	// does not create more than one version; see [api.PutRequest]. If empty
+	// and the client's [RetryPolicy] allows retries, a key is generated from
+	// a hash of the value and a random nonce, so that only retries of the
+	// same call are deduplicated. A put with a key is retried on transient
+	// errors like a read-only call.
+	IdempotencyKey string
+
+	// Format, if non-empty, declares the format of the values of the secret,
+	// such as [api.FormatJSON]. The value must be well-formed in that format,
+	// or the put fails with [api.ErrInvalidFormat]. The declared format is
+	// reported by [Client.Info] and with values fetched by [Client.Get].
+	Format string
+
+	// ContentType, if non-empty, records the MIME type of the values of the
+	// secret, such as "application/json", replacing any recorded before. It
+	// must satisfy [api.CheckContentType]. The content type is reported by
+	// [Client.Info] and with values fetched by [Client.Get]. Use
+	// [api.DetectContentType] to choose between text and binary. It applies
+	// to the secret rather than the new version, so a put of an inactive
+	// version changes the type reported for the active value.
+	ContentType string
+
+	// IfAbsent, if true, creates the secret only if it does not already
+	// exist. If it does, the put fails with [api.ErrAlreadyExists] and
+	// stores nothing. The server checks and creates the secret in a single
+	// update, so this is safe against concurrent puts.
+	IfAbsent bool
+
+	// MaxVersions, if non-zero, sets the number of versions the server keeps
+	// for the secret, overriding the server's default for it. When a put
+	// leaves the secret with more versions, the server deletes the oldest
+	// versions other than the active and the newest. If negative, the
+	// number is not limited. If zero, the limit is unchanged. Setting it, or
+	// a put that deletes versions, requires "delete" permission.
+	MaxVersions int
+
+	// AllowDuplicate, if true, makes the server add a new version even if
+	// the value is the same as that of an existing version it would
+	// otherwise report instead: the newest version, or if the server
+	// deduplicates puts, the active version.
+	AllowDuplicate bool
+
+	// Description, if non-empty, replaces the description of the secret, as
+	// described by [Client.SetDescription]. If empty, the description is
+	// unchanged.
+	Description string
+
+	// Immutable, if true, makes the secret immutable, so that the server
+	// refuses to delete any version of it that was ever active with
+	// [api.ErrImmutable], and to delete or rename it, except for callers
+	// with "admin" permission. It requires "delete" permission. An
+	// immutable secret cannot be made mutable again.
+	Immutable bool
+}
+
+// PutWithOptions is as [Client.Put], but applies the specified options to the
+// new secret version.
+//
+// Access requirement: "put"
+func (c Client) PutWithOptions(ctx context.Context, name string, value []byte, opts PutOptions) (version api.SecretVersion, err error) {
+	if err := api.CheckSecretName(name); err != nil {
+		return 0, err
+	}
+	if err := api.CheckLabels(opts.Labels); err != nil {
+		return 0, err
+	}
+	if err := api.CheckDescription(opts.Description); err != nil {
+		return 0, err
+	}
+	if opts.ContentType != "" {
+		if err := api.CheckContentType(opts.ContentType); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.checkValueSize(value); err != nil {
+		return 0, err
+	}
+	if opts.Template {
+		if _, err := api.TemplateRefs(value); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Format != "" {
+		if err := api.CheckFormat(opts.Format, value); err != nil {
+			return 0, err
+		}
+	}
+	return c.put(ctx, api.PutRequest{Name: name, Value: value}, opts)
+}
+
+// putChunkSize is the size of the chunks in which PutStream uploads a value.
+const putChunkSize = 256 << 10
+
+// PutStream is as [Client.PutWithOptions], but reads the value from r until
+// EOF and uploads it to the server in chunks, then stores it as a new version
+// of the secret. The client holds at most one chunk of the value in memory at
+// a time, and no request carries more than one chunk, so it is suited to
+// large values such as certificate bundles. The server assembles the chunks
+// before storing the value, so its size limit applies as usual.
+//
+// Unlike PutWithOptions, PutStream does not check the format or template
+// syntax of the value locally; the server checks them when the value is
+// stored. Chunks are retried on transient errors according to the
+// [RetryPolicy] of c.
+//
+// Access requirement: "put"
+func (c Client) PutStream(ctx context.Context, name string, r io.Reader, opts PutOptions) (version api.SecretVersion, err error) {
+	if err := api.CheckSecretName(name); err != nil {
+		return 0, err
+	}
+	if err := api.CheckLabels(opts.Labels); err != nil {
+		return 0, err
+	}
+	if err := api.CheckDescription(opts.Description); err != nil {
+		return 0, err
+	}
+	if opts.ContentType != "" {
+		if err := api.CheckContentType(opts.ContentType); err != nil {
+			return 0, err
+		}
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	uploadID := hex.EncodeToString(nonce[:])
+	buf := make([]byte, putChunkSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := c.checkValueLength(size + int64(n)); err != nil {
+				return 0, err
+			}
+			if _, err := doRetry[api.PutChunkResponse](ctx, c, "/api/put-chunk", api.PutChunkRequest{
+				Name:     name,
+				UploadID: uploadID,
+				Offset:   size,
+				Data:     buf[:n],
+			}); err != nil {
+				return 0, fmt.Errorf("uploading value: %w", err)
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("reading value: %w", err)
+		}
+	}
+	if size == 0 {
+		return c.PutWithOptions(ctx, name, nil, opts)
+	}
+	return c.put(ctx, api.PutRequest{Name: name, UploadID: uploadID}, opts)
+}
+
+// put completes req, which has the name and value of the secret, with opts,
+// and sends it to the server.
+func (c Client) put(ctx context.Context, req api.PutRequest, opts PutOptions) (api.SecretVersion, error) {
+	if opts.Activate {
+		c.ValueCache.forget(c.Server, req.Name)
+	}
+	key := opts.IdempotencyKey
+	if key == "" && c.Retry.maxAttempts() > 1 {
+		if req.UploadID != "" {
+			key = newIdempotencyKey([]byte(req.UploadID))
+		} else {
+			key = newIdempotencyKey(req.Value)
+		}
+	}
+	req.ExpiresAt = opts.ExpiresAt
+	req.Labels = opts.Labels
+	req.Activate = opts.Activate
+	req.Template = opts.Template
+	req.IdempotencyKey = key
+	req.Format = opts.Format
+	req.ContentType = opts.ContentType
+	req.IfAbsent = opts.IfAbsent
+	req.MaxVersions = opts.MaxVersions
+	req.AllowDuplicate = opts.AllowDuplicate
+	req.Immutable = opts.Immutable
+	req.Description = opts.Description
+	if key == "" {
+		return do[api.SecretVersion](ctx, c, "/api/put", req)
+	}
+	return doRetry[api.SecretVersion](ctx, c, "/api/put", req)
+}
+
+// newIdempotencyKey returns a fresh idempotency key for a put of value.
+func newIdempotencyKey(value []byte) string {
+	h := sha256.New()
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	h.Write(nonce[:])
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil)[:16])
 }
 
 // CreateVersion creates a specific version of a secret, sets its value and immediately activates that version.
@@ -245,10 +1010,66 @@ func (c Client) Put(ctx context.Context, name string, value []byte) (version api
 //
 // Access requirement: "create-version"
 func (c Client) CreateVersion(ctx context.Context, name string, version api.SecretVersion, value []byte) error {
+	return c.CreateVersionWithOptions(ctx, name, version, value, CreateVersionOptions{})
+}
+
+// CreateVersionOptions are optional settings for [Client.CreateVersionWithOptions].
+// A zero value is ready for use and provides default behavior.
+type CreateVersionOptions struct {
+	// ExpiresAt and Template set the expiration time and template flag of
+	// the new version, as described by [PutOptions].
+	ExpiresAt time.Time
+	Template  bool
+
+	// Format, ContentType, MaxVersions, and Immutable set the corresponding
+	// settings of the secret, as described by [PutOptions], and require the
+	// same permissions. The server deletes no versions to satisfy
+	// MaxVersions until the next put.
+	Format      string
+	ContentType string
+	MaxVersions int
+	Immutable   bool
+}
+
+// CreateVersionWithOptions is as [Client.CreateVersion], but applies the
+// specified options to the new version and the secret. It lets a secret be
+// copied with its version numbers and settings, for example from a backup.
+//
+// Access requirement: "create-version", and "delete" to set MaxVersions or
+// Immutable
+func (c Client) CreateVersionWithOptions(ctx context.Context, name string, version api.SecretVersion, value []byte, opts CreateVersionOptions) error {
+	if err := api.CheckSecretName(name); err != nil {
+		return err
+	}
+	if err := c.checkValueSize(value); err != nil {
+		return err
+	}
+	if opts.ContentType != "" {
+		if err := api.CheckContentType(opts.ContentType); err != nil {
+			return err
+		}
+	}
+	if opts.Template {
+		if _, err := api.TemplateRefs(value); err != nil {
+			return err
+		}
+	}
+	if opts.Format != "" {
+		if err := api.CheckFormat(opts.Format, value); err != nil {
+			return err
+		}
+	}
+	c.ValueCache.forget(c.Server, name)
 	_, err := do[struct{}](ctx, c, "/api/create-version", api.CreateVersionRequest{
-		Name:    name,
-		Version: version,
-		Value:   value,
+		Name:        name,
+		Version:     version,
+		Value:       value,
+		ExpiresAt:   opts.ExpiresAt,
+		Template:    opts.Template,
+		Format:      opts.Format,
+		ContentType: opts.ContentType,
+		MaxVersions: opts.MaxVersions,
+		Immutable:   opts.Immutable,
 	})
 	return err
 }
@@ -257,6 +1078,7 @@ func (c Client) CreateVersion(ctx context.Context, name string, version api.Secr
 //
 // Access requirement: "activate"
 func (c Client) Activate(ctx context.Context, name string, version api.SecretVersion) error {
+	c.ValueCache.forget(c.Server, name)
 	_, err := do[struct{}](ctx, c, "/api/activate", api.ActivateRequest{
 		Name:    name,
 		Version: version,
@@ -264,10 +1086,29 @@ func (c Client) Activate(ctx context.Context, name string, version api.SecretVer
 	return err
 }
 
+// ActivateMany changes the active versions of several secrets in a single
+// update on the server. If any of the secrets or versions does not exist, it
+// reports [api.ErrNotFound] and none of the active versions are changed.
+//
+// Access requirement: "activate", for each secret
+func (c Client) ActivateMany(ctx context.Context, reqs []api.ActivateRequest) error {
+	for _, req := range reqs {
+		c.ValueCache.forget(c.Server, req.Name)
+	}
+	_, err := do[struct{}](ctx, c, "/api/activate-many", api.ActivateManyRequest{
+		Activations: reqs,
+	})
+	return err
+}
+
 // DeleteVersion deletes the specified version of the named secret.
 //
 // Note: DeleteVersion will report an error if the caller attempts to delete
-// the active version, even if they have permission to do so.
+// the active version, even if they have permission to do so. To replace and
+// delete the active version together, use [Client.DeleteVersionAndActivate].
+// If the secret is immutable, a version that was ever active cannot be
+// deleted, even with "admin" permission, and DeleteVersion reports
+// [api.ErrImmutable].
 //
 // Access requirement: "delete"
 func (c Client) DeleteVersion(ctx context.Context, name string, version api.SecretVersion) error {
@@ -278,19 +1119,211 @@ func (c Client) DeleteVersion(ctx context.Context, name string, version api.Secr
 	return err
 }
 
+// DeleteVersionAndActivate deletes the specified version of the named secret,
+// and makes the reactivate version active in the same update on the server,
+// so that the active version can be deleted without a moment when the secret
+// has no active version. If either version does not exist, nothing is
+// changed. If the secret is immutable, a version that was ever active cannot
+// be deleted, even with "admin" permission, and DeleteVersionAndActivate
+// reports [api.ErrImmutable].
+//
+// Access requirement: "delete" and "activate"
+func (c Client) DeleteVersionAndActivate(ctx context.Context, name string, version, reactivate api.SecretVersion) error {
+	if reactivate == api.SecretVersionDefault {
+		return errors.New("no version to activate")
+	}
+	c.ValueCache.forget(c.Server, name)
+	_, err := do[struct{}](ctx, c, "/api/delete-version", api.DeleteVersionRequest{
+		Name:       name,
+		Version:    version,
+		Reactivate: reactivate,
+	})
+	return err
+}
+
 // Delete deletes all versions of the named secret.
 //
 // Note: Delete will delete all versions of the secret, including the active
 // one, if the caller has permission to do so.
 //
+// If name is an alias, Delete removes the alias, and not its target. If the
+// secret is the target of an alias and the server protects alias targets, it
+// reports [api.ErrAliasTarget]. If the secret is immutable and the caller
+// lacks "admin" permission for it, it reports [api.ErrImmutable].
+//
 // Access requirement: "delete"
 func (c Client) Delete(ctx context.Context, name string) error {
+	c.ValueCache.forget(c.Server, name)
 	_, err := do[struct{}](ctx, c, "/api/delete", api.DeleteRequest{
 		Name: name,
 	})
 	return err
 }
 
+// Undelete restores a soft-deleted secret, with all its versions and
+// metadata. It reports [api.ErrNotFound] if there is no such deleted secret,
+// or its retention period has ended, and [api.ErrAlreadyExists] if a new
+// secret with the same name has been created since. Secrets can only be
+// restored if the server is configured to retain deleted secrets.
+//
+// Access requirement: "undelete"
+func (c Client) Undelete(ctx context.Context, name string) error {
+	_, err := do[struct{}](ctx, c, "/api/undelete", api.UndeleteRequest{
+		Name: name,
+	})
+	return err
+}
+
+// Rename moves all versions of the secret called name, including its active
+// version and version metadata, to newName. It reports [api.ErrAlreadyExists]
+// if a secret called newName already exists, [api.ErrAliasTarget] if the
+// secret is the target of an alias and the server protects alias targets, and
+// [api.ErrImmutable] if the secret is immutable and the caller lacks "admin"
+// permission for it. If c has a ValueCache, Rename discards all its values,
+// including those of aliases of either name.
+//
+// Access requirement: "rename", for both name and newName
+func (c Client) Rename(ctx context.Context, name, newName string) error {
+	if err := api.CheckSecretName(newName); err != nil {
+		return err
+	}
+	c.ValueCache.forgetAll()
+	_, err := do[struct{}](ctx, c, "/api/rename", api.RenameRequest{
+		Name:    name,
+		NewName: newName,
+	})
+	return err
+}
+
+// Alias makes name an alias for the secret called target, so that getting
+// name reports the values of target, and [Client.Info] for name reports
+// target in [api.SecretInfo.AliasOf]. If name is already an alias, it is
+// updated to refer to target. It reports [api.ErrAlreadyExists] if a secret
+// called name exists. Deleting name removes the alias. Getting an alias whose
+// target has been deleted reports [api.ErrBrokenAlias].
+//
+// Access requirement: "put" for name, and "info" for target
+func (c Client) Alias(ctx context.Context, name, target string) error {
+	if err := api.CheckSecretName(name); err != nil {
+		return err
+	}
+	c.ValueCache.forget(c.Server, name)
+	_, err := do[struct{}](ctx, c, "/api/alias", api.AliasRequest{
+		Name:   name,
+		Target: target,
+	})
+	return err
+}
+
+// SetPrincipals sets the tailnet users and tags allowed to access the secret
+// called name. Callers not among the principals are denied access to get the
+// secret or its metadata, even if they have permission. If principals is
+// empty, the restriction is removed.
+//
+// Access requirement: "set-principals"
+func (c Client) SetPrincipals(ctx context.Context, name string, principals []string) error {
+	_, err := do[struct{}](ctx, c, "/api/set-principals", api.SetPrincipalsRequest{
+		Name:       name,
+		Principals: principals,
+	})
+	return err
+}
+
+// SetLabels updates the labels of the secret called name. Each label is
+// added to the secret, replacing the value of any existing label with the
+// same key. A label with an empty value is removed.
+//
+// Access requirement: "put"
+func (c Client) SetLabels(ctx context.Context, name string, labels map[string]string) error {
+	if err := api.CheckLabels(labels); err != nil {
+		return err
+	}
+	_, err := do[struct{}](ctx, c, "/api/label", api.LabelRequest{
+		Name:   name,
+		Labels: labels,
+	})
+	return err
+}
+
+// SetDescription replaces the description of the secret called name, free
+// text reported by [Client.Info] that says what the secret is for. An empty
+// desc removes the description. The description must satisfy
+// [api.CheckDescription].
+//
+// Access requirement: "put"
+func (c Client) SetDescription(ctx context.Context, name, desc string) error {
+	if err := api.CheckDescription(desc); err != nil {
+		return err
+	}
+	_, err := do[struct{}](ctx, c, "/api/describe", api.DescribeRequest{
+		Name:        name,
+		Description: desc,
+	})
+	return err
+}
+
+// WhoAmI reports the identity of the caller as seen by the server, including
+// the access rules the tailnet policy grants it. It is useful for diagnosing
+// requests that are unexpectedly denied.
+//
+// Access requirement: none
+func (c Client) WhoAmI(ctx context.Context) (*api.WhoAmIResponse, error) {
+	return doRetry[*api.WhoAmIResponse](ctx, c, "/api/whoami", api.WhoAmIRequest{})
+}
+
+// Ping checks that the server is reachable, and reports its version and
+// whether it recognizes the caller. Unlike other methods, it succeeds even if
+// the caller is not recognized or has no permissions, so it can distinguish
+// those cases from an unreachable server. It is not retried.
+//
+// Access requirement: none
+func (c Client) Ping(ctx context.Context) (*api.PingResponse, error) {
+	return do[*api.PingResponse](ctx, c, "/api/ping", api.PingRequest{})
+}
+
+// ServerInfo reports the version of the server and the optional features it
+// supports, such as [api.CapWatch], so that a caller can use newer methods
+// only with servers that have them. Use [api.ServerInfoResponse.Has] to check
+// for a capability.
+//
+// Servers that predate this method report an error. Callers that want to
+// degrade gracefully should treat any error other than a failure to reach the
+// server as meaning that no optional features are supported.
+//
+// Access requirement: none
+func (c Client) ServerInfo(ctx context.Context) (*api.ServerInfoResponse, error) {
+	return doRetry[*api.ServerInfoResponse](ctx, c, "/api/server-info", api.ServerInfoRequest{})
+}
+
+// AuditOptions are optional settings for [Client.Audit]. A zero value is
+// ready for use and reports the most recent entries for all visible secrets.
+type AuditOptions struct {
+	// Since, if non-zero, selects only entries written at or after this time.
+	Since time.Time
+
+	// Secret, if non-empty, selects only entries acting on the named secret.
+	Secret string
+
+	// Limit is the maximum number of entries to report. If zero,
+	// api.DefaultAuditLimit is used.
+	Limit int
+}
+
+// Audit fetches entries from the audit log of the server, oldest first. Only
+// entries for secrets on which the caller has "info" access are reported; if
+// more entries match opts than its limit, the most recent are reported. If
+// the server cannot read its audit log, Audit reports
+// api.ErrAuditUnavailable.
+//
+// Access requirement: "info" for each secret reported
+func (c Client) Audit(ctx context.Context, opts AuditOptions) ([]*audit.Entry, error) {
+	return doRetry[[]*audit.Entry](ctx, c, "/api/audit", api.AuditRequest{
+		Since:  opts.Since,
+		Secret: opts.Secret,
+		Limit:  opts.Limit,
+	})
+}
+
 // GetKeyring fetches all available versions of the named secret, and
 // returns a [Keyring] containing them.
 func (c Client) GetKeyring(ctx context.Context, name string) (*Keyring, error) {
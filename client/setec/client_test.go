@@ -4,13 +4,21 @@
 package setec_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/client/setec"
 	"github.com/tailscale/setec/setectest"
 	"github.com/tailscale/setec/types/api"
@@ -171,3 +179,758 @@ func TestFileClientCacheCompatibility(t *testing.T) {
 	checkSecretValue(t, st, "pear", "p1")
 	checkSecretValue(t, st, "cherry", "c2")
 }
+
+func TestClientRetry(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "apple", "crumble")
+	ts := setectest.NewServer(t, d, nil)
+
+	// Fail as many requests as the fails counter allows with a 503, then pass
+	// the rest through to ts. While the lost counter allows, requests are
+	// applied by ts, but their responses are replaced by a 503.
+	var calls, fails, lost atomic.Int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if fails.Add(-1) >= 0 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if lost.Add(-1) >= 0 {
+			ts.Mux.ServeHTTP(httptest.NewRecorder(), r)
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		ts.Mux.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	retry := &setec.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do, Retry: retry}
+	setup := func(nfail int32) {
+		calls.Store(0)
+		fails.Store(nfail)
+		lost.Store(0)
+	}
+
+	t.Run("GetRecovers", func(t *testing.T) {
+		setup(2)
+		v, err := cli.Get(t.Context(), "apple")
+		if err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		} else if got := string(v.Value); got != "crumble" {
+			t.Errorf("Get: got %q, want %q", got, "crumble")
+		}
+		if got := calls.Load(); got != 3 {
+			t.Errorf("Get: got %d calls, want 3", got)
+		}
+	})
+
+	t.Run("GetGivesUp", func(t *testing.T) {
+		setup(5)
+		if v, err := cli.Get(t.Context(), "apple"); err == nil {
+			t.Errorf("Get: got %v, want error", v)
+		}
+		if got := calls.Load(); got != 3 {
+			t.Errorf("Get: got %d calls, want 3", got)
+		}
+	})
+
+	t.Run("NotFoundNotRetried", func(t *testing.T) {
+		setup(0)
+		if _, err := cli.Get(t.Context(), "nonesuch"); !errors.Is(err, api.ErrNotFound) {
+			t.Errorf("Get: got %v, want %v", err, api.ErrNotFound)
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("Get: got %d calls, want 1", got)
+		}
+	})
+
+	t.Run("PutRetried", func(t *testing.T) {
+		setup(1)
+		if _, err := cli.Put(t.Context(), "apple", []byte("pie")); err != nil {
+			t.Errorf("Put: unexpected error: %v", err)
+		}
+		if got := calls.Load(); got != 2 {
+			t.Errorf("Put: got %d calls, want 2", got)
+		}
+	})
+
+	t.Run("PutRetryIdempotent", func(t *testing.T) {
+		before, err := cli.Info(t.Context(), "apple")
+		if err != nil {
+			t.Fatalf("Info: unexpected error: %v", err)
+		}
+		setup(0)
+		lost.Store(1) // the first attempt is applied, but its response is lost
+		v, err := cli.Put(t.Context(), "apple", []byte("tart"))
+		if err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		if got := calls.Load(); got != 2 {
+			t.Errorf("Put: got %d calls, want 2", got)
+		}
+		after, err := cli.Info(t.Context(), "apple")
+		if err != nil {
+			t.Fatalf("Info: unexpected error: %v", err)
+		}
+		if got, want := len(after.Versions), len(before.Versions)+1; got != want {
+			t.Errorf("Put: got %d versions, want %d", got, want)
+		}
+		if want := after.Versions[len(after.Versions)-1]; v != want {
+			t.Errorf("Put: got version %v, want %v", v, want)
+		}
+	})
+
+	t.Run("DeleteNotRetried", func(t *testing.T) {
+		setup(1)
+		if err := cli.Delete(t.Context(), "apple"); err == nil {
+			t.Error("Delete: got nil, want error")
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("Delete: got %d calls, want 1", got)
+		}
+	})
+
+	t.Run("DefaultOneRetry", func(t *testing.T) {
+		setup(1)
+		cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+		if _, err := cli.Info(t.Context(), "apple"); err != nil {
+			t.Errorf("Info: unexpected error: %v", err)
+		}
+		if got := calls.Load(); got != 2 {
+			t.Errorf("Info: got %d calls, want 2", got)
+		}
+	})
+}
+
+func TestParseServerURL(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{"setec.example.ts.net", "https://setec.example.ts.net"},
+		{"setec.example.ts.net/", "https://setec.example.ts.net"},
+		{"setec.example.ts.net:8443", "https://setec.example.ts.net:8443"},
+		{" https://setec.example.ts.net// ", "https://setec.example.ts.net"},
+		{"http://localhost:8080", "http://localhost:8080"},
+		{"https://example.com/setec/", "https://example.com/setec"},
+	} {
+		got, err := setec.ParseServerURL(tc.input)
+		if err != nil {
+			t.Errorf("ParseServerURL(%q): unexpected error: %v", tc.input, err)
+		} else if got != tc.want {
+			t.Errorf("ParseServerURL(%q): got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"ftp://setec.example.ts.net",
+		"https://",
+		"https://user@setec.example.ts.net",
+		"setec.example.ts.net?x=1",
+		"http://[::1",
+	} {
+		if got, err := setec.ParseServerURL(bad); err == nil {
+			t.Errorf("ParseServerURL(%q): got %q, want error", bad, got)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestClientHTTPClient(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "apple", "crumble")
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	// Route requests through a custom transport that counts them.
+	var calls atomic.Int32
+	base := hs.Client().Transport
+	cli := setec.Client{
+		Server: hs.URL,
+		HTTPClient: &http.Client{
+			Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				return base.RoundTrip(r)
+			}),
+		},
+	}
+	if v, err := cli.Get(t.Context(), "apple"); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	} else if got := string(v.Value); got != "crumble" {
+		t.Errorf("Get: got %q, want %q", got, "crumble")
+	}
+	if _, err := cli.List(t.Context()); err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Transport: got %d calls, want 2", got)
+	}
+}
+
+func TestClientPinnedCerts(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "apple", "crumble")
+	ts := setectest.NewServer(t, d, nil)
+	var requests atomic.Int32
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		ts.Mux.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	pin := setec.CertFingerprint(hs.Certificate())
+
+	t.Run("Match", func(t *testing.T) {
+		cli := setec.Client{
+			Server:                 hs.URL,
+			HTTPClient:             hs.Client(),
+			PinnedCertFingerprints: [][]byte{[]byte("bogus"), pin},
+		}
+		if v, err := cli.Get(t.Context(), "apple"); err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		} else if got := string(v.Value); got != "crumble" {
+			t.Errorf("Get: got %q, want %q", got, "crumble")
+		}
+	})
+	t.Run("Mismatch", func(t *testing.T) {
+		cli := setec.Client{
+			Server:                 hs.URL,
+			HTTPClient:             hs.Client(),
+			PinnedCertFingerprints: [][]byte{[]byte("bogus")},
+		}
+		before := requests.Load()
+		if _, err := cli.Put(t.Context(), "apple", []byte("pie")); !errors.Is(err, setec.ErrCertificateMismatch) {
+			t.Errorf("Put: got %v, want %v", err, setec.ErrCertificateMismatch)
+		}
+		if n := requests.Load() - before; n != 0 {
+			t.Errorf("Put: server received %d requests, want 0", n)
+		}
+	})
+	t.Run("DoHTTP", func(t *testing.T) {
+		cli := setec.Client{
+			Server:                 hs.URL,
+			DoHTTP:                 hs.Client().Do,
+			PinnedCertFingerprints: [][]byte{pin},
+		}
+		before := requests.Load()
+		if _, err := cli.Get(t.Context(), "apple"); err == nil {
+			t.Error("Get with DoHTTP: got nil error, want an error")
+		}
+		if n := requests.Load() - before; n != 0 {
+			t.Errorf("Get with DoHTTP: server received %d requests, want 0", n)
+		}
+	})
+	t.Run("NoTLS", func(t *testing.T) {
+		ps := httptest.NewServer(ts.Mux)
+		defer ps.Close()
+		cli := setec.Client{
+			Server:                 ps.URL,
+			PinnedCertFingerprints: [][]byte{pin},
+		}
+		if v, err := cli.Get(t.Context(), "apple"); !errors.Is(err, setec.ErrCertificateMismatch) {
+			t.Errorf("Get: got %v, %v; want %v", v, err, setec.ErrCertificateMismatch)
+		}
+	})
+}
+
+func TestClientValueCache(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "apple", "crumble")
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	var calls atomic.Int32
+	base := hs.Client().Transport
+	vc := &setec.ValueCache{
+		Dir: t.TempDir(),
+		TTL: time.Hour,
+		Key: []byte("0123456789abcdef0123456789abcdef"),
+	}
+	cli := setec.Client{
+		Server: hs.URL,
+		HTTPClient: &http.Client{
+			Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				return base.RoundTrip(r)
+			}),
+		},
+		ValueCache: vc,
+	}
+	get := func(want string, wantCalls int32) {
+		t.Helper()
+		if v, err := cli.Get(t.Context(), "apple"); err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		} else if got := string(v.Value); got != want {
+			t.Errorf("Get: got %q, want %q", got, want)
+		}
+		if got := calls.Load(); got != wantCalls {
+			t.Errorf("Get: got %d calls, want %d", got, wantCalls)
+		}
+	}
+
+	get("crumble", 1) // fetched from the server
+	get("crumble", 1) // served from the cache
+
+	// The cache does not store values in the clear.
+	files, err := os.ReadDir(vc.Dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("ReadDir: got %d files, %v; want 1 file", len(files), err)
+	}
+	if data, err := os.ReadFile(filepath.Join(vc.Dir, files[0].Name())); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if strings.Contains(string(data), "crumble") || strings.Contains(string(data), "apple") {
+		t.Errorf("Cache file contains plaintext: %q", data)
+	}
+
+	// A change made by another client is not seen until the TTL expires.
+	d.MustActivate(d.Superuser, "apple", d.MustPut(d.Superuser, "apple", "pie"))
+	get("crumble", 1)
+	vc.TTL = time.Nanosecond
+	get("pie", 2)
+
+	// A change made through the same client discards the cached value.
+	vc.TTL = time.Hour
+	get("pie", 2)
+	if err := cli.Activate(t.Context(), "apple", 1); err != nil {
+		t.Fatalf("Activate: unexpected error: %v", err)
+	}
+	get("crumble", 4)
+
+	// A cache with the wrong key is treated as empty.
+	cli.ValueCache = &setec.ValueCache{Dir: vc.Dir, TTL: time.Hour, Key: []byte("fedcba9876543210")}
+	get("crumble", 5)
+}
+
+func TestClientValueCacheRename(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	id := d.Superuser
+	d.MustPut(id, "apple", "crumble")
+	d.MustPut(id, "pear", "tart")
+	if err := d.Actual.Alias(id, "fruit", "apple"); err != nil {
+		t.Fatalf("Alias: %v", err)
+	}
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{
+		Server: hs.URL,
+		DoHTTP: hs.Client().Do,
+		ValueCache: &setec.ValueCache{
+			Dir: t.TempDir(),
+			TTL: time.Hour,
+			Key: []byte("0123456789abcdef"),
+		},
+	}
+	get := func(name string) (string, error) {
+		v, err := cli.Get(t.Context(), name)
+		if err != nil {
+			return "", err
+		}
+		return string(v.Value), nil
+	}
+
+	// Cache the values of all three names, then delete pear behind the
+	// client's back, so that its cached value is stale.
+	for _, name := range []string{"apple", "pear", "fruit"} {
+		if _, err := get(name); err != nil {
+			t.Fatalf("Get %q: unexpected error: %v", name, err)
+		}
+	}
+	if err := d.Actual.Delete(id, "pear"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if err := cli.Rename(t.Context(), "apple", "pear"); err != nil {
+		t.Fatalf("Rename: unexpected error: %v", err)
+	}
+
+	// The new name reports the renamed value, not the stale one, and the
+	// alias of the old name is broken.
+	if got, err := get("pear"); err != nil || got != "crumble" {
+		t.Errorf("Get pear: got %q, %v; want %q", got, err, "crumble")
+	}
+	if got, err := get("fruit"); !errors.Is(err, api.ErrBrokenAlias) {
+		t.Errorf("Get fruit: got %q, %v; want %v", got, err, api.ErrBrokenAlias)
+	}
+	if got, err := get("apple"); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Get apple: got %q, %v; want %v", got, err, api.ErrNotFound)
+	}
+}
+
+func TestClientValueCacheCoalesce(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "apple", "crumble")
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	// Hold the first request until every other call is waiting for it. A
+	// call is waiting once it blocks on its context; the call making the
+	// request is identified by the context of the request.
+	const numGets = 10
+	var calls atomic.Int32
+	leader := make(chan int, 1)
+	waiting := make(chan int, numGets)
+	release := make(chan struct{})
+	base := hs.Client().Transport
+	cli := setec.Client{
+		Server: hs.URL,
+		HTTPClient: &http.Client{
+			Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				if calls.Add(1) == 1 {
+					leader <- r.Context().Value(getIDKey{}).(int)
+				}
+				<-release
+				return base.RoundTrip(r)
+			}),
+		},
+		ValueCache: &setec.ValueCache{
+			Dir: t.TempDir(),
+			TTL: time.Hour,
+			Key: []byte("0123456789abcdef"),
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := range numGets {
+		ctx := &waitContext{
+			Context: context.WithValue(t.Context(), getIDKey{}, i),
+			id:      i,
+			waiting: waiting,
+		}
+		wg.Go(func() {
+			if v, err := cli.Get(ctx, "apple"); err != nil {
+				t.Errorf("Get: unexpected error: %v", err)
+			} else if got := string(v.Value); got != "crumble" {
+				t.Errorf("Get: got %q, want %q", got, "crumble")
+			}
+		})
+	}
+	first := <-leader
+	seen := make(map[int]bool)
+	for len(seen) < numGets-1 {
+		if id := <-waiting; id != first {
+			seen[id] = true
+		}
+	}
+	close(release)
+	wg.Wait()
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Get: %d concurrent calls made %d requests, want 1", numGets, got)
+	}
+}
+
+type getIDKey struct{}
+
+// waitContext is a context that reports its id on waiting the first time its
+// Done method is called.
+type waitContext struct {
+	context.Context
+	id      int
+	once    sync.Once
+	waiting chan<- int
+}
+
+func (c *waitContext) Done() <-chan struct{} {
+	c.once.Do(func() { c.waiting <- c.id })
+	return c.Context.Done()
+}
+
+func TestClientGetAtMost(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	v1 := d.MustPut(d.Superuser, "key", "old")
+	v2 := d.MustPut(d.Superuser, "key", "new")
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	check := func(maxVersion, wantVersion api.SecretVersion, want string) {
+		t.Helper()
+		v, err := cli.GetAtMost(t.Context(), "key", maxVersion)
+		if err != nil {
+			t.Fatalf("GetAtMost %v: unexpected error: %v", maxVersion, err)
+		} else if v.Version != wantVersion || string(v.Value) != want {
+			t.Errorf("GetAtMost %v: got version %v %q, want version %v %q", maxVersion, v.Version, v.Value, wantVersion, want)
+		}
+	}
+
+	// The active version is within both limits.
+	check(v1, v1, "old")
+	check(v2, v1, "old")
+
+	// Once the newer version is active, an older limit falls back.
+	d.MustActivate(d.Superuser, "key", v2)
+	check(v1, v1, "old")
+	check(v2, v2, "new")
+	check(v2+10, v2, "new")
+
+	// A fallback to a version that does not exist fails.
+	if err := d.Actual.DeleteVersion(d.Superuser, "key", v1); err != nil {
+		t.Fatalf("DeleteVersion: %v", err)
+	}
+	if v, err := cli.GetAtMost(t.Context(), "key", v1); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("GetAtMost deleted: got %v, %v; want %v", v, err, api.ErrNotFound)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	v := d.MustPut(d.Superuser, "apple", "crumble")
+	d.MustPut(d.Superuser, "private", "shh")
+	if err := d.Actual.SetPrincipals(d.Superuser, "private", []string{"someone-else@example.com"}); err != nil {
+		t.Fatalf("SetPrincipals: %v", err)
+	}
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	tests := []struct {
+		name    string
+		call    func() error
+		want    error
+		notWant error
+	}{
+		{"MissingSecret", func() error {
+			_, err := cli.Get(t.Context(), "nonesuch")
+			return err
+		}, setec.ErrSecretNotFound, setec.ErrVersionNotFound},
+		{"MissingVersion", func() error {
+			_, err := cli.GetVersion(t.Context(), "apple", v+10)
+			return err
+		}, setec.ErrVersionNotFound, setec.ErrSecretNotFound},
+		{"AccessDenied", func() error {
+			_, err := cli.Get(t.Context(), "private")
+			return err
+		}, setec.ErrAccessDenied, api.ErrNotFound},
+		{"NotModified", func() error {
+			_, err := cli.GetIfChanged(t.Context(), "apple", v)
+			return err
+		}, setec.ErrNotModified, api.ErrNotFound},
+		{"AlreadyExists", func() error {
+			_, err := cli.PutWithOptions(t.Context(), "apple", []byte("pie"), setec.PutOptions{IfAbsent: true})
+			return err
+		}, api.ErrAlreadyExists, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Got error %v, want %v", err, tc.want)
+			}
+			if tc.notWant != nil && errors.Is(err, tc.notWant) {
+				t.Errorf("Got error %v, which should not be %v", err, tc.notWant)
+			}
+		})
+	}
+
+	// The specific not-found errors are also reported as api.ErrNotFound.
+	if _, err := cli.Get(t.Context(), "nonesuch"); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Get nonesuch: got %v, want %v", err, api.ErrNotFound)
+	}
+}
+
+func TestClientRequestID(t *testing.T) {
+	var logBuf bytes.Buffer
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&logBuf)})
+	ts := setectest.NewServer(t, d, nil)
+
+	var sent []string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.Header.Get(api.RequestIDHeader))
+		ts.Mux.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do, RequestID: "trace-123"}
+
+	if _, err := cli.Put(t.Context(), "apple", []byte("crumble")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	_, err := cli.Get(t.Context(), "nonesuch")
+	if !errors.Is(err, setec.ErrSecretNotFound) {
+		t.Errorf("Get: got %v, want %v", err, setec.ErrSecretNotFound)
+	} else if !strings.Contains(err.Error(), "request ID trace-123") {
+		t.Errorf("Get: error %q does not include the request ID", err)
+	}
+
+	// Without a RequestID, each call gets its own.
+	cli.RequestID = ""
+	for range 2 {
+		if _, err := cli.Info(t.Context(), "apple"); err != nil {
+			t.Fatalf("Info: unexpected error: %v", err)
+		}
+	}
+	if len(sent) != 4 {
+		t.Fatalf("Got %d requests, want 4", len(sent))
+	}
+	if sent[0] != "trace-123" || sent[1] != "trace-123" {
+		t.Errorf("Request IDs: got %q, want trace-123", sent[:2])
+	}
+	if sent[2] == "" || sent[2] == sent[3] || !api.ValidRequestID(sent[2]) {
+		t.Errorf("Request IDs: got %q, want distinct valid IDs", sent[2:])
+	}
+
+	// The audit log records the request IDs.
+	dec := json.NewDecoder(&logBuf)
+	var got []string
+	for dec.More() {
+		var e audit.Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Decode audit entry: %v", err)
+		}
+		got = append(got, e.RequestID)
+	}
+	if n := len(got); n < 3 || got[0] != "trace-123" || got[n-2] != sent[2] || got[n-1] != sent[3] {
+		t.Errorf("Audit request IDs: got %q, want trace-123 first and %q last", got, sent[2:])
+	}
+
+	cli.RequestID = "bad id"
+	if _, err := cli.Info(t.Context(), "apple"); err == nil {
+		t.Error("Info with invalid request ID: got nil, want error")
+	}
+}
+
+func TestClientVersionStatus(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	v1 := d.MustPut(d.Superuser, "apple", "crumble")
+	v2 := d.MustPut(d.Superuser, "apple", "pie")
+	v3 := d.MustPut(d.Superuser, "apple", "tart")
+	if err := d.Actual.DeleteVersion(d.Superuser, "apple", v3); err != nil {
+		t.Fatalf("DeleteVersion: %v", err)
+	}
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	tests := []struct {
+		version api.SecretVersion
+		want    setec.VersionStatus
+	}{
+		{v1, setec.VersionActive},
+		{v2, setec.VersionInactive},
+		{v3, setec.VersionAbsent},
+		{v3 + 1, setec.VersionAbsent},
+	}
+	for _, tc := range tests {
+		got, err := cli.VersionStatus(t.Context(), "apple", tc.version)
+		if err != nil || got != tc.want {
+			t.Errorf("VersionStatus %v: got (%v, %v), want %v", tc.version, got, err, tc.want)
+		}
+	}
+	if got, err := cli.VersionStatus(t.Context(), "nonesuch", 1); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("VersionStatus nonesuch: got (%v, %v), want %v", got, err, api.ErrNotFound)
+	}
+}
+
+func TestClientGetWait(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{
+		Server: hs.URL,
+		DoHTTP: hs.Client().Do,
+		Retry:  &setec.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+	}
+
+	// If the secret does not appear, the wait ends with the context.
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if sv, err := cli.GetWait(ctx, "apple"); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("GetWait missing: got (%v, %v), want %v", sv, err, api.ErrNotFound)
+	}
+
+	// A secret provisioned while waiting is reported.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		d.MustPut(d.Superuser, "apple", "crumble")
+	}()
+	if sv, err := cli.GetWait(t.Context(), "apple"); err != nil {
+		t.Errorf("GetWait: unexpected error: %v", err)
+	} else if got := string(sv.Value); got != "crumble" {
+		t.Errorf("GetWait: got %q, want %q", got, "crumble")
+	}
+}
+
+func TestClientWaitActive(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "apple", "crumble")
+	v2 := d.MustPut(d.Superuser, "apple", "pie")
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{
+		Server: hs.URL,
+		DoHTTP: hs.Client().Do,
+		Retry:  &setec.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+	}
+
+	// If the version is not activated, the wait ends with the context.
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := cli.WaitActive(ctx, "apple", v2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitActive inactive: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A version activated while waiting is reported.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		d.MustActivate(d.Superuser, "apple", v2)
+	}()
+	if err := cli.WaitActive(t.Context(), "apple", v2); err != nil {
+		t.Errorf("WaitActive: unexpected error: %v", err)
+	}
+
+	if err := cli.WaitActive(t.Context(), "apple", 0); err == nil {
+		t.Error("WaitActive version 0: got nil, want error")
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "apple", "crumble")
+	ts := setectest.NewServer(t, d, nil)
+
+	// Delay each response, unless the request is canceled first.
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+			ts.Mux.ServeHTTP(w, r)
+		case <-r.Context().Done():
+		}
+	}))
+	defer hs.Close()
+
+	cli := setec.Client{
+		Server:  hs.URL,
+		DoHTTP:  hs.Client().Do,
+		Retry:   &setec.RetryPolicy{MaxAttempts: 1},
+		Timeout: 20 * time.Millisecond,
+	}
+
+	// With no deadline on the context, the default timeout applies.
+	if sv, err := cli.Get(t.Context(), "apple"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get: got (%v, %v), want %v", sv, err, context.DeadlineExceeded)
+	} else if want := "server did not respond within 20ms"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Get: got error %q, want it to mention %q", err, want)
+	}
+
+	// An explicit deadline takes precedence over the default.
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	if sv, err := cli.Get(ctx, "apple"); err != nil {
+		t.Errorf("Get with deadline: unexpected error: %v", err)
+	} else if got := string(sv.Value); got != "crumble" {
+		t.Errorf("Get with deadline: got %q, want %q", got, "crumble")
+	}
+}
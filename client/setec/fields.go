@@ -76,6 +76,8 @@ func ParseFields(v any, namePrefix string) (*Fields, error) {
 // constructed with the AllowLookup option enabled to add new secrets after the
 // store has been constructed.
 //
+// To populate a struct once at startup without a Store, use [Unmarshal].
+//
 // # Field Types
 //
 // The Fields type can handle struct fields of the following types:
@@ -155,27 +157,27 @@ type fieldInfo struct {
 
 // apply sets the target of fi.value to the secret named. It reports an error
 // if the requested secret could not be fetched from the store.
+func (f fieldInfo) apply(ctx context.Context, s *Store, fullName string) error {
+	v, err := s.LookupSecret(ctx, fullName)
+	if err != nil {
+		return fmt.Errorf("secret lookup error: %w", err)
+	}
+	return f.set(v)
+}
+
+// set sets the target of fi.value to the secret v.
 //
 // If f.isJSON is true, the data are unmarshaled as JSON.
 // Otherwise, the data are converted to the target type and copied.
-func (f fieldInfo) apply(ctx context.Context, s *Store, fullName string) error {
+func (f fieldInfo) set(v Secret) error {
 	if f.isJSON {
-		v, err := s.LookupSecret(ctx, fullName)
-		if err != nil {
-			return fmt.Errorf("secret lookup error: %w", err)
-		}
-		if err = json.Unmarshal(v.Get(), f.value.Interface()); err != nil {
+		if err := json.Unmarshal(v.Get(), f.value.Interface()); err != nil {
 			return fmt.Errorf("json.Unmarshal error: %w", err)
 		}
 		return nil
 	}
-
-	v, err := s.LookupSecret(ctx, fullName)
-	if err != nil {
-		return fmt.Errorf("secret lookup error: %w", err)
-	}
 	if f.unmarshal != nil {
-		if err = f.unmarshal(v.Get()); err != nil {
+		if err := f.unmarshal(v.Get()); err != nil {
 			return fmt.Errorf("unmarshal error: %w", err)
 		}
 		return nil
@@ -193,6 +195,56 @@ func (f fieldInfo) apply(ctx context.Context, s *Store, fullName string) error {
 	return nil
 }
 
+// Unmarshal fetches the active values of the secrets named by the
+// setec-tagged fields of v from the server, in a single request, and stores
+// them in the corresponding fields. The concrete type of v must be a pointer
+// to a struct value with at least one tagged field. See [Fields] for a
+// description of the struct tags and types recognized; a field of type
+// [Secret] receives a handle to the value fetched, which does not change.
+//
+// Unmarshal attempts to fill in every tagged field before reporting an error.
+// If any fields could not be filled in, for example because their secrets do
+// not exist or the caller is not allowed to get them, the error names each of
+// those fields and its secret. Other fields are populated regardless.
+//
+// Unlike a [Store], Unmarshal does not keep the values up to date. To
+// refresh them, call Unmarshal again.
+//
+// Access requirement: "get" for each secret
+func Unmarshal(ctx context.Context, c Client, v any) error {
+	fi, err := parseFields(v)
+	if err != nil {
+		return err
+	} else if len(fi) == 0 {
+		return fmt.Errorf("type %v: %w", reflect.TypeOf(v).Elem(), ErrNoFields)
+	}
+	var names []string
+	for _, f := range fi {
+		if !slices.Contains(names, f.secretName) {
+			names = append(names, f.secretName)
+		}
+	}
+	vals, err := c.GetMany(ctx, names)
+	var gerr GetManyError
+	if err != nil && !errors.As(err, &gerr) {
+		return err
+	}
+
+	var errs []error
+	for _, f := range fi {
+		sv, ok := vals[f.secretName]
+		if !ok {
+			errs = append(errs, fmt.Errorf("apply %q to field %q: %w", f.secretName, f.fieldName, gerr[f.secretName]))
+			continue
+		}
+		value := string(sv.Value)
+		if err := f.set(StaticSecret(value)); err != nil {
+			errs = append(errs, fmt.Errorf("apply %q to field %q: %w", f.secretName, f.fieldName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 var (
 	bytesType  = reflect.TypeOf([]byte(nil))
 	secretType = reflect.TypeOf(Secret(nil))
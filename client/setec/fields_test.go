@@ -150,3 +150,65 @@ func TestParseErrors(t *testing.T) {
 		}
 	})
 }
+
+func TestUnmarshal(t *testing.T) {
+	db := setectest.NewDB(t, nil)
+	db.MustPut(db.Superuser, "app/password", "hunter2")
+	db.MustPut(db.Superuser, "app/key", "kumquat:quince")
+	db.MustPut(db.Superuser, "app/object", `{"x":"hello","y":true}`)
+
+	ts := setectest.NewServer(t, db, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	t.Run("OK", func(t *testing.T) {
+		var cfg struct {
+			Password string       `setec:"app/password"`
+			Again    []byte       `setec:"app/password"`
+			Key      binValue     `setec:"app/key"`
+			Object   testObj      `setec:"app/object,json"`
+			Handle   setec.Secret `setec:"app/password"`
+			Other    string
+		}
+		if err := setec.Unmarshal(t.Context(), cli, &cfg); err != nil {
+			t.Fatalf("Unmarshal: unexpected error: %v", err)
+		}
+		if cfg.Password != "hunter2" || string(cfg.Again) != "hunter2" || string(cfg.Handle.Get()) != "hunter2" {
+			t.Errorf("Password fields: got %q, %q, %q; want hunter2", cfg.Password, cfg.Again, cfg.Handle.Get())
+		}
+		if want := (binValue{"kumquat", "quince"}); cfg.Key != want {
+			t.Errorf("Key: got %q, want %q", cfg.Key, want)
+		}
+		if want := (testObj{X: "hello", Y: true}); cfg.Object != want {
+			t.Errorf("Object: got %+v, want %+v", cfg.Object, want)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		var cfg struct {
+			Password string `setec:"app/password"`
+			Token    string `setec:"app/token"`
+			Cert     []byte `setec:"app/cert"`
+		}
+		err := setec.Unmarshal(t.Context(), cli, &cfg)
+		if err == nil {
+			t.Fatal("Unmarshal: got nil error, want error")
+		}
+		for _, want := range []string{`"app/token" to field "Token"`, `"app/cert" to field "Cert"`} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Unmarshal error %q does not mention %s", err, want)
+			}
+		}
+		if cfg.Password != "hunter2" {
+			t.Errorf("Password: got %q, want hunter2", cfg.Password)
+		}
+	})
+
+	t.Run("NoFields", func(t *testing.T) {
+		var cfg struct{ Name string }
+		if err := setec.Unmarshal(t.Context(), cli, &cfg); !errors.Is(err, setec.ErrNoFields) {
+			t.Errorf("Unmarshal: got %v, want %v", err, setec.ErrNoFields)
+		}
+	})
+}
@@ -4,6 +4,7 @@
 package setec
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -78,7 +79,7 @@ func TestWatcher(t *testing.T) {
 
 func TestPollDisabled(t *testing.T) {
 	d := setectest.NewDB(t, nil)
-	d.MustPut(d.Superuser, "full plate", "and packing steel")
+	d.MustPut(d.Superuser, "full-plate", "and packing steel")
 
 	ts := setectest.NewServer(t, d, nil)
 	hs := httptest.NewServer(ts.Mux)
@@ -86,7 +87,7 @@ func TestPollDisabled(t *testing.T) {
 
 	st, err := NewStore(t.Context(), StoreConfig{
 		Client:       Client{Server: hs.URL, DoHTTP: hs.Client().Do},
-		Secrets:      []string{"full plate"},
+		Secrets:      []string{"full-plate"},
 		PollInterval: -1, // disabled
 	})
 	if err != nil {
@@ -104,3 +105,32 @@ func TestPollDisabled(t *testing.T) {
 		t.Error("Polling is unexpectedly enabled")
 	}
 }
+
+func TestPinnedClientsBounded(t *testing.T) {
+	pins := [][]byte{[]byte("pin")}
+	get := func(base *http.Client) *http.Client {
+		t.Helper()
+		hc, err := pinnedHTTPClient(base, pins)
+		if err != nil {
+			t.Fatalf("pinnedHTTPClient: %v", err)
+		}
+		return hc
+	}
+
+	// A base client and pins map to the same pinned client while it is in
+	// use, however many other base clients come and go.
+	kept := new(http.Client)
+	want := get(kept)
+	for range 3 * maxPinnedClients {
+		get(new(http.Client))
+		if got := get(kept); got != want {
+			t.Fatal("pinnedHTTPClient: got a new client for a recently used base")
+		}
+	}
+	pinnedClients.Lock()
+	n := len(pinnedClients.clients)
+	pinnedClients.Unlock()
+	if n > maxPinnedClients {
+		t.Errorf("Pinned clients: got %d, want at most %d", n, maxPinnedClients)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrCertificateMismatch is reported by a [Client] with pinned certificate
+// fingerprints when the server does not present a matching certificate.
+var ErrCertificateMismatch = errors.New("server certificate does not match a pinned fingerprint")
+
+// CertFingerprint returns the fingerprint of cert, as used by the
+// PinnedCertFingerprints field of a [Client]: the SHA-256 digest of its DER
+// encoding.
+func CertFingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.Raw)
+	return sum[:]
+}
+
+// checkPins reports an error wrapping ErrCertificateMismatch unless the leaf
+// certificate of the TLS connection cs has one of the fingerprints in pins.
+func checkPins(pins [][]byte, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: server presented no certificate", ErrCertificateMismatch)
+	}
+	fp := CertFingerprint(cs.PeerCertificates[0])
+	for _, pin := range pins {
+		if bytes.Equal(pin, fp) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: got %x", ErrCertificateMismatch, fp)
+}
+
+// pinnedKey identifies an HTTP client in pinnedClients: the client it is
+// derived from, and the pinned fingerprints it checks.
+type pinnedKey struct {
+	base *http.Client
+	pins string
+}
+
+// maxPinnedClients is the most HTTP clients pinnedClients keeps.
+const maxPinnedClients = 16
+
+// pinnedClients caches the HTTP clients used for each distinct base client
+// and set of pinned fingerprints, so that clients with the same pins share
+// connections. It keeps the maxPinnedClients most recently used, so that a
+// program that makes many base clients does not accumulate them; the idle
+// connections of a client it drops are closed.
+var pinnedClients struct {
+	sync.Mutex
+	clients []pinnedClient // least recently used first
+}
+
+type pinnedClient struct {
+	key pinnedKey
+	hc  *http.Client
+}
+
+// pinnedHTTPClient returns an HTTP client like base, that also checks the
+// server certificate against pins during the TLS handshake, before any
+// request is sent. It reports an error if base does not use an
+// *http.Transport, since the check cannot then be added to it.
+func pinnedHTTPClient(base *http.Client, pins [][]byte) (*http.Client, error) {
+	var sb strings.Builder
+	for _, pin := range pins {
+		fmt.Fprintf(&sb, "%x,", pin)
+	}
+	key := pinnedKey{base: base, pins: sb.String()}
+
+	pinnedClients.Lock()
+	defer pinnedClients.Unlock()
+	if i := slices.IndexFunc(pinnedClients.clients, func(pc pinnedClient) bool { return pc.key == key }); i >= 0 {
+		pc := pinnedClients.clients[i]
+		pinnedClients.clients = append(slices.Delete(pinnedClients.clients, i, i+1), pc)
+		return pc.hc, nil
+	}
+	var t *http.Transport
+	switch rt := base.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return nil, fmt.Errorf("cannot check pinned certificates with transport %T", rt)
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = new(tls.Config)
+	}
+	pins = append([][]byte(nil), pins...)
+	verify := t.TLSClientConfig.VerifyConnection
+	t.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := checkPins(pins, cs); err != nil {
+			return err
+		} else if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+	hc := *base
+	hc.Transport = t
+	if len(pinnedClients.clients) >= maxPinnedClients {
+		pinnedClients.clients[0].hc.CloseIdleConnections()
+		pinnedClients.clients = slices.Delete(pinnedClients.clients, 0, 1)
+	}
+	pinnedClients.clients = append(pinnedClients.clients, pinnedClient{key, &hc})
+	return &hc, nil
+}
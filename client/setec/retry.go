@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+)
+
+// RetryPolicy controls how a [Client] retries read-only API calls that fail
+// with a transient error, such as a network failure, a 5xx status from the
+// server, or a 429 status reporting that the caller is rate limited. Puts are
+// also retried, using an idempotency key so that a retry does not create a
+// second version; other calls that modify secrets are never retried.
+//
+// Retries are spaced using exponential backoff with random jitter, starting
+// at BaseDelay and doubling after each attempt up to MaxDelay. Retries stop
+// early if the context governing the call ends.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times to attempt a call,
+	// including the first. If zero, DefaultRetryPolicy.MaxAttempts is used.
+	// A value of 1 disables retries.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry.
+	// If zero, DefaultRetryPolicy.BaseDelay is used.
+	BaseDelay time.Duration
+
+	// MaxDelay is the maximum delay between attempts.
+	// If zero, DefaultRetryPolicy.MaxDelay is used.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by a [Client] whose Retry field
+// is nil. It retries a failed call once.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 2,
+	BaseDelay:   250 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts <= 0 {
+		return DefaultRetryPolicy.MaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) baseDelay() time.Duration {
+	if p == nil || p.BaseDelay <= 0 {
+		return DefaultRetryPolicy.BaseDelay
+	}
+	return p.BaseDelay
+}
+
+func (p *RetryPolicy) maxDelay() time.Duration {
+	if p == nil || p.MaxDelay <= 0 {
+		return DefaultRetryPolicy.MaxDelay
+	}
+	return p.MaxDelay
+}
+
+// delay returns the delay to wait after the specified attempt (1-based)
+// fails, before trying again.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d, max := p.baseDelay(), p.maxDelay()
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	d = min(d, max)
+
+	// Choose uniformly from [d/2, d] so concurrent clients spread out.
+	return d/2 + rand.N(d/2+1)
+}
+
+// doRetry is as do, but retries transient failures according to the retry
+// policy of c. It must only be used for API methods that are safe to repeat.
+// All attempts are sent with the same request ID.
+func doRetry[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RESP, error) {
+	c.RequestID = cmp.Or(c.RequestID, api.NewRequestID())
+	for attempt := 1; ; attempt++ {
+		resp, err := do[RESP](ctx, c, path, req)
+		if err == nil || attempt >= c.Retry.maxAttempts() || !isTransient(err) {
+			return resp, err
+		}
+		t := time.NewTimer(c.Retry.delay(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return resp, err
+		case <-t.C:
+		}
+	}
+}
+
+// transientError wraps an error from a call that may succeed if retried.
+type transientError struct{ err error }
+
+func (t transientError) Error() string { return t.err.Error() }
+func (t transientError) Unwrap() error { return t.err }
+
+// isTransient reports whether err is or wraps a transientError.
+func isTransient(err error) bool {
+	var t transientError
+	return errors.As(err, &t)
+}
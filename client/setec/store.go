@@ -35,6 +35,9 @@ type Store struct {
 	timeNow     func() time.Time
 	single      throttle.Set[string, Secret]
 
+	failIfMissing  bool        // fail startup if a secret does not exist
+	onRefreshError func(error) // if non-nil, called for polling errors
+
 	// Undeclared secrets not accessed in at least this long are eligible to be
 	// purged from the cache. If zero, no expiry is performed.
 	expiryAge time.Duration
@@ -48,6 +51,7 @@ type Store struct {
 		m map[string]*cachedSecret // :: secret name → active value
 		f map[string]Secret        // :: secret name → fetch function
 		w map[string][]watcher     // :: secret name → watchers
+		c map[string][]*changeSub  // :: secret name → change subscribers
 	}
 
 	ctx    context.Context    // governs the polling task and lookups
@@ -140,6 +144,20 @@ type StoreConfig struct {
 	// BackgroundContext, if non-nil, is a context that is used for background operations
 	// instead of context.Background.
 	BackgroundContext context.Context
+
+	// FailIfMissing, if true, causes NewStore to report an error immediately
+	// if the service reports that any of the declared secrets does not exist,
+	// or that the caller is not allowed to fetch it. By default, NewStore
+	// keeps retrying until the secret becomes available or ctx ends.
+	// Other errors, such as the service being unreachable, are retried either
+	// way.
+	FailIfMissing bool
+
+	// OnRefreshError, if non-nil, is called with the error reported by each
+	// failed background poll for updated secret values. It is called
+	// synchronously by the polling goroutine, so it should not block.
+	// Errors are logged whether or not this is set.
+	OnRefreshError func(error)
 }
 
 func (c StoreConfig) logger() logger.Logf {
@@ -181,7 +199,8 @@ func (c StoreConfig) timeNow() func() time.Time {
 // retrieval by the Secret method, or ctx ends.  The context passed to NewStore
 // is only used for initializing the store. If a cache is provided, cached
 // values are accepted even if stale, as long as there is a value for each of
-// the secrets in cfg.
+// the secrets in cfg. If cfg.FailIfMissing is true, NewStore fails instead of
+// waiting for secrets the service reports do not exist.
 func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 	if cfg.Client == nil {
 		return nil, errors.New("no service client is set")
@@ -202,12 +221,16 @@ func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 		newTicker:   cfg.newTicker(),
 		timeNow:     cfg.timeNow(),
 		expiryAge:   cfg.ExpiryAge,
+
+		failIfMissing:  cfg.FailIfMissing,
+		onRefreshError: cfg.OnRefreshError,
 	}
 
 	// Initialize the active versions maps.
 	s.active.m = make(map[string]*cachedSecret)
 	s.active.f = make(map[string]Secret)
 	s.active.w = make(map[string][]watcher)
+	s.active.c = make(map[string][]*changeSub)
 
 	// If we have a cache, try to load data from there first.
 	data, err := s.loadCache()
@@ -607,6 +630,9 @@ func (s *Store) run(ctx context.Context, interval time.Duration, done chan<- str
 		case <-doPoll:
 			if err := s.Refresh(ctx); err != nil {
 				s.logf("%s (continuing)", err)
+				if s.onRefreshError != nil && ctx.Err() == nil {
+					s.onRefreshError(err)
+				}
 			}
 			t.Done()
 		}
@@ -644,6 +670,10 @@ func (s *Store) applyUpdates(updates map[string]*cachedSecret) error {
 		// This is a new value for an unexpired secret.
 		// Note that new values do not update access times.
 		sa := s.active.m[name]
+		var old []byte
+		if sa.Secret != nil {
+			old = sa.Secret.Value
+		}
 		sa.Secret = u.Secret
 		sa.Versions = u.Versions
 		s.logf("[store] update to version %d for secret %q", u.Secret.Version, name)
@@ -652,6 +682,11 @@ func (s *Store) applyUpdates(updates map[string]*cachedSecret) error {
 		for _, w := range s.active.w[name] {
 			w.notify()
 		}
+		if !bytes.Equal(old, u.Secret.Value) {
+			for _, c := range s.active.c[name] {
+				c.push(old, u.Secret.Value)
+			}
+		}
 	}
 	return s.flushCacheLocked()
 }
@@ -727,6 +762,8 @@ func (s *Store) initializeActive(ctx context.Context) error {
 				continue
 			} else if ctx.Err() != nil {
 				return err // context ended, give up
+			} else if s.failIfMissing && (errors.Is(err, api.ErrNotFound) || errors.Is(err, api.ErrAccessDenied)) {
+				return fmt.Errorf("secret %q: %w", name, err)
 			}
 			s.logf("[store] error fetching %q: %v (retrying)", name, err)
 			missing++
@@ -6,6 +6,7 @@ package setec_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http/httptest"
 	"os"
@@ -190,8 +191,17 @@ func TestCachedStore(t *testing.T) {
 		t.Fatalf("Lookup alpha: got %q, want %q", got, want)
 	}
 
-	// Check that the cache got updated with the new value.
-	const newCache = `{"alpha":{"secret":{"Value":"YmF6cXV1eA==","Version":2},"lastAccess":"1"}}`
+	// Check that the cache got updated with the new value, including its
+	// creation time.
+	info, err := cli.Info(ctx, "alpha")
+	if err != nil {
+		t.Fatalf("Info alpha: unexpected error: %v", err)
+	}
+	created, err := json.Marshal(info.VersionInfo[v2].CreatedAt)
+	if err != nil {
+		t.Fatalf("Encode creation time: %v", err)
+	}
+	newCache := `{"alpha":{"secret":{"Value":"YmF6cXV1eA==","Version":2,"CreatedAt":` + string(created) + `},"lastAccess":"1"}}`
 
 	if got := mc.String(); got != newCache {
 		t.Errorf("Cache value:\ngot  %#q\nwant %#q", got, newCache)
@@ -391,6 +401,70 @@ func TestUpdater(t *testing.T) {
 	})
 }
 
+func TestStoreOnChange(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "password", "hunter2") // active
+	v2 := d.MustPut(d.Superuser, "password", "correct horse")
+	v3 := d.MustPut(d.Superuser, "password", "battery staple")
+
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	pollTicker := setectest.NewFakeTicker()
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:     cli,
+		Secrets:    []string{"password"},
+		PollTicker: pollTicker,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: unexpected error: %v", err)
+	}
+	defer st.Close()
+
+	if _, err := st.OnChange(ctx, "nonesuch", func(_, _ []byte) {}); err == nil {
+		t.Error("OnChange for an unknown secret: got nil, want error")
+	}
+
+	// The callback blocks until the test reads each change, so the polls
+	// below only complete if they do not wait for it.
+	changes := make(chan string)
+	stop, err := st.OnChange(ctx, "password", func(old, new []byte) {
+		changes <- string(old) + " -> " + string(new)
+	})
+	if err != nil {
+		t.Fatalf("OnChange: unexpected error: %v", err)
+	}
+	defer stop()
+
+	for _, v := range []api.SecretVersion{v2, v3} {
+		if err := cli.Activate(ctx, "password", v); err != nil {
+			t.Fatalf("Activate %v: unexpected error: %v", v, err)
+		}
+		pollTicker.Poll()
+	}
+	pollTicker.Poll() // no change
+
+	for _, want := range []string{"hunter2 -> correct horse", "correct horse -> battery staple"} {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Errorf("Change: got %q, want %q", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for change %q", want)
+		}
+	}
+	select {
+	case got := <-changes:
+		t.Errorf("Unexpected change: %q", got)
+	default:
+	}
+}
+
 func TestLookup(t *testing.T) {
 	d := setectest.NewDB(t, nil)
 	d.MustPut(d.Superuser, "red", "badge of courage") // active
@@ -851,3 +925,57 @@ func (c *closeable[T]) Close() error {
 	c.Closed = true
 	return nil
 }
+
+func TestStoreErrors(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "present", "here")
+	d.MustPut(d.Superuser, "fleeting", "soon gone")
+
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	t.Run("FailIfMissing", func(t *testing.T) {
+		st, err := setec.NewStore(t.Context(), setec.StoreConfig{
+			Client:        cli,
+			Secrets:       []string{"present", "absent"},
+			FailIfMissing: true,
+		})
+		if !errors.Is(err, api.ErrNotFound) {
+			t.Errorf("NewStore: got (%v, %v), want %v", st, err, api.ErrNotFound)
+		}
+		if st != nil {
+			st.Close()
+		}
+	})
+
+	t.Run("OnRefreshError", func(t *testing.T) {
+		var errs []error
+		pollTicker := setectest.NewFakeTicker()
+		st, err := setec.NewStore(t.Context(), setec.StoreConfig{
+			Client:         cli,
+			Secrets:        []string{"present", "fleeting"},
+			PollTicker:     pollTicker,
+			FailIfMissing:  true,
+			OnRefreshError: func(err error) { errs = append(errs, err) },
+		})
+		if err != nil {
+			t.Fatalf("NewStore: unexpected error: %v", err)
+		}
+		defer st.Close()
+
+		pollTicker.Poll()
+		if len(errs) != 0 {
+			t.Errorf("After successful poll: got errors %v, want none", errs)
+		}
+
+		if err := d.Actual.Delete(d.Superuser, "fleeting"); err != nil {
+			t.Fatalf("Delete fleeting: unexpected error: %v", err)
+		}
+		pollTicker.Poll()
+		if len(errs) != 1 || !errors.Is(errs[0], api.ErrNotFound) {
+			t.Errorf("After failed poll: got errors %v, want one %v", errs, api.ErrNotFound)
+		}
+	})
+}
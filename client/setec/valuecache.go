@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/creachadair/msync/throttle"
+	"github.com/tailscale/setec/types/api"
+	"tailscale.com/atomicfile"
+)
+
+// ValueCache is an encrypted on-disk cache of active secret values for a
+// [Client]. When a Client has a ValueCache, [Client.Get] reports a cached
+// value if it was fetched from the server less than TTL ago, and otherwise
+// fetches the value from the server and caches it.
+//
+// This trades consistency for speed: a cached value may be up to TTL older
+// than the active value on the server. Calls through the same Client that
+// change a secret discard its cached value, but changes made by other clients
+// are not seen until the cached value expires. Likewise, the cached values of
+// aliases are not discarded when their target changes, except by
+// [Client.Rename], which discards every cached value, since it can change
+// which secret an alias of either name refers to.
+//
+// Concurrent calls to Get for the same secret on the same server, through
+// Clients that share a ValueCache, are coalesced: one of them fetches the
+// value from the server, and the others share its result. This keeps many
+// goroutines that start at once from each requesting the same secret.
+//
+// Errors reading or writing the cache are not reported; a value that cannot
+// be read from the cache is fetched from the server instead.
+type ValueCache struct {
+	// Dir is the directory where cached values are stored, one file per
+	// server and secret name. It is created if necessary.
+	Dir string
+
+	// TTL is how long a cached value is used before it is fetched again.
+	// If zero or negative, the cache is not used.
+	TTL time.Duration
+
+	// Key is the AES key used to encrypt cached values. It must be 16, 24,
+	// or 32 bytes long; otherwise the cache is not used.
+	Key []byte
+
+	// inflight coalesces concurrent fetches of the same secret, keyed by
+	// server and secret name.
+	inflight throttle.Set[string, *api.SecretValue]
+}
+
+// cachedValue is the plaintext content of a value cache file.
+type cachedValue struct {
+	Value     *api.SecretValue
+	FetchedAt time.Time
+}
+
+// aead returns the cipher used to encrypt cache entries, or nil if the
+// cache is disabled.
+func (vc *ValueCache) aead() cipher.AEAD {
+	if vc == nil || vc.Dir == "" || vc.TTL <= 0 {
+		return nil
+	}
+	block, err := aes.NewCipher(vc.Key)
+	if err != nil {
+		return nil
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil
+	}
+	return gcm
+}
+
+// path returns the path of the cache file for the named secret on server,
+// and the associated data used to encrypt it. File names are hashed so they
+// do not reveal secret names.
+func (vc *ValueCache) path(server, name string) (string, []byte) {
+	ad := []byte(server + "\x00" + name)
+	sum := sha256.Sum256(ad)
+	return filepath.Join(vc.Dir, hex.EncodeToString(sum[:])), ad
+}
+
+// lookup reports the cached value of the named secret on server, if the
+// cache has one that is still fresh.
+func (vc *ValueCache) lookup(server, name string) (*api.SecretValue, bool) {
+	gcm := vc.aead()
+	if gcm == nil {
+		return nil, false
+	}
+	path, ad := vc.path(server, name)
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return nil, false
+	}
+	nonce, enc := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, enc, ad)
+	if err != nil {
+		return nil, false
+	}
+	var cv cachedValue
+	if err := json.Unmarshal(plain, &cv); err != nil || cv.Value == nil {
+		return nil, false
+	}
+	if age := time.Since(cv.FetchedAt); age < 0 || age >= vc.TTL {
+		return nil, false
+	}
+	return cv.Value, true
+}
+
+// store caches v as the value of the named secret on server.
+func (vc *ValueCache) store(server, name string, v *api.SecretValue) error {
+	gcm := vc.aead()
+	if gcm == nil {
+		return nil
+	}
+	plain, err := json.Marshal(cachedValue{Value: v, FetchedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vc.Dir, 0700); err != nil {
+		return fmt.Errorf("cache directory: %w", err)
+	}
+	path, ad := vc.path(server, name)
+	return atomicfile.WriteFile(path, gcm.Seal(nonce, nonce, plain, ad), 0600)
+}
+
+// fetch calls get to fetch the active value of the named secret on server,
+// and caches the result. Concurrent calls for the same secret share a single
+// call of get, made by one of them, and each receives its own copy of the
+// value. If the cache is disabled, fetch simply calls get.
+func (vc *ValueCache) fetch(ctx context.Context, server, name string, get func(context.Context) (*api.SecretValue, error)) (*api.SecretValue, error) {
+	if vc.aead() == nil {
+		return get(ctx)
+	}
+	v, err := vc.inflight.Call(ctx, server+"\x00"+name, func(ctx context.Context) (*api.SecretValue, error) {
+		v, err := get(ctx)
+		if err == nil {
+			vc.store(server, name, v) // best effort
+		}
+		return v, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cp := *v
+	cp.Value = bytes.Clone(v.Value)
+	return &cp, nil
+}
+
+// forgetAll discards every cached value. It is used when the secrets that
+// cached names refer to may have changed, but which names are affected is not
+// known, since the cache does not record which of them are aliases.
+func (vc *ValueCache) forgetAll() {
+	if vc == nil || vc.Dir == "" {
+		return
+	}
+	des, err := os.ReadDir(vc.Dir)
+	if err != nil {
+		return
+	}
+	for _, de := range des {
+		// Only remove files named as cache entries are.
+		if n := de.Name(); len(n) == 2*sha256.Size && isHex(n) && de.Type().IsRegular() {
+			os.Remove(filepath.Join(vc.Dir, n))
+		}
+	}
+}
+
+// isHex reports whether s consists only of lowercase hexadecimal digits.
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// forget discards the cached value of the named secret on server, if any.
+func (vc *ValueCache) forget(server, name string) {
+	if vc == nil || vc.Dir == "" {
+		return
+	}
+	path, _ := vc.path(server, name)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// Removal failed; overwrite the entry with garbage so it cannot be
+		// decrypted, and will be treated as a miss.
+		os.WriteFile(path, nil, 0600)
+	}
+}
@@ -6,6 +6,8 @@ package setec
 import (
 	"context"
 	"errors"
+	"slices"
+	"sync"
 )
 
 // A watcher monitors the current active value of a secret, and allows the user
@@ -61,3 +63,106 @@ func (s *Store) lookupWatcher(ctx context.Context, name string) (watcher, error)
 	s.active.w[name] = append(s.active.w[name], w)
 	return w, nil
 }
+
+// A changeSub delivers changes to the active value of a secret to a callback
+// on a goroutine of its own, in the order they occurred. Changes are queued
+// without limit, so that delivering them never blocks the store.
+type changeSub struct {
+	f    func(old, new []byte)
+	wake chan struct{} // buffered; signals that the queue is non-empty
+	stop chan struct{} // closed when the subscription ends
+	once sync.Once
+
+	mu    sync.Mutex
+	queue [][2][]byte // pending (old, new) pairs, oldest first
+}
+
+// push adds a change from old to new to the queue of c.
+func (c *changeSub) push(old, new []byte) {
+	c.mu.Lock()
+	c.queue = append(c.queue, [2][]byte{old, new})
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes and returns the oldest pending change, if there is one.
+func (c *changeSub) next() (change [2][]byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		return change, false
+	}
+	change = c.queue[0]
+	c.queue = c.queue[1:]
+	return change, true
+}
+
+// run delivers changes to the callback until ctx ends or c is stopped.
+func (c *changeSub) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-c.wake:
+		}
+		for {
+			change, ok := c.next()
+			if !ok {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.stop:
+				return
+			default:
+			}
+			c.f(change[0], change[1])
+		}
+	}
+}
+
+// OnChange arranges for f to be called with the old and new active values of
+// the named secret each time s finds that the value has changed, for example
+// to reconnect a database pool when its password is rotated. It returns a
+// function that ends the calls; pending changes not yet delivered are dropped.
+//
+// The calls are made in the order the changes occurred, one at a time, from a
+// goroutine belonging to the subscription, so f may block without delaying
+// polling or other subscribers; changes found meanwhile are queued for it.
+// The calls end when s is closed. The byte slices passed to f must not be
+// modified.
+//
+// If s has lookups enabled, OnChange will attempt to look up name if it is
+// not already known by s, as NewUpdater does. If lookups are not enabled, or
+// the secret is not found, OnChange reports an error.
+func (s *Store) OnChange(ctx context.Context, name string, f func(old, new []byte)) (stop func(), err error) {
+	// Looking up the secret ensures it is known, and keeps a handle to it so
+	// that it is not expired from the store while subscribed.
+	if _, err := s.LookupSecret(ctx, name); err != nil {
+		return nil, err
+	}
+	c := &changeSub{
+		f:    f,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	s.active.Lock()
+	s.active.c[name] = append(s.active.c[name], c)
+	s.active.Unlock()
+	go c.run(s.ctx)
+
+	return func() {
+		c.once.Do(func() {
+			close(c.stop)
+			s.active.Lock()
+			defer s.active.Unlock()
+			s.active.c[name] = slices.DeleteFunc(s.active.c[name], func(d *changeSub) bool { return d == c })
+		})
+	}, nil
+}
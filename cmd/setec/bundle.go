@@ -0,0 +1,287 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/tailscale/setec/client/setec"
+	"github.com/tailscale/setec/types/api"
+	"github.com/tink-crypto/tink-go/v2/tink"
+)
+
+// bundleFormat is the current version of the export bundle format. Bundles
+// with a higher format version are rejected by import.
+const bundleFormat = 1
+
+// bundleAD is the associated data used to encrypt export bundles.
+var bundleAD = []byte("setec export bundle")
+
+// bundle is the plaintext content of an export bundle. The bundle file is the
+// JSON encoding of a bundle, encrypted with a Tink AEAD.
+type bundle struct {
+	Format     int            // the bundle format version
+	Server     string         // the server the bundle was exported from
+	ExportedAt time.Time      // when the bundle was written
+	Secrets    []bundleSecret // the exported secrets, in name order
+}
+
+// bundleSecret is a single secret in an export bundle.
+type bundleSecret struct {
+	Name          string
+	ActiveVersion api.SecretVersion
+	Versions      []bundleVersion // in increasing version order
+
+	Labels      map[string]string `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	Principals  []string          `json:",omitempty"`
+	Format      string            `json:",omitempty"`
+	ContentType string            `json:",omitempty"`
+	MaxVersions int               `json:",omitempty"`
+	Immutable   bool              `json:",omitempty"`
+}
+
+// bundleVersion is a single version of a secret in an export bundle.
+type bundleVersion struct {
+	Version   api.SecretVersion
+	Value     []byte
+	ExpiresAt time.Time `json:",omitzero"`
+	Template  bool      `json:",omitempty"`
+}
+
+// readBundleKey reads the Tink keyset used to encrypt and decrypt bundles.
+func readBundleKey(path string) (tink.AEAD, error) {
+	if path == "" {
+		return nil, errors.New("--keyset-file must be specified")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readKEK(f)
+}
+
+var exportArgs struct {
+	Out         string `flag:"out,Write the encrypted bundle to this file"`
+	Keyset      string `flag:"keyset-file,Tink keyset file used to encrypt the bundle"`
+	Force       bool   `flag:"force,Replace an existing --out file"`
+	SkipExpired bool   `flag:"skip-expired,Omit expired versions instead of failing"`
+	Concurrency int    `flag:"concurrency,default=8,Number of secrets to fetch at once"`
+}
+
+func runExport(env *command.Env) error {
+	if exportArgs.Out == "" {
+		return errors.New("--out must be specified")
+	} else if err := checkConcurrency(exportArgs.Concurrency); err != nil {
+		return env.Usagef("%v", err)
+	}
+	if !exportArgs.Force {
+		if _, err := os.Lstat(exportArgs.Out); err == nil {
+			return fmt.Errorf("output file %q already exists (use --force to replace it)", exportArgs.Out)
+		}
+	}
+	key, err := readBundleKey(exportArgs.Keyset)
+	if err != nil {
+		return err
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	infos, err := c.List(env.Context())
+	if err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+	b := &bundle{
+		Format:     bundleFormat,
+		Server:     c.Server,
+		ExportedAt: time.Now().UTC(),
+		Secrets:    make([]bundleSecret, len(infos)),
+	}
+	logf := syncLogf(env)
+	if err := forEach(env.Context(), len(infos), exportArgs.Concurrency, func(ctx context.Context, i int) error {
+		s, err := exportSecret(ctx, logf, c, infos[i])
+		if err != nil {
+			return err
+		}
+		b.Secrets[i] = s
+		return nil
+	}); err != nil {
+		return err
+	}
+	var nv int
+	for _, s := range b.Secrets {
+		nv += len(s.Versions)
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("encoding bundle: %w", err)
+	}
+	enc, err := key.Encrypt(data, bundleAD)
+	if err != nil {
+		return fmt.Errorf("encrypting bundle: %w", err)
+	}
+	if err := writeOutputFile(exportArgs.Out, enc, exportArgs.Force); err != nil {
+		return fmt.Errorf("writing bundle: %w", err)
+	}
+	fmt.Printf("Exported %d secrets (%d versions) to %q\n", len(b.Secrets), nv, exportArgs.Out)
+	return nil
+}
+
+var importArgs struct {
+	In          string `flag:"in,Read the encrypted bundle from this file"`
+	Keyset      string `flag:"keyset-file,Tink keyset file used to decrypt the bundle"`
+	DryRun      bool   `flag:"dry-run,Report what would be imported without making changes"`
+	Concurrency int    `flag:"concurrency,default=8,Number of secrets to import at once"`
+}
+
+func runImport(env *command.Env) error {
+	if importArgs.In == "" {
+		return errors.New("--in must be specified")
+	} else if err := checkConcurrency(importArgs.Concurrency); err != nil {
+		return env.Usagef("%v", err)
+	}
+	key, err := readBundleKey(importArgs.Keyset)
+	if err != nil {
+		return err
+	}
+	b, err := readBundle(importArgs.In, key)
+	if err != nil {
+		return err
+	}
+	if importArgs.DryRun {
+		for _, s := range b.Secrets {
+			fmt.Printf("Would import %q with %d versions (active %v)\n", s.Name, len(s.Versions), s.ActiveVersion)
+		}
+		return nil
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	if err := forEach(env.Context(), len(b.Secrets), importArgs.Concurrency, func(ctx context.Context, i int) error {
+		s := b.Secrets[i]
+		if err := importSecret(ctx, c, s); err != nil {
+			return fmt.Errorf("importing %q: %w", s.Name, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	var nv int
+	for _, s := range b.Secrets {
+		nv += len(s.Versions)
+	}
+	fmt.Printf("Imported %d secrets (%d versions) from %q\n", len(b.Secrets), nv, importArgs.In)
+	return nil
+}
+
+// exportSecret fetches the versions of the secret described by info for an
+// export bundle. Skipped versions are reported with logf.
+func exportSecret(ctx context.Context, logf func(string, ...any), c *setec.Client, info *api.SecretInfo) (bundleSecret, error) {
+	s := bundleSecret{
+		Name:          info.Name,
+		ActiveVersion: info.ActiveVersion,
+		Labels:        info.Labels,
+		Description:   info.Description,
+		Principals:    info.Principals,
+		Format:        info.Format,
+		ContentType:   info.ContentType,
+		MaxVersions:   info.MaxVersions,
+		Immutable:     info.Immutable,
+	}
+	for _, v := range info.Versions {
+		val, err := c.GetVersion(ctx, info.Name, v)
+		if errors.Is(err, api.ErrExpired) && exportArgs.SkipExpired && v != info.ActiveVersion {
+			logf("Skipping expired version %v of %q\n", v, info.Name)
+			continue
+		} else if err != nil {
+			return s, fmt.Errorf("failed to get %q version %v: %w", info.Name, v, err)
+		}
+		bv := bundleVersion{Version: v, Value: val.Value}
+		if vi := info.VersionInfo[v]; vi != nil {
+			bv.ExpiresAt = vi.ExpiresAt
+			bv.Template = vi.Template
+		}
+		s.Versions = append(s.Versions, bv)
+	}
+	return s, nil
+}
+
+// readBundle reads and decrypts the bundle stored in path.
+func readBundle(path string, key tink.AEAD) (*bundle, error) {
+	enc, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := key.Decrypt(enc, bundleAD)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting bundle: %w", err)
+	}
+	var b bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("decoding bundle: %w", err)
+	} else if b.Format < 1 || b.Format > bundleFormat {
+		return nil, fmt.Errorf("unsupported bundle format %d (this version supports up to %d)", b.Format, bundleFormat)
+	}
+	return &b, nil
+}
+
+// importSecret creates the versions of s on the server, preserving their
+// version numbers, expirations and template flags, then restores the settings
+// of the secret, its active version, labels, description and principals.
+func importSecret(ctx context.Context, c *setec.Client, s bundleSecret) error {
+	if len(s.Versions) == 0 {
+		return errors.New("no versions in bundle")
+	}
+	vs := slices.SortedFunc(slices.Values(s.Versions), func(a, b bundleVersion) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	for i, v := range vs {
+		opts := setec.CreateVersionOptions{ExpiresAt: v.ExpiresAt, Template: v.Template}
+		if i == len(vs)-1 {
+			// The settings of the secret were declared by the puts that
+			// created its newest versions, so apply them with the newest.
+			opts.Format = s.Format
+			opts.ContentType = s.ContentType
+			opts.MaxVersions = s.MaxVersions
+			opts.Immutable = s.Immutable
+		}
+		if err := c.CreateVersionWithOptions(ctx, s.Name, v.Version, v.Value, opts); err != nil {
+			return fmt.Errorf("version %v: %w", v.Version, err)
+		}
+	}
+	if err := c.Activate(ctx, s.Name, s.ActiveVersion); err != nil {
+		return fmt.Errorf("activating version %v: %w", s.ActiveVersion, err)
+	}
+	if len(s.Labels) != 0 {
+		if err := c.SetLabels(ctx, s.Name, s.Labels); err != nil {
+			return fmt.Errorf("setting labels: %w", err)
+		}
+	}
+	if s.Description != "" {
+		if err := c.SetDescription(ctx, s.Name, s.Description); err != nil {
+			return fmt.Errorf("setting description: %w", err)
+		}
+	}
+	// Set principals last, since they may restrict the caller's own access.
+	if len(s.Principals) != 0 {
+		if err := c.SetPrincipals(ctx, s.Name, s.Principals); err != nil {
+			return fmt.Errorf("setting principals: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/tailscale/setec/client/setec"
+	"github.com/tailscale/setec/db"
+	"github.com/tailscale/setec/setectest"
+	"github.com/tailscale/setec/types/api"
+)
+
+// newTestClient returns a client for a new test server backed by d.
+func newTestClient(t *testing.T, d *setectest.DB) *setec.Client {
+	t.Helper()
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	t.Cleanup(hs.Close)
+	return &setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	src := setectest.NewDB(t, nil)
+	id := src.Superuser
+	expires := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+
+	src.MustPut(id, "plain", "one")
+	if _, err := src.Actual.PutWithOptions(id, "plain", []byte("two"), db.PutOptions{ExpiresAt: expires}); err != nil {
+		t.Fatalf("Put plain: %v", err)
+	}
+	src.MustCreateVersion(id, "plain", 10, "ten")
+	src.MustActivate(id, "plain", 2)
+
+	if _, err := src.Actual.PutWithOptions(id, "conf", []byte(`{"a": 1}`), db.PutOptions{
+		Labels:      map[string]string{"env": "prod"},
+		Format:      api.FormatJSON,
+		ContentType: "application/json",
+		MaxVersions: 5,
+		Description: "Some configuration.",
+		Immutable:   true,
+	}); err != nil {
+		t.Fatalf("Put conf: %v", err)
+	}
+	if _, err := src.Actual.PutWithOptions(id, "tmpl", []byte(`x={{secret "plain"}}`), db.PutOptions{Template: true}); err != nil {
+		t.Fatalf("Put tmpl: %v", err)
+	}
+	if err := src.Actual.SetPrincipals(id, "tmpl", []string{"tag:web"}); err != nil {
+		t.Fatalf("SetPrincipals: %v", err)
+	}
+
+	ctx := t.Context()
+	sc := newTestClient(t, src)
+	infos, err := sc.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var b bundle
+	for _, info := range infos {
+		s, err := exportSecret(ctx, syncLogf(io.Discard), sc, info)
+		if err != nil {
+			t.Fatalf("Export %q: %v", info.Name, err)
+		}
+		b.Secrets = append(b.Secrets, s)
+	}
+
+	// Round-trip the bundle through its encoding.
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got bundle
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	dst := setectest.NewDB(t, nil)
+	dc := newTestClient(t, dst)
+	for _, s := range got.Secrets {
+		if err := importSecret(ctx, dc, s); err != nil {
+			t.Fatalf("Import %q: %v", s.Name, err)
+		}
+	}
+
+	// Everything but the record of who created and activated versions, and
+	// when, should be the same on both servers.
+	opts := cmp.Options{
+		cmpopts.IgnoreFields(api.VersionInfo{}, "CreatedAt", "CreatedBy", "ActivatedAt", "ActivatedBy"),
+		cmpopts.IgnoreFields(api.SecretInfo{}, "AccessCount", "LastAccessedAt"),
+	}
+	for _, info := range infos {
+		want, err := sc.Info(ctx, info.Name)
+		if err != nil {
+			t.Fatalf("Info %q on source: %v", info.Name, err)
+		}
+		got, err := dc.Info(ctx, info.Name)
+		if err != nil {
+			t.Fatalf("Info %q on destination: %v", info.Name, err)
+		}
+		if diff := cmp.Diff(want, got, opts); diff != "" {
+			t.Errorf("Imported %q (-want, +got):\n%s", info.Name, diff)
+		}
+	}
+}
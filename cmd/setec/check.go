@@ -0,0 +1,202 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/tailscale/setec/db"
+	"github.com/tailscale/setec/server"
+	"github.com/tink-crypto/tink-go/v2/tink"
+)
+
+// runServerCheck implements "setec server --check": it performs the setup
+// steps of the server that can fail because of its configuration, without
+// modifying anything or serving, and prints a summary of the results.
+func runServerCheck(env *command.Env) error {
+	ctx := env.Context()
+	stateDir := serverArgs.StateDir
+	tw := newTabWriter(os.Stdout)
+	var total, failed int
+	report := func(name, detail string, err error) {
+		total++
+		if err != nil {
+			failed++
+			fmt.Fprintf(tw, "FAIL\t%s\t%v\n", name, err)
+		} else {
+			fmt.Fprintf(tw, "ok\t%s\t%s\n", name, detail)
+		}
+	}
+
+	report("state directory", stateDir, checkWritableDir(stateDir))
+
+	kek, err := serverKEK(ctx)
+	if err == nil {
+		err = checkKEK(kek)
+	}
+	report("database key", keySource(), err)
+
+	dbPath := filepath.Join(stateDir, "database")
+	if kek == nil {
+		report("database", dbPath, errors.New("not checked without a usable key"))
+	} else {
+		detail, err := checkDatabase(dbPath, kek)
+		report("database", detail, err)
+	}
+
+	if serverArgs.AuditLog == "-" {
+		report("audit log", "stdout", nil)
+	} else {
+		path := cmp.Or(serverArgs.AuditLog, filepath.Join(stateDir, "audit.log"))
+		report("audit log", path, checkAppendable(path))
+	}
+
+	if b := serverArgs.BackupBucket; b != "" {
+		s3b, err := server.NewS3BackupWithOptions(ctx, b, server.S3BackupOptions{
+			Region:               serverArgs.BackupBucketRegion,
+			AssumeRole:           serverArgs.BackupRole,
+			CredentialsFile:      serverArgs.BackupCredentials,
+			Profile:              serverArgs.BackupProfile,
+			WebIdentityTokenFile: serverArgs.BackupTokenFile,
+		})
+		if err == nil {
+			err = withTimeout(ctx, s3b.Check)
+		}
+		report("backup", "s3://"+b, err)
+	}
+	if b := serverArgs.BackupGCSBucket; b != "" {
+		gcsb, err := server.NewGCSBackup(ctx, b)
+		if err == nil {
+			err = withTimeout(ctx, gcsb.Check)
+		}
+		report("backup", "gs://"+b, err)
+	}
+	if dir := serverArgs.BackupDir; dir != "" {
+		report("backup", dir, checkWritableDir(dir))
+	}
+
+	detail, err := checkTailscale(filepath.Join(stateDir, "tsnet"))
+	report("tailscale", detail, err)
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d configuration checks failed", failed, total)
+	}
+	fmt.Println("All configuration checks passed")
+	return nil
+}
+
+// keySource describes where the database key comes from, for the summary.
+func keySource() string {
+	switch {
+	case serverArgs.KMSProvider != "":
+		return serverArgs.KMSProvider + ":" + serverArgs.KMSKeyName
+	case serverArgs.KMSKeysetFile != "":
+		return serverArgs.KMSKeysetFile
+	case serverArgs.KMSKeysetEnv != "":
+		return "keyset from $" + serverArgs.KMSKeysetEnv
+	default:
+		return "keyset from stdin"
+	}
+}
+
+// withTimeout calls f with a context derived from ctx that ends after a fixed
+// time, so that an unreachable service does not stall the checks.
+func withTimeout(ctx context.Context, f func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return f(ctx)
+}
+
+// checkKEK reports whether kek can encrypt a value and decrypt the result. For
+// a KMS key, this checks that the key is reachable and usable.
+func checkKEK(kek tink.AEAD) error {
+	want := make([]byte, 32)
+	rand.Read(want)
+	ct, err := kek.Encrypt(want, nil)
+	if err != nil {
+		return fmt.Errorf("encrypting: %w", err)
+	}
+	got, err := kek.Decrypt(ct, nil)
+	if err != nil {
+		return fmt.Errorf("decrypting: %w", err)
+	} else if !bytes.Equal(got, want) {
+		return errors.New("decrypted value does not match")
+	}
+	return nil
+}
+
+// checkDatabase reports whether the database file at path, if it exists, can
+// be decrypted with kek and is valid. On success it returns a summary of its
+// contents.
+func checkDatabase(path string, kek tink.AEAD) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return path + " (not yet created)", nil
+	} else if err != nil {
+		return "", err
+	}
+	sum, err := db.Inspect(data, kek)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return fmt.Sprintf("%s (%d secrets, %d versions)", path, sum.Secrets, sum.Versions), nil
+}
+
+// checkWritableDir reports whether files can be created in the directory at
+// path. A directory that does not exist yet is accepted, since the server
+// creates it.
+func checkWritableDir(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	f, err := os.CreateTemp(path, ".setec-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", path, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkAppendable reports whether the file at path can be opened for
+// appending, or if it does not exist, created in its directory.
+func checkAppendable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return checkWritableDir(filepath.Dir(path))
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkTailscale reports whether the tsnet node whose state is in dir can
+// come up: either it has state from an earlier run, or an auth key is set to
+// log in with.
+func checkTailscale(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "tailscaled.state")); err == nil {
+		return "existing node state in " + dir, nil
+	}
+	if os.Getenv("TS_AUTHKEY") != "" || os.Getenv("TS_AUTH_KEY") != "" {
+		return "no node state; logging in with TS_AUTHKEY", nil
+	}
+	return "", fmt.Errorf("no node state in %s, and TS_AUTHKEY is not set", dir)
+}
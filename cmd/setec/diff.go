@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/mds/mdiff"
+	"github.com/creachadair/mds/slice"
+	"github.com/tailscale/setec/types/api"
+)
+
+var diffArgs struct {
+	Show    bool `flag:"show,Print a unified diff of text values, including their contents"`
+	Context int  `flag:"context,default=3,Number of lines of context to show with --show"`
+}
+
+func runDiff(env *command.Env, name, v1String, v2String string) error {
+	v1, err := strconv.ParseUint(v1String, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid version %q: %w", v1String, err)
+	}
+	v2, err := strconv.ParseUint(v2String, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid version %q: %w", v2String, err)
+	}
+	if diffArgs.Context < 0 {
+		return env.Usagef("--context must not be negative")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	lhs, err := c.GetVersion(env.Context(), name, api.SecretVersion(v1))
+	if err != nil {
+		return fmt.Errorf("failed to get version %d: %w", v1, err)
+	}
+	rhs, err := c.GetVersion(env.Context(), name, api.SecretVersion(v2))
+	if err != nil {
+		return fmt.Errorf("failed to get version %d: %w", v2, err)
+	}
+
+	return writeDiff(os.Stdout, name, lhs, rhs)
+}
+
+// writeDiff writes a comparison of the values of lhs and rhs, two versions
+// of the secret called name, to w. Unless --show is set, it describes the
+// values only by their length and how they differ, without revealing their
+// contents. It does not print a hash of either value, since an unsalted hash
+// of a low-entropy secret can be reversed by guessing.
+func writeDiff(w io.Writer, name string, lhs, rhs *api.SecretValue) error {
+	fmt.Fprintf(w, "version %d: %d bytes\n", lhs.Version, len(lhs.Value))
+	fmt.Fprintf(w, "version %d: %d bytes\n", rhs.Version, len(rhs.Value))
+	if bytes.Equal(lhs.Value, rhs.Value) {
+		fmt.Fprintln(w, "The values are identical.")
+		return nil
+	}
+	if !utf8.Valid(lhs.Value) || !utf8.Valid(rhs.Value) {
+		fmt.Fprintln(w, "The values differ (binary).")
+		return nil
+	}
+
+	d := mdiff.New(diffLines(lhs.Value), diffLines(rhs.Value))
+	var added, removed int
+	for _, e := range d.Edits {
+		switch e.Op {
+		case slice.OpDrop:
+			removed += len(e.X)
+		case slice.OpCopy:
+			added += len(e.Y)
+		case slice.OpReplace:
+			removed += len(e.X)
+			added += len(e.Y)
+		}
+	}
+	fmt.Fprintf(w, "The values differ: %d lines added, %d lines removed.\n", added, removed)
+	if !diffArgs.Show {
+		return nil
+	}
+	return d.AddContext(diffArgs.Context).Unify().Format(w, mdiff.Unified, &mdiff.FileInfo{
+		Left:  fmt.Sprintf("%s@%d", name, lhs.Version),
+		Right: fmt.Sprintf("%s@%d", name, rhs.Version),
+	})
+}
+
+// diffLines splits a text value into lines for comparison. A value ending in
+// a newline has a final empty line, so that a missing trailing newline shows
+// up as a difference.
+func diffLines(value []byte) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	return strings.Split(string(value), "\n")
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/setec/types/api"
+)
+
+func TestWriteDiff(t *testing.T) {
+	defer func(show bool) { diffArgs.Show = show }(diffArgs.Show)
+
+	tests := []struct {
+		name       string
+		show       bool
+		lhs, rhs   string
+		want, omit []string
+	}{
+		{"same", false, "hunter2", "hunter2",
+			[]string{"version 1: 7 bytes\n", "version 2: 7 bytes\n", "The values are identical.\n"}, nil},
+		{"text", false, "a\nhunter2\n", "a\nhunter3\n",
+			[]string{"The values differ: 1 lines added, 1 lines removed.\n"}, []string{"hunter"}},
+		{"binary", false, "\xff\x01", "\xff\x02",
+			[]string{"version 1: 2 bytes\n", "The values differ (binary).\n"}, nil},
+		{"show", true, "a\nhunter2\n", "a\nhunter3\n",
+			[]string{"-hunter2\n", "+hunter3\n"}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			diffArgs.Show = tc.show
+			var buf strings.Builder
+			if err := writeDiff(&buf, "test",
+				&api.SecretValue{Value: []byte(tc.lhs), Version: 1},
+				&api.SecretValue{Value: []byte(tc.rhs), Version: 2},
+			); err != nil {
+				t.Fatalf("writeDiff: %v", err)
+			}
+			got := buf.String()
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Output is missing %q:\n%s", want, got)
+				}
+			}
+
+			// Neither the values nor a hash from which they could be
+			// guessed are printed, unless --show is set.
+			omit := tc.omit
+			for _, v := range []string{tc.lhs, tc.rhs} {
+				omit = append(omit, fmt.Sprintf("%x", sha256.Sum256([]byte(v))))
+			}
+			for _, s := range omit {
+				if strings.Contains(got, s) {
+					t.Errorf("Output contains %q:\n%s", s, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/creachadair/command"
+)
+
+var getManyArgs struct {
+	Format    string      `flag:"format,Output format: json or dotenv"`
+	Output    string      `flag:"output,Write the values to this file instead of stdout"`
+	Force     bool        `flag:"force,Replace an existing --output file"`
+	EnvPrefix string      `flag:"env-prefix,Prefix for the variable names derived from secret names (dotenv)"`
+	EnvNames  envNameFlag `flag:"env-name,Use this variable name for a secret (secret=NAME, repeatable; dotenv)"`
+}
+
+func runGetMany(env *command.Env, names ...string) error {
+	if len(names) == 0 {
+		return env.Usagef("at least one secret name is required")
+	}
+	format := getManyArgs.Format
+	switch format {
+	case "", "json":
+		if getManyArgs.EnvPrefix != "" || len(getManyArgs.EnvNames) != 0 {
+			return env.Usagef("--env-prefix and --env-name require --format dotenv")
+		}
+	case "dotenv":
+	default:
+		return env.Usagef("unknown --format %q (want json or dotenv)", format)
+	}
+	if getManyArgs.Output != "" && !getManyArgs.Force {
+		if _, err := os.Lstat(getManyArgs.Output); err == nil {
+			return fmt.Errorf("output file %q already exists (use --force to replace it)", getManyArgs.Output)
+		}
+	}
+	names = uniqueNames(names)
+
+	// Check the variable names before fetching anything.
+	var keys []string
+	if format == "dotenv" {
+		var err error
+		keys, err = envKeys(names, getManyArgs.EnvPrefix, getManyArgs.EnvNames)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	vals, err := c.GetMany(env.Context(), names)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if format == "dotenv" {
+		for i, name := range names {
+			q, err := dotenvQuote(vals[name].Value)
+			if err != nil {
+				return fmt.Errorf("secret %q: %w", name, err)
+			}
+			fmt.Fprintf(&buf, "%s=%s\n", keys[i], q)
+		}
+	} else if err := json.NewEncoder(&buf).Encode(vals); err != nil {
+		return err
+	}
+
+	if getManyArgs.Output != "" {
+		if err := writeOutputFile(getManyArgs.Output, buf.Bytes(), getManyArgs.Force); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+		return nil
+	}
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+// uniqueNames returns names without repeats, in the order of their first
+// occurrence.
+func uniqueNames(names []string) []string {
+	seen := make(map[string]bool)
+	return slices.DeleteFunc(slices.Clone(names), func(s string) bool {
+		if seen[s] {
+			return true
+		}
+		seen[s] = true
+		return false
+	})
+}
+
+// envNameFlag is a flag.Value that collects repeated secret=NAME mappings
+// from secret names to environment variable names.
+type envNameFlag map[string]string
+
+func (f envNameFlag) String() string {
+	var out []string
+	for _, k := range slices.Sorted(maps.Keys(f)) {
+		out = append(out, k+"="+f[k])
+	}
+	return strings.Join(out, ",")
+}
+
+func (f *envNameFlag) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return fmt.Errorf("%q is not of the form secret=NAME", s)
+	}
+	name, key := s[:i], s[i+1:]
+	if !validEnvKey(key) {
+		return fmt.Errorf("invalid environment variable name %q", key)
+	}
+	if *f == nil {
+		*f = make(envNameFlag)
+	}
+	(*f)[name] = key
+	return nil
+}
+
+// envKeys returns the environment variable names for the secrets with the
+// given names: the name given in mapping if any, or else the secret name
+// with prefix added, as converted by envKey. It reports an error if two
+// secrets would have the same variable name.
+func envKeys(names []string, prefix string, mapping map[string]string) ([]string, error) {
+	keys := make([]string, len(names))
+	seen := make(map[string]string) // variable name → secret name
+	for i, name := range names {
+		key, ok := mapping[name]
+		if !ok {
+			key = envKey(prefix + name)
+		}
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("secrets %q and %q both have variable name %s (use --env-name to choose another)", other, name, key)
+		}
+		seen[key] = name
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// envKey converts name to an environment variable name, by converting letters
+// to upper case and replacing any other character that is not a digit or an
+// underscore with an underscore. If the result would begin with a digit, an
+// underscore is added before it. For example, "prod/db-password" becomes
+// "PROD_DB_PASSWORD".
+func envKey(name string) string {
+	key := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if key == "" || ('0' <= key[0] && key[0] <= '9') {
+		key = "_" + key
+	}
+	return key
+}
+
+// validEnvKey reports whether key is a valid environment variable name: a
+// letter or underscore followed by letters, digits and underscores.
+func validEnvKey(key string) bool {
+	if key == "" || ('0' <= key[0] && key[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// dotenvQuote returns value quoted for a dotenv file. A value of only
+// characters that no dotenv parser treats specially is written as is. Other
+// values are enclosed in single quotes, which parsers do not interpret, or if
+// the value contains a single quote or a line break, in double quotes with
+// backslash escapes. Values that are not UTF-8 text cannot be represented
+// faithfully, and are reported as an error.
+func dotenvQuote(value []byte) (string, error) {
+	if !utf8.Valid(value) {
+		return "", fmt.Errorf("value is not UTF-8 text (store it encoded, e.g. with put --encode base64)")
+	}
+	s := string(value)
+	if strings.ContainsFunc(s, func(r rune) bool {
+		return r < ' ' && r != '\t' && r != '\n' && r != '\r' || r == 0x7f
+	}) {
+		return "", fmt.Errorf("value contains control characters")
+	}
+	if s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("_-.,/:@%+=", r))
+	}) {
+		return s, nil
+	}
+	if !strings.ContainsAny(s, "'\n\r") {
+		return "'" + s + "'", nil
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\\', '"', '$', '`':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String(), nil
+}
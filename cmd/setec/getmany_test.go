@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEnvKey(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"", "_"},
+		{"token", "TOKEN"},
+		{"API_Key", "API_KEY"},
+		{"prod/db-password", "PROD_DB_PASSWORD"},
+		{"a.b c", "A_B_C"},
+		{"2fa-seed", "_2FA_SEED"},
+		{"_private", "_PRIVATE"},
+		{"clé", "CL_"},
+	}
+	for _, tc := range tests {
+		got := envKey(tc.name)
+		if got != tc.want {
+			t.Errorf("envKey(%q): got %q, want %q", tc.name, got, tc.want)
+		}
+		if !validEnvKey(got) {
+			t.Errorf("envKey(%q) = %q is not a valid variable name", tc.name, got)
+		}
+	}
+}
+
+func TestValidEnvKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"", false},
+		{"A", true},
+		{"_", true},
+		{"db_password", true},
+		{"KEY2", true},
+		{"2KEY", false},
+		{"MY-KEY", false},
+		{"MY KEY", false},
+		{"A.B", false},
+		{"KÉY", false},
+	}
+	for _, tc := range tests {
+		if got := validEnvKey(tc.key); got != tc.want {
+			t.Errorf("validEnvKey(%q): got %v, want %v", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestEnvKeys(t *testing.T) {
+	keys, err := envKeys([]string{"prod/db", "token", "other"}, "app-", map[string]string{"other": "OTHER_NAME"})
+	if err != nil {
+		t.Fatalf("envKeys: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(keys, []string{"APP_PROD_DB", "APP_TOKEN", "OTHER_NAME"}); diff != "" {
+		t.Errorf("envKeys (-got, +want):\n%s", diff)
+	}
+
+	// Two secrets with the same variable name are an error, unless one is
+	// given another name.
+	names := []string{"db-password", "db/password"}
+	if _, err := envKeys(names, "", nil); err == nil {
+		t.Error("envKeys with duplicate names: got nil, want error")
+	}
+	if _, err := envKeys(names, "", map[string]string{"db/password": "DB_PASSWORD_2"}); err != nil {
+		t.Errorf("envKeys with mapping: unexpected error: %v", err)
+	}
+}
+
+func TestDotenvQuote(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "''", false},
+		{"plain", "plain", false},
+		{"user@host:5432/db?", "'user@host:5432/db?'", false},
+		{"a-b_c.d,e/f:g@h%i+j=k", "a-b_c.d,e/f:g@h%i+j=k", false},
+		{"two words", "'two words'", false},
+		{"$HOME", "'$HOME'", false},
+		{`back\slash "quoted"`, `'back\slash "quoted"'`, false},
+		{"tab\there", "'tab\there'", false},
+		{"it's", `"it's"`, false},
+		{"line\nbreak", `"line\nbreak"`, false},
+		{"cr\r\nlf", `"cr\r\nlf"`, false},
+		{"it's $HOME", `"it's \$HOME"`, false},
+		{"it's `cmd`", "\"it's \\`cmd\\`\"", false},
+		{`it's "q" \`, `"it's \"q\" \\"`, false},
+		{"héllo wörld", "'héllo wörld'", false},
+		{"bell\a", "", true},
+		{"nul\x00", "", true},
+		{"del\x7f", "", true},
+		{"\xff\xfe", "", true},
+	}
+	for _, tc := range tests {
+		got, err := dotenvQuote([]byte(tc.value))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("dotenvQuote(%q): got %q, want error", tc.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("dotenvQuote(%q): unexpected error: %v", tc.value, err)
+		} else if got != tc.want {
+			t.Errorf("dotenvQuote(%q): got %s, want %s", tc.value, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// checkConcurrency reports an error if n is not a valid --concurrency value.
+func checkConcurrency(n int) error {
+	if n < 1 {
+		return fmt.Errorf("--concurrency must be at least 1, got %d", n)
+	}
+	return nil
+}
+
+// syncLogf returns a function that writes formatted messages to w. It is safe
+// for concurrent use by the calls of forEach; each message is written whole.
+func syncLogf(w io.Writer) func(format string, args ...any) {
+	var mu sync.Mutex
+	return func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, format, args...)
+	}
+}
+
+// forEach calls f(ctx, i) for each i from 0 to n-1, running up to concurrency
+// calls at once. If a call fails or ctx ends, forEach stops starting new
+// calls, cancels the context passed to the calls in flight, and waits for
+// them to finish. It reports the first error, if any.
+func forEach(ctx context.Context, n, concurrency int, f func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	for i := range n {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := f(ctx, i); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForEach(t *testing.T) {
+	t.Run("all", func(t *testing.T) {
+		const n, concurrency = 50, 4
+		var cur, peak atomic.Int32
+		seen := make([]bool, n)
+		if err := forEach(t.Context(), n, concurrency, func(_ context.Context, i int) error {
+			c := cur.Add(1)
+			defer cur.Add(-1)
+			for {
+				p := peak.Load()
+				if c <= p || peak.CompareAndSwap(p, c) {
+					break
+				}
+			}
+			seen[i] = true
+			return nil
+		}); err != nil {
+			t.Fatalf("forEach: unexpected error: %v", err)
+		}
+		for i, ok := range seen {
+			if !ok {
+				t.Errorf("Call %d was not made", i)
+			}
+		}
+		if p := peak.Load(); p > concurrency {
+			t.Errorf("Peak concurrency: got %d, want at most %d", p, concurrency)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		errBad := errors.New("bad")
+		var calls atomic.Int32
+		err := forEach(t.Context(), 100, 1, func(_ context.Context, i int) error {
+			calls.Add(1)
+			if i == 3 {
+				return errBad
+			}
+			return nil
+		})
+		if !errors.Is(err, errBad) {
+			t.Errorf("forEach: got error %v, want %v", err, errBad)
+		}
+		// With one call at a time, the failing call is the last one started.
+		if n := calls.Load(); n != 4 {
+			t.Errorf("Calls: got %d, want 4", n)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		errBad := errors.New("bad")
+		started := make(chan struct{})
+		var inflight error
+		err := forEach(t.Context(), 2, 2, func(ctx context.Context, i int) error {
+			if i == 0 {
+				// Wait for the failure of the other call to cancel this one.
+				close(started)
+				<-ctx.Done()
+				inflight = context.Cause(ctx)
+				return nil
+			}
+			<-started
+			return errBad
+		})
+		if !errors.Is(err, errBad) {
+			t.Errorf("forEach: got error %v, want %v", err, errBad)
+		}
+		if !errors.Is(inflight, errBad) {
+			t.Errorf("In-flight call: got cause %v, want %v", inflight, errBad)
+		}
+	})
+
+	t.Run("done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		var calls atomic.Int32
+		err := forEach(ctx, 10, 2, func(context.Context, int) error {
+			calls.Add(1)
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("forEach: got error %v, want %v", err, context.Canceled)
+		}
+		if n := calls.Load(); n != 0 {
+			t.Errorf("Calls: got %d, want 0", n)
+		}
+	})
+}
+
+func TestSyncLogf(t *testing.T) {
+	// Run with -race to check that concurrent messages do not race on the
+	// shared writer.
+	var buf bytes.Buffer
+	logf := syncLogf(&buf)
+	const n = 20
+	if err := forEach(t.Context(), n, n, func(_ context.Context, i int) error {
+		logf("message %d\n", i)
+		return nil
+	}); err != nil {
+		t.Fatalf("forEach: unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != n {
+		t.Fatalf("Got %d lines, want %d:\n%s", len(lines), n, buf.String())
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "message ") {
+			t.Errorf("Unexpected line %q", line)
+		}
+	}
+}
@@ -6,36 +6,54 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/tabwriter"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/flax"
+	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/client/setec"
+	"github.com/tailscale/setec/db"
 	"github.com/tailscale/setec/server"
 	"github.com/tailscale/setec/types/api"
+	"github.com/tink-crypto/tink-go-gcpkms/v2/integration/gcpkms"
 	"github.com/tink-crypto/tink-go/v2/aead"
 	ckeyset "github.com/tink-crypto/tink-go/v2/insecurecleartextkeyset"
 	"github.com/tink-crypto/tink-go/v2/keyset"
 	"github.com/tink-crypto/tink-go/v2/tink"
 	"golang.org/x/term"
+	"tailscale.com/atomicfile"
 	"tailscale.com/tsnet"
 	"tailscale.com/tsweb"
 )
@@ -50,7 +68,19 @@ The "server" subcommand starts a server for the setec API.
 The other subcommands call methods of a running setec server.
 
 Client commands must provide a server URL with the -s flag, or via the
-SETEC_SERVER environment variable.`,
+SETEC_SERVER environment variable. A bare hostname such as
+setec.example.ts.net is treated as an https URL.
+
+To speed up scripts that fetch the same secrets repeatedly, set --cache-dir
+and --cache-key-file to cache active secret values on disk, encrypted with
+the AES key in the key file (hex encoded, e.g., from "openssl rand -hex 32").
+Cached values are used by "get" for up to --cache-ttl after they are fetched,
+so changes made elsewhere may not be seen until then.
+
+To avoid hanging when the server or the tailnet is slow to respond, set
+--timeout to limit how long each request to the server may take, e.g.,
+"--timeout 10s". A request that runs out of time reports that the server did
+not respond within the limit. By default there is no limit.`,
 
 		SetFlags: command.Flags(flax.MustBind, &clientArgs),
 
@@ -66,35 +96,145 @@ the node on the tailnet.
 With the --dev flag, the server runs with a dummy KMS. This mode is intended
 for debugging and is NOT SAFE for production use.
 
-Otherwise you must provide a --kms-key-name to use to encrypt the database.
+With --kms-provider=gcp, the database is encrypted using envelope encryption
+with the GCP Cloud KMS key named by --kms-key-name, which has the form
+projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>.
+Ambient Google Cloud credentials are used to access the key.
+
+With --kms-provider=vault, the database is encrypted using envelope encryption
+with the key named by --kms-key-name in the transit secrets engine of the
+HashiCorp Vault server at --vault-addr. The key name is "<key>" for the engine
+mounted at transit/, or "<mount>/<key>" for another mount. The server
+authenticates with the token in VAULT_TOKEN, or logs in with AppRole using
+VAULT_ROLE_ID and VAULT_SECRET_ID. VAULT_NAMESPACE sets the namespace, if any.
+
+Otherwise you must provide a Tink keyset to use to encrypt the database. The
+keyset is read from stdin, from the file named by --kms-keyset-file, or from
+the environment variable named by --kms-keyset-env, e.g.,
+"--kms-keyset-env=SETEC_KEYSET". The environment variable is meant for test
+environments where managing a keyset file is inconvenient; its value is never
+logged.
+
+With --backup-bucket, backups are uploaded to S3 using ambient AWS
+credentials, and the IAM role given by --backup-role is assumed if set. To
+use other credentials, set --backup-credentials to an AWS shared credentials
+file, and --backup-profile to the profile to use from it. On Kubernetes with
+IAM roles for service accounts (IRSA), set --backup-token-file to the service
+account token file (usually $AWS_WEB_IDENTITY_TOKEN_FILE) to exchange it for
+credentials for --backup-role, which is then required. The server obtains
+the credentials when it starts, and exits with an error if it cannot.
 
 Most of the settings can be set via environment variables as well as flags.
-
-   --------------------------------------------------------------------
-   Flag                    Variable                   Format    Default
-   --------------------------------------------------------------------
-    --state-dir            SETEC_DIR                  path      (required)
-    --hostname             SETEC_HOSTNAME             string    (required)
-    --kms-key-name         SETEC_KMS_KEY_NAME         string    (required unless --dev)
-    --backup-bucket        SETEC_BACKUP_BUCKET        string 	(optional)
-	--backup-bucket-region SETEC_BACKUP_BUCKET_REGION string 	(optional)
-	--backup-role          SETEC_BACKUP_ROLE          string 	(optional)
-	--login-server         SETEC_LOGIN_SERVER         string 	(optional)
+If both are set, the flag takes precedence over the environment variable.
+The --dev flag has no environment variable, so that developer mode is never
+enabled by accident.
+
+With --check, the server does not start. Instead, it checks that the state
+directory is writable, that the database key can be loaded and used, that
+the existing database (if any) can be decrypted, that the audit log and each
+backup target can be written, and that Tailscale has node state or an auth
+key, then prints a summary and exits. The exit status is non-zero if any
+check fails. Nothing is modified, so it is safe to run as a pre-flight check
+before deploying. Checking an S3 or GCS backup bucket requires permission to
+read the bucket metadata, in addition to writing objects.
+
+   ----------------------------------------------------------------------------------
+   Flag                     Variable                     Format     Default
+   ----------------------------------------------------------------------------------
+   --state-dir              SETEC_STATE_DIR              path       (required)
+   --hostname               SETEC_HOSTNAME               string     (required)
+   --kms-provider           SETEC_KMS_PROVIDER           string     (optional)
+   --kms-key-name           SETEC_KMS_KEY_NAME           string     (required with --kms-provider)
+   --kms-keyset-file        SETEC_KMS_KEYSET_FILE        path       (optional)
+   --kms-keyset-env         SETEC_KMS_KEYSET_ENV         variable   (optional)
+   --vault-addr             SETEC_VAULT_ADDR             URL        (default $VAULT_ADDR)
+   --backup-bucket          SETEC_BACKUP_BUCKET          string     (optional)
+   --backup-bucket-region   SETEC_BACKUP_BUCKET_REGION   string     (optional)
+   --backup-role            SETEC_BACKUP_ROLE            string     (optional)
+   --backup-credentials     SETEC_BACKUP_CREDENTIALS     path       (optional)
+   --backup-profile         SETEC_BACKUP_PROFILE         string     (optional)
+   --backup-token-file      SETEC_BACKUP_TOKEN_FILE      path       (required with IRSA)
+   --backup-dir             SETEC_BACKUP_DIR             path       (optional)
+   --backup-dir-retain      SETEC_BACKUP_DIR_RETAIN      int        (optional)
+   --backup-gcs-bucket      SETEC_BACKUP_GCS_BUCKET      string     (optional)
+   --login-server           SETEC_LOGIN_SERVER           string     (optional)
+   --health-addr            SETEC_HEALTH_ADDR            host:port  (optional)
+   --max-secret-bytes       SETEC_MAX_SECRET_BYTES       int        (default 1048576)
+   --audit-log              SETEC_AUDIT_LOG              path       (default <state-dir>/audit.log)
+   --audit-log-max-bytes    SETEC_AUDIT_LOG_MAX_BYTES    int        (optional)
+   --audit-log-max-files    SETEC_AUDIT_LOG_MAX_FILES    int        (optional)
+   --rate-limit             SETEC_RATE_LIMIT             float      (optional)
+   --rate-burst             SETEC_RATE_BURST             int        (optional)
+   --compress-db            SETEC_COMPRESS_DB            bool       (optional)
+   --size-metrics           SETEC_SIZE_METRICS           bool       (optional)
+   --no-audit-fingerprints  SETEC_NO_AUDIT_FINGERPRINTS  bool       (optional)
+   --delete-retention       SETEC_DELETE_RETENTION       duration   (optional)
+   --protect-alias-targets  SETEC_PROTECT_ALIAS_TARGETS  bool       (optional)
+   --max-versions           SETEC_MAX_VERSIONS           int        (optional)
+   --dedupe-puts            SETEC_DEDUPE_PUTS            bool       (optional)
+   --write-tags             SETEC_WRITE_TAGS             tags       (optional)
+   --read-only              SETEC_READ_ONLY              bool       (optional)
+   --access-metrics         SETEC_ACCESS_METRICS         patterns   (optional)
+   --http-port              SETEC_HTTP_PORT              int        (default 80)
+   --https-port             SETEC_HTTPS_PORT             int        (default 443)
+   --metrics-addr           SETEC_METRICS_ADDR           host:port  (optional)
+   --shutdown-timeout       SETEC_SHUTDOWN_TIMEOUT       duration   (default 5s)
 `,
 
 				SetFlags: command.Flags(flax.MustBind, &serverArgs),
 				Run:      command.Adapt(runServer),
 			},
 			{
-				Name: "list",
-				Help: "List all secrets visible to the caller.",
-				Run:  command.Adapt(runList),
+				Name:  "list",
+				Usage: "[<name-prefix>]",
+				Help: `List all secrets visible to the caller.
+
+If a name prefix is given, only secrets whose names begin with that prefix
+are listed, e.g., "setec list team/service/".
+
+With --selector, only secrets having all the given labels are listed, e.g.,
+"setec list --selector env=prod,owner=team-a".
+
+With --writable, only secrets the caller is allowed to put new values for are
+listed. The server applies all its checks for writes, including its ACLs and
+--write-tags, so this shows the caller's effective permissions.
+
+With --show-empty, the table has an EMPTY column marking secrets whose newest
+value is not being served: "pending" if a newer version was put but not
+activated, as after an unfinished rotation, or "expired" if the active version
+has expired, so "get" fails. With --only-empty, only those secrets are listed.
+
+With --sort, secrets are listed in order of their name, their active version
+number, or their number of versions ("--sort name|active|versions"), with ties
+listed by name. With --reverse, the order is reversed. Otherwise, secrets are
+listed in the order the server reports them.
+
+With --json, write the list as a JSON array of secret metadata instead of a
+table.`,
+
+				SetFlags: command.Flags(flax.MustBind, &listArgs),
+				Run:      command.Adapt(runList),
 			},
 			{
 				Name:  "info",
 				Usage: "<secret-name>",
-				Help:  "Get metadata for the specified secret.",
-				Run:   command.Adapt(runInfo),
+				Help: `Get metadata for the specified secret.
+
+The output includes a table of the versions of the secret, reporting when
+and by whom each version was created and last activated, and when it
+expires. The active version is marked with "*". Versions created by older
+servers may lack this history.
+
+The server also reports when the value of the secret was last read, and how
+many times, since the server started.
+
+With --json, write the metadata as a JSON object (api.SecretInfo) instead of
+text. Version numbers are JSON numbers, except as the keys of the VersionInfo
+object, where they are decimal strings. Times are RFC 3339 strings in UTC, and
+fields with no value are omitted.`,
+
+				SetFlags: command.Flags(flax.MustBind, &infoArgs),
+				Run:      command.Adapt(runInfo),
 			},
 			{
 				Name:  "get",
@@ -102,11 +242,82 @@ Most of the settings can be set via environment variables as well as flags.
 				Help: `Get the active value of the specified secret.
 
 With --version, fetch the specified version instead of the active one.
-With --if-changed, return the active value only if it differs from --version.`,
+With --if-changed, return the active value only if it differs from --version.
+With --no-cache, fetch the value from the server even if it is cached.
+With --wait, if the secret does not exist yet or the server is unreachable,
+keep trying until it appears or the given duration (e.g., "2m") elapses.
+With --resolve, expand the references to other secrets in a template value
+(see "setec put --template"); this requires get permission on each of them.
+
+By default, exactly the stored bytes are written to stdout, whether or not it
+is a terminal. With --print, a newline is added after the value, for reading
+at a terminal. With --raw, the value is written as stored; this is the default,
+but scripts can use it to say so explicitly. They cannot be combined.
+
+With --output, write the value to the named file (mode 0600) instead of stdout.
+An existing file is not replaced unless --force is set.
+
+With --metadata, write a JSON object with the secret name, the version fetched,
+its creation time if known, and the value, encoded as base64. A program can
+keep the version to pass to --if-changed later.
+
+With --decode base64 or --decode hex, the stored value is decoded from that
+encoding before it is written out, and an error is reported if it is not
+valid in that encoding. This applies to --output and --metadata too. It is
+the counterpart of "setec put --encode".`,
 
 				SetFlags: command.Flags(flax.MustBind, &getArgs),
 				Run:      command.Adapt(runGet),
 			},
+			{
+				Name:  "get-many",
+				Usage: "<secret-name> ...",
+				Help: `Get the active values of several secrets in one request.
+
+By default, a JSON object is written mapping each secret name to its value,
+version and format, with the value encoded as base64.
+
+With --format dotenv, a NAME=value line is written for each secret, in the
+order given, for programs that load their configuration from a .env file.
+The variable name is the secret name in upper case, with each character
+other than a letter, digit or underscore replaced by an underscore, so that
+"prod/db-password" becomes PROD_DB_PASSWORD. With --env-prefix, the prefix
+is added to the secret name first. To choose the name for a secret, use
+--env-name secret=NAME, which may be repeated. It is an error for two
+secrets to have the same variable name.
+
+Values consisting only of letters, digits and the characters _-.,/:@%+= are
+written as they are. Other values are enclosed in single quotes, or if they
+contain a single quote or a line break, in double quotes with backslash
+escapes for \, ", $, backquote, and line breaks. Values that are not UTF-8
+text, or that contain other control characters, cannot be written as dotenv
+and are reported as an error.
+
+With --output, write to the named file (mode 0600) instead of stdout. An
+existing file is not replaced unless --force is set. If any secret cannot be
+fetched, nothing is written.
+
+This requires get permission on each secret.`,
+
+				SetFlags: command.Flags(flax.MustBind, &getManyArgs),
+				Run:      command.Adapt(runGetMany),
+			},
+			{
+				Name:  "diff",
+				Usage: "<secret-name> <version1> <version2>",
+				Help: `Compare two versions of the specified secret.
+
+By default, only a summary is printed: the length of each value, whether
+they differ, and for text values the number of lines added and removed. The
+values themselves are not printed. With --show, a unified diff of text values
+is printed as well, including the lines that differ and --context lines around
+them. Binary values are only reported as the same or different.
+
+This requires get permission on the secret.`,
+
+				SetFlags: command.Flags(flax.MustBind, &diffArgs),
+				Run:      command.Adapt(runDiff),
+			},
 			{
 				Name:  "put",
 				Usage: "<secret-name>",
@@ -115,31 +326,236 @@ With --if-changed, return the active value only if it differs from --version.`,
 With --from-file, the new value is read from the specified file; otherwise if
 stdin is connected to a pipe, its contents are fully read to obtain the new
 value. Otherwise, the user is prompted for a new value and confirmation.
+A file larger than 1 MiB is uploaded in chunks rather than read into memory,
+unless --encode is set, and only the server's limit on the size of a value
+applies to it.
+
+With --value, the new value is taken from the flag itself and stdin is not
+read. This is meant for automation in controlled environments such as CI:
+the value may be recorded in shell history and is visible to other users in
+process listings while the command runs, so prefer --from-file or stdin where
+possible. A warning is printed when --value is used.
+
+With --from-env, the new value is taken from the named environment variable,
+and stdin is not read. It is an error if the variable is not set; a variable
+set to the empty string is accepted only with --empty-ok. Only one of
+--value, --from-file and --from-env may be used.
 
 If the provided value is plain UTF-8 text with leading or trailing whitespace,
 you must specify what to do with the whitespace.  Use --verbatim to keep it, or
 --trim-space to remove it. If you do not specify either, an error is reported.
 If you specify both, --verbatim takes precedence.  Use --verbatim for values
-where whitespace matters, such as PEM-formatted certificates and SSH keys.`,
+where whitespace matters, such as PEM-formatted certificates and SSH keys.
+
+With --expires, the new version expires at the given time, after which the
+server will no longer serve its value. The expiration may be given as an
+RFC3339 timestamp (e.g., 2030-01-02T15:04:05Z), or as a duration relative to
+the current time (e.g., 72h).
+
+With --label key=value, the label is added to the secret. The flag may be
+repeated to add several labels.
+
+With --activate, the new version is made active in the same update, so the
+secret never has a stored but inactive new value. This requires activate
+permission in addition to put.
+
+With --template, the value is stored as a template that refers to other
+secrets with references of the form {{secret "name"}}, for example:
+
+    postgres://app:{{secret "prod/db/password"}}@db.example.com/app
+
+Use "setec get --resolve" to fetch the value with the references expanded.
+The server rejects templates that refer back to the secret itself.
+
+With --format, the value must be well-formed in the given format (json, pem,
+base64, or utf8), or it is rejected. The format is recorded with the secret,
+and "setec get" warns if a value does not match it, for example because a
+later version was put without --format.
+
+The content type of the values is recorded with the secret and shown by
+"setec info", so that other tools can tell how to handle them. It is the type
+given by --content-type, such as "application/json", if set, or else the one
+implied by --format. Otherwise, with --activate or when the put creates the
+secret, it is detected from the new value: "text/plain; charset=utf-8" for a
+value that is valid UTF-8 and "application/octet-stream" for any other value.
+Any other put leaves the recorded content type unchanged, since the secret
+records a single content type, and it should describe the active value.
+
+With --if-absent, the secret is created only if it does not already exist.
+If it does, an error is reported and no version is added. The server checks
+and creates the secret in one step, so this is safe for provisioning scripts
+that may run concurrently.
+
+With --encode base64 or --encode hex, the value is encoded before it is
+stored, so binary input such as a key file can be kept as text. Use "setec
+get --decode" with the same encoding to recover the original bytes.
+
+With --max-versions, the server keeps at most that many versions of the
+secret, overriding its --max-versions default for this secret from now on.
+When a put leaves the secret with more, the oldest versions other than the
+active and the newest are deleted and recorded in the audit log. Use -1 to
+keep all versions of the secret regardless of the server default.
+
+With --description, the description of the secret is replaced with the given
+text, as with "setec describe". Without it, the description is unchanged.
+
+Labels and the description belong to the secret, not to a version. To change
+them without putting a value, use "setec label" or "setec describe", which
+never add a version, so that version numbers track changes to the value only.
+
+A put of the same value as the newest version of the secret reports that
+version rather than adding a copy, as does a put of the value of the active
+version if the server runs with --dedupe-puts. With --allow-duplicate, a new
+version is added regardless.
+
+With --immutable, the secret is made immutable: the server then refuses to
+delete or rename it, or to delete any version that was ever active, so it can
+change only by putting and activating new versions. This requires delete
+permission. Callers with admin permission can still delete or rename the
+secret, but not its versions that were ever active. It cannot be undone; a
+later put without --immutable leaves the secret immutable.`,
 
 				SetFlags: command.Flags(flax.MustBind, &putArgs),
 				Run:      command.Adapt(runPut),
 			},
+			{
+				Name:  "generate",
+				Usage: "<secret-name>",
+				Help: `Generate a random value and put it as a new version of a secret.
+
+The value consists of --bytes cryptographically random bytes, stored using the
+encoding given by --encoding: hex, base64, base64url (without padding), or raw
+for the bytes themselves. The value is not printed unless --show is set.
+
+The --activate, --expires and --label flags behave as for "setec put".
+
+This command creates application secrets; to create a Tink keyset for the
+server, use "setec generate-key".`,
+
+				SetFlags: command.Flags(flax.MustBind, &generateArgs),
+				Run:      command.Adapt(runGenerate),
+			},
+			{
+				Name:  "copy",
+				Usage: "<source-name> <dest-name>",
+				Help: `Copy the active value of a secret to a new name.
+
+The value is copied verbatim. If the destination secret already exists, an
+error is reported unless --overwrite is set, in which case the value is saved
+as a new version of the destination.`,
+
+				SetFlags: command.Flags(flax.MustBind, &copyArgs),
+				Run:      command.Adapt(runCopy),
+			},
+			{
+				Name:  "rename",
+				Usage: "<old-name> <new-name>",
+				Help: `Rename a secret, preserving its version history.
+
+All versions of the secret, its active version, and version metadata are
+moved to the new name, and the old name is removed. It is an error if a
+secret with the new name already exists.`,
+
+				Run: command.Adapt(runRename),
+			},
+			{
+				Name:  "alias",
+				Usage: "<alias-name> <target-name>",
+				Help: `Make a name an alias for another secret.
+
+Getting the alias reports the active value of the target secret, so that
+consumers can keep using an old name while the secret moves to a new one.
+Callers need permission to get both names. If the alias already exists, it
+is updated to refer to the new target. It is an error if a secret with the
+alias name exists, or if the target is itself an alias.
+
+To remove an alias, use "setec delete" on the alias name. If the target is
+deleted or renamed, the alias is broken and reports an error, unless the
+server protects alias targets, in which case the delete or rename fails.`,
+
+				Run: command.Adapt(runAlias),
+			},
+			{
+				Name:  "set-acl",
+				Usage: "<secret-name> [<principal> ...]",
+				Help: `Set the principals allowed to access a secret.
+
+Each principal is a tailnet user login name (e.g., user@example.com) or a tag
+(e.g., tag:prod). Once set, only callers matching one of the principals can
+get the secret or its metadata, in addition to having the necessary
+permissions. With no principals, the restriction is removed.`,
+
+				Run: command.Adapt(runSetACL),
+			},
+			{
+				Name:  "label",
+				Usage: "<secret-name> <key>=<value> ...",
+				Help: `Set labels on a secret.
+
+Each label is added to the secret, replacing the value of any existing label
+with the same key. A label with an empty value, e.g., "owner=", is removed.
+
+Keys consist of ASCII letters, digits, and the characters "-", "_", "." and
+"/". Values follow the same rules, except that they may not contain "/". Keys
+and values may be at most 63 bytes long.`,
+
+				Run: command.Adapt(runLabel),
+			},
+			{
+				Name:  "describe",
+				Usage: "<secret-name> <text>",
+				Help: `Set the description of a secret.
+
+The description is free text saying what the secret is for, who owns it, or
+how to rotate it, and is shown by "setec info". It replaces any previous
+description; an empty text, e.g., "", removes it. Several arguments are
+joined with spaces.
+
+A description may be at most 4096 bytes of UTF-8 text, and may not contain
+control characters other than newlines and tabs.`,
+
+				Run: command.Adapt(runDescribe),
+			},
 			{
 				Name:  "activate",
 				Usage: "<secret-name> <secret-version>",
 				Help:  "Set the active version of the specified secret.",
 				Run:   command.Adapt(runActivate),
 			},
+			{
+				Name: "activate-many",
+				Help: `Set the active versions of several secrets.
+
+Each line of input names a secret and the version to activate, separated by
+whitespace. Blank lines and lines beginning with "#" are ignored. The input is
+read from stdin, or from the file named by --from-file.
+
+By default, each secret is activated separately, and the result for each line
+is reported. With --atomic, all the versions are checked before any of them
+is activated, and either all of the secrets are updated or none of them are.`,
+
+				SetFlags: command.Flags(flax.MustBind, &activateManyArgs),
+				Run:      command.Adapt(runActivateMany),
+			},
 			{
 				Name:  "delete-version",
 				Usage: "<secret-name> <secret-version> [<confirm-token>]",
 				Help: `Delete the specified non-active version of a secret.
 
 A confirmation token is required to delete a secret value.  Run the command to
-generate the token, then re-run appending the provided value.`,
+generate the token, then re-run appending the provided value. If standard input
+is a terminal and no token is given, you are instead prompted to confirm by
+typing the name of the secret.
+
+With --reactivate, the given version is made active in the same update as the
+deletion, so the active version can be deleted, e.g., to roll back from a bad
+version and remove it in one step. This requires activate permission as well.
+
+With --dry-run, report the version that would be deleted without deleting it.
+No confirmation token is needed for a dry run.`,
 
-				Run: command.Adapt(runDeleteVersion),
+				SetFlags: command.Flags(flax.MustBind, &deleteVersionArgs),
+				Run:      command.Adapt(runDeleteVersion),
 			},
 			{
 				Name:  "delete",
@@ -147,15 +563,163 @@ generate the token, then re-run appending the provided value.`,
 				Help: `Delete all versions of a secret (including active).
 
 A confirmation token is required to delete a secret.  Run the command to
-generate the token, then re-run appending the provided value.`,
+generate the token, then re-run appending the provided value. If standard input
+is a terminal and no token is given, you are instead prompted to confirm by
+typing the name of the secret.
 
-				Run: command.Adapt(runDeleteSecret),
+With --dry-run, report the versions that would be deleted without deleting
+them. No confirmation token is needed for a dry run.
+
+If the server is configured with --delete-retention, the deleted secret can
+be restored with "setec undelete" until the retention period ends.`,
+
+				SetFlags: command.Flags(flax.MustBind, &deleteArgs),
+				Run:      command.Adapt(runDeleteSecret),
+			},
+			{
+				Name:  "undelete",
+				Usage: "<secret-name>",
+				Help: `Restore a deleted secret.
+
+The secret is restored with all its versions and metadata. This is possible
+only if the server is configured with --delete-retention, and only until the
+retention period ends. It is an error if a new secret with the same name has
+been created since the secret was deleted.`,
+
+				Run: command.Adapt(runUndelete),
+			},
+			{
+				Name: "whoami",
+				Help: `Report the caller's identity as seen by the server.
+
+The output includes the caller's tailnet login name or tags, node name and
+IP address, and the access rules granted to it by the tailnet policy. Use it
+to diagnose requests that are unexpectedly denied.
+
+With --json, write the identity as a JSON object instead of text.`,
+
+				SetFlags: command.Flags(flax.MustBind, &whoamiArgs),
+				Run:      command.Adapt(runWhoAmI),
+			},
+			{
+				Name: "ping",
+				Help: `Check that the server is reachable and recognizes the caller.
+
+The output reports the server version, the round-trip time of the request,
+and the identity of the caller as the server sees it. The command fails if
+the server cannot be reached, if it does not recognize the caller, or if the
+tailnet policy grants the caller no access to secrets, with a message saying
+which. Use it to check connectivity before running other commands.`,
+
+				Run: command.Adapt(runPing),
+			},
+			{
+				Name: "audit-query",
+				Help: `Report entries from the audit log of the server.
+
+Only entries for secrets on which the caller has info access are reported,
+oldest first. At most --limit entries are reported (default 100); if more
+entries match, the most recent are reported.
+
+With --since, report only entries written at or after the given time, which
+may be an RFC3339 time or a duration before now, e.g., "24h".
+With --secret, report only entries acting on the named secret.
+
+With --json, write the entries as a JSON array instead of a table.
+
+The server can answer audit queries only if it writes its audit log to a file.`,
+
+				SetFlags: command.Flags(flax.MustBind, &auditQueryArgs),
+				Run:      command.Adapt(runAuditQuery),
 			},
 			{
 				Name: "generate-key",
 				Help: "Generate a new tink key and write it to stdout.",
 				Run:  command.Adapt(generateTinkKey),
 			},
+			{
+				Name: "export",
+				Help: `Export all accessible secrets to an encrypted bundle.
+
+Every version of each secret visible to the caller is fetched and written,
+with its expiration time and template flag, and the active version, labels,
+description, principals, format, content type, version limit and
+immutability of each secret, to the file given by --out. The bundle is
+encrypted with the Tink keyset in the file given by --keyset-file, and can be
+loaded into another server with "setec import".
+The caller must have get and info permission for every secret.
+
+Expired versions cannot be fetched, so they cause the export to fail unless
+--skip-expired is set, in which case they are omitted.
+
+Up to --concurrency secrets (default 8) are fetched at once. If fetching any
+secret fails, or the command is interrupted, the export stops and no bundle
+is written.`,
+
+				SetFlags: command.Flags(flax.MustBind, &exportArgs),
+				Run:      command.Adapt(runExport),
+			},
+			{
+				Name: "import",
+				Help: `Import secrets from an encrypted bundle.
+
+The bundle written by "setec export" is read from --in and decrypted with the
+Tink keyset in the file given by --keyset-file. Each secret is re-created on
+the server with its original version numbers, version expirations and
+template flags, and every setting recorded in the bundle. Importing fails if
+a version already exists on the server, so secrets should be imported into a
+server that does not yet have them. Restoring a version limit or
+immutability requires delete permission.
+
+Up to --concurrency secrets (default 8) are imported at once. If importing any
+secret fails, or the command is interrupted, no further secrets are started;
+secrets already imported are left in place.
+
+With --dry-run, the contents of the bundle are listed without making changes.`,
+
+				SetFlags: command.Flags(flax.MustBind, &importArgs),
+				Run:      command.Adapt(runImport),
+			},
+			{
+				Name: "restore",
+				Help: `Restore the server database from a backup.
+
+The backup is read from the local file or S3 URL (s3://bucket/key) given by
+--backup, and decrypted using the Tink keyset read from stdin, which must be
+the same keyset the server used when the backup was written. The contents are
+checked for validity before being written to the database in --state-dir.
+
+An S3 backup is read with ambient AWS credentials, unless --backup-role,
+--backup-credentials, --backup-profile or --backup-token-file are set; they
+work as they do for "setec server", and default to the same environment
+variables.
+
+An existing non-empty database is not overwritten unless --force is set.
+The server should not be running while a restore is in progress.`,
+
+				SetFlags: command.Flags(flax.MustBind, &restoreArgs),
+				Run:      command.Adapt(runRestore),
+			},
+			{
+				Name: "verify-backup",
+				Help: `Check that a backup can be restored, without restoring it.
+
+The backup is read from the local file or S3 URL (s3://bucket/key) given by
+--backup, and decrypted using the Tink keyset read from stdin, as for "setec
+restore". Its contents are checked for validity, and the number of secrets and
+versions it holds is printed, along with the time the backup was taken, if
+its name records it, and the time of the most recent change it records.
+
+An S3 backup is read with the credentials chosen by the --backup-* flags, as
+for "setec restore".
+
+Nothing is written, and the server need not be stopped, so this can be run on
+a schedule to check that backups are usable. The exit status is non-zero if
+the backup cannot be read, decrypted, or validated.`,
+
+				SetFlags: command.Flags(flax.MustBind, &verifyBackupArgs),
+				Run:      command.Adapt(runVerifyBackup),
+			},
 			command.HelpCommand(nil),
 			command.VersionCommand(),
 		},
@@ -167,18 +731,97 @@ generate the token, then re-run appending the provided value.`,
 }
 
 var serverArgs struct {
-	StateDir           string `flag:"state-dir,default=$SETEC_STATE_DIR,Server state directory"`
-	Hostname           string `flag:"hostname,default=$SETEC_HOSTNAME,Tailscale hostname to use"`
-	KMSKeyName         string `flag:"kms-key-name,default=$SETEC_KMS_KEY_NAME,Name of KMS key to use for database encryption"`
-	BackupBucket       string `flag:"backup-bucket,default=$SETEC_BACKUP_BUCKET,Name of AWS S3 bucket to use for database backups"`
-	BackupBucketRegion string `flag:"backup-bucket-region,default=$SETEC_BACKUP_BUCKET_REGION,AWS region of the backup S3 bucket"`
-	BackupRole         string `flag:"backup-role,default=$SETEC_BACKUP_ROLE,Name of AWS IAM role to assume to write backups"`
-	LoginServer        string `flag:"login-server,default=$SETEC_LOGIN_SERVER,URL of control server to use for tsnet"`
-	Dev                bool   `flag:"dev,Run in developer mode"`
+	StateDir           string        `flag:"state-dir,default=$SETEC_STATE_DIR,Server state directory"`
+	Hostname           string        `flag:"hostname,default=$SETEC_HOSTNAME,Tailscale hostname to use"`
+	KMSProvider        string        `flag:"kms-provider,default=$SETEC_KMS_PROVIDER,KMS provider for the database encryption key (gcp, vault)"`
+	KMSKeyName         string        `flag:"kms-key-name,default=$SETEC_KMS_KEY_NAME,Name of KMS key to use for database encryption"`
+	KMSKeysetFile      string        `flag:"kms-keyset-file,default=$SETEC_KMS_KEYSET_FILE,Read the Tink keyset from this file instead of stdin"`
+	KMSKeysetEnv       string        `flag:"kms-keyset-env,default=$SETEC_KMS_KEYSET_ENV,Read the Tink keyset from this environment variable instead of stdin"`
+	VaultAddr          string        `flag:"vault-addr,default=$SETEC_VAULT_ADDR,URL of the Vault server for --kms-provider=vault"`
+	BackupBucket       string        `flag:"backup-bucket,default=$SETEC_BACKUP_BUCKET,Name of AWS S3 bucket to use for database backups"`
+	BackupBucketRegion string        `flag:"backup-bucket-region,default=$SETEC_BACKUP_BUCKET_REGION,AWS region of the backup S3 bucket"`
+	BackupRole         string        `flag:"backup-role,default=$SETEC_BACKUP_ROLE,Name of AWS IAM role to assume to write backups"`
+	BackupCredentials  string        `flag:"backup-credentials,default=$SETEC_BACKUP_CREDENTIALS,AWS shared credentials file to use for backups"`
+	BackupProfile      string        `flag:"backup-profile,default=$SETEC_BACKUP_PROFILE,AWS profile to use for backups"`
+	BackupTokenFile    string        `flag:"backup-token-file,default=$SETEC_BACKUP_TOKEN_FILE,Web identity token file to exchange for --backup-role credentials"`
+	BackupDir          string        `flag:"backup-dir,default=$SETEC_BACKUP_DIR,Local directory to use for database backups"`
+	BackupDirRetain    int           `flag:"backup-dir-retain,default=$SETEC_BACKUP_DIR_RETAIN,Number of backups to keep in --backup-dir (0 keeps all)"`
+	BackupGCSBucket    string        `flag:"backup-gcs-bucket,default=$SETEC_BACKUP_GCS_BUCKET,Name of Google Cloud Storage bucket to use for database backups"`
+	LoginServer        string        `flag:"login-server,default=$SETEC_LOGIN_SERVER,URL of control server to use for tsnet"`
+	AuditLog           string        `flag:"audit-log,default=$SETEC_AUDIT_LOG,Write audit logs to this file, or - for stdout (default <state-dir>/audit.log)"`
+	AuditLogMaxBytes   int64         `flag:"audit-log-max-bytes,default=$SETEC_AUDIT_LOG_MAX_BYTES,Rotate the audit log file when it reaches this size (0 never rotates)"`
+	AuditLogMaxFiles   int           `flag:"audit-log-max-files,default=$SETEC_AUDIT_LOG_MAX_FILES,Number of rotated audit log files to keep (0 keeps all)"`
+	RateLimit          float64       `flag:"rate-limit,default=$SETEC_RATE_LIMIT,Maximum API requests per second per caller (0 is unlimited)"`
+	RateBurst          int           `flag:"rate-burst,default=$SETEC_RATE_BURST,Maximum burst of API requests per caller above --rate-limit"`
+	MaxSecretBytes     int           `flag:"max-secret-bytes,default=$SETEC_MAX_SECRET_BYTES,Maximum size in bytes of a secret value (default 1MiB)"`
+	CompressDB         bool          `flag:"compress-db,default=$SETEC_COMPRESS_DB,Compress the database before encrypting it on disk"`
+	SizeMetrics        bool          `flag:"size-metrics,default=$SETEC_SIZE_METRICS,Export the sizes of the database file and backups as metrics"`
+	NoAuditFPs         bool          `flag:"no-audit-fingerprints,default=$SETEC_NO_AUDIT_FINGERPRINTS,Omit fingerprints of secret values from audit log entries"`
+	DeleteRetention    time.Duration `flag:"delete-retention,default=$SETEC_DELETE_RETENTION,Keep deleted secrets for this long so they can be restored (0 deletes immediately)"`
+	ProtectAliases     bool          `flag:"protect-alias-targets,default=$SETEC_PROTECT_ALIAS_TARGETS,Refuse to delete or rename secrets that are the target of an alias"`
+	MaxVersions        int           `flag:"max-versions,default=$SETEC_MAX_VERSIONS,Number of versions to keep per secret, pruning the oldest on put (0 keeps all)"`
+	DedupePuts         bool          `flag:"dedupe-puts,default=$SETEC_DEDUPE_PUTS,Report the active version for a put of its value instead of adding a new one"`
+	WriteTags          string        `flag:"write-tags,default=$SETEC_WRITE_TAGS,Comma-separated tags a caller must have one of to modify secrets"`
+	AccessMetrics      string        `flag:"access-metrics,default=$SETEC_ACCESS_METRICS,Comma-separated secret name patterns to export per-secret read and activation metrics for"`
+	HTTPPort           int           `flag:"http-port,default=$SETEC_HTTP_PORT,Tailnet port for the plain HTTP listener (default 80)"`
+	HTTPSPort          int           `flag:"https-port,default=$SETEC_HTTPS_PORT,Tailnet port for the HTTPS listener (default 443)"`
+	MetricsAddr        string        `flag:"metrics-addr,default=$SETEC_METRICS_ADDR,Local address to serve /metrics and /healthz on, outside Tailscale"`
+	ReadOnly           bool          `flag:"read-only,default=$SETEC_READ_ONLY,Serve reads but reject all requests that modify secrets"`
+	ShutdownTimeout    time.Duration `flag:"shutdown-timeout,default=$SETEC_SHUTDOWN_TIMEOUT,How long to wait for requests in progress to finish when stopping (default 5s)"`
+	HealthAddr         string        `flag:"health-addr,default=$SETEC_HEALTH_ADDR,Local address to serve only the /healthz check on, outside Tailscale"`
+	Dev                bool          `flag:"dev,Run in developer mode"`
+	Check              bool          `flag:"check,Check that the server can start with this configuration, and exit"`
+}
+
+// parseAccessMetrics parses the comma-separated secret name patterns given
+// by the --access-metrics flag.
+func parseAccessMetrics(s string) []acl.Secret {
+	var out []acl.Secret
+	for _, pat := range splitList(s) {
+		out = append(out, acl.Secret(pat))
+	}
+	return out
+}
+
+// splitList splits a comma-separated flag value into its non-empty elements,
+// with surrounding whitespace removed.
+func splitList(s string) []string {
+	var out []string
+	for _, elt := range strings.Split(s, ",") {
+		if elt = strings.TrimSpace(elt); elt != "" {
+			out = append(out, elt)
+		}
+	}
+	return out
+}
+
+// openAuditLog opens the audit log writer selected by the --audit-log flag,
+// and reports the path of the file it writes. If path is "-", entries are
+// written to stdout and the reported path is empty; if it is empty, they are
+// appended to audit.log in stateDir. Files are rotated as set by the
+// --audit-log-max-bytes and --audit-log-max-files flags.
+func openAuditLog(path, stateDir string) (*audit.Writer, string, error) {
+	switch path {
+	case "-":
+		// Hide the Sync and Close methods of os.Stdout, since syncing fails
+		// on pipes and we must not close stdout when the server stops.
+		return audit.New(struct{ io.Writer }{os.Stdout}), "", nil
+	case "":
+		path = filepath.Join(stateDir, "audit.log")
+	}
+	w, err := audit.NewFileWithOptions(path, audit.FileOptions{
+		MaxBytes: serverArgs.AuditLogMaxBytes,
+		MaxFiles: serverArgs.AuditLogMaxFiles,
+	})
+	return w, path, err
 }
 
 var clientArgs struct {
-	Server string `flag:"s,default=$SETEC_SERVER,Server address"`
+	Server       string        `flag:"s,default=$SETEC_SERVER,Server address"`
+	CacheDir     string        `flag:"cache-dir,default=$SETEC_CACHE_DIR,Cache fetched secret values in this directory"`
+	CacheTTL     time.Duration `flag:"cache-ttl,default=$SETEC_CACHE_TTL,How long cached secret values are used (default 1m)"`
+	CacheKeyFile string        `flag:"cache-key-file,default=$SETEC_CACHE_KEY_FILE,File containing the hex-encoded AES key for --cache-dir"`
+	Timeout      time.Duration `flag:"timeout,default=$SETEC_TIMEOUT,Time limit for each request to the server (0 is unlimited)"`
 }
 
 func runServer(env *command.Env) error {
@@ -208,14 +851,24 @@ func runServer(env *command.Env) error {
 	if serverArgs.Hostname == "" {
 		return errors.New("--hostname must be specified")
 	}
-	if kek == nil {
-		keySet, err := ckeyset.Read(keyset.NewJSONReader(os.Stdin))
-		if err != nil {
-			return fmt.Errorf("reading keyset: %v", err)
+	for _, p := range []int{serverArgs.HTTPPort, serverArgs.HTTPSPort} {
+		if p < 0 || p > 65535 {
+			return fmt.Errorf("invalid port %d", p)
 		}
-		kek, err = aead.New(keySet)
+	}
+	if serverArgs.BackupBucket == "" && (serverArgs.BackupCredentials != "" || serverArgs.BackupProfile != "" || serverArgs.BackupTokenFile != "") {
+		return errors.New("--backup-credentials, --backup-profile and --backup-token-file require --backup-bucket")
+	} else if serverArgs.BackupTokenFile != "" && serverArgs.BackupRole == "" {
+		return errors.New("--backup-token-file requires --backup-role")
+	}
+	if serverArgs.Check {
+		return runServerCheck(env)
+	}
+	if kek == nil {
+		var err error
+		kek, err = serverKEK(env.Context())
 		if err != nil {
-			return fmt.Errorf("creating aead: %v", err)
+			return err
 		}
 	}
 
@@ -235,181 +888,985 @@ func runServer(env *command.Env) error {
 		return fmt.Errorf("tailscale did not come up: %w", err)
 	}
 
-	doms := s.CertDomains()
-	if len(doms) == 0 {
-		return fmt.Errorf("tailscale did not provide TLS domains")
+	doms, err := waitCertDomains(env.Context(), s)
+	if err != nil {
+		return err
 	}
 	fqdn := doms[0]
 
 	mux := http.NewServeMux()
 	tsweb.Debugger(mux)
 
-	audit, err := audit.NewFile(filepath.Join(serverArgs.StateDir, "audit.log"))
+	audit, auditPath, err := openAuditLog(serverArgs.AuditLog, serverArgs.StateDir)
 	if err != nil {
 		return fmt.Errorf("opening audit log: %w", err)
 	}
+	logStartupConfig(fqdn, auditPath)
+
+	var backups []server.BackupTarget
+	if serverArgs.BackupGCSBucket != "" {
+		b, err := server.NewGCSBackup(env.Context(), serverArgs.BackupGCSBucket)
+		if err != nil {
+			return err
+		}
+		backups = append(backups, b)
+	}
 
 	srv, err := server.New(env.Context(), server.Config{
-		DBPath:             filepath.Join(serverArgs.StateDir, "database"),
-		Key:                kek,
-		AuditLog:           audit,
-		WhoIs:              lc.WhoIs,
-		BackupBucket:       serverArgs.BackupBucket,
-		BackupBucketRegion: serverArgs.BackupBucketRegion,
-		BackupAssumeRole:   serverArgs.BackupRole,
-		Mux:                mux,
+		DBPath:                     filepath.Join(serverArgs.StateDir, "database"),
+		Key:                        kek,
+		AuditLog:                   audit,
+		AuditLogPath:               auditPath,
+		WhoIs:                      lc.WhoIs,
+		BackupBucket:               serverArgs.BackupBucket,
+		BackupBucketRegion:         serverArgs.BackupBucketRegion,
+		BackupAssumeRole:           serverArgs.BackupRole,
+		BackupCredentialsFile:      serverArgs.BackupCredentials,
+		BackupProfile:              serverArgs.BackupProfile,
+		BackupWebIdentityTokenFile: serverArgs.BackupTokenFile,
+		BackupDir:                  serverArgs.BackupDir,
+		BackupDirRetain:            serverArgs.BackupDirRetain,
+		BackupTargets:              backups,
+		MaxSecretBytes:             serverArgs.MaxSecretBytes,
+		RateLimit:                  serverArgs.RateLimit,
+		RateBurst:                  serverArgs.RateBurst,
+		CompressDB:                 serverArgs.CompressDB,
+		SizeMetrics:                serverArgs.SizeMetrics,
+		NoAuditFingerprints:        serverArgs.NoAuditFPs,
+		DeleteRetention:            serverArgs.DeleteRetention,
+		ProtectAliasTargets:        serverArgs.ProtectAliases,
+		MaxVersionsPerSecret:       serverArgs.MaxVersions,
+		DedupePuts:                 serverArgs.DedupePuts,
+		WriteTags:                  splitList(serverArgs.WriteTags),
+		ReadOnly:                   serverArgs.ReadOnly,
+		AccessMetrics:              parseAccessMetrics(serverArgs.AccessMetrics),
+		Mux:                        mux,
 	})
 	if err != nil {
 		return fmt.Errorf("initializing setec server: %v", err)
 	}
 	expvar.Publish("setec_server", srv.Metrics())
 
-	l80, err := s.Listen("tcp", ":80")
+	// Serve only the health check and metrics on local addresses, so that
+	// they can be probed without access to the tailnet. The metrics address
+	// serves the health check too, so a single address need not be bound
+	// twice.
+	if serverArgs.HealthAddr != "" && serverArgs.HealthAddr != serverArgs.MetricsAddr {
+		if err := serveLocal(serverArgs.HealthAddr, "health check", mux, "/healthz"); err != nil {
+			return err
+		}
+	}
+	if serverArgs.MetricsAddr != "" {
+		if err := serveLocal(serverArgs.MetricsAddr, "metrics", mux, "/metrics", "/healthz"); err != nil {
+			return err
+		}
+	}
+
+	// Count requests in progress, so that shutdown can report any it had to
+	// abandon.
+	handler := &inFlightHandler{Handler: mux}
+
+	httpPort := cmp.Or(serverArgs.HTTPPort, 80)
+	httpsPort := cmp.Or(serverArgs.HTTPSPort, 443)
+	l80, err := s.Listen("tcp", fmt.Sprintf(":%d", httpPort))
 	if err != nil {
 		return fmt.Errorf("creating HTTP listener: %v", err)
 	}
+	port80 := tsweb.Port80Handler{
+		Main: handler,
+		FQDN: fqdn,
+	}
+	if httpsPort != 443 {
+		// Redirect to the HTTPS listener wherever it is.
+		port80.FQDN = net.JoinHostPort(fqdn, strconv.Itoa(httpsPort))
+	}
+	hs80 := &http.Server{Handler: port80}
 	go func() {
-		port80 := tsweb.Port80Handler{
-			Main: mux,
-			FQDN: fqdn,
-		}
-		if err := http.Serve(l80, port80); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := hs80.Serve(l80); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("serving HTTP: %v", err)
 		}
 	}()
 
-	l, err := s.ListenTLS("tcp", ":443")
+	l, err := s.ListenTLS("tcp", fmt.Sprintf(":%d", httpsPort))
 	if err != nil {
 		return fmt.Errorf("creating TLS listener: %v", err)
 	}
-	hs := &http.Server{Handler: tsweb.BrowserHeaderHandler(mux)}
+	hs := &http.Server{Handler: tsweb.BrowserHeaderHandler(handler)}
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		<-env.Context().Done()
 		log.Print("Signal received, stopping...")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(serverArgs.ShutdownTimeout, 5*time.Second))
 		defer cancel()
-		hs.Shutdown(ctx)
+
+		// Stop accepting new requests on both listeners, and wait for those
+		// in progress to finish or the deadline to pass.
+		var wg sync.WaitGroup
+		wg.Go(func() { hs80.Shutdown(ctx) })
+		wg.Go(func() { hs.Shutdown(ctx) })
+		wg.Wait()
+		if ctx.Err() != nil {
+			log.Printf("Shutdown deadline reached with %d requests in flight", handler.active.Load())
+		}
 	}()
 
 	if err := hs.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("serving HTTPS: %v", err)
 	}
-
+	<-stopped
+	if err := audit.Close(); err != nil {
+		return fmt.Errorf("closing audit log: %w", err)
+	}
 	return nil
 }
 
-func newClient() (*setec.Client, error) {
-	if clientArgs.Server == "" {
-		return nil, errors.New("no server address is set")
+// serverKEK returns the key-encryption key for the database selected by the
+// server flags: a KMS key if --kms-provider is set, or else a Tink keyset read
+// from the --kms-keyset-file, the --kms-keyset-env variable, or stdin.
+func serverKEK(ctx context.Context) (tink.AEAD, error) {
+	if serverArgs.KMSProvider != "" {
+		return remoteKEK(ctx, serverArgs.KMSProvider, serverArgs.KMSKeyName)
+	}
+	if serverArgs.KMSKeysetFile != "" && serverArgs.KMSKeysetEnv != "" {
+		return nil, errors.New("--kms-keyset-file and --kms-keyset-env are mutually exclusive")
+	}
+	// The keyset is read from stdin unless a keyset file or environment
+	// variable is given, in which case stdin is left untouched.
+	var keysetInput io.Reader = os.Stdin
+	if name := serverArgs.KMSKeysetEnv; name != "" {
+		// The keyset is secret, so errors mention only the variable name.
+		val := os.Getenv(name)
+		if val == "" {
+			return nil, fmt.Errorf("environment variable %s for --kms-keyset-env is not set", name)
+		}
+		keysetInput = strings.NewReader(val)
+	} else if serverArgs.KMSKeysetFile != "" {
+		f, err := os.Open(serverArgs.KMSKeysetFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening keyset file: %w", err)
+		}
+		defer f.Close()
+		keysetInput = f
 	}
-	return &setec.Client{Server: clientArgs.Server}, nil
+	return readKEK(keysetInput)
 }
 
-func runList(env *command.Env) error {
-	c, err := newClient()
+// certDomainsTimeout is how long the server waits for tailscale to provide
+// TLS domains after it comes up.
+const certDomainsTimeout = 2 * time.Minute
+
+// waitCertDomains returns the TLS domains of s, which must be up. On a node
+// that has just joined the tailnet they may not be available at once, so it
+// polls for them, logging its progress, until certDomainsTimeout passes or
+// ctx ends.
+func waitCertDomains(ctx context.Context, s *tsnet.Server) ([]string, error) {
+	start := time.Now()
+	lastLog := start
+	for {
+		if doms := s.CertDomains(); len(doms) != 0 {
+			if time.Since(start) > time.Second {
+				log.Printf("TLS domains available after %v", time.Since(start).Round(time.Second))
+			}
+			return doms, nil
+		}
+		elapsed := time.Since(start)
+		if elapsed >= certDomainsTimeout {
+			return nil, fmt.Errorf("tailscale did not provide TLS domains within %v; check that HTTPS certificates are enabled for the tailnet", certDomainsTimeout)
+		}
+		if time.Since(lastLog) >= 10*time.Second {
+			log.Printf("Waiting for tailscale to provide TLS domains (%v elapsed)", elapsed.Round(time.Second))
+			lastLog = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// inFlightHandler is an http.Handler that counts the requests it is serving.
+type inFlightHandler struct {
+	http.Handler
+	active atomic.Int64
+}
+
+func (h *inFlightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.active.Add(1)
+	defer h.active.Add(-1)
+	h.Handler.ServeHTTP(w, r)
+}
+
+// serveLocal serves the given paths of mux on a listener at addr, outside
+// Tailscale. It reports an error if the listener cannot be created; errors
+// while serving are fatal.
+func serveLocal(addr, what string, mux *http.ServeMux, paths ...string) error {
+	lmux := http.NewServeMux()
+	for _, p := range paths {
+		lmux.Handle(p, mux)
+	}
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		return err
+		return fmt.Errorf("creating %s listener: %v", what, err)
 	}
+	go func() {
+		if err := http.Serve(l, lmux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("serving %s: %v", what, err)
+		}
+	}()
+	return nil
+}
 
-	secrets, err := c.List(env.Context())
+// readKEK reads a JSON Tink keyset from r and returns an AEAD for it.
+func readKEK(r io.Reader) (tink.AEAD, error) {
+	keySet, err := ckeyset.Read(keyset.NewJSONReader(r))
 	if err != nil {
-		return fmt.Errorf("failed to list secrets: %v", err)
+		return nil, fmt.Errorf("reading keyset: %v", err)
+	}
+	kek, err := aead.New(keySet)
+	if err != nil {
+		return nil, fmt.Errorf("creating aead: %v", err)
 	}
+	return kek, nil
+}
 
-	tw := newTabWriter(os.Stdout)
-	io.WriteString(tw, "NAME\tACTIVE\tVERSIONS\n")
-	for _, s := range secrets {
-		vers := make([]string, 0, len(s.Versions))
-		for _, v := range s.Versions {
-			vers = append(vers, v.String())
+// remoteKEK returns an AEAD that uses envelope encryption with the named key
+// from the given KMS provider as its key-encryption key.
+func remoteKEK(ctx context.Context, provider, keyName string) (tink.AEAD, error) {
+	if keyName == "" {
+		return nil, errors.New("--kms-key-name must be specified with --kms-provider")
+	}
+	var remote tink.AEAD
+	switch provider {
+	case "gcp":
+		if !strings.HasPrefix(keyName, "projects/") {
+			return nil, fmt.Errorf("invalid GCP KMS key name %q, want projects/.../cryptoKeys/...", keyName)
+		}
+		const uriPrefix = "gcp-kms://"
+		client, err := gcpkms.NewClientWithOptions(ctx, uriPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("creating GCP KMS client: %w", err)
+		}
+		remote, err = client.GetAEAD(uriPrefix + keyName)
+		if err != nil {
+			return nil, fmt.Errorf("getting GCP KMS key: %w", err)
+		}
+	case "vault":
+		var err error
+		remote, err = newVaultAEAD(cmp.Or(serverArgs.VaultAddr, os.Getenv("VAULT_ADDR")), keyName)
+		if err != nil {
+			return nil, err
 		}
-		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Name, s.ActiveVersion, strings.Join(vers, ","))
+	default:
+		return nil, fmt.Errorf("unknown KMS provider %q", provider)
 	}
-	return tw.Flush()
+	return aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), remote), nil
 }
 
-func runInfo(env *command.Env, name string) error {
-	c, err := newClient()
-	if err != nil {
+var restoreArgs struct {
+	Backup            string `flag:"backup,Path or s3://bucket/key URL of the backup to restore"`
+	BackupRegion      string `flag:"backup-bucket-region,default=$SETEC_BACKUP_BUCKET_REGION,AWS region of the backup S3 bucket"`
+	BackupRole        string `flag:"backup-role,default=$SETEC_BACKUP_ROLE,Name of AWS IAM role to assume to read the backup"`
+	BackupCredentials string `flag:"backup-credentials,default=$SETEC_BACKUP_CREDENTIALS,AWS shared credentials file to use to read the backup"`
+	BackupProfile     string `flag:"backup-profile,default=$SETEC_BACKUP_PROFILE,AWS profile to use to read the backup"`
+	BackupTokenFile   string `flag:"backup-token-file,default=$SETEC_BACKUP_TOKEN_FILE,Web identity token file to exchange for --backup-role credentials"`
+	StateDir          string `flag:"state-dir,default=$SETEC_STATE_DIR,Server state directory to restore into"`
+	Force             bool   `flag:"force,Overwrite an existing non-empty database"`
+}
+
+func runRestore(env *command.Env) error {
+	if restoreArgs.Backup == "" {
+		return errors.New("--backup must be specified")
+	}
+	s3opts := server.S3BackupOptions{
+		Region:               restoreArgs.BackupRegion,
+		AssumeRole:           restoreArgs.BackupRole,
+		CredentialsFile:      restoreArgs.BackupCredentials,
+		Profile:              restoreArgs.BackupProfile,
+		WebIdentityTokenFile: restoreArgs.BackupTokenFile,
+	}
+	if err := checkBackupReadOptions(restoreArgs.Backup, s3opts); err != nil {
+		return err
+	}
+	if restoreArgs.StateDir == "" {
+		return errors.New("--state-dir must be specified")
+	}
+	dbPath := filepath.Join(restoreArgs.StateDir, "database")
+	if fi, err := os.Stat(dbPath); err == nil && fi.Size() > 0 && !restoreArgs.Force {
+		return fmt.Errorf("database %q already exists (use --force to overwrite)", dbPath)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
-	info, err := c.Info(env.Context(), name)
+	kek, err := readKEK(os.Stdin)
 	if err != nil {
-		return fmt.Errorf("failed to get secret info: %v", err)
+		return err
 	}
-	vers := make([]string, 0, len(info.Versions))
-	for _, v := range info.Versions {
-		vers = append(vers, v.String())
+	data, err := server.ReadBackupWithOptions(env.Context(), restoreArgs.Backup, s3opts)
+	if err != nil {
+		return fmt.Errorf("reading backup: %w", err)
 	}
-	tw := newTabWriter(os.Stdout)
-	fmt.Fprintf(tw, "Name:\t%s\n", info.Name)
-	fmt.Fprintf(tw, "Active version:\t%s\n", info.ActiveVersion)
-	fmt.Fprintf(tw, "Versions:\t%s\n", strings.Join(vers, ", "))
-	return tw.Flush()
+	sum, err := db.Inspect(data, kek)
+	if err != nil {
+		return fmt.Errorf("checking backup: %w", err)
+	}
+
+	if err := os.MkdirAll(restoreArgs.StateDir, 0700); err != nil {
+		return fmt.Errorf("creating state dir: %w", err)
+	}
+	if err := atomicfile.WriteFile(dbPath, data, 0600); err != nil {
+		return fmt.Errorf("writing database: %w", err)
+	}
+	fmt.Printf("Restored %d secrets (%d versions) to %s\n", sum.Secrets, sum.Versions, dbPath)
+	return nil
 }
 
-var getArgs struct {
-	IfChanged bool   `flag:"if-changed,Get active version if changed from --version"`
-	Version   uint64 `flag:"version,Secret version to retrieve (default: the active version)"`
+// checkBackupReadOptions checks the S3 options given for reading the backup
+// at src. They default to the server's environment variables, so they are
+// ignored rather than rejected for a local file.
+func checkBackupReadOptions(src string, opts server.S3BackupOptions) error {
+	if strings.HasPrefix(src, "s3://") && opts.WebIdentityTokenFile != "" && opts.AssumeRole == "" {
+		return errors.New("--backup-token-file requires --backup-role")
+	}
+	return nil
 }
 
-func runGet(env *command.Env, name string) error {
-	c, err := newClient()
+var verifyBackupArgs struct {
+	Backup            string `flag:"backup,Path or s3://bucket/key URL of the backup to verify"`
+	BackupRegion      string `flag:"backup-bucket-region,default=$SETEC_BACKUP_BUCKET_REGION,AWS region of the backup S3 bucket"`
+	BackupRole        string `flag:"backup-role,default=$SETEC_BACKUP_ROLE,Name of AWS IAM role to assume to read the backup"`
+	BackupCredentials string `flag:"backup-credentials,default=$SETEC_BACKUP_CREDENTIALS,AWS shared credentials file to use to read the backup"`
+	BackupProfile     string `flag:"backup-profile,default=$SETEC_BACKUP_PROFILE,AWS profile to use to read the backup"`
+	BackupTokenFile   string `flag:"backup-token-file,default=$SETEC_BACKUP_TOKEN_FILE,Web identity token file to exchange for --backup-role credentials"`
+}
+
+func runVerifyBackup(env *command.Env) error {
+	if verifyBackupArgs.Backup == "" {
+		return errors.New("--backup must be specified")
+	}
+	s3opts := server.S3BackupOptions{
+		Region:               verifyBackupArgs.BackupRegion,
+		AssumeRole:           verifyBackupArgs.BackupRole,
+		CredentialsFile:      verifyBackupArgs.BackupCredentials,
+		Profile:              verifyBackupArgs.BackupProfile,
+		WebIdentityTokenFile: verifyBackupArgs.BackupTokenFile,
+	}
+	if err := checkBackupReadOptions(verifyBackupArgs.Backup, s3opts); err != nil {
+		return err
+	}
+	kek, err := readKEK(os.Stdin)
 	if err != nil {
 		return err
 	}
-
-	var val *api.SecretValue
-	if getArgs.Version == 0 {
-		val, err = c.Get(env.Context(), name)
-	} else if getArgs.IfChanged {
-		val, err = c.GetIfChanged(env.Context(), name, api.SecretVersion(getArgs.Version))
-	} else {
-		val, err = c.GetVersion(env.Context(), name, api.SecretVersion(getArgs.Version))
+	data, err := server.ReadBackupWithOptions(env.Context(), verifyBackupArgs.Backup, s3opts)
+	if err != nil {
+		return fmt.Errorf("reading backup: %w", err)
 	}
+	sum, err := db.Inspect(data, kek)
 	if err != nil {
-		return fmt.Errorf("failed to get secret: %v", err)
+		return fmt.Errorf("checking backup: %w", err)
 	}
 
-	// Print with a newline if a human's going to look at it,
-	// otherwise output just the secret bytes.
-	if term.IsTerminal(int(os.Stdout.Fd())) {
-		fmt.Println(string(val.Value))
-	} else {
-		os.Stdout.Write(val.Value)
+	tw := newTabWriter(os.Stdout)
+	fmt.Fprintf(tw, "Backup:\t%s\n", verifyBackupArgs.Backup)
+	fmt.Fprintf(tw, "Contents:\t%d secrets, %d versions\n", sum.Secrets, sum.Versions)
+	if at, ok := server.BackupTime(verifyBackupArgs.Backup); ok {
+		fmt.Fprintf(tw, "Taken at:\t%s\n", formatTime(at))
+	}
+	if !sum.LastChange.IsZero() {
+		fmt.Fprintf(tw, "Last change:\t%s\n", formatTime(sum.LastChange))
 	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Println("Backup is valid")
 	return nil
 }
 
-var putArgs struct {
-	File      string `flag:"from-file,Read secret value from this file instead of stdin"`
-	EmptyOK   bool   `flag:"empty-ok,Allow an empty secret value"`
-	Verbatim  bool   `flag:"verbatim,Do not trim whitespace from plain text values"`
-	TrimSpace bool   `flag:"trim-space,Trim whitespace from plain text values"`
+func newClient() (*setec.Client, error) {
+	server, err := setec.ParseServerURL(clientArgs.Server)
+	if err != nil {
+		return nil, err
+	}
+	vc, err := newValueCache()
+	if err != nil {
+		return nil, err
+	}
+	return &setec.Client{Server: server, ValueCache: vc, Timeout: clientArgs.Timeout}, nil
 }
 
-func runPut(env *command.Env, name string) error {
-	c, err := newClient()
+// newValueCache returns the value cache selected by the --cache-* flags, or
+// nil if caching is not enabled.
+func newValueCache() (*setec.ValueCache, error) {
+	if clientArgs.CacheDir == "" {
+		return nil, nil
+	} else if clientArgs.CacheKeyFile == "" {
+		return nil, errors.New("--cache-key-file must be specified with --cache-dir")
+	}
+	data, err := os.ReadFile(clientArgs.CacheKeyFile)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("reading cache key: %w", err)
 	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding cache key: %w", err)
+	} else if n := len(key); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("cache key is %d bytes, want 16, 24, or 32", n)
+	}
+	return &setec.ValueCache{
+		Dir: clientArgs.CacheDir,
+		TTL: cmp.Or(clientArgs.CacheTTL, time.Minute),
+		Key: key,
+	}, nil
+}
 
-	var value []byte
-	if putArgs.File != "" {
-		// The user requested we use input from a file.
-		var err error
-		value, err = os.ReadFile(putArgs.File)
+var listArgs struct {
+	JSON      bool   `flag:"json,Write output as JSON"`
+	Selector  string `flag:"selector,List only secrets with these labels (key=value,...)"`
+	Writable  bool   `flag:"writable,List only secrets the caller can put values for"`
+	ShowEmpty bool   `flag:"show-empty,Mark secrets whose newest version is not active, or whose active version expired"`
+	OnlyEmpty bool   `flag:"only-empty,List only secrets marked by --show-empty"`
+	Sort      string `flag:"sort,Sort secrets by this key (name, active, versions)"`
+	Reverse   bool   `flag:"reverse,List secrets in reverse order"`
+}
+
+func runList(env *command.Env, rest ...string) error {
+	if len(rest) > 1 {
+		return env.Usagef("extra arguments after prefix: %q", rest[1:])
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	var prefix string
+	if len(rest) != 0 {
+		prefix = rest[0]
+	}
+
+	selector, err := parseSelector(listArgs.Selector)
+	if err != nil {
+		return err
+	}
+	compare, err := listOrder(listArgs.Sort)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := c.ListWithOptions(env.Context(), setec.ListOptions{
+		Prefix:   prefix,
+		Selector: selector,
+		Writable: listArgs.Writable,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list secrets: %v", err)
+	}
+	now := time.Now()
+	if listArgs.OnlyEmpty {
+		secrets = slices.DeleteFunc(secrets, func(s *api.SecretInfo) bool { return emptyReason(s, now) == "" })
+	}
+	if compare != nil {
+		slices.SortStableFunc(secrets, compare)
+	}
+	if listArgs.Reverse {
+		slices.Reverse(secrets)
+	}
+
+	if listArgs.JSON {
+		if secrets == nil {
+			secrets = []*api.SecretInfo{} // encode as [], not null
+		}
+		return json.NewEncoder(os.Stdout).Encode(secrets)
+	}
+
+	showEmpty := listArgs.ShowEmpty || listArgs.OnlyEmpty
+	tw := newTabWriter(os.Stdout)
+	io.WriteString(tw, "NAME\tACTIVE\tVERSIONS\tEXPIRES")
+	if showEmpty {
+		io.WriteString(tw, "\tEMPTY")
+	}
+	io.WriteString(tw, "\n")
+	for _, s := range secrets {
+		vers := make([]string, 0, len(s.Versions))
+		for _, v := range s.Versions {
+			vers = append(vers, v.String())
+		}
+		expires := "-"
+		if vi := s.VersionInfo[s.ActiveVersion]; vi != nil && !vi.ExpiresAt.IsZero() {
+			expires = vi.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s", s.Name, s.ActiveVersion, strings.Join(vers, ","), expires)
+		if showEmpty {
+			fmt.Fprintf(tw, "\t%s", cmp.Or(emptyReason(s, now), "-"))
+		}
+		io.WriteString(tw, "\n")
+	}
+	return tw.Flush()
+}
+
+// listOrder returns a comparison function for sorting secrets by the given
+// --sort key, or nil if key is empty. Ties are ordered by name.
+func listOrder(key string) (func(a, b *api.SecretInfo) int, error) {
+	byName := func(a, b *api.SecretInfo) int { return strings.Compare(a.Name, b.Name) }
+	switch key {
+	case "":
+		return nil, nil
+	case "name":
+		return byName, nil
+	case "active":
+		return func(a, b *api.SecretInfo) int {
+			return cmp.Or(cmp.Compare(a.ActiveVersion, b.ActiveVersion), byName(a, b))
+		}, nil
+	case "versions":
+		return func(a, b *api.SecretInfo) int {
+			return cmp.Or(cmp.Compare(len(a.Versions), len(b.Versions)), byName(a, b))
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid --sort key %q, want name, active, or versions", key)
+	}
+}
+
+// emptyReason reports why s is marked by list --show-empty as of now: "expired"
+// if its active version has expired, "pending" if a newer version than the
+// active one exists, or "" if neither.
+func emptyReason(s *api.SecretInfo, now time.Time) string {
+	if vi := s.VersionInfo[s.ActiveVersion]; vi != nil && !vi.ExpiresAt.IsZero() && !now.Before(vi.ExpiresAt) {
+		return "expired"
+	}
+	if len(s.Versions) != 0 && slices.Max(s.Versions) > s.ActiveVersion {
+		return "pending"
+	}
+	return ""
+}
+
+// parseSelector parses a comma-separated list of key=value labels.
+func parseSelector(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	sel := make(map[string]string)
+	for term := range strings.SplitSeq(s, ",") {
+		key, value, err := parseLabel(strings.TrimSpace(term))
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("invalid selector: %w", err)
+		} else if value == "" {
+			return nil, fmt.Errorf("invalid selector: empty value for %q", key)
 		}
+		sel[key] = value
+	}
+	return sel, nil
+}
 
-		value, err = checkPutText(value)
+// parseLabel parses a label of the form key=value.
+func parseLabel(s string) (key, value string, err error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", fmt.Errorf("label %q is not of the form key=value", s)
+	}
+	return key, value, api.CheckLabel(key, value)
+}
+
+// labelFlag is a flag.Value that collects repeated key=value labels.
+type labelFlag map[string]string
+
+func (f labelFlag) String() string {
+	var out []string
+	for _, k := range slices.Sorted(maps.Keys(f)) {
+		out = append(out, k+"="+f[k])
+	}
+	return strings.Join(out, ",")
+}
+
+func (f *labelFlag) Set(s string) error {
+	key, value, err := parseLabel(s)
+	if err != nil {
+		return err
+	}
+	if *f == nil {
+		*f = make(labelFlag)
+	}
+	(*f)[key] = value
+	return nil
+}
+
+// valueFlag is a flag.Value for a string that records whether it was set, so
+// that an explicitly empty value can be distinguished from no value.
+type valueFlag struct {
+	set   bool
+	value string
+}
+
+func (f valueFlag) String() string { return f.value }
+
+func (f *valueFlag) Set(s string) error {
+	f.set, f.value = true, s
+	return nil
+}
+
+var infoArgs struct {
+	JSON bool `flag:"json,Write output as JSON"`
+}
+
+func runInfo(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	info, err := c.Info(env.Context(), name)
+	if err != nil {
+		return fmt.Errorf("failed to get secret info: %v", err)
+	}
+	if infoArgs.JSON {
+		info.LastAccessedAt = info.LastAccessedAt.UTC()
+		for _, vi := range info.VersionInfo {
+			if vi == nil {
+				continue
+			}
+			vi.CreatedAt = vi.CreatedAt.UTC()
+			vi.ActivatedAt = vi.ActivatedAt.UTC()
+			vi.ExpiresAt = vi.ExpiresAt.UTC()
+		}
+		return json.NewEncoder(os.Stdout).Encode(info)
+	}
+	tw := newTabWriter(os.Stdout)
+	fmt.Fprintf(tw, "Name:\t%s\n", info.Name)
+	if info.AliasOf != "" {
+		fmt.Fprintf(tw, "Alias of:\t%s\n", info.AliasOf)
+		return tw.Flush()
+	}
+	if info.Description != "" {
+		fmt.Fprintf(tw, "Description:\t%s\n", strings.ReplaceAll(info.Description, "\n", "\n\t"))
+	}
+	fmt.Fprintf(tw, "Active version:\t%s\n", info.ActiveVersion)
+	if len(info.Principals) != 0 {
+		fmt.Fprintf(tw, "Principals:\t%s\n", strings.Join(info.Principals, ", "))
+	}
+	for _, k := range slices.Sorted(maps.Keys(info.Labels)) {
+		fmt.Fprintf(tw, "Label %s:\t%s\n", k, info.Labels[k])
+	}
+	if info.MaxVersions > 0 {
+		fmt.Fprintf(tw, "Max versions:\t%d\n", info.MaxVersions)
+	} else if info.MaxVersions < 0 {
+		fmt.Fprintf(tw, "Max versions:\tunlimited\n")
+	}
+	if info.Format != "" {
+		fmt.Fprintf(tw, "Format:\t%s\n", info.Format)
+	}
+	if info.ContentType != "" {
+		fmt.Fprintf(tw, "Content type:\t%s\n", info.ContentType)
+	}
+	if info.Immutable {
+		fmt.Fprintf(tw, "Immutable:\tyes\n")
+	}
+	if info.MaxValueBytes > 0 {
+		fmt.Fprintf(tw, "Max value size:\t%d bytes\n", info.MaxValueBytes)
+	}
+	if info.AccessCount > 0 {
+		fmt.Fprintf(tw, "Last accessed:\t%s (%d reads since server start)\n", formatTime(info.LastAccessedAt), info.AccessCount)
+	} else {
+		fmt.Fprintf(tw, "Last accessed:\tnot since server start\n")
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	tw = newTabWriter(os.Stdout)
+	io.WriteString(tw, "VERSION\tCREATED\tCREATED BY\tACTIVATED\tACTIVATED BY\tEXPIRES\n")
+	for _, v := range info.Versions {
+		vi := info.VersionInfo[v]
+		if vi == nil {
+			vi = new(api.VersionInfo)
+		}
+		ver := v.String()
+		if v == info.ActiveVersion {
+			ver += "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", ver,
+			formatTime(vi.CreatedAt), orDash(vi.CreatedBy),
+			formatTime(vi.ActivatedAt), orDash(vi.ActivatedBy),
+			formatTime(vi.ExpiresAt))
+	}
+	return tw.Flush()
+}
+
+// formatTime formats t for display in a table, or "-" if t is zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// orDash returns s, or "-" if s is empty.
+func orDash(s string) string { return cmp.Or(s, "-") }
+
+var getArgs struct {
+	IfChanged bool          `flag:"if-changed,Get active version if changed from --version"`
+	Version   uint64        `flag:"version,Secret version to retrieve (default: the active version)"`
+	Output    string        `flag:"output,Write the secret value to this file instead of stdout"`
+	Force     bool          `flag:"force,Replace an existing --output file"`
+	NoCache   bool          `flag:"no-cache,Fetch the value from the server even if it is cached"`
+	Resolve   bool          `flag:"resolve,Expand references to other secrets in a template value"`
+	Wait      time.Duration `flag:"wait,Wait up to this long for the secret to exist"`
+	Metadata  bool          `flag:"metadata,Write the value with its version and creation time as JSON"`
+	Decode    string        `flag:"decode,Decode the stored value from base64 or hex before writing it"`
+	Raw       bool          `flag:"raw,Write exactly the stored bytes to stdout (the default)"`
+	Print     bool          `flag:"print,Write a newline after the value"`
+}
+
+func runGet(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if getArgs.NoCache {
+		c.ValueCache = nil
+	}
+	if getArgs.Output != "" && !getArgs.Force {
+		if _, err := os.Lstat(getArgs.Output); err == nil {
+			return fmt.Errorf("output file %q already exists (use --force to replace it)", getArgs.Output)
+		}
+	}
+
+	if getArgs.Metadata && getArgs.Output != "" {
+		return env.Usagef("--metadata cannot be used with --output")
+	}
+	if getArgs.Raw && getArgs.Print {
+		return env.Usagef("--raw cannot be used with --print")
+	} else if (getArgs.Raw || getArgs.Print) && (getArgs.Metadata || getArgs.Output != "") {
+		return env.Usagef("--raw and --print cannot be used with --metadata or --output")
+	}
+	if getArgs.Wait < 0 {
+		return env.Usagef("--wait must not be negative")
+	} else if getArgs.Wait > 0 && (getArgs.Resolve || getArgs.Version != 0) {
+		return env.Usagef("--wait cannot be used with --resolve or --version")
+	}
+	if getArgs.Decode != "" && !validValueEncoding(getArgs.Decode) {
+		return env.Usagef("unknown --decode encoding %q (want base64 or hex)", getArgs.Decode)
+	}
+
+	var val *api.SecretValue
+	if getArgs.Wait > 0 {
+		ctx, cancel := context.WithTimeout(env.Context(), getArgs.Wait)
+		defer cancel()
+		val, err = c.GetWait(ctx, name)
+	} else if getArgs.Resolve {
+		if getArgs.Version != 0 {
+			return env.Usagef("--resolve cannot be used with --version")
+		}
+		val, err = c.GetResolved(env.Context(), name)
+	} else if getArgs.Version == 0 {
+		val, err = c.Get(env.Context(), name)
+	} else if getArgs.IfChanged {
+		val, err = c.GetIfChanged(env.Context(), name, api.SecretVersion(getArgs.Version))
+	} else {
+		val, err = c.GetVersion(env.Context(), name, api.SecretVersion(getArgs.Version))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get secret: %v", err)
+	}
+	if val.Format != "" {
+		if err := api.CheckFormat(val.Format, val.Value); err != nil {
+			fmt.Fprintf(env, "Warning: version %d of %q does not match its declared format: %v\n", val.Version, name, err)
+		}
+	}
+	if getArgs.Decode != "" {
+		dec, err := decodeValue(getArgs.Decode, val.Value)
+		if err != nil {
+			return fmt.Errorf("version %d of %q is not valid %s: %w", val.Version, name, getArgs.Decode, err)
+		}
+		val.Value = dec
+	}
+
+	if getArgs.Metadata {
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			Name string
+			*api.SecretValue
+		}{name, val})
+	}
+	if getArgs.Output != "" {
+		if err := writeOutputFile(getArgs.Output, val.Value, getArgs.Force); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := os.Stdout.Write(val.Value); err != nil {
+		return err
+	}
+	if getArgs.Print {
+		fmt.Println()
+	}
+	return nil
+}
+
+// validValueEncoding reports whether enc is an encoding accepted by get
+// --decode and put --encode.
+func validValueEncoding(enc string) bool { return enc == "base64" || enc == "hex" }
+
+// decodeValue decodes v from the named encoding, which is "base64" (standard,
+// with or without padding) or "hex". Surrounding whitespace is ignored.
+func decodeValue(enc string, v []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(v))
+	switch enc {
+	case "base64":
+		if len(text)%4 != 0 {
+			return base64.RawStdEncoding.DecodeString(text)
+		}
+		return base64.StdEncoding.DecodeString(text)
+	case "hex":
+		return hex.DecodeString(text)
+	}
+	return nil, fmt.Errorf("unknown encoding %q", enc)
+}
+
+// encodeValue encodes v in the named encoding, which is "base64" (standard,
+// with padding) or "hex".
+func encodeValue(enc string, v []byte) []byte {
+	if enc == "hex" {
+		return []byte(hex.EncodeToString(v))
+	}
+	return []byte(base64.StdEncoding.EncodeToString(v))
+}
+
+// writeOutputFile writes data to the file at path with mode 0600. If replace
+// is false, it fails if path already exists, including when another process
+// creates it while data is being written. The check is made by linking a
+// fully-written temporary file into place, so path is never left partially
+// written.
+func writeOutputFile(path string, data []byte, replace bool) error {
+	if replace {
+		return atomicfile.WriteFile(path, data, 0600)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Link(tmp, path); errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("output file %q already exists (use --force to replace it)", path)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+var putArgs struct {
+	File        string    `flag:"from-file,Read secret value from this file instead of stdin"`
+	Value       valueFlag `flag:"value,Use this secret value instead of reading stdin (unsafe: visible to other processes)"`
+	FromEnv     string    `flag:"from-env,Read secret value from this environment variable instead of stdin"`
+	EmptyOK     bool      `flag:"empty-ok,Allow an empty secret value"`
+	Verbatim    bool      `flag:"verbatim,Do not trim whitespace from plain text values"`
+	TrimSpace   bool      `flag:"trim-space,Trim whitespace from plain text values"`
+	Expires     string    `flag:"expires,Expiration time for the new version (RFC3339 or duration)"`
+	Labels      labelFlag `flag:"label,Add a label to the secret (key=value, repeatable)"`
+	Activate    bool      `flag:"activate,Make the new version active"`
+	Template    bool      `flag:"template,Store the value as a template referring to other secrets"`
+	Format      string    `flag:"format,Check that the value is valid json, pem, base64, or utf8, and record the format"`
+	ContentType string    `flag:"content-type,Record this MIME type for the value instead of detecting it"`
+	IfAbsent    bool      `flag:"if-absent,Create the secret only if it does not already exist"`
+	Encode      string    `flag:"encode,Encode the value as base64 or hex before storing it"`
+	MaxVersions int       `flag:"max-versions,Number of versions the server keeps for this secret (-1 for no limit)"`
+	AllowDup    bool      `flag:"allow-duplicate,Add a new version even if an existing version has the same value"`
+	Description string    `flag:"description,Set the description of the secret"`
+	Immutable   bool      `flag:"immutable,Make the secret immutable (cannot be undone)"`
+}
+
+func runPut(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	expires, err := parseExpires(putArgs.Expires)
+	if err != nil {
+		return err
+	}
+
+	var nsrc int
+	for _, set := range []bool{putArgs.Value.set, putArgs.File != "", putArgs.FromEnv != ""} {
+		if set {
+			nsrc++
+		}
+	}
+	if nsrc > 1 {
+		return env.Usagef("only one of --value, --from-file and --from-env may be used")
+	}
+	if putArgs.Encode != "" && !validValueEncoding(putArgs.Encode) {
+		return env.Usagef("unknown --encode encoding %q (want base64 or hex)", putArgs.Encode)
+	}
+
+	var value []byte
+	var stream io.Reader // if non-nil, the value is uploaded from here
+	var streamText bool  // whether the stream is text
+	if putArgs.Value.set {
+		// The user provided the value on the command line.
+		fmt.Fprintln(env, "Warning: a secret value passed with --value may be recorded in shell history and visible in process listings")
+		var err error
+		value, err = checkPutText([]byte(putArgs.Value.value))
 		if err != nil {
 			return err
 		} else if len(value) == 0 && !putArgs.EmptyOK {
 			return errors.New("empty secret value")
 		}
+	} else if putArgs.FromEnv != "" {
+		// The user requested we use the value of an environment variable.
+		ev, ok := os.LookupEnv(putArgs.FromEnv)
+		if !ok {
+			return fmt.Errorf("environment variable %q is not set", putArgs.FromEnv)
+		}
+		var err error
+		value, err = checkPutText([]byte(ev))
+		if err != nil {
+			return err
+		} else if len(value) == 0 && !putArgs.EmptyOK {
+			return fmt.Errorf("environment variable %q is empty", putArgs.FromEnv)
+		}
+	} else if putArgs.File != "" {
+		// The user requested we use input from a file. Large files are
+		// uploaded in chunks rather than read into memory.
+		f, err := os.Open(putArgs.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && fi.Size() > streamPutThreshold && putArgs.Encode == "" {
+			sr, text, err := checkPutFile(f, fi.Size())
+			if err != nil {
+				return err
+			} else if sr.Size() == 0 && !putArgs.EmptyOK {
+				return errors.New("empty secret value")
+			}
+			stream, streamText = sr, text
+		} else {
+			value, err = io.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			value, err = checkPutText(value)
+			if err != nil {
+				return err
+			} else if len(value) == 0 && !putArgs.EmptyOK {
+				return errors.New("empty secret value")
+			}
+		}
 	} else if term.IsTerminal(int(os.Stdin.Fd())) {
 		// Standard input is connected to a terminal; prompt the human to type or
 		// paste the value and require confirmation.
@@ -449,14 +1906,263 @@ func runPut(env *command.Env, name string) error {
 		}
 		fmt.Fprintf(env, "Read %d bytes from stdin\n", len(value))
 	}
+	if putArgs.Encode != "" {
+		value = encodeValue(putArgs.Encode, value)
+	}
+	contentType := cmp.Or(putArgs.ContentType, formatContentType(putArgs.Format))
+	if contentType == "" {
+		contentType = putContentType(env.Context(), c, name, value, stream != nil && !streamText)
+	}
+
+	opts := setec.PutOptions{
+		ExpiresAt:      expires,
+		Labels:         putArgs.Labels,
+		Activate:       putArgs.Activate,
+		Template:       putArgs.Template,
+		Format:         putArgs.Format,
+		ContentType:    contentType,
+		IfAbsent:       putArgs.IfAbsent,
+		MaxVersions:    putArgs.MaxVersions,
+		AllowDuplicate: putArgs.AllowDup,
+		Description:    putArgs.Description,
+		Immutable:      putArgs.Immutable,
+	}
+	var ver api.SecretVersion
+	if stream != nil {
+		// The server enforces its own limit on the size of the value, which
+		// may be larger than the default limit of the client.
+		sc := *c
+		sc.MaxValueBytes = -1
+		ver, err = sc.PutStream(env.Context(), name, stream, opts)
+	} else {
+		ver, err = c.PutWithOptions(env.Context(), name, value, opts)
+	}
+	if errors.Is(err, api.ErrAlreadyExists) && putArgs.IfAbsent {
+		return fmt.Errorf("secret %q already exists, not overwritten: %w", name, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to write secret: %w", err)
+	}
+	if putArgs.Activate {
+		fmt.Printf("Secret saved as %q, version %d (active)\n", name, ver)
+	} else {
+		fmt.Printf("Secret saved as %q, version %d\n", name, ver)
+	}
+	if ver != 1 && !putArgs.Activate {
+		fmt.Printf("  To activate this version, run 'setec activate %q %d'\n", name, ver)
+	}
+	return nil
+}
+
+// putContentType returns the content type detected for value, to be put as
+// a new version of the named secret, or "" to leave the content type of the
+// secret unchanged. If binary is true, the value is binary whatever it holds.
+// The content type belongs to the secret rather than the version, so it is
+// detected only when the new version becomes the active one: with --activate,
+// or when the put creates the secret.
+func putContentType(ctx context.Context, c *setec.Client, name string, value []byte, binary bool) string {
+	if !putArgs.Activate && !putArgs.IfAbsent {
+		// If the secret cannot be checked, assume it exists.
+		if _, err := c.Info(ctx, name); !errors.Is(err, api.ErrNotFound) {
+			return ""
+		}
+	}
+	if binary {
+		return api.ContentTypeBinary
+	}
+	return api.DetectContentType(value)
+}
+
+var copyArgs struct {
+	Overwrite bool `flag:"overwrite,Add a new version if the destination secret exists"`
+}
 
-	ver, err := c.Put(env.Context(), name, value)
+func runCopy(env *command.Env, src, dst string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	if !copyArgs.Overwrite {
+		if _, err := c.Info(env.Context(), dst); err == nil {
+			return fmt.Errorf("secret %q already exists (use --overwrite to add a new version)", dst)
+		} else if !errors.Is(err, api.ErrNotFound) {
+			return fmt.Errorf("failed to check secret %q: %w", dst, err)
+		}
+	}
+
+	val, err := c.Get(env.Context(), src)
+	if err != nil {
+		return fmt.Errorf("failed to get secret %q: %w", src, err)
+	}
+	ver, err := c.Put(env.Context(), dst, val.Value)
 	if err != nil {
 		return fmt.Errorf("failed to write secret: %w", err)
 	}
-	fmt.Printf("Secret saved as %q, version %d\n", name, ver)
+	fmt.Printf("Secret %q version %d copied to %q, version %d\n", src, val.Version, dst, ver)
 	if ver != 1 {
-		fmt.Printf("  To activate this version, run 'setec activate %q %d'\n", name, ver)
+		fmt.Printf("  To activate this version, run 'setec activate %q %d'\n", dst, ver)
+	}
+	return nil
+}
+
+var generateArgs struct {
+	Bytes    int       `flag:"bytes,default=32,Number of random bytes to generate"`
+	Encoding string    `flag:"encoding,default=base64,Encoding of the stored value (hex, base64, base64url, raw)"`
+	Show     bool      `flag:"show,Print the generated value"`
+	Activate bool      `flag:"activate,Make the new version active"`
+	Expires  string    `flag:"expires,Expiration time for the new version (RFC3339 or duration)"`
+	Labels   labelFlag `flag:"label,Add a label to the secret (key=value, repeatable)"`
+}
+
+func runGenerate(env *command.Env, name string) error {
+	if generateArgs.Bytes <= 0 {
+		return env.Usagef("--bytes must be positive")
+	}
+	var encode func([]byte) string
+	switch generateArgs.Encoding {
+	case "hex":
+		encode = hex.EncodeToString
+	case "base64":
+		encode = base64.StdEncoding.EncodeToString
+	case "base64url":
+		encode = base64.RawURLEncoding.EncodeToString
+	case "raw":
+		encode = func(b []byte) string { return string(b) }
+	default:
+		return env.Usagef("unknown encoding %q", generateArgs.Encoding)
+	}
+	expires, err := parseExpires(generateArgs.Expires)
+	if err != nil {
+		return err
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, generateArgs.Bytes)
+	rand.Read(buf)
+	value := []byte(encode(buf))
+
+	ver, err := c.PutWithOptions(env.Context(), name, value, setec.PutOptions{
+		ExpiresAt: expires,
+		Labels:    generateArgs.Labels,
+		Activate:  generateArgs.Activate,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write secret: %w", err)
+	}
+	if generateArgs.Show {
+		fmt.Println(string(value))
+	}
+	if generateArgs.Activate {
+		fmt.Fprintf(env, "Generated secret saved as %q, version %d (active)\n", name, ver)
+	} else {
+		fmt.Fprintf(env, "Generated secret saved as %q, version %d\n", name, ver)
+		if ver != 1 {
+			fmt.Fprintf(env, "  To activate this version, run 'setec activate %q %d'\n", name, ver)
+		}
+	}
+	return nil
+}
+
+// parseExpires parses an expiration time given either as an RFC3339
+// timestamp or as a duration relative to the current time. An empty string
+// yields the zero time, meaning no expiration.
+func parseExpires(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	var exp time.Time
+	if d, err := time.ParseDuration(s); err == nil {
+		exp = time.Now().Add(d)
+	} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+		exp = t
+	} else {
+		return time.Time{}, fmt.Errorf("invalid expiration %q: must be an RFC3339 time or a duration", s)
+	}
+	if !exp.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("expiration %q is not in the future", s)
+	}
+	return exp.UTC().Round(time.Second), nil
+}
+
+func runRename(env *command.Env, oldName, newName string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.Rename(env.Context(), oldName, newName); err != nil {
+		return fmt.Errorf("failed to rename secret %q to %q: %w", oldName, newName, err)
+	}
+	return nil
+}
+
+func runAlias(env *command.Env, name, target string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.Alias(env.Context(), name, target); err != nil {
+		return fmt.Errorf("failed to alias %q to %q: %w", name, target, err)
+	}
+	return nil
+}
+
+func runUndelete(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.Undelete(env.Context(), name); err != nil {
+		return fmt.Errorf("failed to restore secret %q: %w", name, err)
+	}
+	return nil
+}
+
+func runSetACL(env *command.Env, name string, principals ...string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.SetPrincipals(env.Context(), name, principals); err != nil {
+		return fmt.Errorf("failed to set principals for %q: %w", name, err)
+	}
+	return nil
+}
+
+func runLabel(env *command.Env, name string, args ...string) error {
+	if len(args) == 0 {
+		return env.Usagef("no labels specified")
+	}
+	labels := make(map[string]string)
+	for _, arg := range args {
+		key, value, err := parseLabel(arg)
+		if err != nil {
+			return err
+		}
+		labels[key] = value
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.SetLabels(env.Context(), name, labels); err != nil {
+		return fmt.Errorf("failed to set labels for %q: %w", name, err)
+	}
+	return nil
+}
+
+func runDescribe(env *command.Env, name string, text ...string) error {
+	if len(text) == 0 {
+		return env.Usagef("no description specified")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.SetDescription(env.Context(), name, strings.Join(text, " ")); err != nil {
+		return fmt.Errorf("failed to set description for %q: %w", name, err)
 	}
 	return nil
 }
@@ -473,12 +2179,240 @@ func runActivate(env *command.Env, name, versionString string) error {
 	}
 
 	if err := c.Activate(env.Context(), name, api.SecretVersion(version)); err != nil {
+		if errors.Is(err, api.ErrNotFound) {
+			// Say which of the secret and the version is missing, if we can.
+			st, serr := c.VersionStatus(env.Context(), name, api.SecretVersion(version))
+			if errors.Is(serr, api.ErrNotFound) {
+				return fmt.Errorf("failed to set active version: secret %q does not exist", name)
+			} else if serr == nil && st == setec.VersionAbsent {
+				return fmt.Errorf("failed to set active version: secret %q has no version %d (see \"setec info %s\")", name, version, name)
+			}
+		}
 		return fmt.Errorf("failed to set active version: %w", err)
 	}
 
 	return nil
 }
 
+var whoamiArgs struct {
+	JSON bool `flag:"json,Write output as JSON"`
+}
+
+func runWhoAmI(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	who, err := c.WhoAmI(env.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get identity: %w", err)
+	}
+	if whoamiArgs.JSON {
+		return json.NewEncoder(os.Stdout).Encode(who)
+	}
+
+	tw := newTabWriter(os.Stdout)
+	fmt.Fprintf(tw, "User:\t%s\n", orDash(who.User))
+	fmt.Fprintf(tw, "Hostname:\t%s\n", who.Hostname)
+	fmt.Fprintf(tw, "IP:\t%s\n", who.IP)
+	fmt.Fprintf(tw, "Tags:\t%s\n", orDash(strings.Join(who.Tags, ", ")))
+	if len(who.Permissions) == 0 {
+		fmt.Fprintf(tw, "Permissions:\t(none)\n")
+	}
+	for i, rule := range who.Permissions {
+		label := ""
+		if i == 0 {
+			label = "Permissions:"
+		}
+		acts := make([]string, len(rule.Action))
+		for j, a := range rule.Action {
+			acts[j] = string(a)
+		}
+		secrets := make([]string, len(rule.Secret))
+		for j, s := range rule.Secret {
+			secrets[j] = string(s)
+		}
+		fmt.Fprintf(tw, "%s\t%s on %s\n", label, strings.Join(acts, ","), strings.Join(secrets, ", "))
+	}
+	return tw.Flush()
+}
+
+func runPing(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	rsp, err := c.Ping(env.Context())
+	if err != nil {
+		return fmt.Errorf("server %s is unreachable: %w", c.Server, err)
+	}
+	rtt := time.Since(start)
+
+	tw := newTabWriter(os.Stdout)
+	fmt.Fprintf(tw, "Server:\t%s\n", c.Server)
+	fmt.Fprintf(tw, "Version:\t%s\n", cmp.Or(rsp.Version, "(unknown)"))
+	fmt.Fprintf(tw, "Round trip:\t%v\n", rtt.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Caller:\t%s\n", cmp.Or(rsp.Caller, "(not recognized)"))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if !rsp.Recognized {
+		return errors.New("server is reachable, but does not recognize the caller")
+	} else if !rsp.HasPermissions {
+		return fmt.Errorf("server is reachable, but %s has no access to secrets", rsp.Caller)
+	}
+	return nil
+}
+
+var auditQueryArgs struct {
+	Since  string `flag:"since,Report entries at or after this time (RFC3339 or duration before now)"`
+	Secret string `flag:"secret,Report only entries for this secret"`
+	Limit  int    `flag:"limit,Maximum number of entries to report (default 100)"`
+	JSON   bool   `flag:"json,Write output as JSON"`
+}
+
+func runAuditQuery(env *command.Env) error {
+	since, err := parseSince(auditQueryArgs.Since)
+	if err != nil {
+		return err
+	}
+	if auditQueryArgs.Limit < 0 {
+		return env.Usagef("--limit must not be negative")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	entries, err := c.Audit(env.Context(), setec.AuditOptions{
+		Since:  since,
+		Secret: auditQueryArgs.Secret,
+		Limit:  auditQueryArgs.Limit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query audit log: %w", err)
+	}
+
+	if auditQueryArgs.JSON {
+		if entries == nil {
+			entries = []*audit.Entry{} // encode as [], not null
+		}
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+
+	tw := newTabWriter(os.Stdout)
+	io.WriteString(tw, "TIME\tPRINCIPAL\tACTION\tSECRET\tVERSION\tAUTHORIZED\n")
+	for _, e := range entries {
+		secret := e.Secret
+		if e.NewSecret != "" {
+			secret += " -> " + e.NewSecret
+		}
+		version := "-"
+		if e.SecretVersion != 0 {
+			version = e.SecretVersion.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\n", e.Time.Format(time.RFC3339),
+			e.Principal.Name(), e.Action, secret, version, e.Authorized)
+	}
+	return tw.Flush()
+}
+
+// parseSince parses a --since time, which is either an RFC3339 time or a
+// duration before now. An empty string is the zero time.
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d).UTC(), nil
+	} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: must be an RFC3339 time or a duration", s)
+}
+
+var deleteArgs struct {
+	DryRun bool `flag:"dry-run,Report what would be deleted without deleting it"`
+}
+
+var deleteVersionArgs struct {
+	DryRun     bool   `flag:"dry-run,Report what would be deleted without deleting it"`
+	Reactivate uint64 `flag:"reactivate,Make this version active in the same update"`
+}
+
+var activateManyArgs struct {
+	File   string `flag:"from-file,Read name and version pairs from this file instead of stdin"`
+	Atomic bool   `flag:"atomic,Activate all the versions or none of them"`
+}
+
+func runActivateMany(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	var input []byte
+	if activateManyArgs.File != "" {
+		input, err = os.ReadFile(activateManyArgs.File)
+	} else {
+		input, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return fmt.Errorf("reading input: %w", err)
+	}
+	reqs, err := parseActivations(input)
+	if err != nil {
+		return err
+	}
+
+	if activateManyArgs.Atomic {
+		if err := c.ActivateMany(env.Context(), reqs); err != nil {
+			return fmt.Errorf("failed to activate versions: %w", err)
+		}
+		fmt.Printf("Activated %d secrets\n", len(reqs))
+		return nil
+	}
+
+	var nfail int
+	for _, r := range reqs {
+		if err := c.Activate(env.Context(), r.Name, r.Version); err != nil {
+			fmt.Printf("FAIL %s %v: %v\n", r.Name, r.Version, err)
+			nfail++
+		} else {
+			fmt.Printf("ok   %s %v\n", r.Name, r.Version)
+		}
+	}
+	fmt.Printf("Activated %d secrets, %d failed\n", len(reqs)-nfail, nfail)
+	if nfail != 0 {
+		return fmt.Errorf("%d activations failed", nfail)
+	}
+	return nil
+}
+
+// parseActivations parses lines of "name version" pairs from input.
+func parseActivations(input []byte) ([]api.ActivateRequest, error) {
+	var reqs []api.ActivateRequest
+	for i, line := range strings.Split(string(input), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want <secret-name> <secret-version>, got %q", i+1, line)
+		}
+		version, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid version %q: %w", i+1, fields[1], err)
+		}
+		reqs = append(reqs, api.ActivateRequest{Name: fields[0], Version: api.SecretVersion(version)})
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("no secrets to activate")
+	}
+	return reqs, nil
+}
+
 func runDeleteVersion(env *command.Env, name, versionString string, rest ...string) error {
 	c, err := newClient()
 	if err != nil {
@@ -493,11 +2427,44 @@ func runDeleteVersion(env *command.Env, name, versionString string, rest ...stri
 	if err != nil {
 		return fmt.Errorf("invalid version %q: %w", versionString, err)
 	}
+	reactivate := deleteVersionArgs.Reactivate
+	if reactivate > math.MaxUint32 {
+		return env.Usagef("invalid --reactivate version %d", reactivate)
+	} else if reactivate != 0 && reactivate == version {
+		return env.Usagef("--reactivate must name a version other than the one deleted")
+	}
+	if deleteVersionArgs.DryRun {
+		info, err := c.Info(env.Context(), name)
+		if err != nil {
+			return fmt.Errorf("failed to get secret info: %w", err)
+		}
+		v, rv := api.SecretVersion(version), api.SecretVersion(reactivate)
+		if !slices.Contains(info.Versions, v) {
+			return fmt.Errorf("secret %q has no version %d", name, version)
+		} else if rv != 0 && !slices.Contains(info.Versions, rv) {
+			return fmt.Errorf("secret %q has no version %d to reactivate", name, reactivate)
+		} else if v == info.ActiveVersion && rv == 0 {
+			return fmt.Errorf("version %d of secret %q is active and cannot be deleted (use --reactivate to replace it)", version, name)
+		}
+		if rv != 0 && rv != info.ActiveVersion {
+			fmt.Printf("Would activate secret %q version %d\n", name, reactivate)
+		}
+		fmt.Printf("Would delete secret %q version %d\n", name, version)
+		return nil
+	}
 	req := fmt.Sprintf("delete-version:%s:%d", name, version)
-	if err := checkConfirmation(req, token); err != nil {
+	if reactivate != 0 {
+		req += fmt.Sprintf(":reactivate=%d", reactivate)
+	}
+	if err := checkConfirmation(req, name, token); err != nil {
 		return err
 	}
-	if err := c.DeleteVersion(env.Context(), name, api.SecretVersion(version)); err != nil {
+	if reactivate != 0 {
+		err = c.DeleteVersionAndActivate(env.Context(), name, api.SecretVersion(version), api.SecretVersion(reactivate))
+	} else {
+		err = c.DeleteVersion(env.Context(), name, api.SecretVersion(version))
+	}
+	if err != nil {
 		return fmt.Errorf("failed to delete secret %q version %d: %w", name, version, err)
 	}
 	return nil
@@ -513,8 +2480,23 @@ func runDeleteSecret(env *command.Env, name string, rest ...string) error {
 		token = rest[0]
 	}
 
+	if deleteArgs.DryRun {
+		info, err := c.Info(env.Context(), name)
+		if err != nil {
+			return fmt.Errorf("failed to get secret info: %w", err)
+		}
+		fmt.Printf("Would delete secret %q, %d versions:\n", name, len(info.Versions))
+		for _, v := range info.Versions {
+			if v == info.ActiveVersion {
+				fmt.Printf("  %v (active)\n", v)
+			} else {
+				fmt.Printf("  %v\n", v)
+			}
+		}
+		return nil
+	}
 	req := fmt.Sprintf("delete-secret:%s", name)
-	if err := checkConfirmation(req, token); err != nil {
+	if err := checkConfirmation(req, name, token); err != nil {
 		return err
 	}
 	if err := c.Delete(env.Context(), name); err != nil {
@@ -537,24 +2519,46 @@ func generateTinkKey(env *command.Env, rest ...string) error {
 }
 
 // newConfirmationToken returns a nonce "token" that must be supplied to
-// perform a dangerous operation like deleting a secret or secret value.
-// The token is not a security feature, it is just a request digest with a
-// timestamp to reduce the chances of things getting deleted by accident.
-func newConfirmationToken(req string) string {
+// perform a dangerous operation like deleting a secret or secret value on the
+// specified server. The token is not a security feature, it is just a request
+// digest with a timestamp to reduce the chances of things getting deleted by
+// accident. The server address should be normalized with setec.ParseServerURL.
+func newConfirmationToken(server, req string) string {
 	// Code format: <time-window>.<req-digest>
 	//
 	// Confirmation codes last about 1 minute after construction, as a cheap
 	// hedge against copy-pasta from old script output or command history.  The
-	// digest is just to tie the token to the specific request.
+	// digest is just to tie the token to the specific server and request, so
+	// that a token for one server is not accepted by another.
 	window := (int64(time.Now().Unix()) + 119) / 60 // round up
-	sum := sha256.Sum256([]byte(req))
+	sum := sha256.Sum256([]byte(server + "\x00" + req))
 	return fmt.Sprintf("%x.%x", window, sum[:8])
 }
 
-func checkConfirmation(req, token string) error {
+// checkConfirmation checks that token is the confirmation token for req on
+// the server given by the -s flag. If token is empty and standard input is a
+// terminal, it instead prompts the user to confirm by typing the secret name,
+// and reports an error unless they do so exactly.
+func checkConfirmation(req, name, token string) error {
+	server, err := setec.ParseServerURL(clientArgs.Server)
+	if err != nil {
+		return err
+	}
+	if token == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Printf("To confirm %q on %s, type the secret name: ", req, server)
+		os.Stdout.Sync()
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if strings.TrimRight(line, "\r\n") != name {
+			return errors.New("confirmation does not match, aborting")
+		}
+		return nil
+	}
 	if token == "" {
-		return fmt.Errorf("confirmation required for %q, use token %q", req, newConfirmationToken(req))
-	} else if want := newConfirmationToken(req); token != want {
+		return fmt.Errorf("confirmation required for %q, use token %q", req, newConfirmationToken(server, req))
+	} else if want := newConfirmationToken(server, req); token != want {
 		return fmt.Errorf("incorrect confirmation for %q, use token %q", req, want)
 	}
 	return nil
@@ -587,6 +2591,63 @@ func checkPutText(value []byte) ([]byte, error) {
 	}
 	// Reaching here, the value is text with extra space, but the user did not
 	// specify its disposition. Report an error.
-	return nil, errors.New("text value has surrounding whitespace, " +
-		"specify --verbatim to keep the space or --trim-space to remove it")
+	return nil, errPutTextSpace
+}
+
+// errPutTextSpace is reported by put for a text value with surrounding
+// whitespace, if neither --verbatim nor --trim-space is set.
+var errPutTextSpace = errors.New("text value has surrounding whitespace, " +
+	"specify --verbatim to keep the space or --trim-space to remove it")
+
+// streamPutThreshold is the file size above which put --from-file uploads
+// the value in chunks rather than reading it into memory.
+const streamPutThreshold = 1 << 20
+
+// formatContentType returns the content type implied by a value format
+// declared with put --format, or "" if format is empty or unknown.
+func formatContentType(format string) string {
+	switch format {
+	case api.FormatJSON:
+		return "application/json"
+	case api.FormatPEM:
+		return "application/x-pem-file"
+	case api.FormatBase64, api.FormatUTF8:
+		return api.ContentTypeText
+	}
+	return ""
+}
+
+// checkPutFile is as checkPutText for the contents of f, which is size bytes
+// long, but scans the file instead of reading it into memory. It returns a
+// reader for the part of the file to store, and reports whether the file is
+// text.
+func checkPutFile(f *os.File, size int64) (_ *io.SectionReader, text bool, _ error) {
+	br := bufio.NewReaderSize(f, 64<<10)
+	var off int64
+	start, end := int64(-1), int64(0) // the span of f without surrounding space
+	for {
+		r, n, err := br.ReadRune()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+		if r == utf8.RuneError && n == 1 {
+			return io.NewSectionReader(f, 0, size), false, nil // binary value, always handle verbatim
+		}
+		if !unicode.IsSpace(r) {
+			if start < 0 {
+				start = off
+			}
+			end = off + int64(n)
+		}
+		off += int64(n)
+	}
+	start = max(start, 0)
+	if (start == 0 && end == off) || putArgs.Verbatim {
+		return io.NewSectionReader(f, 0, off), true, nil
+	} else if putArgs.TrimSpace {
+		return io.NewSectionReader(f, start, end-start), true, nil
+	}
+	return nil, true, errPutTextSpace
 }
@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/tailscale/setec/db"
+	"github.com/tailscale/setec/setectest"
+	"github.com/tailscale/setec/types/api"
+)
+
+func TestWriteOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out")
+
+	checkFile := func(want string) {
+		t.Helper()
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		} else if string(got) != want {
+			t.Errorf("File content: got %q, want %q", got, want)
+		}
+	}
+
+	if err := writeOutputFile(path, []byte("first"), false); err != nil {
+		t.Fatalf("writeOutputFile: unexpected error: %v", err)
+	}
+	checkFile("first")
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if m := fi.Mode().Perm(); m != 0600 {
+		t.Errorf("File mode: got %v, want 0600", m)
+	}
+
+	// Without replace, an existing file is kept.
+	if err := writeOutputFile(path, []byte("second"), false); err == nil {
+		t.Error("writeOutputFile: got nil, want error for existing file")
+	}
+	checkFile("first")
+
+	// With replace, it is overwritten.
+	if err := writeOutputFile(path, []byte("third"), true); err != nil {
+		t.Fatalf("writeOutputFile: unexpected error: %v", err)
+	}
+	checkFile("third")
+
+	// No temporary files are left behind.
+	if des, err := os.ReadDir(dir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	} else if len(des) != 1 {
+		t.Errorf("Directory has %d entries, want 1", len(des))
+	}
+}
+
+func TestEmptyReason(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	id := d.Superuser
+	expires := time.Now().Add(time.Hour)
+
+	d.MustPut(id, "done", "v1")
+	d.MustActivate(id, "done", d.MustPut(id, "done", "v2"))
+	d.MustPut(id, "pending", "v1")
+	d.MustPut(id, "pending", "v2") // not activated
+	if _, err := d.Actual.PutWithOptions(id, "expiring", []byte("v1"), db.PutOptions{ExpiresAt: expires}); err != nil {
+		t.Fatalf("Put expiring: %v", err)
+	}
+
+	c := newTestClient(t, d)
+	infos, err := c.List(t.Context())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	check := func(now time.Time, want map[string]string) {
+		t.Helper()
+		got := make(map[string]string)
+		for _, info := range infos {
+			if r := emptyReason(info, now); r != "" {
+				got[info.Name] = r
+			}
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("Empty secrets at %v (-got, +want):\n%s", now, diff)
+		}
+	}
+	check(time.Now(), map[string]string{"pending": "pending"})
+	check(expires, map[string]string{"pending": "pending", "expiring": "expired"})
+}
+
+func TestPutContentType(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "exists", "value")
+	c := newTestClient(t, d)
+	defer func(activate, ifAbsent bool) {
+		putArgs.Activate, putArgs.IfAbsent = activate, ifAbsent
+	}(putArgs.Activate, putArgs.IfAbsent)
+
+	tests := []struct {
+		name               string
+		activate, ifAbsent bool
+		value              string
+		binary             bool
+		want               string
+	}{
+		// A put that creates the secret detects the type.
+		{"new", false, false, "text", false, api.ContentTypeText},
+		{"new", false, false, "\xff\xfe", false, api.ContentTypeBinary},
+		{"new", false, false, "text", true, api.ContentTypeBinary},
+		{"new", false, true, "text", false, api.ContentTypeText},
+
+		// A put of an inactive version of an existing secret does not.
+		{"exists", false, false, "text", false, ""},
+
+		// A put that activates the new version does.
+		{"exists", true, false, "\xff\xfe", false, api.ContentTypeBinary},
+	}
+	for _, tc := range tests {
+		putArgs.Activate, putArgs.IfAbsent = tc.activate, tc.ifAbsent
+		got := putContentType(t.Context(), c, tc.name, []byte(tc.value), tc.binary)
+		if got != tc.want {
+			t.Errorf("putContentType(%q, %q, activate=%v, if-absent=%v, binary=%v): got %q, want %q",
+				tc.name, tc.value, tc.activate, tc.ifAbsent, tc.binary, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// startupConfig is the effective configuration of the server, as logged when
+// it starts. It must not include secret material: the keyset itself is never
+// recorded, only where it came from.
+type startupConfig struct {
+	StateDir    string
+	Hostname    string
+	FQDN        string
+	LoginServer string `json:",omitempty"`
+
+	KeySource  string // "kms", "keyset-file", "keyset-env" or "stdin"
+	KMS        string `json:",omitempty"` // provider and key name
+	VaultAddr  string `json:",omitempty"`
+	KeysetFile string `json:",omitempty"`
+	KeysetEnv  string `json:",omitempty"` // name of the variable, not its value
+
+	AuditLog         string   // path, or "-" for stdout
+	AuditLogMaxBytes int64    `json:",omitempty"`
+	AuditLogMaxFiles int      `json:",omitempty"`
+	Backups          []string `json:",omitempty"`
+
+	ReadOnly            bool
+	WriteTags           []string `json:",omitempty"`
+	MaxSecretBytes      int      `json:",omitempty"`
+	RateLimit           float64  `json:",omitempty"`
+	RateBurst           int      `json:",omitempty"`
+	CompressDB          bool
+	SizeMetrics         bool
+	NoAuditFingerprints bool
+	DeleteRetention     string `json:",omitempty"`
+	ProtectAliasTargets bool
+	DedupePuts          bool
+	MaxVersions         int      `json:",omitempty"`
+	AccessMetrics       []string `json:",omitempty"`
+
+	HTTPPort        int
+	HTTPSPort       int
+	HealthAddr      string `json:",omitempty"`
+	MetricsAddr     string `json:",omitempty"`
+	ShutdownTimeout string
+}
+
+// logStartupConfig logs the effective configuration of the server as a single
+// JSON record. The fqdn is the domain name the server serves under, and
+// auditPath is the path of the audit log file, or "" if entries are written to
+// stdout.
+func logStartupConfig(fqdn, auditPath string) {
+	cfg := startupConfig{
+		StateDir:    serverArgs.StateDir,
+		Hostname:    serverArgs.Hostname,
+		FQDN:        fqdn,
+		LoginServer: redactURL(serverArgs.LoginServer),
+
+		AuditLog:         cmp.Or(auditPath, "-"),
+		AuditLogMaxBytes: serverArgs.AuditLogMaxBytes,
+		AuditLogMaxFiles: serverArgs.AuditLogMaxFiles,
+
+		ReadOnly:            serverArgs.ReadOnly,
+		WriteTags:           splitList(serverArgs.WriteTags),
+		MaxSecretBytes:      serverArgs.MaxSecretBytes,
+		RateLimit:           serverArgs.RateLimit,
+		RateBurst:           serverArgs.RateBurst,
+		CompressDB:          serverArgs.CompressDB,
+		SizeMetrics:         serverArgs.SizeMetrics,
+		NoAuditFingerprints: serverArgs.NoAuditFPs,
+		ProtectAliasTargets: serverArgs.ProtectAliases,
+		MaxVersions:         serverArgs.MaxVersions,
+		DedupePuts:          serverArgs.DedupePuts,
+		AccessMetrics:       splitList(serverArgs.AccessMetrics),
+
+		HTTPPort:        cmp.Or(serverArgs.HTTPPort, 80),
+		HTTPSPort:       cmp.Or(serverArgs.HTTPSPort, 443),
+		HealthAddr:      serverArgs.HealthAddr,
+		MetricsAddr:     serverArgs.MetricsAddr,
+		ShutdownTimeout: cmp.Or(serverArgs.ShutdownTimeout, 5*time.Second).String(),
+	}
+	switch {
+	case serverArgs.KMSProvider != "":
+		cfg.KeySource = "kms"
+		cfg.KMS = serverArgs.KMSProvider + ":" + serverArgs.KMSKeyName
+		if serverArgs.KMSProvider == "vault" {
+			cfg.VaultAddr = redactURL(cmp.Or(serverArgs.VaultAddr, os.Getenv("VAULT_ADDR")))
+		}
+	case serverArgs.KMSKeysetFile != "":
+		cfg.KeySource = "keyset-file"
+		cfg.KeysetFile = serverArgs.KMSKeysetFile
+	case serverArgs.KMSKeysetEnv != "":
+		cfg.KeySource = "keyset-env"
+		cfg.KeysetEnv = serverArgs.KMSKeysetEnv
+	default:
+		cfg.KeySource = "stdin"
+	}
+	if b := serverArgs.BackupBucket; b != "" {
+		target := "s3://" + b
+		if serverArgs.BackupBucketRegion != "" {
+			target += " region=" + serverArgs.BackupBucketRegion
+		}
+		if serverArgs.BackupRole != "" {
+			target += " role=" + serverArgs.BackupRole
+		}
+		if serverArgs.BackupCredentials != "" {
+			target += " credentials=" + serverArgs.BackupCredentials
+		}
+		if serverArgs.BackupProfile != "" {
+			target += " profile=" + serverArgs.BackupProfile
+		}
+		if serverArgs.BackupTokenFile != "" {
+			target += " token-file=" + serverArgs.BackupTokenFile
+		}
+		cfg.Backups = append(cfg.Backups, target)
+	}
+	if serverArgs.BackupDir != "" {
+		target := "dir:" + serverArgs.BackupDir
+		if serverArgs.BackupDirRetain > 0 {
+			target += " retain=" + strconv.Itoa(serverArgs.BackupDirRetain)
+		}
+		cfg.Backups = append(cfg.Backups, target)
+	}
+	if serverArgs.BackupGCSBucket != "" {
+		cfg.Backups = append(cfg.Backups, "gs://"+serverArgs.BackupGCSBucket)
+	}
+	if serverArgs.DeleteRetention > 0 {
+		cfg.DeleteRetention = serverArgs.DeleteRetention.String()
+	}
+
+	bs, err := json.Marshal(cfg)
+	if err != nil {
+		log.Printf("Encoding startup configuration: %v", err)
+		return
+	}
+	log.Printf("Starting with configuration: %s", bs)
+}
+
+// redactURL returns s with any password in it replaced, if s is a URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,220 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultAEAD is a tink.AEAD that encrypts and decrypts with a key in the
+// transit secrets engine of a HashiCorp Vault server. It does not support
+// associated data, so it is meant to be used as the remote key of an envelope
+// AEAD, which does not need it.
+type vaultAEAD struct {
+	addr  string // base URL of the Vault server
+	mount string // mount path of the transit engine
+	key   string // name of the transit key
+	ns    string // Vault namespace, or ""
+
+	// Exactly one of these is set: a fixed token, or AppRole credentials
+	// to log in with.
+	token            string
+	roleID, secretID string
+
+	mu         sync.Mutex
+	loginToken string // token from the last AppRole login, or ""
+}
+
+// newVaultAEAD returns an AEAD for the named transit key on the Vault server
+// at addr. The keyName has the form "<key>" for a key in the transit engine
+// mounted at "transit", or "<mount>/<key>" for another mount path.
+//
+// Credentials are read from the environment: VAULT_TOKEN for a token, or
+// VAULT_ROLE_ID and VAULT_SECRET_ID to log in with AppRole. VAULT_NAMESPACE,
+// if set, is the Vault Enterprise namespace of the key.
+func newVaultAEAD(addr, keyName string) (*vaultAEAD, error) {
+	if addr == "" {
+		return nil, errors.New("--vault-addr must be specified with --kms-provider=vault")
+	}
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Vault address %q, want an http or https URL", addr)
+	}
+	mount, key := "transit", keyName
+	if i := strings.LastIndex(keyName, "/"); i >= 0 {
+		mount, key = keyName[:i], keyName[i+1:]
+	}
+	if mount == "" || key == "" {
+		return nil, fmt.Errorf("invalid Vault transit key name %q, want <key> or <mount>/<key>", keyName)
+	}
+	v := &vaultAEAD{
+		addr:  strings.TrimSuffix(addr, "/"),
+		mount: strings.Trim(mount, "/"),
+		key:   key,
+		ns:    os.Getenv("VAULT_NAMESPACE"),
+	}
+	if tok := os.Getenv("VAULT_TOKEN"); tok != "" {
+		v.token = tok
+	} else if rid, sid := os.Getenv("VAULT_ROLE_ID"), os.Getenv("VAULT_SECRET_ID"); rid != "" && sid != "" {
+		v.roleID, v.secretID = rid, sid
+	} else {
+		return nil, errors.New("no Vault credentials: set VAULT_TOKEN, or VAULT_ROLE_ID and VAULT_SECRET_ID")
+	}
+	return v, nil
+}
+
+// Encrypt encrypts plaintext with the transit key, and returns the Vault
+// ciphertext ("vault:v1:...").
+func (v *vaultAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) != 0 {
+		return nil, errors.New("vault: associated data is not supported")
+	}
+	var rsp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := v.call("encrypt", map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	}, &rsp); err != nil {
+		return nil, err
+	}
+	return []byte(rsp.Ciphertext), nil
+}
+
+// Decrypt decrypts ciphertext, as returned by Encrypt, with the transit key.
+func (v *vaultAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) != 0 {
+		return nil, errors.New("vault: associated data is not supported")
+	}
+	var rsp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.call("decrypt", map[string]string{
+		"ciphertext": string(ciphertext),
+	}, &rsp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(rsp.Plaintext)
+}
+
+// call invokes the named operation of the transit engine on the key with the
+// given request body, and decodes the data of the response into rsp. With
+// AppRole credentials, it logs in first if necessary, and once more if the
+// token is rejected, in case it expired.
+func (v *vaultAEAD) call(op string, req, rsp any) error {
+	path := fmt.Sprintf("/v1/%s/%s/%s", v.mount, op, url.PathEscape(v.key))
+	tok, err := v.authToken(false)
+	if err != nil {
+		return err
+	}
+	err = v.post(path, tok, req, rsp)
+	if v.token == "" && errors.Is(err, errVaultForbidden) {
+		if tok, err = v.authToken(true); err != nil {
+			return err
+		}
+		err = v.post(path, tok, req, rsp)
+	}
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", op, err)
+	}
+	return nil
+}
+
+// authToken returns the token to authenticate requests with. With AppRole
+// credentials, it logs in if there is no token yet or if renew is true.
+func (v *vaultAEAD) authToken(renew bool) (string, error) {
+	if v.token != "" {
+		return v.token, nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.loginToken == "" || renew {
+		var rsp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if err := v.post("/v1/auth/approle/login", "", map[string]string{
+			"role_id":   v.roleID,
+			"secret_id": v.secretID,
+		}, &rsp); err != nil {
+			return "", fmt.Errorf("vault AppRole login: %w", err)
+		} else if rsp.Auth.ClientToken == "" {
+			return "", errors.New("vault AppRole login: no token in response")
+		}
+		v.loginToken = rsp.Auth.ClientToken
+	}
+	return v.loginToken, nil
+}
+
+// errVaultForbidden is reported by post when Vault rejects the token.
+var errVaultForbidden = errors.New("permission denied")
+
+// post sends a JSON request to the Vault API at path, authenticated with tok
+// if it is non-empty. For a successful response, it decodes into rsp the data
+// field of the response, or the whole response for the AppRole login.
+func (v *vaultAEAD) post(path, tok string, req, rsp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// The AEAD is used long after it is created, by operations that carry no
+	// context of their own, so each request is bounded by its own timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, "POST", v.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if tok != "" {
+		hreq.Header.Set("X-Vault-Token", tok)
+	}
+	if v.ns != "" {
+		hreq.Header.Set("X-Vault-Namespace", v.ns)
+	}
+	hrsp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hrsp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(hrsp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if hrsp.StatusCode != http.StatusOK {
+		var msg struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(data, &msg)
+		detail := strings.Join(msg.Errors, "; ")
+		if hrsp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: %s", errVaultForbidden, detail)
+		}
+		return fmt.Errorf("%s: %s", hrsp.Status, detail)
+	}
+	if path == "/v1/auth/approle/login" {
+		return json.Unmarshal(data, rsp)
+	}
+	var wrapper struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	} else if len(wrapper.Data) == 0 {
+		return errors.New("no data in response")
+	}
+	return json.Unmarshal(wrapper.Data, rsp)
+}
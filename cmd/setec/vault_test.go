@@ -0,0 +1,274 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tink-crypto/tink-go/v2/aead"
+)
+
+// fakeVault is a minimal fake of the Vault transit secrets engine and AppRole
+// login. Its "ciphertext" is the base64 plaintext, prefixed with the key name.
+type fakeVault struct {
+	mount string // mount path of the transit engine
+	key   string // name of the transit key
+
+	mu       sync.Mutex
+	tokens   map[string]bool // valid tokens
+	ns       string          // the namespace of the last request
+	logins   int             // number of AppRole logins
+	failWith int             // if nonzero, the status of every transit request
+}
+
+func newFakeVault(t *testing.T, mount, key string, tokens ...string) (*fakeVault, string) {
+	f := &fakeVault{mount: mount, key: key, tokens: make(map[string]bool)}
+	for _, tok := range tokens {
+		f.tokens[tok] = true
+	}
+	hs := httptest.NewServer(f)
+	t.Cleanup(hs.Close)
+	return f, hs.URL
+}
+
+// state reports the namespace of the last request and the number of logins.
+func (f *fakeVault) state() (ns string, logins int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ns, f.logins
+}
+
+// expireTokens makes all tokens issued so far invalid.
+func (f *fakeVault) expireTokens() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.tokens)
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ns = r.Header.Get("X-Vault-Namespace")
+
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.fail(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if r.URL.Path == "/v1/auth/approle/login" {
+		if req["role_id"] != "role" || req["secret_id"] != "secret" {
+			f.fail(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		f.logins++
+		tok := fmt.Sprintf("login-%d", f.logins)
+		f.tokens[tok] = true
+		json.NewEncoder(w).Encode(map[string]any{
+			"auth": map[string]string{"client_token": tok},
+		})
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		f.fail(w, http.StatusForbidden, "permission denied")
+		return
+	} else if f.failWith != 0 {
+		f.fail(w, f.failWith, "internal error")
+		return
+	}
+
+	prefix := "vault:v1:" + f.key + ":"
+	var data map[string]string
+	switch r.URL.Path {
+	case "/v1/" + f.mount + "/encrypt/" + f.key:
+		if _, err := base64.StdEncoding.DecodeString(req["plaintext"]); err != nil {
+			f.fail(w, http.StatusBadRequest, "invalid plaintext")
+			return
+		}
+		data = map[string]string{"ciphertext": prefix + req["plaintext"]}
+	case "/v1/" + f.mount + "/decrypt/" + f.key:
+		pt, ok := strings.CutPrefix(req["ciphertext"], prefix)
+		if !ok {
+			f.fail(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		data = map[string]string{"plaintext": pt}
+	default:
+		f.fail(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func (f *fakeVault) fail(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"errors": []string{msg}})
+}
+
+func TestVaultAEAD(t *testing.T) {
+	t.Run("token", func(t *testing.T) {
+		f, addr := newFakeVault(t, "transit", "db-key", "tok")
+		t.Setenv("VAULT_TOKEN", "tok")
+		t.Setenv("VAULT_NAMESPACE", "team")
+
+		v, err := newVaultAEAD(addr+"/", "db-key")
+		if err != nil {
+			t.Fatalf("newVaultAEAD: %v", err)
+		}
+		ct, err := v.Encrypt([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		} else if !bytes.HasPrefix(ct, []byte("vault:v1:")) {
+			t.Errorf("Encrypt: got %q, want a Vault ciphertext", ct)
+		}
+		pt, err := v.Decrypt(ct, nil)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		} else if string(pt) != "hello" {
+			t.Errorf("Decrypt: got %q, want %q", pt, "hello")
+		}
+		if ns, _ := f.state(); ns != "team" {
+			t.Errorf("Namespace: got %q, want %q", ns, "team")
+		}
+	})
+
+	t.Run("envelope", func(t *testing.T) {
+		_, addr := newFakeVault(t, "keys/prod", "db-key", "tok")
+		t.Setenv("VAULT_TOKEN", "tok")
+
+		v, err := newVaultAEAD(addr, "keys/prod/db-key")
+		if err != nil {
+			t.Fatalf("newVaultAEAD: %v", err)
+		}
+		// The database is encrypted with an envelope AEAD whose remote key is
+		// in Vault; the associated data is handled by the envelope.
+		env := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), v)
+		ad := []byte("associated")
+		ct, err := env.Encrypt([]byte("database"), ad)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		pt, err := env.Decrypt(ct, ad)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		} else if string(pt) != "database" {
+			t.Errorf("Decrypt: got %q, want %q", pt, "database")
+		}
+		if _, err := env.Decrypt(ct, []byte("other")); err == nil {
+			t.Error("Decrypt with other associated data: got nil, want error")
+		}
+	})
+
+	t.Run("approle", func(t *testing.T) {
+		f, addr := newFakeVault(t, "transit", "db-key")
+		t.Setenv("VAULT_TOKEN", "")
+		t.Setenv("VAULT_ROLE_ID", "role")
+		t.Setenv("VAULT_SECRET_ID", "secret")
+
+		v, err := newVaultAEAD(addr, "db-key")
+		if err != nil {
+			t.Fatalf("newVaultAEAD: %v", err)
+		}
+		ct, err := v.Encrypt([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if _, err := v.Encrypt([]byte("again"), nil); err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if _, n := f.state(); n != 1 {
+			t.Errorf("After login: got %d logins, want 1", n)
+		}
+
+		// When the login token expires, the AEAD logs in again.
+		f.expireTokens()
+		pt, err := v.Decrypt(ct, nil)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		} else if string(pt) != "hello" {
+			t.Errorf("Decrypt: got %q, want %q", pt, "hello")
+		}
+		if _, n := f.state(); n != 2 {
+			t.Errorf("After expiry: got %d logins, want 2", n)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		f, addr := newFakeVault(t, "transit", "db-key", "tok")
+		t.Setenv("VAULT_TOKEN", "tok")
+
+		v, err := newVaultAEAD(addr, "db-key")
+		if err != nil {
+			t.Fatalf("newVaultAEAD: %v", err)
+		}
+		check := func(name string, err error, want string) {
+			t.Helper()
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: got error %v, want %q", name, err, want)
+			}
+		}
+
+		_, err = v.Encrypt([]byte("x"), []byte("ad"))
+		check("Encrypt with associated data", err, "associated data is not supported")
+		_, err = v.Decrypt([]byte("vault:v1:x"), []byte("ad"))
+		check("Decrypt with associated data", err, "associated data is not supported")
+		_, err = v.Decrypt([]byte("bogus"), nil)
+		check("Decrypt invalid", err, "invalid ciphertext")
+
+		f.mu.Lock()
+		f.failWith = http.StatusInternalServerError
+		f.mu.Unlock()
+		_, err = v.Encrypt([]byte("x"), nil)
+		check("Encrypt server error", err, "internal error")
+
+		// A rejected fixed token is reported, not retried.
+		f.expireTokens()
+		_, err = v.Encrypt([]byte("x"), nil)
+		check("Encrypt forbidden", err, "permission denied")
+
+		// A failed AppRole login is reported.
+		t.Setenv("VAULT_TOKEN", "")
+		t.Setenv("VAULT_ROLE_ID", "role")
+		t.Setenv("VAULT_SECRET_ID", "wrong")
+		lv, err := newVaultAEAD(addr, "db-key")
+		if err != nil {
+			t.Fatalf("newVaultAEAD: %v", err)
+		}
+		_, err = lv.Encrypt([]byte("x"), nil)
+		check("Encrypt bad login", err, "vault AppRole login")
+	})
+
+	t.Run("config", func(t *testing.T) {
+		t.Setenv("VAULT_TOKEN", "tok")
+		for _, tc := range []struct {
+			addr, key, want string
+		}{
+			{"", "k", "--vault-addr must be specified"},
+			{"vault:8200", "k", "invalid Vault address"},
+			{"ftp://vault", "k", "invalid Vault address"},
+			{"http://vault", "", "invalid Vault transit key name"},
+			{"http://vault", "mount/", "invalid Vault transit key name"},
+			{"http://vault", "/k", "invalid Vault transit key name"},
+		} {
+			_, err := newVaultAEAD(tc.addr, tc.key)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("newVaultAEAD(%q, %q): got error %v, want %q", tc.addr, tc.key, err, tc.want)
+			}
+		}
+
+		t.Setenv("VAULT_TOKEN", "")
+		t.Setenv("VAULT_ROLE_ID", "role")
+		t.Setenv("VAULT_SECRET_ID", "")
+		if _, err := newVaultAEAD("http://vault", "k"); err == nil || !strings.Contains(err.Error(), "no Vault credentials") {
+			t.Errorf("newVaultAEAD without credentials: got error %v, want no credentials", err)
+		}
+	})
+}
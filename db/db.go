@@ -17,11 +17,14 @@
 package db
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"slices"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
 
 	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
@@ -32,9 +35,14 @@ import (
 
 // DB is an encrypted secrets database.
 type DB struct {
-	mu       sync.Mutex
-	kv       *kv
-	auditLog *audit.Writer
+	mu             sync.Mutex
+	kv             *kv
+	auditLog       *audit.Writer
+	noFingerprints bool          // omit value fingerprints from audit entries
+	retention      time.Duration // how long deleted secrets can be restored
+	protectAliases bool          // refuse to delete or rename alias targets
+	values         valueCache    // recently read values
+	onActivate     func(string)  // see OnActivate
 }
 
 // We might store some of setec's configuration in the secrets
@@ -50,6 +58,11 @@ var (
 	// ErrNotFound is the error returned by DB methods when the
 	// database lacks a necessary secret or secret version.
 	ErrNotFound = errors.New("not found")
+	// ErrSecretNotFound and ErrVersionNotFound are reported by DB methods
+	// when the named secret, or the requested version of it, does not
+	// exist. Both wrap ErrNotFound.
+	ErrSecretNotFound  = fmt.Errorf("secret %w", ErrNotFound)
+	ErrVersionNotFound = fmt.Errorf("version %w", ErrNotFound)
 	// ErrVersionClaimed indicates that an attempt was made to create a
 	// version of a secret that has at some point already been set,
 	// even if it has since been deleted.
@@ -57,26 +70,166 @@ var (
 	// ErrInvalidVersion indicates that an attempt was made to create a
 	// version of a secret using an invalid version number (<=0).
 	ErrInvalidVersion = errors.New("invalid version")
+	// ErrExpired is the error returned by DB methods when the requested
+	// secret version exists but has passed its expiration time.
+	ErrExpired = errors.New("secret version has expired")
+	// ErrInvalidName indicates that an attempt was made to create a
+	// secret whose name is not valid according to api.CheckSecretName.
+	ErrInvalidName = api.ErrInvalidName
+	// ErrInvalidLabel indicates that an attempt was made to set a label that
+	// is not valid according to api.CheckLabel.
+	ErrInvalidLabel = api.ErrInvalidLabel
+	// ErrInvalidDescription indicates that an attempt was made to set a
+	// description that is not valid according to api.CheckDescription.
+	ErrInvalidDescription = api.ErrInvalidDescription
+	// ErrAlreadyExists indicates that an attempt was made to rename a
+	// secret to a name that is already in use.
+	ErrAlreadyExists = errors.New("secret already exists")
+	// ErrWrongKey indicates that an existing database could not be opened
+	// because its data encryption key did not authenticate with the key
+	// provided, typically because the database was created with another
+	// key. A key that cannot be used, such as a remote KMS key that is
+	// unreachable or denies access, is reported with its own error instead.
+	// A key other than an AEAD made from a Tink keyset reports a failed
+	// authentication by wrapping ErrWrongKey in the error from Decrypt.
+	ErrWrongKey = errors.New("database key does not match the database")
 )
 
 // Open loads the secrets database at path, decrypting it using key.
 // If no database exists at path, a new empty database is created.
 func Open(path string, key tink.AEAD, auditLog *audit.Writer) (*DB, error) {
+	return OpenWithOptions(path, key, auditLog, OpenOptions{})
+}
+
+// OpenOptions are optional settings for opening a database. A zero value is
+// ready for use and provides default behavior.
+type OpenOptions struct {
+	// Compress, if true, compresses the database contents before they are
+	// encrypted and written to disk. Compressed and uncompressed databases
+	// can both be opened regardless of this setting; if the database on disk
+	// does not match, it is rewritten when opened.
+	Compress bool
+
+	// NoAuditFingerprints, if true, omits value fingerprints from audit log
+	// entries. By default, entries for put, create-version and activate
+	// record a truncated SHA-256 fingerprint of the secret value involved,
+	// as computed by audit.Fingerprint. Secret values themselves are never
+	// written to the audit log.
+	NoAuditFingerprints bool
+
+	// DeleteRetention, if positive, enables soft deletion: Delete keeps a
+	// deleted secret for this long, during which it is hidden from other
+	// operations but can be restored by Undelete. After that, it is removed
+	// permanently by PurgeDeleted. If zero or negative, Delete removes
+	// secrets immediately.
+	DeleteRetention time.Duration
+
+	// ProtectAliasTargets, if true, makes Delete and Rename report an error
+	// wrapping api.ErrAliasTarget for a secret that is the target of an
+	// alias. Otherwise, they succeed, and the aliases are left broken until
+	// the target is recreated or they are removed. See Alias.
+	ProtectAliasTargets bool
+
+	// MaxVersions, if positive, is the number of versions kept for each
+	// secret, unless a secret sets its own limit with PutOptions. When a put
+	// leaves a secret with more versions than this, its oldest versions are
+	// pruned, as if by DeleteVersion, until it is within the limit. The
+	// active version and the newest version are never pruned. If zero or
+	// negative, the number of versions is not limited.
+	MaxVersions int
+
+	// DedupeActive, if true, makes a put whose value and options match the
+	// active version of the secret return that version instead of adding a
+	// new one, unless PutOptions.AllowDuplicate is set. Any label or format
+	// changes in the put are still applied. A put that matches the newest
+	// version is always handled this way, whether or not it is active.
+	DedupeActive bool
+}
+
+// OpenWithOptions is as Open, but applies the specified options.
+func OpenWithOptions(path string, key tink.AEAD, auditLog *audit.Writer, opts OpenOptions) (*DB, error) {
 	if auditLog == nil {
 		return nil, errors.New("must provide an audit.Writer to db.Open")
 	}
 
-	kv, err := openOrCreateKV(path, key)
+	kv, err := openOrCreateKV(path, key, opts.Compress)
 	if err != nil {
 		return nil, err
 	}
+	return newDB(kv, auditLog, opts), nil
+}
 
-	ret := &DB{
-		kv:       kv,
-		auditLog: auditLog,
+// OpenInMemory constructs a new empty database that is kept only in memory,
+// using key to encrypt it as Open would. Changes are never written to disk,
+// and are lost when the database is discarded; Path reports "". It is meant
+// for tests, and for other programs that need a short-lived database.
+func OpenInMemory(key tink.AEAD, auditLog *audit.Writer, opts OpenOptions) (*DB, error) {
+	if auditLog == nil {
+		return nil, errors.New("must provide an audit.Writer to db.OpenInMemory")
 	}
+	kv, err := newKV("", key, opts.Compress)
+	if err != nil {
+		return nil, err
+	}
+	return newDB(kv, auditLog, opts), nil
+}
 
-	return ret, nil
+// newDB constructs a DB backed by kv with the specified options.
+func newDB(kv *kv, auditLog *audit.Writer, opts OpenOptions) *DB {
+	kv.maxVersions = opts.MaxVersions
+	kv.dedupeActive = opts.DedupeActive
+	return &DB{
+		kv:             kv,
+		auditLog:       auditLog,
+		noFingerprints: opts.NoAuditFingerprints,
+		retention:      opts.DeleteRetention,
+		protectAliases: opts.ProtectAliasTargets,
+	}
+}
+
+// Summary describes the contents of a database, as reported by Inspect.
+type Summary struct {
+	Secrets  int // the number of secrets
+	Versions int // the total number of secret versions
+
+	// LastChange is the time of the most recent change recorded in the
+	// contents: the latest time a version was created or activated, or a
+	// secret was deleted. It is zero if no times are recorded. Since not
+	// every change records a time, the contents may be somewhat newer.
+	LastChange time.Time
+}
+
+// Inspect decrypts data, the contents of a database file such as a backup,
+// using key, and checks that its contents are structurally valid. On success,
+// it returns a summary of the contents. Inspect does not modify any files.
+func Inspect(data []byte, key tink.AEAD) (*Summary, error) {
+	kv, err := decodeKV("", data, key)
+	if err != nil {
+		return nil, err
+	} else if err := kv.validate(); err != nil {
+		return nil, fmt.Errorf("invalid database: %w", err)
+	}
+	sum := &Summary{Secrets: kv.numSecrets, Versions: kv.numVersions}
+	latest := func(t time.Time) {
+		if t.After(sum.LastChange) {
+			sum.LastChange = t
+		}
+	}
+	for name, s := range kv.secrets {
+		if strings.HasPrefix(name, configPrefix) {
+			continue
+		}
+		for _, vi := range s.VersionInfo {
+			if vi != nil {
+				latest(vi.CreatedAt)
+				latest(vi.ActivatedAt)
+			}
+		}
+	}
+	for _, ts := range kv.deleted {
+		latest(ts.DeletedAt)
+	}
+	return sum, nil
 }
 
 // Caller encapsulates a caller identity. It is required by all database
@@ -88,6 +241,15 @@ type Caller struct {
 	Principal audit.Principal
 	// Permissions are the permissions the caller has.
 	Permissions acl.Rules
+	// Authorize, if non-nil, is called to check each action that
+	// Permissions allow, and may deny it by reporting an error. The error
+	// is recorded in the audit log entry for the action. For List, it is
+	// called once with acl.ActionInfo and an empty secret name. It is not
+	// called with the database locked, so it may be slow.
+	Authorize func(action acl.Action, secret string) error
+	// RequestID, if non-empty, is the ID of the API request on behalf of
+	// which the caller is acting. It is recorded in audit log entries.
+	RequestID string
 }
 
 // checkAndLog verifies that caller can perform action on secret, and
@@ -95,31 +257,222 @@ type Caller struct {
 // The caller must not perform the requested operation if an error is
 // returned.
 func (db *DB) checkAndLog(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion) error {
+	e := db.check(caller, action, secret)
+	e.SecretVersion = secretVersion
+	return db.logAccess(caller, e)
+}
+
+// checkAndLogValue is as checkAndLog, but also records a fingerprint of
+// value, the secret value the action will store, in the audit log entry.
+func (db *DB) checkAndLogValue(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion, value []byte) error {
+	e := db.check(caller, action, secret)
+	e.SecretVersion = secretVersion
+	e.Fingerprint = db.fingerprint(value)
+	return db.logAccess(caller, e)
+}
+
+// checkAndLogVersion is as checkAndLog, but if the action is authorized, it
+// also records a fingerprint of the stored value of secretVersion in the
+// audit log entry.
+func (db *DB) checkAndLogVersion(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion) error {
+	e := db.check(caller, action, secret)
+	e.SecretVersion = secretVersion
+	if e.Authorized {
+		db.mu.Lock()
+		if s := db.kv.secrets[secret]; s != nil {
+			if bs, ok := s.Versions[secretVersion]; ok {
+				e.Fingerprint = db.fingerprint([]byte(bs))
+			}
+		}
+		db.mu.Unlock()
+	}
+	return db.logAccess(caller, e)
+}
+
+// check reports whether caller may perform action on secret, as an audit log
+// entry for the action. The caller's Authorize hook, if any, is consulted
+// only if its permissions allow the action.
+func (db *DB) check(caller Caller, action acl.Action, secret string) *audit.Entry {
+	db.mu.Lock()
+	authorized := db.allowLocked(caller, action, secret)
+	db.mu.Unlock()
+	e := &audit.Entry{Action: action, Secret: secret, Authorized: authorized}
+	if authorized {
+		db.authorize(caller, e)
+	}
+	return e
+}
+
+// CheckAccess reports whether caller may perform action on the secret called
+// name, applying the same checks as the methods that perform it: the
+// caller's permissions, the principals listed for the secret, and the
+// caller's Authorize hook. It reports ErrAccessDenied if the action is not
+// allowed. Unlike those methods, it does not write an audit log entry.
+func (db *DB) CheckAccess(caller Caller, action acl.Action, name string) error {
+	if !db.check(caller, action, name).Authorized {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// CheckAuditQuery checks that caller may query the audit log, and records the
+// query in the audit log. As for List, the query is recorded as a single
+// acl.ActionInfo entry with no secret name, and only the query as a whole is
+// subject to the caller's Authorize hook.
+//
+// On success, it returns a function that reports whether the audit entry e
+// may be reported to caller: that is, whether caller may see the metadata of
+// e.Secret or e.NewSecret, as checked by CheckAccess for acl.ActionInfo. Since
+// a fingerprint can be used to confirm a guess at a value, the function also
+// removes the fingerprint from e unless caller may get e.Secret. The function
+// caches its results, and must not be used concurrently.
+func (db *DB) CheckAuditQuery(caller Caller) (func(e *audit.Entry) bool, error) {
+	e := &audit.Entry{Action: acl.ActionInfo, Authorized: true}
+	db.authorize(caller, e)
+	if err := db.logAccess(caller, e); err != nil {
+		return nil, err
+	}
+	type key struct {
+		action acl.Action
+		name   string
+	}
+	allowed := make(map[key]bool)
+	allow := func(action acl.Action, name string) bool {
+		if name == "" {
+			return false
+		}
+		k := key{action, name}
+		ok, seen := allowed[k]
+		if !seen {
+			ok = db.CheckAccess(caller, action, name) == nil
+			allowed[k] = ok
+		}
+		return ok
+	}
+	return func(e *audit.Entry) bool {
+		if !allow(acl.ActionInfo, e.Secret) && !allow(acl.ActionInfo, e.NewSecret) {
+			return false
+		}
+		if e.Fingerprint != "" && !allow(acl.ActionGet, e.Secret) {
+			e.Fingerprint = ""
+		}
+		return true
+	}, nil
+}
+
+// checkOverride reports whether caller may delete or rename the secret
+// called name, if it is immutable, as allowed by "admin" permission. If so,
+// it returns the audit entry to record once the operation succeeds; see
+// logOverride. Otherwise, including for a secret that is not immutable, it
+// returns nil and records nothing.
+func (db *DB) checkOverride(caller Caller, name string) *audit.Entry {
+	db.mu.Lock()
+	s := db.kv.secrets[name]
+	immutable := s != nil && s.Immutable
+	db.mu.Unlock()
+	if !immutable {
+		return nil
+	}
+	if e := db.check(caller, acl.ActionAdmin, name); e.Authorized {
+		return e
+	}
+	return nil
+}
+
+// logOverride records the override e, from checkOverride, in the audit log
+// if e is not nil and the operation it permitted succeeded, that is, if err
+// is nil. It returns err, or any error writing the log.
+func (db *DB) logOverride(caller Caller, e *audit.Entry, err error) error {
+	if e == nil || err != nil {
+		return err
+	}
+	return db.logAccess(caller, e)
+}
+
+// authorize applies the Authorize hook of caller, if any, to the action
+// described by e. If the hook denies the action, it marks e as not
+// authorized and records the reason.
+func (db *DB) authorize(caller Caller, e *audit.Entry) {
+	if caller.Authorize == nil {
+		return
+	}
+	if err := caller.Authorize(e.Action, e.Secret); err != nil {
+		e.Authorized = false
+		e.Reason = err.Error()
+	}
+}
+
+// fingerprint returns the audit fingerprint of value, or "" if fingerprints
+// are disabled for db.
+func (db *DB) fingerprint(value []byte) string {
+	if db.noFingerprints {
+		return ""
+	}
+	return audit.Fingerprint(value)
+}
+
+// allowLocked reports whether caller may perform action on secret. In
+// addition to the caller's permissions, access to get a secret or its
+// metadata is limited to the principals listed for the secret, if any.
+func (db *DB) allowLocked(caller Caller, action acl.Action, secret string) bool {
+	if !caller.Permissions.Allow(action, secret) {
+		return false
+	}
+	switch action {
+	case acl.ActionGet, acl.ActionInfo:
+		return db.kv.principalAllowed(secret, caller.Principal)
+	}
+	return true
+}
+
+// logAccess writes the audit log entry e for an action by caller. It reports
+// ErrAccessDenied if the action is not authorized.
+func (db *DB) logAccess(caller Caller, e *audit.Entry) error {
 	var errs []error
-	authorized := caller.Permissions.Allow(action, secret)
-	if !authorized {
+	if !e.Authorized {
 		errs = append(errs, ErrAccessDenied)
 	}
-	err := db.auditLog.WriteEntries(&audit.Entry{
-		Principal:     caller.Principal,
-		Action:        action,
-		Secret:        secret,
-		SecretVersion: secretVersion,
-		Authorized:    authorized,
-	})
-	if err != nil {
+	e.Principal = caller.Principal
+	e.RequestID = caller.RequestID
+	if err := db.auditLog.WriteEntries(e); err != nil {
 		errs = append(errs, fmt.Errorf("writing audit log: %w", err))
 	}
 	return multierr.New(errs...)
 }
 
-// Path returns the path to the database file on disk.
+// Path returns the path to the database file on disk, or "" if the database
+// is kept in memory (see OpenInMemory).
 func (db *DB) Path() string {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	return db.kv.filePath()
 }
 
+// Size reports the size in bytes of the database file as of the last time it
+// was loaded or saved, and the size of its contents before compression and
+// encryption.
+func (db *DB) Size() (stored, uncompressed int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.storedSize, db.kv.clearSize
+}
+
+// Count reports the number of secrets in the database and the total number of
+// versions they have, as of the last time it was loaded or saved. Soft-deleted
+// secrets and aliases are not counted.
+func (db *DB) Count() (secrets, versions int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.numSecrets, db.kv.numVersions
+}
+
+// DeleteRetention reports how long deleted secrets are kept so that they can
+// be restored with Undelete, or 0 if they are deleted immediately. See
+// OpenOptions.DeleteRetention.
+func (db *DB) DeleteRetention() time.Duration {
+	return max(db.retention, 0)
+}
+
 // WriteGen returns a process-local "write generation" for the DB. The
 // write generation is a positive value that increments whenever a
 // change is saved to disk, and can be used as a coarse change
@@ -130,12 +483,90 @@ func (db *DB) WriteGen() uint64 {
 	return db.kv.writeGen()
 }
 
+// CheckKey reports whether the database's key-encryption key can still
+// decrypt the database encryption key. It is meant for health checks, and may
+// involve a call to a remote key management service.
+func (db *DB) CheckKey() error {
+	db.mu.Lock()
+	dekRaw, kek := db.kv.dekRaw, db.kv.kekCipher
+	db.mu.Unlock()
+	return checkDEK(dekRaw, kek)
+}
+
+// OnActivate arranges for f to be called with the name of a secret each time
+// the active version of an existing secret changes, whether by Activate,
+// ActivateMany, or a put, CreateVersion or DeleteVersion that activates
+// another version. Creating or deleting a secret is not reported, nor is a
+// request that leaves the active version as it was. The function f is called
+// with the database locked, so it must not call methods of db. Only the f of
+// the latest call is used.
+func (db *DB) OnActivate(f func(name string)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.onActivate = f
+}
+
+// watchActiveLocked records the active versions of the named secrets, and
+// returns a function that reports each of them whose active version has
+// since changed to the OnActivate hook. The caller must hold db.mu when
+// calling both.
+func (db *DB) watchActiveLocked(names ...string) func() {
+	if db.onActivate == nil {
+		return func() {}
+	}
+	old := make([]api.SecretVersion, len(names))
+	for i, name := range names {
+		old[i] = db.kv.activeVersion(name)
+	}
+	return func() {
+		for i, name := range names {
+			if v := db.kv.activeVersion(name); old[i] != 0 && v != 0 && v != old[i] {
+				db.onActivate(name)
+			}
+		}
+	}
+}
+
+// Changed returns a channel that is closed the next time a change to the
+// database is saved, for example when a secret is added or its active
+// version changes. A new channel must be obtained after each change.
+func (db *DB) Changed() <-chan struct{} {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.changedChan()
+}
+
 // List returns secret metadata for all secrets on which at least one
 // member of 'from' has acl.ActionInfo permissions.
 func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.ListWithOptions(caller, ListOptions{})
+}
+
+// ListPrefix is as List, but reports only secrets whose names begin with
+// prefix. An empty prefix matches all secrets.
+func (db *DB) ListPrefix(caller Caller, prefix string) ([]*api.SecretInfo, error) {
+	return db.ListWithOptions(caller, ListOptions{Prefix: prefix})
+}
+
+// ListOptions are optional settings for a List operation. A zero value is
+// ready for use and reports all secrets.
+type ListOptions struct {
+	// Prefix, if non-empty, restricts the results to secrets whose names
+	// begin with this string.
+	Prefix string
+
+	// Selector, if non-empty, restricts the results to secrets having all
+	// the specified labels with the specified values.
+	Selector map[string]string
 
+	// Writable, if true, restricts the results to secrets the caller has
+	// put permission for, and that the caller's Authorize hook, if any,
+	// allows it to put.
+	Writable bool
+}
+
+// ListWithOptions is as List, but reports only secrets matching opts.
+func (db *DB) ListWithOptions(caller Caller, opts ListOptions) ([]*api.SecretInfo, error) {
 	// List is unusual, because we don't check a permission
 	// upfront. Instead, we return the output of Info() for every
 	// secret the caller can access.
@@ -143,26 +574,42 @@ func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
 	// To avoid spamming the audit log, we record a single audit entry
 	// to reflect that List took place, then do per-secret permission
 	// checks to construct the response without generating individual
-	// audit entries there.
-	err := db.auditLog.WriteEntries(&audit.Entry{
-		Principal:  caller.Principal,
-		Action:     acl.ActionInfo,
-		Authorized: true,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("writing audit log: %w", err)
+	// audit entries there. Only the list as a whole is subject to the
+	// caller's Authorize hook.
+	e := &audit.Entry{Action: acl.ActionInfo, Authorized: true}
+	db.authorize(caller, e)
+	if err := db.logAccess(caller, e); err != nil {
+		return nil, err
 	}
 
-	var ret []*api.SecretInfo
-	for _, name := range db.kv.list() {
-		if !caller.Permissions.Allow(acl.ActionInfo, name) {
-			continue
-		}
-		info, err := db.kv.info(name)
-		if err != nil {
-			return nil, err
+	ret, err := func() ([]*api.SecretInfo, error) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+
+		var ret []*api.SecretInfo
+		for _, name := range db.kv.list() {
+			if !strings.HasPrefix(name, opts.Prefix) || !db.kv.hasLabels(name, opts.Selector) ||
+				!db.allowLocked(caller, acl.ActionInfo, name) ||
+				(opts.Writable && !db.allowLocked(caller, acl.ActionPut, name)) {
+				continue
+			}
+			info, err := db.kv.info(name)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, info)
 		}
-		ret = append(ret, info)
+		return ret, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	// The Authorize hook may be slow, so it is not called with the lock held.
+	if opts.Writable && caller.Authorize != nil {
+		ret = slices.DeleteFunc(ret, func(info *api.SecretInfo) bool {
+			return caller.Authorize(acl.ActionPut, info.Name) != nil
+		})
 	}
 	slices.SortFunc(ret, func(a, b *api.SecretInfo) int { return strings.Compare(a.Name, b.Name) })
 	return ret, nil
@@ -176,18 +623,164 @@ func (db *DB) Info(caller Caller, name string) (*api.SecretInfo, error) {
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if target, ok := db.kv.aliases[name]; ok {
+		return &api.SecretInfo{Name: name, AliasOf: target}, nil
+	}
 	return db.kv.info(name)
 }
 
-// Get returns a secret's active value.
+// Get returns a secret's active value. If name is an alias, Get returns the
+// active value of its target, and the caller must have permission to get both
+// the alias and the target.
 func (db *DB) Get(caller Caller, name string) (*api.SecretValue, error) {
-	if err := db.checkAndLog(caller, acl.ActionGet, name, 0); err != nil {
+	target, err := db.checkGetAndLog(caller, name, 0)
+	if err != nil {
 		return nil, err
 	}
+	return db.readValue(name, target, 0)
+}
 
+// readValue returns the specified version, or the active version if version
+// is 0, of the secret called target, which name refers to. Concurrent reads
+// of the same version are coalesced, and values are reused for a short time
+// if the database does not change; see valueCache. The caller must already
+// have checked and logged the access.
+func (db *DB) readValue(name, target string, version api.SecretVersion) (*api.SecretValue, error) {
 	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.kv.get(name)
+	gen := db.kv.writeGen()
+	err := db.brokenAliasLocked(name, target)
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	sv, err := db.values.get(valueKey{target, version}, gen, func() (*api.SecretValue, uint64, time.Time, error) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		var sv *api.SecretValue
+		var err error
+		if version == 0 {
+			sv, err = db.kv.get(target)
+		} else {
+			sv, err = db.kv.getVersion(target, version)
+		}
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		var expires time.Time
+		if vi := db.kv.secrets[target].VersionInfo[sv.Version]; vi != nil {
+			expires = vi.ExpiresAt
+		}
+		return sv, db.kv.writeGen(), expires, nil
+	})
+	if errors.Is(err, ErrSecretNotFound) && name != target {
+		// The target was removed after the alias was checked.
+		return nil, fmt.Errorf("%w: alias %q refers to %q", api.ErrBrokenAlias, name, target)
+	}
+	return sv, err
+}
+
+// checkGetAndLog is as checkAndLog for acl.ActionGet, but if name is an alias,
+// it also checks that caller can get the target of the alias. It returns the
+// name of the secret whose value should be reported.
+func (db *DB) checkGetAndLog(caller Caller, name string, version api.SecretVersion) (string, error) {
+	if err := db.checkAndLog(caller, acl.ActionGet, name, version); err != nil {
+		return "", err
+	}
+	db.mu.Lock()
+	target, ok := db.kv.aliases[name]
+	db.mu.Unlock()
+	if !ok {
+		return name, nil
+	}
+	if err := db.checkAndLog(caller, acl.ActionGet, target, version); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// brokenAliasLocked reports an error wrapping api.ErrBrokenAlias if name is an
+// alias whose target, the secret called target, does not exist.
+func (db *DB) brokenAliasLocked(name, target string) error {
+	if name == target || db.kv.secrets[target] != nil {
+		return nil
+	}
+	return fmt.Errorf("%w: alias %q refers to %q", api.ErrBrokenAlias, name, target)
+}
+
+// checkAliasesLocked reports an error wrapping api.ErrAliasTarget if db
+// protects alias targets, and the secret called name exists and is the
+// target of an alias.
+func (db *DB) checkAliasesLocked(name string) error {
+	if !db.protectAliases || db.kv.secrets[name] == nil {
+		return nil
+	}
+	if aliases := db.kv.aliasesOf(name); len(aliases) != 0 {
+		return fmt.Errorf("%w: %q is the target of %q", api.ErrAliasTarget, name, aliases)
+	}
+	return nil
+}
+
+// GetResolved returns a secret's active value. If the value is a template,
+// its references to other secrets are expanded with their active values,
+// recursively. The caller must have permission to get each secret that is
+// referenced, and each access is audited as a separate get; a secret
+// referenced more than once is fetched and expanded only once. If the
+// references form a cycle, are nested more than api.MaxTemplateDepth deep, or
+// expand to more than api.MaxTemplateSize bytes, GetResolved reports an error
+// wrapping api.ErrTemplate.
+func (db *DB) GetResolved(caller Caller, name string) (*api.SecretValue, error) {
+	sv, err := db.Get(caller, name)
+	if err != nil {
+		return nil, err
+	}
+	value, err := db.resolve(caller, name, sv, []string{name}, make(map[string][]byte))
+	if err != nil {
+		return nil, err
+	}
+	return &api.SecretValue{
+		Value:       value,
+		Version:     sv.Version,
+		CreatedAt:   sv.CreatedAt,
+		Format:      sv.Format,
+		ContentType: sv.ContentType,
+	}, nil
+}
+
+// resolve expands the template references in sv, the active value of the
+// secret called name, if it is a template. The stack holds the names of the
+// templates being expanded, to detect cycles, and done holds the values of
+// the secrets already resolved by the same GetResolved call.
+func (db *DB) resolve(caller Caller, name string, sv *api.SecretValue, stack []string, done map[string][]byte) ([]byte, error) {
+	db.mu.Lock()
+	isTemplate := db.kv.isTemplate(name, sv.Version)
+	db.mu.Unlock()
+	if !isTemplate {
+		return sv.Value, nil
+	} else if len(stack) > api.MaxTemplateDepth {
+		return nil, fmt.Errorf("%w: references nested more than %d deep", api.ErrTemplate, api.MaxTemplateDepth)
+	}
+	size := len(sv.Value)
+	return api.ExpandTemplate(sv.Value, func(ref string) ([]byte, error) {
+		if slices.Contains(stack, ref) {
+			return nil, fmt.Errorf("%w: %q refers to itself", api.ErrTemplate, ref)
+		}
+		value, ok := done[ref]
+		if !ok {
+			rv, err := db.Get(caller, ref)
+			if err != nil {
+				return nil, fmt.Errorf("resolving %q: %w", ref, err)
+			}
+			value, err = db.resolve(caller, ref, rv, append(slices.Clip(stack), ref), done)
+			if err != nil {
+				return nil, err
+			}
+			done[ref] = value
+		}
+		if size += len(value); size > api.MaxTemplateSize {
+			return nil, fmt.Errorf("%w: %q expands to more than %d bytes", api.ErrTemplate, name, api.MaxTemplateSize)
+		}
+		return value, nil
+	})
 }
 
 // GetConditional returns a secret's active value if it is different from oldVersion.
@@ -196,12 +789,30 @@ func (db *DB) GetConditional(caller Caller, name string, oldVersion api.SecretVe
 	// This case is special in that we only log an access if the condition
 	// succeeds and we report a fresh value to the caller. However, we still
 	// want a log if authorization fails.
-	if !caller.Permissions.Allow(acl.ActionGet, name) {
-		return nil, db.checkAndLog(caller, acl.ActionGet, name, 0)
+	e := db.check(caller, acl.ActionGet, name)
+	if !e.Authorized {
+		return nil, db.logAccess(caller, e)
+	}
+	entries := []*audit.Entry{e}
+	db.mu.Lock()
+	target, ok := db.kv.aliases[name]
+	db.mu.Unlock()
+	if ok {
+		te := db.check(caller, acl.ActionGet, target)
+		if !te.Authorized {
+			return nil, db.logAccess(caller, te)
+		}
+		entries = append(entries, te)
+	} else {
+		target = name
 	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	sv, err := db.kv.get(name)
+	if err := db.brokenAliasLocked(name, target); err != nil {
+		return nil, err
+	}
+	sv, err := db.kv.get(target)
 	if err != nil {
 		return nil, err
 	} else if sv.Version == oldVersion {
@@ -210,41 +821,204 @@ func (db *DB) GetConditional(caller Caller, name string, oldVersion api.SecretVe
 
 	// Reaching here, we have a value we need to deliver back to the caller, and
 	// we must write an audit log. We already know it's authorized.
-	if err := db.checkAndLog(caller, acl.ActionGet, name, 0); err != nil {
-		return nil, err
+	for _, e := range entries {
+		if err := db.logAccess(caller, e); err != nil {
+			return nil, err
+		}
 	}
 	return sv, nil
 }
 
-// GetVersion returns a secret's value at a specific version.
+// GetVersion returns a secret's value at a specific version. If name is an
+// alias, GetVersion reports the specified version of its target, as Get does.
 func (db *DB) GetVersion(caller Caller, name string, version api.SecretVersion) (*api.SecretValue, error) {
-	if err := db.checkAndLog(caller, acl.ActionGet, name, version); err != nil {
+	target, err := db.checkGetAndLog(caller, name, version)
+	if err != nil {
 		return nil, err
+	} else if version <= 0 {
+		return nil, ErrVersionNotFound
 	}
-
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.kv.getVersion(name, version)
+	return db.readValue(name, target, version)
 }
 
 // Put writes value to the secret called name. If the secret already
 // exists, value is saved as a new inactive version. Otherwise, value
 // is saved as the initial version of the secret and immediately set
 // active. On success, returns the secret version for the new value.
+//
+// The name must satisfy api.CheckSecretName, or Put reports an error wrapping
+// ErrInvalidName. Other methods accept any name, so that existing secrets with
+// names that are no longer valid can still be read and deleted.
 func (db *DB) Put(caller Caller, name string, value []byte) (api.SecretVersion, error) {
-	if name == "" {
-		return 0, errors.New("empty secret name")
+	return db.PutWithOptions(caller, name, value, PutOptions{})
+}
+
+// PutOptions are optional settings for a Put operation. A zero value is ready
+// for use and provides default behavior.
+type PutOptions struct {
+	// ExpiresAt, if non-zero, is the time after which the new version will no
+	// longer be served by Get or GetVersion.
+	ExpiresAt time.Time
+
+	// Labels, if non-empty, are added to the labels of the secret as
+	// described by SetLabels.
+	Labels map[string]string
+
+	// Activate, if true, makes the new version active in the same update.
+	// This requires "activate" permission in addition to "put".
+	Activate bool
+
+	// Template, if true, marks the new version as a template whose
+	// references to other secrets are expanded by GetResolved. The value
+	// must be well-formed, and must not refer back to the secret itself
+	// through the active values of other templates, or PutWithOptions
+	// reports an error wrapping api.ErrTemplate. See api.TemplateRefs.
+	Template bool
+
+	// Format, if non-empty, declares the format of the values of the secret,
+	// replacing any format declared before. The value must be well-formed in
+	// that format, or PutWithOptions reports an error wrapping
+	// api.ErrInvalidFormat. See api.CheckFormat. If empty, the value is not
+	// checked, and the declared format of the secret is unchanged.
+	Format string
+
+	// ContentType, if non-empty, records the MIME type of the values of the
+	// secret, replacing any content type recorded before. It must satisfy
+	// api.CheckContentType. If empty, the content type is unchanged.
+	ContentType string
+
+	// IfAbsent, if true, creates the secret only if it does not exist. If a
+	// secret or alias with the name exists, PutWithOptions reports
+	// ErrAlreadyExists and stores nothing. The check and the update are
+	// made together, so concurrent puts cannot both succeed.
+	IfAbsent bool
+
+	// MaxVersions, if non-zero, sets the number of versions kept for the
+	// secret, overriding OpenOptions.MaxVersions for it from now on. If
+	// negative, the number of versions of the secret is not limited. If
+	// zero, the limit of the secret is unchanged. Setting it requires
+	// "delete" permission in addition to "put".
+	MaxVersions int
+
+	// AllowDuplicate, if true, always adds a new version, even if the value
+	// and options are the same as those of the newest or the active version
+	// of the secret. Otherwise, such a put returns the existing version.
+	AllowDuplicate bool
+
+	// Description, if non-empty, replaces the description of the secret. It
+	// must satisfy api.CheckDescription. If empty, the description of the
+	// secret is unchanged.
+	Description string
+
+	// Immutable, if true, makes the secret immutable: DeleteVersion for any
+	// version that was ever active then reports an error wrapping
+	// api.ErrImmutable, as do Delete and Rename, unless the caller has
+	// "admin" permission for the secret. Setting it requires "delete"
+	// permission in addition to "put". If false, the secret is unchanged;
+	// an immutable secret cannot be made mutable again.
+	Immutable bool
+}
+
+// PutWithOptions is as Put, but applies the specified options to the new
+// secret version.
+//
+// If the put leaves the secret with more versions than its limit, the oldest
+// versions are pruned in the same update, and each is recorded in the audit
+// log as a delete by the caller. See OpenOptions.MaxVersions. Since pruning
+// deletes versions, it requires "delete" permission in addition to "put":
+// without it, a put that would prune versions reports ErrAccessDenied and
+// stores nothing.
+func (db *DB) PutWithOptions(caller Caller, name string, value []byte, opts PutOptions) (api.SecretVersion, error) {
+	if err := api.CheckSecretName(name); err != nil {
+		return 0, err
 	}
-	if err := db.checkAndLog(caller, acl.ActionPut, name, 0); err != nil {
+	if err := api.CheckLabels(opts.Labels); err != nil {
 		return 0, err
 	}
+	if err := api.CheckDescription(opts.Description); err != nil {
+		return 0, err
+	}
+	if opts.Format != "" {
+		if err := api.CheckFormat(opts.Format, value); err != nil {
+			return 0, err
+		}
+	}
+	if opts.ContentType != "" {
+		if err := api.CheckContentType(opts.ContentType); err != nil {
+			return 0, err
+		}
+	}
+	var refs []string
+	if opts.Template {
+		var err error
+		refs, err = api.TemplateRefs(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := db.checkAndLogValue(caller, acl.ActionPut, name, 0, value); err != nil {
+		return 0, err
+	}
+	if opts.Activate {
+		if strings.HasPrefix(name, configPrefix) {
+			return 0, fmt.Errorf("cannot activate config value %q with put", name)
+		}
+		if err := db.checkAndLogValue(caller, acl.ActionActivate, name, 0, value); err != nil {
+			return 0, err
+		}
+	}
+
+	// Pruning deletes versions, and an immutable secret cannot be deleted,
+	// so check delete permission for a put that sets the version limit or
+	// immutability, or may prune. The check is made before the update,
+	// since the Authorize hook must not be called with db.mu held, and the
+	// update is refused if it prunes without permission.
+	needDelete := opts.MaxVersions != 0 || opts.Immutable
+	db.mu.Lock()
+	mayPrune := needDelete || db.kv.mayPrune(name)
+	db.mu.Unlock()
+	de := &audit.Entry{Action: acl.ActionDelete, Secret: name}
+	if mayPrune {
+		de = db.check(caller, acl.ActionDelete, name)
+		if needDelete && !de.Authorized {
+			return 0, db.logAccess(caller, de)
+		}
+	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if strings.HasPrefix(name, configPrefix) {
 		return db.putConfigLocked(name, value)
 	}
-	return db.kv.put(name, value)
+	defer db.watchActiveLocked(name)()
+	if db.kv.templateCycle(name, refs) {
+		return 0, fmt.Errorf("%w: %q refers to itself", api.ErrTemplate, name)
+	}
+	ver, pruned, err := db.kv.put(name, value, opts, caller.Principal.Name(), de.Authorized)
+	if errors.Is(err, errPruneDenied) {
+		de.Reason = cmp.Or(de.Reason, err.Error())
+		return 0, db.logAccess(caller, de)
+	} else if err != nil {
+		return 0, err
+	} else if len(pruned) == 0 {
+		return ver, nil
+	}
+	entries := make([]*audit.Entry, len(pruned))
+	for i, v := range pruned {
+		entries[i] = &audit.Entry{
+			Principal:     caller.Principal,
+			Action:        acl.ActionDelete,
+			Authorized:    de.Authorized,
+			Secret:        name,
+			SecretVersion: v,
+			Reason:        fmt.Sprintf("pruned to keep %d versions", db.kv.versionLimit(db.kv.secrets[name])),
+			RequestID:     caller.RequestID,
+		}
+	}
+	if err := db.auditLog.WriteEntries(entries...); err != nil {
+		return ver, fmt.Errorf("writing audit log: %w", err)
+	}
+	return ver, nil
 }
 
 func (db *DB) putConfigLocked(name string, value []byte) (api.SecretVersion, error) {
@@ -260,30 +1034,93 @@ func (db *DB) putConfigLocked(name string, value []byte) (api.SecretVersion, err
 // secret's initial version. For a secret that  already exists, CreateVersion
 // returns an error if the specified version ever had a value; otherwise, CreateVersion
 // sets the specified version to the given value and immediately activates this version.
+// If the secret has a declared format, the value must be well-formed in it, or
+// CreateVersion reports an error wrapping api.ErrInvalidFormat.
 //
 // Access requirement: "create-version"
 func (db *DB) CreateVersion(caller Caller, name string, version api.SecretVersion, value []byte) error {
-	if name == "" {
-		return errors.New("empty secret name")
+	return db.CreateVersionWithOptions(caller, name, version, value, CreateVersionOptions{})
+}
+
+// CreateVersionOptions are optional settings for a CreateVersion operation.
+// A zero value is ready for use and provides default behavior. They let a
+// secret be copied from elsewhere with its version numbers, such as from an
+// export bundle, along with the settings a put would otherwise record.
+type CreateVersionOptions struct {
+	// ExpiresAt and Template set the expiration time and template flag of
+	// the new version, as described by PutOptions.
+	ExpiresAt time.Time
+	Template  bool
+
+	// Format, ContentType, MaxVersions, and Immutable set the corresponding
+	// settings of the secret, as described by PutOptions, and require the
+	// same permissions. Unlike a put, CreateVersion never deletes versions
+	// to satisfy MaxVersions; the limit applies from the next put. If Format
+	// is empty, the value is checked against the format already declared for
+	// the secret, if any.
+	Format      string
+	ContentType string
+	MaxVersions int
+	Immutable   bool
+}
+
+// CreateVersionWithOptions creates the specified version of the secret called
+// name with the specified value, as CreateVersion does, and applies opts.
+//
+// Access requirement: "create-version", and "delete" to set MaxVersions or
+// Immutable.
+func (db *DB) CreateVersionWithOptions(caller Caller, name string, version api.SecretVersion, value []byte, opts CreateVersionOptions) error {
+	if err := api.CheckSecretName(name); err != nil {
+		return err
 	}
 	if version <= 0 {
 		return ErrInvalidVersion
 	}
-	if err := db.checkAndLog(caller, acl.ActionCreateVersion, name, version); err != nil {
+	if opts.Format != "" {
+		if err := api.CheckFormat(opts.Format, value); err != nil {
+			return err
+		}
+	}
+	if opts.ContentType != "" {
+		if err := api.CheckContentType(opts.ContentType); err != nil {
+			return err
+		}
+	}
+	var refs []string
+	if opts.Template {
+		var err error
+		refs, err = api.TemplateRefs(value)
+		if err != nil {
+			return err
+		}
+	}
+	if err := db.checkAndLogValue(caller, acl.ActionCreateVersion, name, version, value); err != nil {
 		return err
 	}
+	if opts.MaxVersions != 0 || opts.Immutable {
+		if de := db.check(caller, acl.ActionDelete, name); !de.Authorized {
+			return db.logAccess(caller, de)
+		}
+	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.createVersion(name, version, value)
+	if db.kv.templateCycle(name, refs) {
+		return fmt.Errorf("%w: %q refers to itself", api.ErrTemplate, name)
+	}
+	defer db.watchActiveLocked(name)()
+	return db.kv.createVersion(name, version, value, opts, caller.Principal.Name())
 }
 
 // Activate changes the active version of the secret called name to version.
+// If the version is a template that would refer back to the secret through
+// the active values of other templates, Activate reports an error wrapping
+// api.ErrTemplate and the active version is unchanged.
 func (db *DB) Activate(caller Caller, name string, version api.SecretVersion) error {
 	if name == "" {
 		return errors.New("empty secret name")
 	}
-	if err := db.checkAndLog(caller, acl.ActionActivate, name, version); err != nil {
+	if err := db.checkAndLogVersion(caller, acl.ActionActivate, name, version); err != nil {
 		return err
 	}
 
@@ -292,7 +1129,44 @@ func (db *DB) Activate(caller Caller, name string, version api.SecretVersion) er
 	if strings.HasPrefix(name, configPrefix) {
 		return db.activateConfigLocked(name, version)
 	}
-	return db.kv.setActive(name, version)
+	defer db.watchActiveLocked(name)()
+	return db.kv.setActive(name, version, caller.Principal.Name())
+}
+
+// ActivateMany changes the active versions of several secrets in a single
+// update. Every secret and version must exist, and each secret may be listed
+// only once. If any of them does not exist, ActivateMany reports an error
+// wrapping ErrNotFound and no changes are made. Likewise, if the new active
+// versions would leave a template referring back to itself, ActivateMany
+// reports an error wrapping api.ErrTemplate and no changes are made.
+//
+// Access requirement: "activate", for each secret.
+func (db *DB) ActivateMany(caller Caller, reqs []api.ActivateRequest) error {
+	seen := make(map[string]bool)
+	for _, r := range reqs {
+		if r.Name == "" {
+			return errors.New("empty secret name")
+		} else if strings.HasPrefix(r.Name, configPrefix) {
+			return fmt.Errorf("cannot activate config value %q with other secrets", r.Name)
+		} else if seen[r.Name] {
+			return fmt.Errorf("secret %q is listed more than once", r.Name)
+		}
+		seen[r.Name] = true
+	}
+	for _, r := range reqs {
+		if err := db.checkAndLogVersion(caller, acl.ActionActivate, r.Name, r.Version); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, len(reqs))
+	for i, r := range reqs {
+		names[i] = r.Name
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.watchActiveLocked(names...)()
+	return db.kv.setActiveMany(reqs, caller.Principal.Name())
 }
 
 func (db *DB) activateConfigLocked(name string, version api.SecretVersion) error {
@@ -304,17 +1178,42 @@ func (db *DB) activateConfigLocked(name string, version api.SecretVersion) error
 
 // DeleteVersion deletes the specified version of a secret.
 // It reports an error without change if version is the active version.
+// If the secret is immutable, a version that was ever active cannot be
+// deleted, even by a caller with "admin" permission, and DeleteVersion
+// reports an error wrapping api.ErrImmutable.
 func (db *DB) DeleteVersion(caller Caller, name string, version api.SecretVersion) error {
+	return db.DeleteVersionWithOptions(caller, name, version, DeleteVersionOptions{})
+}
+
+// DeleteVersionOptions are optional settings for DeleteVersionWithOptions.
+type DeleteVersionOptions struct {
+	// Reactivate, if non-zero, is a version of the secret to make active in
+	// the same update as the deletion. This permits deleting the active
+	// version, without a moment when the secret has no active version. It
+	// requires "activate" permission in addition to "delete", and must not
+	// be the version being deleted.
+	Reactivate api.SecretVersion
+}
+
+// DeleteVersionWithOptions is as DeleteVersion, but applies the specified
+// options. If the deletion fails, the active version is unchanged.
+func (db *DB) DeleteVersionWithOptions(caller Caller, name string, version api.SecretVersion, opts DeleteVersionOptions) error {
 	if err := db.checkAndLog(caller, acl.ActionDelete, name, version); err != nil {
 		return err
 	}
+	if opts.Reactivate != api.SecretVersionDefault {
+		if err := db.checkAndLogVersion(caller, acl.ActionActivate, name, opts.Reactivate); err != nil {
+			return err
+		}
+	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if cfg, ok := strings.CutPrefix(name, configPrefix); ok {
 		return db.deleteConfigVersionLocked(cfg, version)
 	}
-	return db.kv.deleteVersion(name, version)
+	defer db.watchActiveLocked(name)()
+	return db.kv.deleteVersion(name, version, opts.Reactivate, caller.Principal.Name())
 }
 
 func (db *DB) deleteConfigVersionLocked(name string, version api.SecretVersion) error {
@@ -324,17 +1223,229 @@ func (db *DB) deleteConfigVersionLocked(name string, version api.SecretVersion)
 // Delete deletes all the versions of a secret. If the specified secret does
 // not exist, this is a no-op without error, provided the caller has access to
 // delete things at all.
+//
+// If the database was opened with a DeleteRetention, the secret is
+// soft-deleted: it is hidden from all other operations, but can be restored
+// by Undelete until the retention period ends. If a secret with the same name
+// was already soft-deleted, the earlier one is replaced and can no longer be
+// restored.
+//
+// If name is an alias, Delete removes the alias and leaves its target
+// unchanged. Deleting a secret that is the target of aliases breaks them,
+// unless the database protects alias targets; see OpenOptions. An immutable
+// secret can be deleted only by a caller with "admin" permission for it, or
+// Delete reports an error wrapping api.ErrImmutable.
 func (db *DB) Delete(caller Caller, name string) error {
 	if err := db.checkAndLog(caller, acl.ActionDelete, name, 0); err != nil {
 		return err
 	}
+	override := db.checkOverride(caller, name)
+	return db.logOverride(caller, override, db.delete(caller, name, override != nil))
+}
 
+// delete implements Delete, once access has been checked.
+func (db *DB) delete(caller Caller, name string, override bool) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if cfg, ok := strings.CutPrefix(name, configPrefix); ok {
 		return db.deleteConfigLocked(cfg)
 	}
-	return db.kv.deleteSecret(name)
+	if _, ok := db.kv.aliases[name]; ok {
+		return db.kv.deleteAlias(name)
+	}
+	if err := db.checkAliasesLocked(name); err != nil {
+		return err
+	}
+	return db.kv.deleteSecret(name, db.retention > 0, caller.Principal.Name(), override)
+}
+
+// Undelete restores a soft-deleted secret, with all its versions and
+// metadata, provided its retention period has not ended. It reports
+// ErrNotFound if there is no such deleted secret, and ErrAlreadyExists if a
+// new secret with the same name has been created since it was deleted.
+//
+// Access requirement: "undelete"
+func (db *DB) Undelete(caller Caller, name string) error {
+	if name == "" {
+		return errors.New("empty secret name")
+	}
+	if err := db.checkAndLog(caller, acl.ActionUndelete, name, 0); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.undelete(name, time.Now().Add(-db.retention))
+}
+
+// PurgeDeleted permanently removes soft-deleted secrets whose retention
+// period has ended, and reports the names of the secrets removed. If soft
+// deletion is disabled, all soft-deleted secrets are removed.
+func (db *DB) PurgeDeleted() ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.purgeDeleted(time.Now().Add(-max(db.retention, 0)))
+}
+
+// Rename moves all versions of the secret called name, along with its active
+// version and version metadata, to newName. The old name is removed. Rename
+// reports ErrNotFound if the secret does not exist, and ErrAlreadyExists if a
+// secret called newName already exists. The newName must satisfy
+// api.CheckSecretName. An immutable secret can be renamed only by a caller
+// with "admin" permission for it, or Rename reports an error wrapping
+// api.ErrImmutable.
+//
+// Access requirement: "rename", for both name and newName. The operation is
+// recorded as a single audit entry for the old name.
+func (db *DB) Rename(caller Caller, name, newName string) error {
+	if name == "" {
+		return errors.New("empty secret name")
+	}
+	if err := api.CheckSecretName(newName); err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, configPrefix) || strings.HasPrefix(newName, configPrefix) {
+		return errors.New("cannot rename config values")
+	}
+
+	e := &audit.Entry{
+		Action:    acl.ActionRename,
+		Secret:    name,
+		NewSecret: newName,
+		Authorized: caller.Permissions.Allow(acl.ActionRename, name) &&
+			caller.Permissions.Allow(acl.ActionRename, newName),
+	}
+	for _, n := range []string{name, newName} {
+		if e.Authorized && caller.Authorize != nil {
+			if err := caller.Authorize(acl.ActionRename, n); err != nil {
+				e.Authorized = false
+				e.Reason = err.Error()
+			}
+		}
+	}
+	if err := db.logAccess(caller, e); err != nil {
+		return err
+	}
+	override := db.checkOverride(caller, name)
+	return db.logOverride(caller, override, db.rename(name, newName, override != nil))
+}
+
+// rename implements Rename, once access has been checked.
+func (db *DB) rename(name, newName string, override bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkAliasesLocked(name); err != nil {
+		return err
+	}
+	return db.kv.rename(name, newName, override)
+}
+
+// Alias makes name an alias for the secret called target, so that Get and
+// GetVersion for name report the values of target, and Info reports the name
+// of the target. If name is already an alias, it is updated to refer to
+// target. Alias reports ErrAlreadyExists if a secret called name exists, and
+// ErrNotFound if target does not exist. The target must not itself be an
+// alias, and name must satisfy api.CheckSecretName. Since aliases cannot form
+// chains, name must not be the target of another alias, even a broken one,
+// or Alias reports an error wrapping api.ErrAliasTarget.
+//
+// An alias is removed by Delete. Aliases are not reported by List.
+//
+// Access requirement: "put" for name, and "info" for target. The operation
+// is recorded as an audit entry for each.
+func (db *DB) Alias(caller Caller, name, target string) error {
+	if err := api.CheckSecretName(name); err != nil {
+		return err
+	}
+	if target == "" {
+		return errors.New("empty target name")
+	}
+	if strings.HasPrefix(name, configPrefix) || strings.HasPrefix(target, configPrefix) {
+		return errors.New("cannot alias config values")
+	}
+	e := db.check(caller, acl.ActionPut, name)
+	e.NewSecret = target
+	if err := db.logAccess(caller, e); err != nil {
+		return err
+	}
+	if err := db.checkAndLog(caller, acl.ActionInfo, target, 0); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.setAlias(name, target)
+}
+
+// SetPrincipals sets the principals allowed to get the secret called name or
+// its metadata. Each principal is either a tailnet user login name or a tag
+// ("tag:..."). Callers who are not among the listed principals are denied
+// access, even if their permissions would otherwise allow it. If principals
+// is empty, the restriction is removed and access is governed only by
+// permissions.
+//
+// Access requirement: "set-principals"
+func (db *DB) SetPrincipals(caller Caller, name string, principals []string) error {
+	if name == "" {
+		return errors.New("empty secret name")
+	}
+	for _, p := range principals {
+		if p == "" || strings.ContainsFunc(p, unicode.IsSpace) {
+			return fmt.Errorf("invalid principal %q", p)
+		}
+	}
+	if err := db.checkAndLog(caller, acl.ActionSetPrincipals, name, 0); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.setPrincipals(name, principals)
+}
+
+// SetLabels updates the labels of the secret called name. Each label in
+// labels is added to the secret, replacing the value of any existing label
+// with the same key. A label with an empty value is removed. Each label must
+// satisfy api.CheckLabel, or SetLabels reports an error wrapping
+// ErrInvalidLabel.
+//
+// Access requirement: "put"
+func (db *DB) SetLabels(caller Caller, name string, labels map[string]string) error {
+	if name == "" {
+		return errors.New("empty secret name")
+	}
+	if err := api.CheckLabels(labels); err != nil {
+		return err
+	}
+	if err := db.checkAndLog(caller, acl.ActionPut, name, 0); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.setLabels(name, labels)
+}
+
+// SetDescription replaces the description of the secret called name with
+// desc. An empty desc removes the description. The description must satisfy
+// api.CheckDescription, or SetDescription reports an error wrapping
+// ErrInvalidDescription.
+//
+// Access requirement: "put"
+func (db *DB) SetDescription(caller Caller, name, desc string) error {
+	if name == "" {
+		return errors.New("empty secret name")
+	}
+	if err := api.CheckDescription(desc); err != nil {
+		return err
+	}
+	if err := db.checkAndLog(caller, acl.ActionPut, name, 0); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.setDescription(name, desc)
 }
 
 func (db *DB) deleteConfigLocked(name string) error {
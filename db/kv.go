@@ -5,15 +5,21 @@ package db
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"maps"
 	"os"
 	"slices"
+	"strings"
+	"time"
 
+	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/types/api"
 	"github.com/tink-crypto/tink-go/v2/aead"
 	"github.com/tink-crypto/tink-go/v2/keyset"
@@ -59,7 +65,11 @@ const databaseSchemaVersion = 1
 //	        "2": "<secret-2-value-base64>"
 //	      },
 //	      "ActiveVersion": "1",
-//	      "LatestVersion": "2"
+//	      "LatestVersion": "2",
+//	      "VersionInfo": {
+//	        "1": {"CreatedAt": "2024-05-05T17:41:28Z", "CreatedBy": "user@example.com"},
+//	        "2": {"ExpiresAt": "2030-01-01T00:00:00Z"}
+//	      }
 //	    },
 //
 //	    "secret2": {
@@ -73,13 +83,47 @@ type kv struct {
 
 	secrets map[string]*secret
 
+	// deleted holds secrets that have been soft-deleted, by name. They are
+	// not visible to other operations until restored by undelete.
+	deleted map[string]*tombstone
+
+	// aliases maps the name of an alias to the name of the secret it refers
+	// to. The target need not exist, in which case the alias is broken.
+	aliases map[string]string
+
 	dek       *keyset.Handle
 	dekCipher tink.AEAD
 	dekRaw    []byte
 
 	kekCipher tink.AEAD
 
+	// compress reports whether the database is compressed when saved.
+	compress bool
+
+	// maxVersions, if positive, is the number of versions kept for secrets
+	// that do not set a limit of their own.
+	maxVersions int
+
+	// dedupeActive reports whether a put of the value of the active version
+	// of a secret returns that version instead of adding a new one.
+	dedupeActive bool
+
+	// storedSize and clearSize are the sizes in bytes of the database file
+	// and of its unencrypted, uncompressed contents as of the last load or
+	// save.
+	storedSize, clearSize int
+
+	// numSecrets and numVersions are the number of secrets, not counting
+	// config values and soft-deleted secrets, and the total number of their
+	// versions. They are counted on load and kept up to date by addCounts as
+	// changes are saved.
+	numSecrets, numVersions int
+
 	gen uint64
+
+	// changed, if non-nil, is closed and cleared the next time a change is
+	// saved to disk.
+	changed chan struct{}
 }
 
 // secret is a named secret, which may have multiple versioned secret
@@ -100,6 +144,257 @@ type secret struct {
 	// DeletedVersions tracks versions that were previously set but
 	// have since been deleted. These are not permitted to be set again.
 	DeletedVersions map[api.SecretVersion]bool
+	// VersionInfo maps versions to optional metadata about those
+	// versions. Versions with no metadata need not have an entry.
+	VersionInfo map[api.SecretVersion]*versionInfo `json:",omitempty"`
+	// Principals, if non-empty, are the user login names and tags of the
+	// callers allowed to get the secret or its metadata.
+	Principals []string `json:",omitempty"`
+	// Labels are key/value pairs attached to the secret.
+	Labels map[string]string `json:",omitempty"`
+	// Format, if non-empty, is the format most recently declared for the
+	// values of the secret. See api.CheckFormat.
+	Format string `json:",omitempty"`
+	// ContentType, if non-empty, is the MIME type most recently recorded for
+	// the values of the secret. See api.CheckContentType.
+	ContentType string `json:",omitempty"`
+	// MaxVersions, if non-zero, is the number of versions kept for the
+	// secret, overriding the default of the database. If negative, the
+	// number of versions is not limited. See PutOptions.
+	MaxVersions int `json:",omitempty"`
+	// Description, if non-empty, is free text describing the secret. See
+	// api.CheckDescription.
+	Description string `json:",omitempty"`
+	// Immutable, if true, prevents the secret and any version that was ever
+	// active from being deleted, and the secret from being renamed, except
+	// by an override. It is never cleared. See PutOptions.
+	Immutable bool `json:",omitempty"`
+}
+
+// mergeLabels returns a copy of old updated with the labels in update. A
+// label in update with an empty value is removed. The result is nil if no
+// labels remain.
+func mergeLabels(old, update map[string]string) map[string]string {
+	out := maps.Clone(old)
+	for k, v := range update {
+		if v == "" {
+			delete(out, k)
+		} else {
+			if out == nil {
+				out = make(map[string]string)
+			}
+			out[k] = v
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// hasLabels reports whether the secret has all the labels in selector with
+// the same values.
+func (s *secret) hasLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if got, ok := s.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// versionInfo is optional metadata about a single version of a secret.
+type versionInfo struct {
+	// ExpiresAt, if non-zero, is the time after which the version is no
+	// longer served to clients.
+	ExpiresAt time.Time `json:",omitzero"`
+
+	// CreatedAt and CreatedBy record when and by whom the version was
+	// created. They are empty for versions created before this metadata
+	// was recorded.
+	CreatedAt time.Time `json:",omitzero"`
+	CreatedBy string    `json:",omitempty"`
+
+	// ActivatedAt and ActivatedBy record when and by whom the version was
+	// most recently made active, if it was activated after being created.
+	ActivatedAt time.Time `json:",omitzero"`
+	ActivatedBy string    `json:",omitempty"`
+
+	// Template reports whether the value of the version is a template that
+	// refers to other secrets.
+	Template bool `json:",omitempty"`
+
+	// Activated reports whether the version has ever been active, whether
+	// from its creation or later. In a database written before this was
+	// recorded, every version is marked as activated when it is loaded,
+	// since whether it was active at creation is not known.
+	Activated bool `json:",omitempty"`
+}
+
+// expiresAt returns the expiration time of vi, or zero if it has none.
+func (vi *versionInfo) expiresAt() time.Time {
+	if vi == nil {
+		return time.Time{}
+	}
+	return vi.ExpiresAt
+}
+
+// createdAt returns the creation time of vi, or zero if it has none.
+func (vi *versionInfo) createdAt() time.Time {
+	if vi == nil {
+		return time.Time{}
+	}
+	return vi.CreatedAt
+}
+
+// isTemplate reports whether vi marks a template value.
+func (vi *versionInfo) isTemplate() bool { return vi != nil && vi.Template }
+
+// wasActive reports whether the specified version of s is or ever was active.
+func (s *secret) wasActive(version api.SecretVersion) bool {
+	vi := s.VersionInfo[version]
+	return version == s.ActiveVersion || (vi != nil && (vi.Activated || !vi.ActivatedAt.IsZero()))
+}
+
+// isZero reports whether vi carries no metadata.
+func (vi *versionInfo) isZero() bool { return vi == nil || *vi == versionInfo{} }
+
+// value returns the API representation of bs, the value of the specified
+// version of the secret.
+func (s *secret) value(version api.SecretVersion, bs byteString) *api.SecretValue {
+	return &api.SecretValue{
+		Value:       []byte(bs),
+		Version:     version,
+		CreatedAt:   s.VersionInfo[version].createdAt(),
+		Format:      s.Format,
+		ContentType: s.ContentType,
+	}
+}
+
+// expired reports whether the specified version has passed its expiration
+// time, if it has one.
+func (s *secret) expired(version api.SecretVersion) bool {
+	vi := s.VersionInfo[version]
+	return vi != nil && !vi.ExpiresAt.IsZero() && !time.Now().Before(vi.ExpiresAt)
+}
+
+// setVersionInfo records vi as the metadata for version, or removes any
+// existing metadata if vi is empty.
+func (s *secret) setVersionInfo(version api.SecretVersion, vi *versionInfo) {
+	if vi.isZero() {
+		delete(s.VersionInfo, version)
+		return
+	}
+	if s.VersionInfo == nil {
+		s.VersionInfo = make(map[api.SecretVersion]*versionInfo)
+	}
+	s.VersionInfo[version] = vi
+}
+
+// prune removes the oldest versions of s, other than its active and latest
+// versions and, if s is immutable, any version that was ever active, until
+// it has at most limit versions, and marks them deleted. It
+// does nothing if limit is not positive. It reports the versions removed,
+// and a function that restores them.
+func (s *secret) prune(limit int) (pruned []api.SecretVersion, undo func()) {
+	if limit <= 0 || len(s.Versions) <= limit {
+		return nil, func() {}
+	}
+	type saved struct {
+		value byteString
+		info  *versionInfo
+	}
+	old := make(map[api.SecretVersion]saved)
+	for _, v := range slices.Sorted(maps.Keys(s.Versions)) {
+		if len(s.Versions) <= limit {
+			break
+		} else if v == s.ActiveVersion || v == s.LatestVersion || (s.Immutable && s.wasActive(v)) {
+			continue
+		}
+		old[v] = saved{s.Versions[v], s.VersionInfo[v]}
+		delete(s.Versions, v)
+		delete(s.VersionInfo, v)
+		if s.DeletedVersions == nil {
+			s.DeletedVersions = make(map[api.SecretVersion]bool)
+		}
+		s.DeletedVersions[v] = true
+		pruned = append(pruned, v)
+	}
+	return pruned, func() {
+		for v, o := range old {
+			s.Versions[v] = o.value
+			s.setVersionInfo(v, o.info)
+			delete(s.DeletedVersions, v)
+		}
+	}
+}
+
+// checkFormat reports an error wrapping api.ErrInvalidFormat if value is not
+// well-formed in the format declared for s, if any.
+func (s *secret) checkFormat(value []byte) error {
+	if s.Format == "" {
+		return nil
+	}
+	return api.CheckFormat(s.Format, value)
+}
+
+// errPruneDenied is reported by put if the update would prune versions that
+// the caller is not allowed to delete.
+var errPruneDenied = errors.New("put would prune versions without delete permission")
+
+// activeVersion returns the active version of the secret called name, or 0
+// if it does not exist.
+func (kv *kv) activeVersion(name string) api.SecretVersion {
+	if s := kv.secrets[name]; s != nil {
+		return s.ActiveVersion
+	}
+	return 0
+}
+
+// mayPrune reports whether a put to the secret called name could prune any
+// of its versions under its current version limit.
+func (kv *kv) mayPrune(name string) bool {
+	s := kv.secrets[name]
+	if s == nil {
+		return false
+	}
+	limit := kv.versionLimit(s)
+	return limit > 0 && len(s.Versions) >= limit
+}
+
+// versionLimit reports the number of versions kept for s, or 0 if it is not
+// limited.
+func (kv *kv) versionLimit(s *secret) int {
+	return max(cmp.Or(s.MaxVersions, kv.maxVersions), 0)
+}
+
+// markActivated records that version was activated by the specified
+// principal at the current time. It returns a function that restores the
+// previous metadata for version.
+func (s *secret) markActivated(version api.SecretVersion, by string) (undo func()) {
+	old := s.VersionInfo[version]
+	vi := new(versionInfo)
+	if old != nil {
+		*vi = *old
+	}
+	vi.ActivatedAt = time.Now().UTC()
+	vi.ActivatedBy = by
+	vi.Activated = true
+	s.setVersionInfo(version, vi)
+	return func() { s.setVersionInfo(version, old) }
+}
+
+// markAllActivated records every version of s as having been active. It is
+// used for versions whose activation history was not recorded.
+func (s *secret) markAllActivated() {
+	for v := range s.Versions {
+		vi := new(versionInfo)
+		if old := s.VersionInfo[v]; old != nil {
+			*vi = *old
+		}
+		vi.Activated = true
+		s.setVersionInfo(v, vi)
+	}
 }
 
 // byteString is an alias for a string, but encodes to JSON as the conventional
@@ -120,11 +415,26 @@ func (b byteString) MarshalText() ([]byte, error) {
 	return []byte(base64.StdEncoding.EncodeToString([]byte(b))), nil
 }
 
+// tombstone is a soft-deleted secret, which can be restored until it is
+// purged.
+type tombstone struct {
+	Secret    *secret
+	DeletedAt time.Time
+	DeletedBy string `json:",omitempty"`
+}
+
 // persist is the portion of DB that is persisted to disk, before
 // encryption.
 type persist struct {
 	// Secrets maps a secret name to associated data and metadata.
 	Secrets map[string]*secret
+	// Deleted maps the name of a soft-deleted secret to its tombstone.
+	Deleted map[string]*tombstone `json:",omitempty"`
+	// Aliases maps the name of an alias to the name of its target secret.
+	Aliases map[string]string `json:",omitempty"`
+	// ActivationRecorded reports whether the version metadata records every
+	// version that was ever active. See versionInfo.Activated.
+	ActivationRecorded bool `json:",omitempty"`
 }
 
 // wrapped is the database as it is stored on disk.
@@ -138,29 +448,61 @@ type wrapped struct {
 	// DB is the database. It is a serialized persist struct encrypted
 	// with the DEK.
 	DB []byte
+	// Compression, if set, is the compression applied to the serialized
+	// persist struct before it was encrypted. The only supported value is
+	// "gzip". If empty, the database is not compressed.
+	Compression string `json:",omitempty"`
 }
 
-func openOrCreateKV(path string, kek tink.AEAD) (*kv, error) {
+// compressGzip is the value of wrapped.Compression for gzip compression.
+const compressGzip = "gzip"
+
+func openOrCreateKV(path string, kek tink.AEAD, compress bool) (*kv, error) {
 	bs, err := os.ReadFile(path)
 	if errors.Is(err, fs.ErrNotExist) {
-		return newKV(path, kek)
+		return newKV(path, kek, compress)
 	} else if err != nil {
 		return nil, err
 	}
+	kv, err := decodeKV(path, bs, kek)
+	if err != nil {
+		return nil, err
+	}
+	// If the requested compression differs from the file, rewrite it now so
+	// the change takes effect without waiting for an update.
+	if kv.compress != compress {
+		kv.compress = compress
+		if err := kv.save(); err != nil {
+			return nil, err
+		}
+	}
+	return kv, nil
+}
 
+// decodeKV decrypts and decodes bs, the encrypted contents of a kv store
+// whose file path is path, using kek.
+func decodeKV(path string, bs []byte, kek tink.AEAD) (*kv, error) {
 	var wrapped wrapped
 	if err := json.Unmarshal(bs, &wrapped); err != nil {
 		return nil, fmt.Errorf("loading encrypted database: %w", err)
 	}
 
 	if wrapped.Version != 1 {
-		return nil, fmt.Errorf("unsupported database version %d", err)
+		return nil, fmt.Errorf("unsupported database version %d", wrapped.Version)
 	}
 
+	// Keyset errors do not wrap the error from the KEK, so record it to tell
+	// a wrong key from a failure to reach the key.
+	rec := &decryptRecorder{AEAD: kek}
 	reader := keyset.NewBinaryReader(bytes.NewReader(wrapped.DEK))
-	dek, err := keyset.ReadWithAssociatedData(reader, kek, aeadContextDEK(wrapped.Version))
+	dek, err := keyset.ReadWithAssociatedData(reader, rec, aeadContextDEK(wrapped.Version))
 	if err != nil {
-		return nil, fmt.Errorf("decrypting DEK: %w", err)
+		if rec.err == nil {
+			return nil, fmt.Errorf("decrypting DEK: %w", err)
+		} else if isAuthFailure(rec.err) {
+			return nil, fmt.Errorf("%w: decrypting DEK: %w", ErrWrongKey, rec.err)
+		}
+		return nil, fmt.Errorf("decrypting DEK: %w", rec.err)
 	}
 	dekCipher, err := aead.New(dek)
 	if err != nil {
@@ -170,28 +512,141 @@ func openOrCreateKV(path string, kek tink.AEAD) (*kv, error) {
 	if err != nil {
 		return nil, fmt.Errorf("decrypting database: %w", err)
 	}
+	switch wrapped.Compression {
+	case "":
+	case compressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(clear))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing database: %w", err)
+		}
+		clear, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing database: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported database compression %q", wrapped.Compression)
+	}
 
 	var persist persist
 	if err := json.Unmarshal(clear, &persist); err != nil {
 		return nil, fmt.Errorf("unmarshaling decrypted database: %w", err)
 	}
+	if !persist.ActivationRecorded {
+		for _, s := range persist.Secrets {
+			s.markAllActivated()
+		}
+		for _, ts := range persist.Deleted {
+			ts.Secret.markAllActivated()
+		}
+	}
 
 	ret := &kv{
 		path:      path,
 		secrets:   persist.Secrets,
+		deleted:   persist.Deleted,
+		aliases:   persist.Aliases,
 		dek:       dek,
 		dekCipher: dekCipher,
 		dekRaw:    wrapped.DEK,
 		kekCipher: kek,
+		compress:  wrapped.Compression != "",
+
+		storedSize: len(bs),
+		clearSize:  len(clear),
+
 		// Initialize gen to 1, so that 0 can be used as a sentinel
 		// value by calling code.
 		gen: 1,
 	}
+	ret.count()
 	return ret, nil
 }
 
-// newKV creates a new empty KV store, and saves it to path using key.
-func newKV(path string, key tink.AEAD) (*kv, error) {
+// decryptRecorder is a tink.AEAD that records the last error from Decrypt.
+type decryptRecorder struct {
+	tink.AEAD
+	err error
+}
+
+func (d *decryptRecorder) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	pt, err := d.AEAD.Decrypt(ciphertext, associatedData)
+	d.err = err
+	return pt, err
+}
+
+// tinkDecryptFailed is the message of the error reported by an AEAD made from
+// a Tink keyset when no key in the keyset authenticates the ciphertext.
+const tinkDecryptFailed = "aead_factory: decryption failed"
+
+// isAuthFailure reports whether err, from decrypting with a KEK, means that
+// the ciphertext did not authenticate with the key, rather than that the key
+// could not be used. A KEK may report this by wrapping ErrWrongKey; an AEAD
+// made from a local Tink keyset reports it with an error that wraps nothing.
+func isAuthFailure(err error) bool {
+	return errors.Is(err, ErrWrongKey) || err.Error() == tinkDecryptFailed
+}
+
+// checkDEK reports whether kek can decrypt dekRaw, an encrypted DEK.
+func checkDEK(dekRaw []byte, kek tink.AEAD) error {
+	reader := keyset.NewBinaryReader(bytes.NewReader(dekRaw))
+	if _, err := keyset.ReadWithAssociatedData(reader, kek, aeadContextDEK(databaseSchemaVersion)); err != nil {
+		return fmt.Errorf("decrypting DEK: %w", err)
+	}
+	return nil
+}
+
+// validate checks the structural consistency of the secrets in kv,
+// including soft-deleted secrets.
+func (kv *kv) validate() error {
+	for name, s := range kv.secrets {
+		if err := validateSecret(name, s); err != nil {
+			return err
+		}
+	}
+	for name, t := range kv.deleted {
+		if t == nil {
+			return fmt.Errorf("deleted secret %q: missing data", name)
+		} else if err := validateSecret(name, t.Secret); err != nil {
+			return fmt.Errorf("deleted %w", err)
+		}
+	}
+	for name, target := range kv.aliases {
+		if name == "" || target == "" {
+			return fmt.Errorf("alias %q: empty name or target", name)
+		} else if _, ok := kv.secrets[name]; ok {
+			return fmt.Errorf("alias %q: name is also a secret", name)
+		} else if _, ok := kv.aliases[target]; ok {
+			return fmt.Errorf("alias %q: target %q is an alias", name, target)
+		}
+	}
+	return nil
+}
+
+// validateSecret checks the structural consistency of s, a secret called name.
+func validateSecret(name string, s *secret) error {
+	if name == "" {
+		return errors.New("secret with empty name")
+	} else if s == nil {
+		return fmt.Errorf("secret %q: missing data", name)
+	} else if _, ok := s.Versions[s.ActiveVersion]; !ok {
+		return fmt.Errorf("secret %q: active version %v not found", name, s.ActiveVersion)
+	}
+	for v := range s.Versions {
+		if v == api.SecretVersionDefault {
+			return fmt.Errorf("secret %q: invalid version %v", name, v)
+		} else if v > s.LatestVersion {
+			return fmt.Errorf("secret %q: version %v exceeds latest version %v", name, v, s.LatestVersion)
+		} else if s.DeletedVersions[v] {
+			return fmt.Errorf("secret %q: version %v is both present and deleted", name, v)
+		}
+	}
+	return nil
+}
+
+// newKV creates a new empty KV store, and saves it to path using key. If
+// compress is true, the store is compressed when saved. If path is empty,
+// the store is kept in memory.
+func newKV(path string, key tink.AEAD, compress bool) (*kv, error) {
 	dek, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
 	if err != nil {
 		return nil, fmt.Errorf("generating database keyset: %w", err)
@@ -213,6 +668,7 @@ func newKV(path string, key tink.AEAD) (*kv, error) {
 		dekCipher: dekCipher,
 		dekRaw:    encryptedDEK.Bytes(),
 		kekCipher: key,
+		compress:  compress,
 	}
 	if err := ret.save(); err != nil {
 		return nil, fmt.Errorf("creating database: %w", err)
@@ -221,38 +677,86 @@ func newKV(path string, key tink.AEAD) (*kv, error) {
 }
 
 // save encrypts and writes the kv to kv.path. If save return an
-// error, the file at kv.path is unchanged.
+// error, the file at kv.path is unchanged. If kv.path is empty, the kv is
+// kept in memory: it is encrypted as usual, but not written anywhere.
 func (kv *kv) save() (err error) {
 	defer func() {
 		if err == nil {
 			kv.gen++
+			if kv.changed != nil {
+				close(kv.changed)
+				kv.changed = nil
+			}
 		}
 	}()
 
 	clearDB, err := json.Marshal(persist{
-		Secrets: kv.secrets,
+		Secrets:            kv.secrets,
+		Deleted:            kv.deleted,
+		Aliases:            kv.aliases,
+		ActivationRecorded: true,
 	})
 	if err != nil {
 		return err
 	}
+	clearSize := len(clearDB)
+	var compression string
+	if kv.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(clearDB); err != nil {
+			return fmt.Errorf("compressing database: %w", err)
+		} else if err := zw.Close(); err != nil {
+			return fmt.Errorf("compressing database: %w", err)
+		}
+		clearDB, compression = buf.Bytes(), compressGzip
+	}
 	encryptedDB, err := kv.dekCipher.Encrypt(clearDB, aeadContextDB(databaseSchemaVersion))
 	if err != nil {
 		return fmt.Errorf("encrypting database: %w", err)
 	}
 	out, err := json.Marshal(wrapped{
-		Version: databaseSchemaVersion,
-		DEK:     kv.dekRaw,
-		DB:      encryptedDB,
+		Version:     databaseSchemaVersion,
+		DEK:         kv.dekRaw,
+		DB:          encryptedDB,
+		Compression: compression,
 	})
 	if err != nil {
 		return fmt.Errorf("serializing encrypted database: %w", err)
 	}
-	if err := atomicfile.WriteFile(kv.path, out, 0600); err != nil {
-		return fmt.Errorf("writing database to %q: %w", kv.path, err)
+	if kv.path != "" {
+		if err := atomicfile.WriteFile(kv.path, out, 0600); err != nil {
+			return fmt.Errorf("writing database to %q: %w", kv.path, err)
+		}
 	}
+	kv.storedSize, kv.clearSize = len(out), clearSize
 	return nil
 }
 
+// count sets the counts of secrets and versions in kv from its contents. It
+// is called when kv is loaded; later changes update the counts by addCounts.
+func (kv *kv) count() {
+	kv.numSecrets, kv.numVersions = 0, 0
+	for name, s := range kv.secrets {
+		if strings.HasPrefix(name, configPrefix) {
+			continue
+		}
+		kv.numSecrets++
+		kv.numVersions += len(s.Versions)
+	}
+}
+
+// addCounts adds the specified numbers of secrets and versions to the counts
+// in kv, after a change to the secret called name has been saved. Changes to
+// config values are not counted.
+func (kv *kv) addCounts(name string, secrets, versions int) {
+	if strings.HasPrefix(name, configPrefix) {
+		return
+	}
+	kv.numSecrets += secrets
+	kv.numVersions += versions
+}
+
 // filePath returns the path to the database file on disk.
 func (kv *kv) filePath() string {
 	return kv.path
@@ -265,6 +769,15 @@ func (kv *kv) writeGen() uint64 {
 	return kv.gen
 }
 
+// changedChan returns a channel that is closed the next time a change to kv
+// is saved to disk.
+func (kv *kv) changedChan() <-chan struct{} {
+	if kv.changed == nil {
+		kv.changed = make(chan struct{})
+	}
+	return kv.changed
+}
+
 // list returns a list of all secret names in kv.
 func (kv *kv) list() []string {
 	return slices.Sorted(maps.Keys(kv.secrets))
@@ -274,7 +787,7 @@ func (kv *kv) list() []string {
 func (kv *kv) info(name string) (*api.SecretInfo, error) {
 	secret := kv.secrets[name]
 	if secret == nil {
-		return nil, ErrNotFound
+		return nil, ErrSecretNotFound
 	}
 	info := &api.SecretInfo{
 		Name:          name,
@@ -282,79 +795,355 @@ func (kv *kv) info(name string) (*api.SecretInfo, error) {
 	}
 	for v := range secret.Versions {
 		info.Versions = append(info.Versions, v)
+		if vi := secret.VersionInfo[v]; !vi.isZero() {
+			if info.VersionInfo == nil {
+				info.VersionInfo = make(map[api.SecretVersion]*api.VersionInfo)
+			}
+			info.VersionInfo[v] = &api.VersionInfo{
+				ExpiresAt:   vi.ExpiresAt,
+				CreatedAt:   vi.CreatedAt,
+				CreatedBy:   vi.CreatedBy,
+				ActivatedAt: vi.ActivatedAt,
+				ActivatedBy: vi.ActivatedBy,
+				Template:    vi.Template,
+			}
+		}
 	}
 	slices.Sort(info.Versions)
+	info.Principals = slices.Clone(secret.Principals)
+	info.Labels = maps.Clone(secret.Labels)
+	info.Format = secret.Format
+	info.ContentType = secret.ContentType
+	info.MaxVersions = secret.MaxVersions
+	info.Description = secret.Description
+	info.Immutable = secret.Immutable
 	return info, nil
 }
 
+// hasLabels reports whether the secret called name exists and has all the
+// labels in selector.
+func (kv *kv) hasLabels(name string, selector map[string]string) bool {
+	secret := kv.secrets[name]
+	return secret != nil && secret.hasLabels(selector)
+}
+
+// setLabels updates the labels of the secret called name as described by
+// mergeLabels.
+func (kv *kv) setLabels(name string, labels map[string]string) error {
+	secret := kv.secrets[name]
+	if secret == nil {
+		return ErrSecretNotFound
+	}
+	old := secret.Labels
+	secret.Labels = mergeLabels(old, labels)
+	if maps.Equal(old, secret.Labels) {
+		return nil
+	}
+	if err := kv.save(); err != nil {
+		secret.Labels = old
+		return err
+	}
+	return nil
+}
+
+// setDescription replaces the description of the secret called name.
+func (kv *kv) setDescription(name, desc string) error {
+	secret := kv.secrets[name]
+	if secret == nil {
+		return ErrSecretNotFound
+	}
+	old := secret.Description
+	if old == desc {
+		return nil
+	}
+	secret.Description = desc
+	if err := kv.save(); err != nil {
+		secret.Description = old
+		return err
+	}
+	return nil
+}
+
+// principalAllowed reports whether the principal p is allowed to access the
+// secret called name. A secret that does not exist, or that lists no
+// principals, allows all principals.
+func (kv *kv) principalAllowed(name string, p audit.Principal) bool {
+	secret := kv.secrets[name]
+	if secret == nil || len(secret.Principals) == 0 {
+		return true
+	}
+	for _, want := range secret.Principals {
+		if (p.User != "" && want == p.User) || slices.Contains(p.Tags, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPrincipals sets the principals allowed to access the secret called name.
+func (kv *kv) setPrincipals(name string, principals []string) error {
+	secret := kv.secrets[name]
+	if secret == nil {
+		return ErrSecretNotFound
+	}
+	old := secret.Principals
+	if len(principals) == 0 {
+		secret.Principals = nil
+	} else {
+		secret.Principals = slices.Compact(slices.Sorted(slices.Values(principals)))
+	}
+	if slices.Equal(old, secret.Principals) {
+		return nil
+	}
+	if err := kv.save(); err != nil {
+		secret.Principals = old
+		return err
+	}
+	return nil
+}
+
 // get returns a secret's active value.
 func (kv *kv) get(name string) (*api.SecretValue, error) {
 	secret := kv.secrets[name]
 	if secret == nil {
-		return nil, ErrNotFound
+		return nil, ErrSecretNotFound
 	}
 	bs, ok := secret.Versions[secret.ActiveVersion]
 	if !ok {
 		return nil, errors.New("[unexpected] active secret version missing from DB")
+	} else if secret.expired(secret.ActiveVersion) {
+		return nil, ErrExpired
 	}
-	return &api.SecretValue{
-		Value:   []byte(bs),
-		Version: secret.ActiveVersion,
-	}, nil
+	return secret.value(secret.ActiveVersion, bs), nil
+}
+
+// isTemplate reports whether the specified version of the secret called name,
+// or of its target if name is an alias, exists and has a template value.
+func (kv *kv) isTemplate(name string, version api.SecretVersion) bool {
+	s := kv.secrets[kv.resolve(name)]
+	return s != nil && s.VersionInfo[version].isTemplate()
+}
+
+// templateCycle reports whether the template references refs, if stored as
+// the active value of the secret called name, would refer back to name
+// through the active values of other template secrets, or aliases of them.
+func (kv *kv) templateCycle(name string, refs []string) bool {
+	seen := make(map[string]bool)
+	var visit func(string) bool
+	visit = func(ref string) bool {
+		if ref == name || kv.resolve(ref) == name {
+			return true
+		} else if seen[ref] {
+			return false
+		}
+		seen[ref] = true
+		s := kv.secrets[kv.resolve(ref)]
+		if s == nil || !s.VersionInfo[s.ActiveVersion].isTemplate() {
+			return false
+		}
+		next, _ := api.TemplateRefs([]byte(s.Versions[s.ActiveVersion]))
+		return slices.ContainsFunc(next, visit)
+	}
+	return slices.ContainsFunc(refs, visit)
+}
+
+// checkTemplateCycle reports an error wrapping api.ErrTemplate if the active
+// value of the secret called name is a template that refers back to name.
+func (kv *kv) checkTemplateCycle(name string) error {
+	s := kv.secrets[name]
+	if s == nil || !s.VersionInfo[s.ActiveVersion].isTemplate() {
+		return nil
+	}
+	refs, _ := api.TemplateRefs([]byte(s.Versions[s.ActiveVersion]))
+	if kv.templateCycle(name, refs) {
+		return fmt.Errorf("%w: %q refers to itself", api.ErrTemplate, name)
+	}
+	return nil
+}
+
+// saveActivated saves kv after the active versions of the named secrets have
+// changed. If the change leaves any of them referring back to itself through
+// templates, it reports an error wrapping api.ErrTemplate without saving.
+func (kv *kv) saveActivated(names ...string) error {
+	for _, name := range names {
+		if err := kv.checkTemplateCycle(name); err != nil {
+			return err
+		}
+	}
+	return kv.save()
 }
 
 // getVersion returns a secret's value at a specific version.
 func (kv *kv) getVersion(name string, version api.SecretVersion) (*api.SecretValue, error) {
 	secret := kv.secrets[name]
 	if secret == nil {
-		return nil, ErrNotFound
+		return nil, ErrSecretNotFound
 	}
 	bs, ok := secret.Versions[version]
 	if !ok {
-		return nil, ErrNotFound
+		return nil, ErrVersionNotFound
+	} else if secret.expired(version) {
+		return nil, ErrExpired
 	}
-	return &api.SecretValue{
-		Value:   []byte(bs),
-		Version: version,
-	}, nil
+	return secret.value(version, bs), nil
 }
 
 // put writes value to the secret called name. If the secret already
-// exists, value is saved as a new inactive version. Otherwise, value
+// exists, value is saved as a new version, which is inactive unless
+// opts.Activate is set. Otherwise, value
 // is saved as the initial version of the secret and immediately set
-// active. On success, returns the secret version for the new value.
-func (kv *kv) put(name string, value []byte) (api.SecretVersion, error) {
+// active. On success, returns the secret version for the new value, and the
+// old versions pruned to keep within the version limit of the secret. The new
+// version is recorded as created by the specified principal. If the update
+// would prune versions and canPrune is false, put reports errPruneDenied and
+// makes no changes.
+func (kv *kv) put(name string, value []byte, opts PutOptions, by string, canPrune bool) (api.SecretVersion, []api.SecretVersion, error) {
+	vi := &versionInfo{
+		ExpiresAt: opts.ExpiresAt,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: by,
+		Template:  opts.Template,
+		Activated: opts.Activate,
+	}
 	s := kv.secrets[name]
-	if s == nil {
-		kv.secrets[name] = &secret{
+	if s != nil && opts.IfAbsent {
+		return 0, nil, fmt.Errorf("%w: %q", ErrAlreadyExists, name)
+	} else if s == nil {
+		if _, ok := kv.aliases[name]; ok {
+			return 0, nil, fmt.Errorf("%w: %q is an alias", ErrAlreadyExists, name)
+		}
+		s = &secret{
 			LatestVersion: 1,
 			ActiveVersion: 1,
 			Versions: map[api.SecretVersion]byteString{
 				1: byteString(value),
 			},
+			Labels:      mergeLabels(nil, opts.Labels),
+			Format:      opts.Format,
+			ContentType: opts.ContentType,
+			MaxVersions: opts.MaxVersions,
+			Description: opts.Description,
+			Immutable:   opts.Immutable,
 		}
+		vi.Activated = true
+		s.setVersionInfo(1, vi)
+		kv.secrets[name] = s
 		if err := kv.save(); err != nil {
 			delete(kv.secrets, name)
-			return 0, err
+			return 0, nil, err
 		}
-		return 1, nil
+		kv.addCounts(name, 1, 1)
+		return 1, nil, nil
 	}
 
-	// If the new value is the same as the current latest version, don't store a
-	// new copy.
+	oldLabels := s.Labels
+	newLabels := mergeLabels(oldLabels, opts.Labels)
+
+	oldActive := s.ActiveVersion
+	oldFormat := s.Format
+	newFormat := cmp.Or(opts.Format, oldFormat)
+	oldType := s.ContentType
+	newType := cmp.Or(opts.ContentType, oldType)
+	oldMax := s.MaxVersions
+	newMax := cmp.Or(opts.MaxVersions, oldMax)
+	oldDesc := s.Description
+	newDesc := cmp.Or(opts.Description, oldDesc)
+	oldImmutable := s.Immutable
+	newImmutable := oldImmutable || opts.Immutable
+
+	// If the new value and its metadata are the same as the current latest
+	// version, or with dedupeActive the active version, don't store a new
+	// copy, but do apply any label or format changes and activate the
+	// existing version if requested.
 	bsValue := byteString(value)
-	if s.Versions[s.LatestVersion] == bsValue {
-		return s.LatestVersion, nil
+	var same api.SecretVersion
+	switch {
+	case opts.AllowDuplicate:
+		// A new version is wanted regardless.
+	case s.Versions[s.LatestVersion] == bsValue && s.sameVersionInfo(s.LatestVersion, vi):
+		same = s.LatestVersion
+	case kv.dedupeActive && oldActive != 0 && s.Versions[oldActive] == bsValue && s.sameVersionInfo(oldActive, vi):
+		same = oldActive
+	}
+	if same != 0 {
+		activate := opts.Activate && oldActive != same
+		if !activate && maps.Equal(oldLabels, newLabels) && oldFormat == newFormat && oldType == newType && oldMax == newMax && oldDesc == newDesc && oldImmutable == newImmutable {
+			return same, nil, nil
+		}
+		undo := func() {}
+		if activate {
+			s.ActiveVersion = same
+			undo = s.markActivated(same, by)
+		}
+		s.Labels = newLabels
+		s.Format = newFormat
+		s.ContentType = newType
+		s.MaxVersions = newMax
+		s.Description = newDesc
+		s.Immutable = newImmutable
+		pruned, undoPrune := s.prune(kv.versionLimit(s))
+		if err := kv.savePruned(pruned, canPrune); err != nil {
+			undoPrune()
+			s.Labels = oldLabels
+			s.Format = oldFormat
+			s.ContentType = oldType
+			s.MaxVersions = oldMax
+			s.Description = oldDesc
+			s.Immutable = oldImmutable
+			s.ActiveVersion = oldActive
+			undo()
+			return 0, nil, err
+		}
+		kv.addCounts(name, 0, -len(pruned))
+		return same, pruned, nil
 	}
 
 	s.LatestVersion++
 	s.Versions[s.LatestVersion] = bsValue
-	if err := kv.save(); err != nil {
+	s.setVersionInfo(s.LatestVersion, vi)
+	s.Labels = newLabels
+	s.Format = newFormat
+	s.ContentType = newType
+	s.MaxVersions = newMax
+	s.Description = newDesc
+	s.Immutable = newImmutable
+	if opts.Activate {
+		s.ActiveVersion = s.LatestVersion
+	}
+	pruned, undoPrune := s.prune(kv.versionLimit(s))
+	if err := kv.savePruned(pruned, canPrune); err != nil {
+		undoPrune()
 		delete(s.Versions, s.LatestVersion)
+		delete(s.VersionInfo, s.LatestVersion)
 		s.LatestVersion--
-		return 0, err
+		s.Labels = oldLabels
+		s.Format = oldFormat
+		s.ContentType = oldType
+		s.MaxVersions = oldMax
+		s.Description = oldDesc
+		s.Immutable = oldImmutable
+		s.ActiveVersion = oldActive
+		return 0, nil, err
 	}
-	return s.LatestVersion, nil
+	kv.addCounts(name, 0, 1-len(pruned))
+	return s.LatestVersion, pruned, nil
+}
+
+// savePruned saves kv after an update that pruned the specified versions,
+// unless versions were pruned and canPrune is false, in which case it reports
+// errPruneDenied without saving.
+func (kv *kv) savePruned(pruned []api.SecretVersion, canPrune bool) error {
+	if len(pruned) != 0 && !canPrune {
+		return errPruneDenied
+	}
+	return kv.save()
+}
+
+// sameVersionInfo reports whether the metadata for version matches vi, not
+// counting when and by whom they were created.
+func (s *secret) sameVersionInfo(version api.SecretVersion, vi *versionInfo) bool {
+	old := s.VersionInfo[version]
+	return old.expiresAt().Equal(vi.expiresAt()) && old.isTemplate() == vi.isTemplate()
 }
 
 // createVersion creates the specified version of the secret called name with
@@ -363,21 +1152,39 @@ func (kv *kv) put(name string, value []byte) (api.SecretVersion, error) {
 // secret's initial version. For a secret that already exists, createVersion
 // returns ErrVersionExists if the specified version ever had a value; otherwise,
 // createVersion sets the specified version to the given value and immediately
-// activates this version.
-func (kv *kv) createVersion(name string, version api.SecretVersion, value []byte) error {
+// activates this version. The new version is recorded as created by the
+// specified principal, and the settings in opts are applied.
+func (kv *kv) createVersion(name string, version api.SecretVersion, value []byte, opts CreateVersionOptions, by string) error {
+	vi := &versionInfo{
+		ExpiresAt: opts.ExpiresAt,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: by,
+		Template:  opts.Template,
+		Activated: true,
+	}
 	s := kv.secrets[name]
 	if s == nil {
-		kv.secrets[name] = &secret{
+		if _, ok := kv.aliases[name]; ok {
+			return fmt.Errorf("%w: %q is an alias", ErrAlreadyExists, name)
+		}
+		s = &secret{
 			LatestVersion: version,
 			ActiveVersion: version,
 			Versions: map[api.SecretVersion]byteString{
 				version: byteString(value),
 			},
+			Format:      opts.Format,
+			ContentType: opts.ContentType,
+			MaxVersions: opts.MaxVersions,
+			Immutable:   opts.Immutable,
 		}
+		s.setVersionInfo(version, vi)
+		kv.secrets[name] = s
 		if err := kv.save(); err != nil {
 			delete(kv.secrets, name)
 			return err
 		}
+		kv.addCounts(name, 1, 1)
 		return nil
 	}
 
@@ -386,63 +1193,137 @@ func (kv *kv) createVersion(name string, version api.SecretVersion, value []byte
 	if hasVersion || hadVersion {
 		return ErrVersionClaimed
 	}
+	if opts.Format == "" {
+		if err := s.checkFormat(value); err != nil {
+			return err
+		}
+	}
 
 	bsValue := byteString(value)
 	s.Versions[version] = bsValue
+	s.setVersionInfo(version, vi)
 	priorLatestVersion := s.LatestVersion
 	priorActiveVersion := s.ActiveVersion
+	oldFormat, oldType, oldMax, oldImmutable := s.Format, s.ContentType, s.MaxVersions, s.Immutable
 	s.LatestVersion = max(priorLatestVersion, version)
 	s.ActiveVersion = version
-	if err := kv.save(); err != nil {
+	s.Format = cmp.Or(opts.Format, oldFormat)
+	s.ContentType = cmp.Or(opts.ContentType, oldType)
+	s.MaxVersions = cmp.Or(opts.MaxVersions, oldMax)
+	s.Immutable = oldImmutable || opts.Immutable
+	if err := kv.saveActivated(name); err != nil {
 		delete(s.Versions, version)
+		delete(s.VersionInfo, version)
 		s.LatestVersion = priorLatestVersion
 		s.ActiveVersion = priorActiveVersion
+		s.Format, s.ContentType, s.MaxVersions, s.Immutable = oldFormat, oldType, oldMax, oldImmutable
 		return err
 	}
+	kv.addCounts(name, 0, 1)
 	return nil
 }
 
 // setActive changes the active version of the secret called name to
-// version.
-func (kv *kv) setActive(name string, version api.SecretVersion) error {
+// version, recording the specified principal as having activated it.
+func (kv *kv) setActive(name string, version api.SecretVersion, by string) error {
 	if version == api.SecretVersionDefault {
 		return errors.New("invalid version")
 	}
 	secret := kv.secrets[name]
 	if secret == nil {
-		return ErrNotFound
+		return ErrSecretNotFound
 	}
 	if _, ok := secret.Versions[version]; !ok {
-		return ErrNotFound
+		return ErrVersionNotFound
 	}
 	if secret.ActiveVersion == version {
 		return nil
 	}
 	old := secret.ActiveVersion
 	secret.ActiveVersion = version
-	if err := kv.save(); err != nil {
+	undo := secret.markActivated(version, by)
+	if err := kv.saveActivated(name); err != nil {
 		secret.ActiveVersion = old
+		undo()
 		return err
 	}
 	return nil
 }
 
-// deleteVersion deletes the specified version of a secret.
-func (kv *kv) deleteVersion(name string, version api.SecretVersion) error {
+// setActiveMany sets the active versions of several secrets, saving the
+// result once. If any secret or version does not exist, no changes are made.
+// Each activation is recorded as made by the specified principal.
+func (kv *kv) setActiveMany(reqs []api.ActivateRequest, by string) error {
+	for _, r := range reqs {
+		secret := kv.secrets[r.Name]
+		if secret == nil {
+			return fmt.Errorf("secret %q: %w", r.Name, ErrSecretNotFound)
+		} else if _, ok := secret.Versions[r.Version]; !ok || r.Version == api.SecretVersionDefault {
+			return fmt.Errorf("secret %q version %v: %w", r.Name, r.Version, ErrVersionNotFound)
+		}
+	}
+
+	old := make(map[string]api.SecretVersion)
+	var undo []func()
+	for _, r := range reqs {
+		secret := kv.secrets[r.Name]
+		if secret.ActiveVersion != r.Version {
+			old[r.Name] = secret.ActiveVersion
+			secret.ActiveVersion = r.Version
+			undo = append(undo, secret.markActivated(r.Version, by))
+		}
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	if err := kv.saveActivated(slices.Sorted(maps.Keys(old))...); err != nil {
+		for name, v := range old {
+			kv.secrets[name].ActiveVersion = v
+		}
+		for _, f := range undo {
+			f()
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteVersion deletes the specified version of a secret. If reactivate is
+// non-zero, that version is made active in the same update, as if by the
+// specified principal, so that the active version can be deleted. A version
+// of an immutable secret that was ever active is never deleted.
+func (kv *kv) deleteVersion(name string, version, reactivate api.SecretVersion, by string) error {
 	if version == api.SecretVersionDefault {
 		return errors.New("invalid version")
+	} else if reactivate == version {
+		return errors.New("cannot reactivate the version being deleted")
 	}
 	secret := kv.secrets[name]
 	if secret == nil {
-		return fmt.Errorf("secret %q: %w", name, ErrNotFound)
-	} else if version == secret.ActiveVersion {
+		return fmt.Errorf("secret %q: %w", name, ErrSecretNotFound)
+	} else if secret.Immutable && secret.wasActive(version) {
+		return fmt.Errorf("%w: cannot delete version %v of %q, which was active", api.ErrImmutable, version, name)
+	} else if version == secret.ActiveVersion && reactivate == api.SecretVersionDefault {
 		return errors.New("cannot delete active version")
 	}
 	old, ok := secret.Versions[version]
 	if !ok {
-		return fmt.Errorf("version %v: %w", version, ErrNotFound)
+		return fmt.Errorf("version %v: %w", version, ErrVersionNotFound)
 	}
+	oldActive := secret.ActiveVersion
+	undoActivate := func() {}
+	if reactivate != api.SecretVersionDefault {
+		if _, ok := secret.Versions[reactivate]; !ok {
+			return fmt.Errorf("version %v: %w", reactivate, ErrVersionNotFound)
+		}
+		if reactivate != oldActive {
+			secret.ActiveVersion = reactivate
+			undoActivate = secret.markActivated(reactivate, by)
+		}
+	}
+	oldInfo := secret.VersionInfo[version]
 	delete(secret.Versions, version)
+	delete(secret.VersionInfo, version)
 	if secret.DeletedVersions == nil {
 		secret.DeletedVersions = map[api.SecretVersion]bool{
 			version: true,
@@ -451,23 +1332,191 @@ func (kv *kv) deleteVersion(name string, version api.SecretVersion) error {
 		secret.DeletedVersions[version] = true
 	}
 
-	if err := kv.save(); err != nil {
+	if err := kv.saveActivated(name); err != nil {
 		secret.Versions[version] = old
+		secret.setVersionInfo(version, oldInfo)
 		delete(secret.DeletedVersions, version)
+		secret.ActiveVersion = oldActive
+		undoActivate()
 		return err
 	}
+	kv.addCounts(name, 0, -1)
 	return nil
 }
 
-// deleteSecret deletes all versions of a secret.
-func (kv *kv) deleteSecret(name string) error {
+// rename moves the secret called name to newName, which must not exist. An
+// immutable secret is moved only if override is true.
+func (kv *kv) rename(name, newName string, override bool) error {
+	secret := kv.secrets[name]
+	if secret == nil {
+		return ErrSecretNotFound
+	} else if secret.Immutable && !override {
+		return fmt.Errorf("%w: cannot rename %q", api.ErrImmutable, name)
+	} else if _, ok := kv.secrets[newName]; ok {
+		return ErrAlreadyExists
+	} else if _, ok := kv.aliases[newName]; ok {
+		return fmt.Errorf("%w: %q is an alias", ErrAlreadyExists, newName)
+	}
+	kv.secrets[newName] = secret
+	delete(kv.secrets, name)
+	if err := kv.save(); err != nil {
+		kv.secrets[name] = secret
+		delete(kv.secrets, newName)
+		return err
+	}
+	kv.addCounts(name, -1, -len(secret.Versions))
+	kv.addCounts(newName, 1, len(secret.Versions))
+	return nil
+}
+
+// deleteSecret deletes all versions of a secret. If soft is true, the secret
+// is kept as a tombstone recording its deletion by the specified principal,
+// replacing any earlier tombstone for the same name, so that it can be
+// restored by undelete. An immutable secret is deleted only if override is
+// true.
+func (kv *kv) deleteSecret(name string, soft bool, by string, override bool) error {
 	secret := kv.secrets[name]
 	if secret == nil {
 		return nil // the secret (already) has no version
+	} else if secret.Immutable && !override {
+		return fmt.Errorf("%w: cannot delete %q", api.ErrImmutable, name)
 	}
+	old := kv.deleted[name]
 	delete(kv.secrets, name)
+	if soft {
+		if kv.deleted == nil {
+			kv.deleted = make(map[string]*tombstone)
+		}
+		kv.deleted[name] = &tombstone{Secret: secret, DeletedAt: time.Now().UTC(), DeletedBy: by}
+	}
 	if err := kv.save(); err != nil {
 		kv.secrets[name] = secret
+		if old != nil {
+			kv.deleted[name] = old
+		} else {
+			delete(kv.deleted, name)
+		}
+		return err
+	}
+	kv.addCounts(name, -1, -len(secret.Versions))
+	return nil
+}
+
+// undelete restores the soft-deleted secret called name, if it was deleted
+// after the specified time. It reports ErrNotFound if there is no such
+// tombstone, and ErrAlreadyExists if a secret called name has since been
+// created.
+func (kv *kv) undelete(name string, after time.Time) error {
+	t := kv.deleted[name]
+	if t == nil || !t.DeletedAt.After(after) {
+		return ErrSecretNotFound
+	} else if _, ok := kv.secrets[name]; ok {
+		return ErrAlreadyExists
+	} else if _, ok := kv.aliases[name]; ok {
+		return fmt.Errorf("%w: %q is an alias", ErrAlreadyExists, name)
+	}
+	kv.secrets[name] = t.Secret
+	delete(kv.deleted, name)
+	if err := kv.save(); err != nil {
+		delete(kv.secrets, name)
+		kv.deleted[name] = t
+		return err
+	}
+	kv.addCounts(name, 1, len(t.Secret.Versions))
+	return nil
+}
+
+// purgeDeleted permanently removes the soft-deleted secrets that were
+// deleted at or before the specified time, and reports their names.
+func (kv *kv) purgeDeleted(before time.Time) ([]string, error) {
+	old := kv.deleted
+	var purged []string
+	for name, t := range kv.deleted {
+		if !t.DeletedAt.After(before) {
+			purged = append(purged, name)
+		}
+	}
+	if len(purged) == 0 {
+		return nil, nil
+	}
+	kv.deleted = maps.Clone(old)
+	for _, name := range purged {
+		delete(kv.deleted, name)
+	}
+	if err := kv.save(); err != nil {
+		kv.deleted = old
+		return nil, err
+	}
+	slices.Sort(purged)
+	return purged, nil
+}
+
+// resolve returns the name of the target of the alias called name, or name
+// itself if it is not an alias.
+func (kv *kv) resolve(name string) string {
+	if target, ok := kv.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// aliasesOf returns the names of the aliases whose target is the secret called
+// name, in sorted order.
+func (kv *kv) aliasesOf(name string) []string {
+	var names []string
+	for alias, target := range kv.aliases {
+		if target == name {
+			names = append(names, alias)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// setAlias makes name an alias for the secret called target, replacing the
+// target of any existing alias called name. It reports ErrAlreadyExists if a
+// secret called name exists, and ErrNotFound if target does not exist. An
+// alias cannot refer to another alias, or ErrInvalidName is reported, and an
+// alias cannot be made with the name of the missing target of other aliases,
+// or api.ErrAliasTarget is reported.
+func (kv *kv) setAlias(name, target string) error {
+	if _, ok := kv.secrets[name]; ok {
+		return fmt.Errorf("%w: %q is a secret", ErrAlreadyExists, name)
+	} else if aliases := kv.aliasesOf(name); len(aliases) != 0 {
+		return fmt.Errorf("%w: %q is the target of %q", api.ErrAliasTarget, name, aliases)
+	} else if _, ok := kv.aliases[target]; ok || target == name {
+		return fmt.Errorf("%w: target %q is an alias", ErrInvalidName, target)
+	} else if _, ok := kv.secrets[target]; !ok {
+		return fmt.Errorf("target %q: %w", target, ErrSecretNotFound)
+	}
+	old, hadOld := kv.aliases[name]
+	if hadOld && old == target {
+		return nil
+	}
+	if kv.aliases == nil {
+		kv.aliases = make(map[string]string)
+	}
+	kv.aliases[name] = target
+	if err := kv.save(); err != nil {
+		if hadOld {
+			kv.aliases[name] = old
+		} else {
+			delete(kv.aliases, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteAlias removes the alias called name, if it exists.
+func (kv *kv) deleteAlias(name string) error {
+	target, ok := kv.aliases[name]
+	if !ok {
+		return nil
+	}
+	delete(kv.aliases, name)
+	if err := kv.save(); err != nil {
+		kv.aliases[name] = target
 		return err
 	}
 	return nil
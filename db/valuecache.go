@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/creachadair/msync/throttle"
+	"github.com/tailscale/setec/types/api"
+)
+
+// valueCacheTTL is how long a value read by Get or GetVersion is reused for
+// later reads of the same secret version, if the database does not change.
+const valueCacheTTL = time.Second
+
+// valueKey identifies a value in a valueCache: a version of a secret, or its
+// active version if version is 0.
+type valueKey struct {
+	name    string
+	version api.SecretVersion
+}
+
+// flightKey identifies a read of a value at a write generation.
+type flightKey struct {
+	valueKey
+	gen uint64
+}
+
+// cachedValue is a value held by a valueCache.
+type cachedValue struct {
+	sv      *api.SecretValue
+	gen     uint64    // the write generation of the database it was read at
+	expires time.Time // when the entry must no longer be used
+}
+
+// valueCache coalesces concurrent reads of the same secret version and
+// briefly caches the values read, so that a burst of reads of one secret, as
+// when many replicas of a service start at once, looks the value up once.
+// Access is still checked and logged for each read before the cache is
+// consulted. An entry is used only while the write generation of the
+// database is unchanged, so any put, activation or deletion invalidates it.
+type valueCache struct {
+	// inflight coalesces reads of the same value at the same write
+	// generation, so that no caller gets a value read before a change it
+	// could have observed.
+	inflight throttle.Set[flightKey, *api.SecretValue]
+
+	mu      sync.Mutex
+	entries map[valueKey]cachedValue
+}
+
+// get returns the value for key as of the write generation gen, from the
+// cache if possible, or else from read. The read function reports the value,
+// the write generation it was read at, and when the version expires, if it
+// does. Each caller gets its own copy of the value.
+func (c *valueCache) get(key valueKey, gen uint64, read func() (*api.SecretValue, uint64, time.Time, error)) (*api.SecretValue, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && (e.gen != gen || !now.Before(e.expires)) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return cloneValue(e.sv), nil
+	}
+
+	sv, err := c.inflight.Call(context.Background(), flightKey{key, gen}, func(context.Context) (*api.SecretValue, error) {
+		sv, gen, expires, err := read()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		limit := now.Add(valueCacheTTL)
+		if expires.IsZero() || expires.After(limit) {
+			expires = limit
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.entries == nil {
+			c.entries = make(map[valueKey]cachedValue)
+		}
+		// Drop entries that can no longer be used, so the cache holds only
+		// values read recently.
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.entries[key] = cachedValue{sv: sv, gen: gen, expires: expires}
+		return sv, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloneValue(sv), nil
+}
+
+// cloneValue returns a copy of sv that does not share its value bytes.
+func cloneValue(sv *api.SecretValue) *api.SecretValue {
+	cp := *sv
+	cp.Value = bytes.Clone(sv.Value)
+	return &cp
+}
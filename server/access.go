@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tailscale/setec/acl"
+	"github.com/tailscale/setec/types/api"
+	"tailscale.com/metrics"
+)
+
+// accessStats records how often and how recently each secret has been read
+// since the server started, and exports metrics for the reads and
+// activations of selected secrets. The statistics are kept in memory only.
+type accessStats struct {
+	// metricNames are the patterns of secret names whose access counts and
+	// activations are exported as per-secret metrics. Other secrets are
+	// tracked, but not exported, to bound the cardinality of the metrics.
+	metricNames     []acl.Secret
+	counts          *metrics.LabelMap // :: secret name → count
+	activations     *metrics.LabelMap // :: secret name → count
+	lastActivations *metrics.LabelMap // :: secret name → Unix time of last activation
+
+	mu    sync.Mutex
+	stats map[string]*accessStat
+}
+
+type accessStat struct {
+	count int64
+	last  time.Time
+}
+
+func newAccessStats(metricNames []acl.Secret) *accessStats {
+	return &accessStats{
+		metricNames:     metricNames,
+		counts:          &metrics.LabelMap{Label: "secret"},
+		activations:     &metrics.LabelMap{Label: "secret"},
+		lastActivations: &metrics.LabelMap{Label: "secret"},
+		stats:           make(map[string]*accessStat),
+	}
+}
+
+// record notes a successful read of the secret called name.
+func (a *accessStats) record(name string) {
+	a.mu.Lock()
+	st := a.stats[name]
+	if st == nil {
+		st = new(accessStat)
+		a.stats[name] = st
+	}
+	st.count++
+	st.last = time.Now().UTC()
+	a.mu.Unlock()
+
+	if a.exported(name) {
+		a.counts.Add(name, 1)
+	}
+}
+
+// activated notes that a version of the secret called name was activated.
+func (a *accessStats) activated(name string) {
+	if a.exported(name) {
+		a.activations.Add(name, 1)
+		a.lastActivations.Get(name).Set(time.Now().Unix())
+	}
+}
+
+// exported reports whether metrics are exported for the secret called name.
+func (a *accessStats) exported(name string) bool {
+	return slices.ContainsFunc(a.metricNames, func(pat acl.Secret) bool { return pat.Match(name) })
+}
+
+// annotate fills in the access statistics for info.
+func (a *accessStats) annotate(info *api.SecretInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if st := a.stats[info.Name]; st != nil {
+		info.AccessCount = st.count
+		info.LastAccessedAt = st.last
+	}
+}
@@ -6,25 +6,189 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"google.golang.org/api/storage/v1"
+	"tailscale.com/atomicfile"
 )
 
+// A BackupTarget is a destination for database backups. The server writes a
+// copy of the database to each of its backup targets whenever the database
+// changes. The database file is already encrypted, so backups are simply
+// copies of its contents.
+type BackupTarget interface {
+	// String returns a short description of the target, such as
+	// "s3://bucket", for use in logs and metrics.
+	String() string
+
+	// WriteBackup stores data, the contents of the database file, as a
+	// backup taken at the specified time.
+	WriteBackup(ctx context.Context, data []byte, at time.Time) error
+}
+
+// S3Backup is a BackupTarget that uploads backups to an AWS S3 bucket, with
+// keys of the form "year/month/day/db-<RFC3339 time>.json".
+type S3Backup struct {
+	client *s3.Client
+	bucket string
+}
+
+// NewS3Backup returns a BackupTarget for the specified S3 bucket in region,
+// using ambient AWS credentials. If assumeRole is non-empty, that IAM role is
+// assumed to write backups.
+func NewS3Backup(ctx context.Context, bucket, region, assumeRole string) (*S3Backup, error) {
+	return NewS3BackupWithOptions(ctx, bucket, S3BackupOptions{
+		Region:     region,
+		AssumeRole: assumeRole,
+	})
+}
+
+// S3BackupOptions are settings for NewS3BackupWithOptions. A zero value uses
+// ambient AWS credentials, as found by the AWS SDK, without assuming a role.
+type S3BackupOptions struct {
+	// Region is the AWS region the bucket is in.
+	Region string
+
+	// AssumeRole, if non-empty, is an IAM role to assume to access the
+	// bucket.
+	AssumeRole string
+
+	// CredentialsFile, if non-empty, is an AWS shared credentials file to
+	// read credentials from, instead of the default locations.
+	CredentialsFile string
+
+	// Profile, if non-empty, is the profile to use from the AWS shared
+	// credentials and config files, instead of the default profile.
+	Profile string
+
+	// WebIdentityTokenFile, if non-empty, is a file holding an OpenID
+	// Connect token, such as a Kubernetes service account token, that is
+	// exchanged for credentials for AssumeRole, which must be set. No other
+	// credentials are needed. The file is read again whenever the
+	// credentials are refreshed, so the token can be rotated.
+	WebIdentityTokenFile string
+}
+
+// NewS3BackupWithOptions returns a BackupTarget for the specified S3 bucket,
+// using the credentials described by opts. It obtains credentials, and
+// assumes the role if one is set, before it returns, so that a problem with
+// them is reported now rather than when the first backup is written.
+func NewS3BackupWithOptions(ctx context.Context, bucket string, opts S3BackupOptions) (*S3Backup, error) {
+	if opts.WebIdentityTokenFile != "" && opts.AssumeRole == "" {
+		return nil, errors.New("creating backups S3 client: a web identity token file requires a role to assume")
+	}
+	cfg, err := awsConfig(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("creating backups S3 client: %w", err)
+	}
+	if err := checkAWSCredentials(ctx, cfg, opts.AssumeRole); err != nil {
+		return nil, fmt.Errorf("creating backups S3 client: %w", err)
+	}
+	return &S3Backup{client: s3.NewFromConfig(cfg), bucket: bucket}, nil
+}
+
+func (b *S3Backup) String() string { return "s3://" + b.bucket }
+
+// Check reports whether the bucket exists and the credentials of b can
+// access it, without writing a backup. It requires permission to read the
+// bucket (s3:ListBucket) as well as the credentials used for writing.
+func (b *S3Backup) Check(ctx context.Context) error {
+	_, err := b.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &b.bucket})
+	return err
+}
+
+func (b *S3Backup) WriteBackup(ctx context.Context, data []byte, at time.Time) error {
+	key := backupKey(at)
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &b.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// GCSBackup is a BackupTarget that uploads backups to a Google Cloud Storage
+// bucket, with the same object names as S3Backup.
+type GCSBackup struct {
+	svc    *storage.Service
+	bucket string
+}
+
+// NewGCSBackup returns a BackupTarget for the specified GCS bucket, using
+// application default credentials.
+func NewGCSBackup(ctx context.Context, bucket string) (*GCSBackup, error) {
+	svc, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating backups GCS client: %w", err)
+	}
+	return &GCSBackup{svc: svc, bucket: bucket}, nil
+}
+
+func (b *GCSBackup) String() string { return "gs://" + b.bucket }
+
+// Check reports whether the bucket exists and the credentials of b can
+// access it, without writing a backup. It requires permission to read the
+// bucket metadata (storage.buckets.get).
+func (b *GCSBackup) Check(ctx context.Context) error {
+	_, err := b.svc.Buckets.Get(b.bucket).Context(ctx).Do()
+	return err
+}
+
+func (b *GCSBackup) WriteBackup(ctx context.Context, data []byte, at time.Time) error {
+	_, err := b.svc.Objects.Insert(b.bucket, &storage.Object{Name: backupKey(at)}).
+		Media(bytes.NewReader(data)).Context(ctx).Do()
+	return err
+}
+
+// DirBackup is a BackupTarget that writes backups to timestamped files in a
+// local directory, keeping at most Retain of them.
+type DirBackup struct {
+	// Dir is the directory where backups are written.
+	Dir string
+
+	// Retain is the maximum number of backups to keep in Dir. When a new
+	// backup is written, the oldest backups beyond this number are removed.
+	// If zero or negative, all backups are kept.
+	Retain int
+}
+
+// NewDirBackup returns a BackupTarget for the specified local directory,
+// creating it if necessary.
+func NewDirBackup(dir string, retain int) (*DirBackup, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating backup directory: %w", err)
+	}
+	return &DirBackup{Dir: dir, Retain: retain}, nil
+}
+
+func (b *DirBackup) String() string { return b.Dir }
+
+func (b *DirBackup) WriteBackup(ctx context.Context, data []byte, at time.Time) error {
+	out := filepath.Join(b.Dir, backupFileName(at))
+	if err := atomicfile.WriteFile(out, data, 0600); err != nil {
+		return err
+	}
+	if err := pruneBackupDir(b.Dir, b.Retain); err != nil {
+		log.Printf("Failed to prune old backups in %s: %v", b.Dir, err)
+	}
+	return nil
+}
+
 func (s *Server) periodicBackup(ctx context.Context) {
-	lastWriteGen := uint64(0)
+	// lastGen[i] is the write generation last backed up to target i.
+	lastGen := make([]uint64, len(s.backups))
 	for {
-		gen := s.db.WriteGen()
-		if gen != lastWriteGen {
-			if err := s.doBackup(ctx); err != nil {
-				log.Printf("Failed to take backup: %v", err)
-			} else {
-				lastWriteGen = gen
-			}
+		if err := s.doBackup(ctx, lastGen); err != nil {
+			log.Printf("Failed to take backup: %v", err)
 		}
 		select {
 		case <-time.After(time.Minute):
@@ -34,35 +198,172 @@ func (s *Server) periodicBackup(ctx context.Context) {
 	}
 }
 
-func (s *Server) doBackup(ctx context.Context) error {
+// doBackup writes a copy of the database to each backup target whose last
+// backup, according to lastGen, is older than the current write generation,
+// and updates lastGen and the time of the last backup for the targets that
+// succeed. A failure writing to one target does not prevent writing to the
+// others; failures are counted in the server metrics and reported together.
+func (s *Server) doBackup(ctx context.Context, lastGen []uint64) (err error) {
+	gen := s.db.WriteGen()
+	if !slices.ContainsFunc(lastGen, func(g uint64) bool { return g != gen }) {
+		return nil // all targets are up to date
+	}
+	defer s.recordBackup(time.Now(), &err)
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
 
-	start := time.Now()
-
 	path := s.db.Path()
+	if path == "" {
+		return errors.New("database is in memory")
+	}
 	bs, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
+	name := filepath.Base(path)
+	now := time.Now().Round(time.Second)
 
-	key := backupKey()
+	var errs []error
+	for i, t := range s.backups {
+		if lastGen[i] == gen {
+			continue
+		}
+		start := time.Now()
+		if err := t.WriteBackup(ctx, bs, now); err != nil {
+			s.countBackupErrors.Add(t.String(), 1)
+			errs = append(errs, fmt.Errorf("backup to %s: %w", t, err))
+			continue
+		}
+		s.countBackups.Add(t.String(), 1)
+		s.countBackupBytes.Add(t.String(), int64(len(bs)))
+		s.lastBackupTimes.Get(t.String()).Set(now.Unix())
+		lastGen[i] = gen
+		log.Printf("Backed up file %q to %s. Took %v", name, t, time.Since(start).Round(time.Millisecond))
+	}
+	s.updateLastBackup()
+	return errors.Join(errs...)
+}
 
-	_, err = s.backupClient.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &s.backupBucket,
+// updateLastBackup records the time as of which every backup target has a
+// backup, for the health check: the oldest of the last successful backups to
+// each target. It records nothing until every target has a backup.
+func (s *Server) updateLastBackup() {
+	var oldest int64
+	for i, t := range s.backups {
+		at := s.lastBackupTimes.Get(t.String()).Value()
+		if at == 0 {
+			return
+		} else if i == 0 || at < oldest {
+			oldest = at
+		}
+	}
+	if len(s.backups) != 0 {
+		t := time.Unix(oldest, 0)
+		s.lastBackup.Store(&t)
+	}
+}
+
+// recordBackup records the duration of a backup that began at start, and the
+// error *errp it reported, for the server metrics and health check. A backup
+// that succeeds for every target clears the last error.
+func (s *Server) recordBackup(start time.Time, errp *error) {
+	s.backupSeconds.Set(time.Since(start).Seconds())
+	if err := *errp; err != nil {
+		msg := err.Error()
+		s.lastBackupError.Store(&msg)
+	} else {
+		s.lastBackupError.Store(nil)
+	}
+}
+
+// ReadBackup reads the contents of a database backup from src, which is either
+// a local file path or an S3 URL of the form "s3://bucket/key". For an S3 URL,
+// region is the AWS region of the bucket, and ambient AWS credentials are used.
+// The contents are returned as stored, still encrypted.
+func ReadBackup(ctx context.Context, src, region string) ([]byte, error) {
+	return ReadBackupWithOptions(ctx, src, S3BackupOptions{Region: region})
+}
+
+// ReadBackupWithOptions is as ReadBackup, but for an S3 URL it uses the
+// region and credentials described by opts, as NewS3BackupWithOptions does.
+// The options are ignored for a local file path.
+func ReadBackupWithOptions(ctx context.Context, src string, opts S3BackupOptions) ([]byte, error) {
+	loc, ok := strings.CutPrefix(src, "s3://")
+	if !ok {
+		return os.ReadFile(src)
+	}
+	bucket, key, ok := strings.Cut(loc, "/")
+	if !ok || bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q, want s3://bucket/key", src)
+	}
+	if opts.WebIdentityTokenFile != "" && opts.AssumeRole == "" {
+		return nil, errors.New("a web identity token file requires a role to assume")
+	}
+	client, err := makeS3Client(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
 		Key:    &key,
-		Body:   bytes.NewReader(bs),
 	})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("fetching backup: %w", err)
 	}
-
-	name := filepath.Base(path)
-	log.Printf("Uploaded file %q to %s/%s. Took %v", name, s.backupBucket, key, time.Since(start).Round(time.Millisecond))
-	return nil
+	defer obj.Body.Close()
+	return io.ReadAll(obj.Body)
 }
 
-func backupKey() string {
-	now := time.Now().Round(time.Second)
+func backupKey(now time.Time) string {
 	return fmt.Sprintf("%d/%d/%d/db-%s.json", now.Year(), now.Month(), now.Day(), now.Format(time.RFC3339))
 }
+
+// backupFileName returns the name of a backup file in a local backup
+// directory for a backup taken at now. Names sort in chronological order.
+func backupFileName(now time.Time) string {
+	return "db-" + now.UTC().Format("20060102T150405Z") + ".json"
+}
+
+// BackupTime reports the time a backup was taken, as recorded in the name of
+// the backup file or S3 object at src by the server that wrote it. It reports
+// false if the name is not that of a backup written by the server.
+func BackupTime(src string) (time.Time, bool) {
+	name := filepath.Base(src)
+	stamp, ok := strings.CutPrefix(name, "db-")
+	if !ok {
+		return time.Time{}, false
+	}
+	stamp, ok = strings.CutSuffix(stamp, ".json")
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{time.RFC3339, "20060102T150405Z"} {
+		if t, err := time.Parse(layout, stamp); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// pruneBackupDir removes the oldest backup files from dir, so that at most
+// retain backups remain. If retain <= 0, no backups are removed.
+func pruneBackupDir(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, "db-*.json"))
+	if err != nil {
+		return err
+	}
+	if len(backups) <= retain {
+		return nil
+	}
+	slices.Sort(backups) // chronological, see backupFileName
+	var errs []error
+	for _, old := range backups[:len(backups)-retain] {
+		if err := os.Remove(old); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxExemplars is the number of recent notable events kept to serve as
+// exemplars.
+const maxExemplars = 64
+
+// exemplars is a ring buffer of recent notable API events, such as requests
+// that were denied, with the IDs of the requests that caused them. When
+// metrics are served in the OpenMetrics format, the most recent event for
+// each counter and method is attached to its sample as an exemplar, so that
+// a spike in a counter can be traced to audit log entries.
+type exemplars struct {
+	mu     sync.Mutex
+	events [maxExemplars]exemplar
+	next   int // index of the slot for the next event
+}
+
+type exemplar struct {
+	metric    string // metric name, as passed to metrics.Set
+	method    string // API method
+	requestID string
+	at        time.Time
+}
+
+// add records an event counted by the named metric for apiMethod, caused by
+// the request with the given ID. Events without a request ID are ignored.
+func (e *exemplars) add(metric, apiMethod, requestID string) {
+	if requestID == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events[e.next] = exemplar{
+		metric:    metric,
+		method:    apiMethod,
+		requestID: requestID,
+		at:        time.Now(),
+	}
+	e.next = (e.next + 1) % len(e.events)
+}
+
+// latest returns the most recent event for each metric and method, keyed by
+// the name and labels of the sample it belongs to in the Prometheus output of
+// Server.Metrics.
+func (e *exemplars) latest() map[string]exemplar {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := make(map[string]exemplar)
+	for _, ev := range e.events {
+		if ev.requestID == "" {
+			continue
+		}
+		key := fmt.Sprintf("setec_%s{method=%q}", strings.TrimPrefix(ev.metric, "counter_"), ev.method)
+		if old, ok := m[key]; !ok || ev.at.After(old.at) {
+			m[key] = ev
+		}
+	}
+	return m
+}
+
+// writeOpenMetrics writes the metrics in prom, in the Prometheus text format,
+// to w in the OpenMetrics text format, with the events in ex attached to
+// their samples as exemplars.
+func writeOpenMetrics(w io.Writer, prom string, ex map[string]exemplar) {
+	counters := make(map[string]bool)
+	for line := range strings.Lines(prom) {
+		line = strings.TrimSuffix(line, "\n")
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, typ, _ := strings.Cut(rest, " ")
+			switch typ {
+			case "counter":
+				counters[name] = true
+			case "untyped":
+				typ = "unknown"
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			continue
+		} else if line == "" || strings.HasPrefix(line, "#") {
+			continue // OpenMetrics does not permit other comments
+		}
+
+		name, labels, value, ok := parseSample(line)
+		if !ok {
+			continue
+		}
+		sample := line[:len(line)-len(value)-1]
+		if counters[name] {
+			// OpenMetrics requires counter samples to have a _total suffix.
+			name += "_total"
+		}
+		io.WriteString(w, name)
+		writeLabels(w, labels)
+		fmt.Fprintf(w, " %s", value)
+		if e, ok := ex[sample]; ok {
+			fmt.Fprintf(w, " # {request_id=%q} 1 %.3f", e.requestID, float64(e.at.UnixMilli())/1000)
+		}
+		io.WriteString(w, "\n")
+	}
+	io.WriteString(w, "# EOF\n")
+}
+
+// label is a label name and its unquoted value.
+type label struct{ name, value string }
+
+// parseSample parses a sample line of the Prometheus output of
+// Server.Metrics into the metric name, its labels, and its value. Label
+// values are quoted as Go strings, and may contain any character, such as
+// the spaces and quotes of a backup directory path, so they are unquoted
+// rather than split on separators.
+func parseSample(line string) (name string, labels []label, value string, ok bool) {
+	i := strings.IndexAny(line, "{ ")
+	if i < 0 {
+		return "", nil, "", false
+	}
+	name, rest := line[:i], line[i:]
+	if rest, ok = strings.CutPrefix(rest, "{"); ok {
+		for !strings.HasPrefix(rest, "}") {
+			k, v, ok := strings.Cut(rest, "=")
+			if !ok {
+				return "", nil, "", false
+			}
+			q, err := strconv.QuotedPrefix(v)
+			if err != nil {
+				return "", nil, "", false
+			}
+			uq, err := strconv.Unquote(q)
+			if err != nil {
+				return "", nil, "", false
+			}
+			labels = append(labels, label{k, uq})
+			rest = strings.TrimPrefix(v[len(q):], ",")
+		}
+		rest = rest[1:]
+	}
+	value, ok = strings.CutPrefix(rest, " ")
+	if !ok || value == "" || strings.Contains(value, " ") {
+		return "", nil, "", false
+	}
+	return name, labels, value, true
+}
+
+// escapeLabel escapes a label value as OpenMetrics requires.
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeLabels writes labels to w as an OpenMetrics label set, or nothing if
+// there are none.
+func writeLabels(w io.Writer, labels []label) {
+	if len(labels) == 0 {
+		return
+	}
+	io.WriteString(w, "{")
+	for i, l := range labels {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		fmt.Fprintf(w, `%s="%s"`, l.name, escapeLabel.Replace(l.value))
+	}
+	io.WriteString(w, "}")
+}
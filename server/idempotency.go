@@ -0,0 +1,144 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+)
+
+// errBadIdempotencyKey is reported when a put request has an idempotency key
+// that is too long, or that was recently used for a different request.
+var errBadIdempotencyKey = errors.New("invalid idempotency key")
+
+const (
+	// idempotencyTTL is how long the result of a put with an idempotency key
+	// is remembered. It needs to cover only the retries of a single call.
+	idempotencyTTL = 10 * time.Minute
+
+	// maxIdempotencyKeys is the number of recent idempotency keys the server
+	// remembers. Once it is reached, keys are not recorded until old ones
+	// expire, so further puts are applied without deduplication.
+	maxIdempotencyKeys = 10000
+
+	// maxIdempotencyKeyLength is the maximum length in bytes of an
+	// idempotency key.
+	maxIdempotencyKeyLength = 128
+)
+
+// idempotencyKeys remembers the versions assigned to recent put requests that
+// carried an idempotency key, so that retries of those requests do not create
+// additional versions. Keys are kept in memory only.
+type idempotencyKeys struct {
+	// mu protects seen. It is not held while a put is applied; instead, a
+	// retry that arrives while the original request is still in progress
+	// waits for the pending entry of the original to be done, rather than
+	// creating a version of its own.
+	mu   sync.Mutex
+	seen map[idempotencyKey]*idempotentPut
+}
+
+// idempotencyKey identifies a put request. Keys are scoped to the caller and
+// the secret, so one caller cannot observe the results of another's puts.
+type idempotencyKey struct {
+	caller, secret, key string
+}
+
+type idempotentPut struct {
+	request [sha256.Size]byte // hash of the request, excluding the key
+	done    chan struct{}     // closed once the put has been applied or failed
+
+	// The following fields are set before done is closed.
+	applied bool // whether the put succeeded
+	version api.SecretVersion
+	at      time.Time
+}
+
+// pending reports whether the put for p is still being applied.
+func (p *idempotentPut) pending() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func newIdempotencyKeys() *idempotencyKeys {
+	return &idempotencyKeys{seen: make(map[idempotencyKey]*idempotentPut)}
+}
+
+// put calls put to apply req on behalf of caller, unless req has the same
+// idempotency key as a recent request, in which case it reports the version
+// assigned to that request without calling put. It reports an error wrapping
+// errBadIdempotencyKey if the recent request differed from req.
+func (k *idempotencyKeys) put(caller string, req api.PutRequest, put func() (api.SecretVersion, error)) (api.SecretVersion, error) {
+	if req.IdempotencyKey == "" {
+		return put()
+	} else if len(req.IdempotencyKey) > maxIdempotencyKeyLength {
+		return 0, fmt.Errorf("%w: key is longer than %d bytes", errBadIdempotencyKey, maxIdempotencyKeyLength)
+	}
+	ik := idempotencyKey{caller: caller, secret: req.Name, key: req.IdempotencyKey}
+	req.IdempotencyKey = ""
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.Sum256(bs)
+
+	for {
+		k.mu.Lock()
+		now := time.Now()
+		p := k.seen[ik]
+		if p != nil && (p.pending() || now.Sub(p.at) < idempotencyTTL) {
+			k.mu.Unlock()
+			if p.request != hash {
+				return 0, fmt.Errorf("%w: key was used for a different request", errBadIdempotencyKey)
+			}
+			<-p.done
+			if p.applied {
+				return p.version, nil
+			}
+			continue // the original request failed, so apply this one
+		}
+
+		if len(k.seen) >= maxIdempotencyKeys {
+			k.pruneLocked(now)
+		}
+		if len(k.seen) >= maxIdempotencyKeys {
+			k.mu.Unlock()
+			return put()
+		}
+		p = &idempotentPut{request: hash, done: make(chan struct{})}
+		k.seen[ik] = p
+		k.mu.Unlock()
+
+		v, err := put()
+		k.mu.Lock()
+		if err != nil {
+			delete(k.seen, ik)
+		} else {
+			p.applied, p.version, p.at = true, v, time.Now()
+		}
+		close(p.done)
+		k.mu.Unlock()
+		return v, err
+	}
+}
+
+// pruneLocked discards keys that have expired. Keys whose puts are still
+// being applied are kept.
+func (k *idempotencyKeys) pruneLocked(now time.Time) {
+	for ik, p := range k.seen {
+		if !p.pending() && now.Sub(p.at) >= idempotencyTTL {
+			delete(k.seen, ik)
+		}
+	}
+}
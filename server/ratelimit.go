@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"tailscale.com/tstime/rate"
+)
+
+// callerLimiter enforces a separate token-bucket rate limit for each caller.
+type callerLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+// maxIdleLimiters is the number of per-caller limiters kept before idle ones
+// are discarded. A discarded limiter is recreated with a full bucket.
+const maxIdleLimiters = 1024
+
+// newCallerLimiter returns a limiter allowing each caller perSecond requests
+// per second, with bursts of up to burst requests. If perSecond is zero or
+// negative, it returns nil, which allows all requests. If burst is less than
+// one, a burst of max(1, perSecond) is used.
+func newCallerLimiter(perSecond float64, burst int) *callerLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = max(1, int(perSecond))
+	}
+	return &callerLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// allow reports whether a request by the caller identified by key may
+// proceed now. A nil limiter allows all requests.
+func (c *callerLimiter) allow(key string) bool {
+	if c == nil {
+		return true
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	e := c.limiters[key]
+	if e == nil {
+		if len(c.limiters) >= maxIdleLimiters {
+			c.pruneLocked(now)
+		}
+		e = &limiterEntry{lim: rate.NewLimiter(c.limit, c.burst)}
+		c.limiters[key] = e
+	}
+	e.lastSeen = now
+	c.mu.Unlock()
+
+	return e.lim.Allow()
+}
+
+// pruneLocked discards limiters that have been idle long enough for their
+// buckets to refill completely, so that dropping them has no effect.
+func (c *callerLimiter) pruneLocked(now time.Time) {
+	refill := time.Duration(float64(c.burst) / float64(c.limit) * float64(time.Second))
+	for key, e := range c.limiters {
+		if now.Sub(e.lastSeen) > refill {
+			delete(c.limiters, key)
+		}
+	}
+}
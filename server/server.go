@@ -5,6 +5,7 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"embed"
 	"encoding/json"
@@ -12,9 +13,16 @@ import (
 	"expvar"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
 	"net/netip"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -25,10 +33,13 @@ import (
 	"github.com/tailscale/setec/audit"
 	"github.com/tailscale/setec/db"
 	"github.com/tailscale/setec/types/api"
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/keyset"
 	"github.com/tink-crypto/tink-go/v2/tink"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/metrics"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tsweb/varz"
 )
 
 // Config is the configuration for a Server.
@@ -46,10 +57,107 @@ type Config struct {
 	// It must be set if DB is nil.
 	Key tink.AEAD
 
-	// AuditLog is the writer to use for audit logs.
-	// It must be set if DB is nil.
+	// CompressDB, if true, compresses the database contents before they are
+	// encrypted and written to DBPath. The server opens both compressed and
+	// uncompressed databases, and rewrites the database on startup if its
+	// format does not match this setting. Backups are copies of the database
+	// file, so they are compressed too. It is ignored if DB is set.
+	CompressDB bool
+
+	// SizeMetrics, if true, exports the size of the database file in the
+	// gauge_db_size_bytes metric, and the bytes written to each backup target
+	// in counter_backup_bytes. With CompressDB, the size depends on how
+	// well secret values compress together, so a caller who can store
+	// values and watch the metric could guess at other values. Enable it
+	// only if the metrics are not public.
+	SizeMetrics bool
+
+	// NoAuditFingerprints, if true, omits the fingerprints of secret values
+	// from audit log entries. See db.OpenOptions. It is ignored if DB is set.
+	NoAuditFingerprints bool
+
+	// WriteTags, if non-empty, restricts all operations other than reads
+	// (get and info) to callers that are tagged nodes with at least one of
+	// these tags, such as "tag:secret-admin". Other callers keep only the
+	// read permissions granted to them by the tailnet policy, so their
+	// attempts to write are denied and recorded as such in the audit log.
+	// If empty, writes are governed by the policy alone.
+	WriteTags []string
+
+	// Authorize, if non-nil, is called to check each action on a secret that
+	// the caller's permissions allow, and may deny it by reporting an error.
+	// It can implement additional policy, such as consulting an external
+	// entitlement service, but cannot grant access the tailnet policy does
+	// not. The context is that of the API request. Denials are recorded in
+	// the audit log with the error text as the reason. When listing secrets,
+	// it is called once with acl.ActionInfo and an empty secret name. If
+	// nil, access is governed by the tailnet policy alone.
+	Authorize func(ctx context.Context, caller db.Caller, action acl.Action, secret string) error
+
+	// ReadOnly, if true, makes the server reject all requests that would
+	// modify the database with an error wrapping api.ErrReadOnly, while
+	// serving reads normally. Soft-deleted secrets are not purged. This is
+	// meant for standby servers that mirror another server's backups.
+	ReadOnly bool
+
+	// AccessMetrics are patterns of secret names, which may contain "*"
+	// wildcards, for which the server exports the number of successful
+	// reads of each matching secret in the counter_secret_gets metric, and
+	// the number and time of its activations in counter_secret_activations
+	// and gauge_last_activation_timestamp_seconds. The metrics have one
+	// label per secret, so the patterns should be chosen to bound their
+	// cardinality. Access counts and times for all secrets are reported by
+	// the info API method regardless, and activations of all secrets are
+	// counted in counter_activations. An activation is any change of the
+	// active version of an existing secret, including by a put or by
+	// deleting a version; a request that leaves it unchanged is not counted.
+	AccessMetrics []acl.Secret
+
+	// DeleteRetention, if positive, enables soft deletion: deleted secrets
+	// are kept for this long, during which they can be restored with the
+	// undelete API method, and are then purged permanently. If zero, secrets
+	// are deleted immediately. It is ignored if DB is set, but the server
+	// purges expired secrets in any case. See db.OpenOptions.
+	DeleteRetention time.Duration
+
+	// ProtectAliasTargets, if true, makes the server refuse to delete or
+	// rename a secret that is the target of an alias, with an error wrapping
+	// api.ErrAliasTarget. Otherwise, such aliases are left broken. It is
+	// ignored if DB is set. See db.OpenOptions.
+	ProtectAliasTargets bool
+
+	// MaxVersionsPerSecret, if positive, is the number of versions kept for
+	// each secret that does not set a limit of its own with a put. When a put
+	// exceeds it, the oldest versions other than the active and the newest
+	// are deleted, and each deletion is recorded in the audit log. It is
+	// ignored if DB is set. See db.OpenOptions.
+	MaxVersionsPerSecret int
+
+	// DedupePuts, if true, makes a put of the value of the active version of
+	// a secret report that version instead of adding a redundant one, unless
+	// the request sets AllowDuplicate. It is ignored if DB is set. See
+	// db.OpenOptions.DedupeActive.
+	DedupePuts bool
+
+	// AuditLog is the writer to use for audit logs. Use audit.NewFile to log
+	// to a file, or audit.New to send entries to any io.Writer. If it is nil
+	// and AuditLogPath is set, the server opens that file itself, and closes
+	// it when Close is called; an AuditLog given here is left to the caller
+	// to close. One or the other must be set if DB is nil.
 	AuditLog *audit.Writer
 
+	// AuditLogPath, if non-empty, is the path of the file AuditLog writes
+	// to. It is used to answer audit queries, including entries in files
+	// rotated out of it; if it is empty, the server reports
+	// api.ErrAuditUnavailable for them.
+	AuditLogPath string
+
+	// AuditLogMaxBytes and AuditLogMaxFiles control rotation of the audit log
+	// file, when the server opens it from AuditLogPath. They are ignored if
+	// AuditLog is set. See audit.FileOptions.
+	AuditLogMaxBytes int64
+	AuditLogMaxFiles int
+
 	// WhoIs is a function that reports an identity for a client IP
 	// address. Outside of tests, it will be the WhoIs of a Tailscale
 	// LocalClient.
@@ -76,26 +184,93 @@ type Config struct {
 	// BackupAssumeRole is an AWS IAM role to assume to access the
 	// backup bucket. The role assumption is requested using the
 	// process's ambient AWS permissions, as autoconfigured by the AWS
-	// SDK. If BackupAssumeRole is empty, backups are written without
-	// assuming a role.
+	// SDK, or the credentials given by the options below. If
+	// BackupAssumeRole is empty, backups are written without assuming a
+	// role.
 	BackupAssumeRole string
+
+	// BackupCredentialsFile, BackupProfile and BackupWebIdentityTokenFile,
+	// if set, choose the credentials used to access the backup bucket,
+	// instead of the ambient ones. See S3BackupOptions. If credentials
+	// cannot be obtained, or the role cannot be assumed, New reports an
+	// error.
+	BackupCredentialsFile      string
+	BackupProfile              string
+	BackupWebIdentityTokenFile string
+
+	// BackupDir, if non-empty, is a local directory to which database
+	// backups should be saved, as an alternative or in addition to S3.
+	// Backups are written to timestamped files, in the same format as the
+	// backups uploaded to S3.
+	BackupDir string
+
+	// BackupDirRetain is the maximum number of backups to keep in BackupDir.
+	// When a new backup is written, the oldest backups beyond this number
+	// are removed. If zero or negative, all backups are kept.
+	BackupDirRetain int
+
+	// BackupTargets are additional destinations to which database backups
+	// should be saved, alongside any configured by BackupBucket and
+	// BackupDir. Each target is written independently: a failure writing
+	// to one target is logged and counted in the server metrics, but does
+	// not prevent backups to the others.
+	BackupTargets []BackupTarget
+
+	// MaxSecretBytes is the maximum size in bytes of a secret value that the
+	// server accepts in a put or create-version request. If zero or negative,
+	// api.DefaultMaxValueBytes is used.
+	MaxSecretBytes int
+
+	// RateLimit, if positive, is the maximum sustained rate of API requests
+	// per second allowed for each caller, identified by tailnet user login
+	// name or, for tagged nodes, by hostname. Requests beyond the limit are
+	// rejected with 429 Too Many Requests. The health check is not limited.
+	// If zero or negative, requests are not rate limited.
+	RateLimit float64
+
+	// RateBurst is the maximum number of requests a caller may make in a
+	// burst above RateLimit. If zero, max(1, RateLimit) is used.
+	RateBurst int
 }
 
 // Server is a secrets HTTP server.
 type Server struct {
-	db           *db.DB
-	whois        func(context.Context, string) (*apitype.WhoIsResponse, error)
-	tmpl         *template.Template
-	backupClient *s3.Client
-	backupBucket string
+	ctx             context.Context // governs background tasks and watchers
+	db              *db.DB
+	mux             *http.ServeMux // where the handlers are registered
+	whois           func(context.Context, string) (*apitype.WhoIsResponse, error)
+	tmpl            *template.Template
+	backups         []BackupTarget
+	auditPath       string                    // audit log file to read for queries, or ""
+	ownLog          *audit.Writer             // audit log opened by New, or nil
+	maxValue        int                       // maximum size of a secret value in bytes
+	lastBackup      atomic.Pointer[time.Time] // time as of which every target has a backup
+	lastBackupError atomic.Pointer[string]    // error from the last backup, or nil
+	limiter         *callerLimiter            // per-caller rate limits, or nil
+	access          *accessStats              // per-secret read statistics
+	writeTags       []string                  // tags required for writes, or nil
+	idempotency     *idempotencyKeys          // recent idempotent puts
+	uploads         *uploads                  // chunked uploads in progress
+	readOnly        bool                      // reject requests that modify the database
+	sizeMetrics     bool                      // export the stored size of the database
+	authorize       func(context.Context, db.Caller, acl.Action, string) error
 
 	// Metrics
 	countCalls             *metrics.LabelMap // :: method name → count
 	countCallBadRequest    *metrics.LabelMap // :: method name → count
 	countCallForbidden     *metrics.LabelMap // :: method name → count
 	countCallNotFound      *metrics.LabelMap // :: method name → count
+	countCallExpired       *metrics.LabelMap // :: method name → count
 	countCallInternalError *metrics.LabelMap // :: method name → count
 	countCallAlreadySet    *metrics.LabelMap // :: method name → count
+	countCallRateLimited   *metrics.LabelMap // :: method name → count
+	countBackups           *metrics.LabelMap // :: backup target → count
+	countBackupErrors      *metrics.LabelMap // :: backup target → count
+	countBackupBytes       *metrics.LabelMap // :: backup target → bytes written
+	lastBackupTimes        *metrics.LabelMap // :: backup target → Unix time of last success
+	backupSeconds          *expvar.Float     // duration of the last backup
+	countActivations       *expvar.Int       // versions activated
+	exemplars              *exemplars        // recent notable events, for exemplars
 }
 
 //go:embed templates
@@ -104,13 +279,38 @@ var dashboardTemplates embed.FS
 //go:embed static
 var staticFiles embed.FS
 
-// New creates a secret server and makes it ready to serve.
+// New creates a secret server and makes it ready to serve. If cfg.DBPath names
+// an existing database whose key does not authenticate with cfg.Key, New
+// reports an error wrapping [db.ErrWrongKey] before anything is served.
 func New(ctx context.Context, cfg Config) (*Server, error) {
 	kdb := cfg.DB
+	var ownLog *audit.Writer // an audit log opened here, closed by Close
 	if kdb == nil {
+		alog := cfg.AuditLog
+		if alog == nil && cfg.AuditLogPath != "" {
+			var err error
+			alog, err = audit.NewFileWithOptions(cfg.AuditLogPath, audit.FileOptions{
+				MaxBytes: cfg.AuditLogMaxBytes,
+				MaxFiles: cfg.AuditLogMaxFiles,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("opening audit log: %w", err)
+			}
+			ownLog = alog
+		}
 		var err error
-		kdb, err = db.Open(cfg.DBPath, cfg.Key, cfg.AuditLog)
+		kdb, err = db.OpenWithOptions(cfg.DBPath, cfg.Key, alog, db.OpenOptions{
+			Compress:            cfg.CompressDB,
+			NoAuditFingerprints: cfg.NoAuditFingerprints,
+			DeleteRetention:     cfg.DeleteRetention,
+			ProtectAliasTargets: cfg.ProtectAliasTargets,
+			MaxVersions:         cfg.MaxVersionsPerSecret,
+			DedupeActive:        cfg.DedupePuts,
+		})
 		if err != nil {
+			if ownLog != nil {
+				ownLog.Close()
+			}
 			return nil, fmt.Errorf("opening DB: %w", err)
 		}
 	}
@@ -125,54 +325,247 @@ func New(ctx context.Context, cfg Config) (*Server, error) {
 	}
 
 	ret := &Server{
+		ctx:   ctx,
 		db:    kdb,
+		mux:   cfg.Mux,
 		whois: cfg.WhoIs,
 		tmpl:  tmpl,
 
+		auditPath:   cfg.AuditLogPath,
+		ownLog:      ownLog,
+		maxValue:    cmp.Or(max(cfg.MaxSecretBytes, 0), api.DefaultMaxValueBytes),
+		limiter:     newCallerLimiter(cfg.RateLimit, cfg.RateBurst),
+		access:      newAccessStats(cfg.AccessMetrics),
+		writeTags:   cfg.WriteTags,
+		idempotency: newIdempotencyKeys(),
+		uploads:     newUploads(),
+		readOnly:    cfg.ReadOnly,
+		sizeMetrics: cfg.SizeMetrics,
+		authorize:   cfg.Authorize,
+
 		countCalls:             &metrics.LabelMap{Label: "method"},
 		countCallBadRequest:    &metrics.LabelMap{Label: "method"},
 		countCallForbidden:     &metrics.LabelMap{Label: "method"},
 		countCallNotFound:      &metrics.LabelMap{Label: "method"},
+		countCallExpired:       &metrics.LabelMap{Label: "method"},
 		countCallInternalError: &metrics.LabelMap{Label: "method"},
 		countCallAlreadySet:    &metrics.LabelMap{Label: "method"},
+		countCallRateLimited:   &metrics.LabelMap{Label: "method"},
+		countBackups:           &metrics.LabelMap{Label: "target"},
+		countBackupErrors:      &metrics.LabelMap{Label: "target"},
+		countBackupBytes:       &metrics.LabelMap{Label: "target"},
+		lastBackupTimes:        &metrics.LabelMap{Label: "target"},
+		backupSeconds:          new(expvar.Float),
+		countActivations:       new(expvar.Int),
+		exemplars:              new(exemplars),
 	}
+	kdb.OnActivate(ret.activated)
 
 	if cfg.BackupBucket != "" {
-		s3Client, err := makeS3Client(ctx, cfg.BackupBucketRegion, cfg.BackupBucket, cfg.BackupAssumeRole)
+		b, err := NewS3BackupWithOptions(ctx, cfg.BackupBucket, S3BackupOptions{
+			Region:               cfg.BackupBucketRegion,
+			AssumeRole:           cfg.BackupAssumeRole,
+			CredentialsFile:      cfg.BackupCredentialsFile,
+			Profile:              cfg.BackupProfile,
+			WebIdentityTokenFile: cfg.BackupWebIdentityTokenFile,
+		})
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+		ret.backups = append(ret.backups, b)
+	}
+	if cfg.BackupDir != "" {
+		b, err := NewDirBackup(cfg.BackupDir, cfg.BackupDirRetain)
 		if err != nil {
-			return nil, fmt.Errorf("creating backups S3 client: %w", err)
+			ret.Close()
+			return nil, err
 		}
-		ret.backupClient = s3Client
-		ret.backupBucket = cfg.BackupBucket
+		ret.backups = append(ret.backups, b)
+	}
+	ret.backups = append(ret.backups, cfg.BackupTargets...)
+	if len(ret.backups) != 0 {
 		go ret.periodicBackup(ctx)
 	}
+	if !cfg.ReadOnly {
+		go ret.periodicPurge(ctx)
+	}
 
 	cfg.Mux.HandleFunc("/", ret.htmlList)
 	cfg.Mux.Handle("/static/", http.FileServer(http.FS(staticFiles)))
 	cfg.Mux.HandleFunc("/api/list", ret.list)
 	cfg.Mux.HandleFunc("/api/get", ret.get)
+	cfg.Mux.HandleFunc("/api/get-many", ret.getMany)
+	cfg.Mux.HandleFunc("/api/get-resolved", ret.getResolved)
+	cfg.Mux.HandleFunc("/api/watch", ret.watch)
 	cfg.Mux.HandleFunc("/api/info", ret.info)
-	cfg.Mux.HandleFunc("/api/put", ret.put)
-	cfg.Mux.HandleFunc("/api/create-version", ret.createVersion)
-	cfg.Mux.HandleFunc("/api/activate", ret.activate)
-	cfg.Mux.HandleFunc("/api/delete", ret.deleteSecret)
-	cfg.Mux.HandleFunc("/api/delete-version", ret.deleteVersion)
+	cfg.Mux.HandleFunc("/api/put", ret.writer(ret.put))
+	cfg.Mux.HandleFunc("/api/put-chunk", ret.writer(ret.putChunk))
+	cfg.Mux.HandleFunc("/api/create-version", ret.writer(ret.createVersion))
+	cfg.Mux.HandleFunc("/api/activate", ret.writer(ret.activate))
+	cfg.Mux.HandleFunc("/api/activate-many", ret.writer(ret.activateMany))
+	cfg.Mux.HandleFunc("/api/rename", ret.writer(ret.rename))
+	cfg.Mux.HandleFunc("/api/alias", ret.writer(ret.alias))
+	cfg.Mux.HandleFunc("/api/set-principals", ret.writer(ret.setPrincipals))
+	cfg.Mux.HandleFunc("/api/label", ret.writer(ret.label))
+	cfg.Mux.HandleFunc("/api/describe", ret.writer(ret.describe))
+	cfg.Mux.HandleFunc("/api/delete", ret.writer(ret.deleteSecret))
+	cfg.Mux.HandleFunc("/api/delete-version", ret.writer(ret.deleteVersion))
+	cfg.Mux.HandleFunc("/api/undelete", ret.writer(ret.undelete))
+	cfg.Mux.HandleFunc("/api/audit", ret.auditQuery)
+	cfg.Mux.HandleFunc("/api/whoami", ret.whoami)
+	cfg.Mux.HandleFunc("/api/ping", ret.ping)
+	cfg.Mux.HandleFunc("/api/server-info", ret.serverInfo)
+	cfg.Mux.HandleFunc("/metrics", ret.prometheusMetrics)
+	cfg.Mux.HandleFunc("/healthz", ret.healthz)
 
 	return ret, nil
 }
 
-func makeS3Client(ctx context.Context, region, bucket, assumeRole string) (*s3.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+// NewInMemory creates a secret server whose database is kept only in memory,
+// as by db.OpenInMemory, and makes it ready to serve. It is meant for tests:
+// the server does not touch the disk unless cfg asks it to, and can be served
+// with httptest by way of its Handler.
+//
+// The DB and DBPath fields of cfg are ignored. If cfg.Key is nil, a fresh
+// random key is used. If cfg.AuditLog is nil and cfg.AuditLogPath is empty,
+// audit log entries are discarded. If cfg.Mux is nil, a new mux is allocated.
+// The WhoIs field must be set as for New.
+func NewInMemory(ctx context.Context, cfg Config) (*Server, error) {
+	if cfg.Key == nil {
+		kh, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
+		if err != nil {
+			return nil, fmt.Errorf("generating key: %w", err)
+		}
+		cfg.Key, err = aead.New(kh)
+		if err != nil {
+			return nil, fmt.Errorf("constructing key: %w", err)
+		}
+	}
+	if cfg.AuditLog == nil {
+		if cfg.AuditLogPath == "" {
+			cfg.AuditLog = audit.New(io.Discard)
+		} else {
+			alog, err := audit.NewFileWithOptions(cfg.AuditLogPath, audit.FileOptions{
+				MaxBytes: cfg.AuditLogMaxBytes,
+				MaxFiles: cfg.AuditLogMaxFiles,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("opening audit log: %w", err)
+			}
+			cfg.AuditLog = alog
+		}
+	}
+	if cfg.Mux == nil {
+		cfg.Mux = http.NewServeMux()
+	}
+	kdb, err := db.OpenInMemory(cfg.Key, cfg.AuditLog, db.OpenOptions{
+		Compress:            cfg.CompressDB,
+		NoAuditFingerprints: cfg.NoAuditFingerprints,
+		DeleteRetention:     cfg.DeleteRetention,
+		ProtectAliasTargets: cfg.ProtectAliasTargets,
+		MaxVersions:         cfg.MaxVersionsPerSecret,
+		DedupeActive:        cfg.DedupePuts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening DB: %w", err)
+	}
+	cfg.DB = kdb
+	return New(ctx, cfg)
+}
+
+// Handler returns an http.Handler that serves the endpoints of s, namely the
+// mux given in its Config.
+func (s *Server) Handler() http.Handler { return s.mux }
+
+func makeS3Client(ctx context.Context, opts S3BackupOptions) (*s3.Client, error) {
+	cfg, err := awsConfig(ctx, opts)
 	if err != nil {
-		return nil, fmt.Errorf("getting ambient AWS credentials: %w", err)
+		return nil, err
 	}
+	return s3.NewFromConfig(cfg), nil
+}
 
-	if assumeRole != "" {
-		creds := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), assumeRole)
+// awsConfig loads the AWS configuration for the region and credentials
+// described by opts.
+func awsConfig(ctx context.Context, opts S3BackupOptions) (aws.Config, error) {
+	load := []func(*config.LoadOptions) error{config.WithRegion(opts.Region)}
+	if opts.CredentialsFile != "" {
+		// The SDK ignores a credentials file it cannot read.
+		if _, err := os.Stat(opts.CredentialsFile); err != nil {
+			return aws.Config{}, fmt.Errorf("AWS credentials file: %w", err)
+		}
+		load = append(load, config.WithSharedCredentialsFiles([]string{opts.CredentialsFile}))
+	}
+	if opts.Profile != "" {
+		load = append(load, config.WithSharedConfigProfile(opts.Profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, load...)
+	if err != nil {
+		if opts.CredentialsFile == "" && opts.Profile == "" {
+			return aws.Config{}, fmt.Errorf("getting ambient AWS credentials: %w", err)
+		}
+		return aws.Config{}, fmt.Errorf("getting AWS credentials: %w", err)
+	}
+
+	switch {
+	case opts.WebIdentityTokenFile != "":
+		creds := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), opts.AssumeRole,
+			stscreds.IdentityTokenFile(opts.WebIdentityTokenFile))
+		cfg.Credentials = aws.NewCredentialsCache(creds)
+	case opts.AssumeRole != "":
+		creds := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.AssumeRole)
 		cfg.Credentials = aws.NewCredentialsCache(creds)
 	}
+	return cfg, nil
+}
 
-	return s3.NewFromConfig(cfg), nil
+// checkAWSCredentials reports whether credentials can be obtained from cfg,
+// including assuming the role, if assumeRole is non-empty.
+func checkAWSCredentials(ctx context.Context, cfg aws.Config, assumeRole string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var err error
+	if cfg.Credentials == nil {
+		err = errors.New("no credentials found")
+	} else {
+		_, err = cfg.Credentials.Retrieve(ctx)
+	}
+	if err != nil && assumeRole != "" {
+		return fmt.Errorf("obtaining AWS credentials to assume role %q: %w", assumeRole, err)
+	} else if err != nil {
+		return fmt.Errorf("obtaining AWS credentials: %w", err)
+	}
+	return nil
+}
+
+// periodicPurge permanently removes soft-deleted secrets once their retention
+// period ends, until ctx ends.
+func (s *Server) periodicPurge(ctx context.Context) {
+	for {
+		purged, err := s.db.PurgeDeleted()
+		if err != nil {
+			log.Printf("Failed to purge deleted secrets: %v", err)
+		} else if len(purged) != 0 {
+			log.Printf("Purged %d deleted secrets: %q", len(purged), purged)
+		}
+		select {
+		case <-time.After(time.Minute):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close closes the audit log that New opened from Config.AuditLogPath, if
+// any. It should be called once s no longer serves requests, since any later
+// request fails to write its audit entry. It does not close a DB or AuditLog
+// given in the Config, which remain the caller's to close.
+func (s *Server) Close() error {
+	if s.ownLog == nil {
+		return nil
+	}
+	return s.ownLog.Close()
 }
 
 // Metrics returns a collection of metrics for s. THe caller is responsible for
@@ -183,9 +576,108 @@ func (s *Server) Metrics() expvar.Var {
 	m.Set("counter_api_bad_request", s.countCallBadRequest)
 	m.Set("counter_api_forbidden", s.countCallForbidden)
 	m.Set("counter_api_internal_error", s.countCallInternalError)
+	m.Set("counter_api_not_found", s.countCallNotFound)
+	m.Set("counter_api_expired", s.countCallExpired)
+	m.Set("counter_api_already_set", s.countCallAlreadySet)
+	m.Set("counter_api_rate_limited", s.countCallRateLimited)
+	m.Set("counter_backups", s.countBackups)
+	m.Set("counter_backup_errors", s.countBackupErrors)
+	m.Set("gauge_backup_duration_seconds", s.backupSeconds)
+	m.Set("gauge_last_backup_timestamp_seconds", s.lastBackupTimes)
+	m.Set("counter_secret_gets", s.access.counts)
+	m.Set("counter_activations", s.countActivations)
+	m.Set("counter_secret_activations", s.access.activations)
+	m.Set("gauge_last_activation_timestamp_seconds", s.access.lastActivations)
+
+	maxValue := new(expvar.Int)
+	maxValue.Set(int64(s.maxValue))
+	m.Set("gauge_max_secret_bytes", maxValue)
+	readOnly := new(expvar.Int)
+	if s.readOnly {
+		readOnly.Set(1)
+	}
+	m.Set("gauge_read_only", readOnly)
+	if s.sizeMetrics {
+		m.Set("gauge_db_size_bytes", expvar.Func(func() any {
+			stored, _ := s.db.Size()
+			return stored
+		}))
+		m.Set("counter_backup_bytes", s.countBackupBytes)
+	}
+	m.Set("gauge_db_uncompressed_bytes", expvar.Func(func() any {
+		_, clear := s.db.Size()
+		return clear
+	}))
+	m.Set("gauge_secrets", expvar.Func(func() any {
+		secrets, _ := s.db.Count()
+		return secrets
+	}))
+	m.Set("gauge_secret_versions", expvar.Func(func() any {
+		_, versions := s.db.Count()
+		return versions
+	}))
 	return m
 }
 
+// prometheusMetrics serves the metrics reported by s.Metrics in the Prometheus
+// text exposition format. Metric names are prefixed with "setec_".
+//
+// If the client accepts the OpenMetrics text format, the metrics are served in
+// that format instead, and the counters of denied, rate-limited and failed
+// requests carry the ID of a recent such request as an exemplar.
+func (s *Server) prometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.Metrics()
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		var buf strings.Builder
+		varz.WritePrometheusExpvar(&buf, expvar.KeyValue{Key: "setec", Value: m})
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		writeOpenMetrics(w, buf.String(), s.exemplars.latest())
+		return
+	}
+	varz.ExpvarDoHandler(func(f func(expvar.KeyValue)) {
+		f(expvar.KeyValue{Key: "setec", Value: m})
+	})(w, r)
+}
+
+// writer wraps a handler for an API method that modifies the database, so
+// that it is rejected if the server is read-only.
+func (s *Server) writer(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.readOnly {
+			s.countCalls.Add(r.URL.Path, 1)
+			requestID(w, r)
+			s.writeError(w, r.URL.Path, api.ErrReadOnly)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// healthz reports whether the server is ready to serve requests, meaning the
+// database is open and its key-encryption key is usable. Unlike the API
+// methods, it does not require the caller to be identified, so that it can be
+// used as a liveness or readiness probe.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	rsp := api.HealthResponse{OK: true, ReadOnly: s.readOnly}
+	if err := s.db.CheckKey(); err != nil {
+		log.Printf("Health check failed: %v", err)
+		rsp.OK = false
+		rsp.Error = "database key check failed"
+	}
+	if t := s.lastBackup.Load(); t != nil {
+		rsp.LastBackup = *t
+	}
+	if msg := s.lastBackupError.Load(); msg != nil {
+		rsp.LastBackupError = *msg
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !rsp.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
 func (s *Server) htmlList(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
@@ -223,12 +715,25 @@ func (s *Server) htmlList(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) list(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.ListRequest, id db.Caller) ([]*api.SecretInfo, error) {
-		return s.db.List(id)
+		infos, err := s.db.ListWithOptions(id, db.ListOptions{
+			Prefix:   req.Prefix,
+			Selector: req.Selector,
+			Writable: req.Writable,
+		})
+		if err == nil && req.Writable && s.readOnly {
+			infos = nil // nothing can be written to a read-only server
+		}
+		return infos, err
 	})
 }
 
 func (s *Server) get(w http.ResponseWriter, r *http.Request) {
-	serveJSON(s, w, r, func(req api.GetRequest, id db.Caller) (*api.SecretValue, error) {
+	serveJSON(s, w, r, func(req api.GetRequest, id db.Caller) (sv *api.SecretValue, err error) {
+		defer func() {
+			if err == nil {
+				s.access.record(req.Name)
+			}
+		}()
 		if req.Version != 0 {
 			if req.UpdateIfChanged {
 				// Case 1: Old version specified, update requested.
@@ -242,21 +747,196 @@ func (s *Server) get(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) getResolved(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.ResolveRequest, id db.Caller) (*api.SecretValue, error) {
+		sv, err := s.db.GetResolved(id, req.Name)
+		if err == nil {
+			s.access.record(req.Name)
+		}
+		return sv, err
+	})
+}
+
+// watch streams the active value of a secret to the client, as a sequence of
+// JSON-encoded api.SecretValue objects, each time the active version changes.
+// The stream continues until the client disconnects or the server stops.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	apiMethod := r.URL.Path
+	req, id, ok := decodeRequest[api.WatchRequest](s, w, r)
+	if !ok {
+		return
+	}
+
+	// Subscribe to changes before reading the initial value, so that we do
+	// not miss an update that lands in between.
+	changed := s.db.Changed()
+	sv, err := s.db.GetConditional(id, req.Name, req.Version)
+	if err != nil && !errors.Is(err, api.ErrValueNotChanged) {
+		s.writeError(w, apiMethod, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	last := req.Version
+	for {
+		if sv != nil {
+			if err := enc.Encode(sv); err != nil {
+				return
+			}
+			last = sv.Version
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-changed:
+		}
+
+		changed = s.db.Changed()
+		sv, err = s.db.GetConditional(id, req.Name, last)
+		if errors.Is(err, api.ErrValueNotChanged) {
+			sv = nil
+		} else if err != nil {
+			// The secret may have been deleted, or access revoked; either way
+			// the stream is over. The client will see the stream end.
+			log.Printf("watch %q: %v (closing stream)", req.Name, err)
+			return
+		}
+	}
+}
+
+func (s *Server) getMany(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.GetManyRequest, id db.Caller) (map[string]*api.GetManyResult, error) {
+		// Failures for individual secrets are reported in the response, rather
+		// than failing the whole request.
+		out := make(map[string]*api.GetManyResult, len(req.Names))
+		for _, name := range req.Names {
+			sv, err := s.db.Get(id, name)
+			switch {
+			case err == nil:
+				s.access.record(name)
+				out[name] = &api.GetManyResult{Value: sv}
+			case errors.Is(err, db.ErrAccessDenied):
+				out[name] = &api.GetManyResult{Status: http.StatusForbidden, Code: api.CodeAccessDenied}
+			case errors.Is(err, db.ErrSecretNotFound):
+				out[name] = &api.GetManyResult{Status: http.StatusNotFound, Code: api.CodeSecretNotFound}
+			case errors.Is(err, db.ErrNotFound):
+				out[name] = &api.GetManyResult{Status: http.StatusNotFound, Code: api.CodeNotFound}
+			case errors.Is(err, db.ErrExpired):
+				out[name] = &api.GetManyResult{Status: http.StatusGone, Code: api.CodeExpired}
+			case errors.Is(err, api.ErrBrokenAlias):
+				out[name] = &api.GetManyResult{Status: http.StatusFailedDependency, Code: api.CodeBrokenAlias}
+			default:
+				out[name] = &api.GetManyResult{Status: http.StatusInternalServerError}
+			}
+		}
+		return out, nil
+	})
+}
+
 func (s *Server) info(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.InfoRequest, id db.Caller) (*api.SecretInfo, error) {
-		return s.db.Info(id, req.Name)
+		info, err := s.db.Info(id, req.Name)
+		if err != nil {
+			return nil, err
+		}
+		if info.AliasOf == "" {
+			info.MaxValueBytes = s.maxValue
+			s.access.annotate(info)
+		}
+		return info, nil
 	})
 }
 
 func (s *Server) put(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.PutRequest, id db.Caller) (api.SecretVersion, error) {
-		return s.db.Put(id, req.Name, req.Value)
+		if err := s.checkValueSize(req.Value); err != nil {
+			return 0, err
+		}
+		caller := id.Principal.Name()
+		return s.idempotency.put(caller, req, func() (api.SecretVersion, error) {
+			value, err := s.putValue(caller, req)
+			if err != nil {
+				return 0, err
+			}
+			v, err := s.db.PutWithOptions(id, req.Name, value, db.PutOptions{
+				ExpiresAt:      req.ExpiresAt,
+				Labels:         req.Labels,
+				Activate:       req.Activate,
+				Template:       req.Template,
+				IfAbsent:       req.IfAbsent,
+				Format:         req.Format,
+				ContentType:    req.ContentType,
+				MaxVersions:    req.MaxVersions,
+				AllowDuplicate: req.AllowDuplicate,
+				Description:    req.Description,
+				Immutable:      req.Immutable,
+			})
+			if err == nil && req.UploadID != "" {
+				s.uploads.done(caller, req.UploadID)
+			}
+			return v, err
+		})
+	})
+}
+
+// putValue returns the value to store for req on behalf of caller: the value
+// in req, or the value caller uploaded in chunks with the upload ID of req.
+func (s *Server) putValue(caller string, req api.PutRequest) ([]byte, error) {
+	if req.UploadID == "" {
+		return req.Value, nil
+	} else if len(req.Value) != 0 {
+		return nil, fmt.Errorf("%w: value given with an upload ID", api.ErrInvalidUpload)
+	}
+	return s.uploads.value(caller, req.Name, req.UploadID)
+}
+
+func (s *Server) putChunk(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.PutChunkRequest, id db.Caller) (api.PutChunkResponse, error) {
+		if err := api.CheckSecretName(req.Name); err != nil {
+			return api.PutChunkResponse{}, err
+		}
+		// Check permission up front, so that a caller cannot hold memory in
+		// uploads for secrets it cannot put. The put that completes the
+		// upload is checked and audited as usual.
+		if err := s.db.CheckAccess(id, acl.ActionPut, req.Name); err != nil {
+			return api.PutChunkResponse{}, err
+		}
+		size, err := s.uploads.add(id.Principal.Name(), req, s.maxValue)
+		return api.PutChunkResponse{Size: size}, err
 	})
 }
 
+// checkValueSize reports an error wrapping api.ErrValueTooLarge if value is
+// larger than the server accepts.
+func (s *Server) checkValueSize(value []byte) error {
+	if len(value) > s.maxValue {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d", api.ErrValueTooLarge, len(value), s.maxValue)
+	}
+	return nil
+}
+
 func (s *Server) createVersion(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.CreateVersionRequest, id db.Caller) (struct{}, error) {
-		if err := s.db.CreateVersion(id, req.Name, req.Version, req.Value); err != nil {
+		if err := s.checkValueSize(req.Value); err != nil {
+			return struct{}{}, err
+		}
+		if err := s.db.CreateVersionWithOptions(id, req.Name, req.Version, req.Value, db.CreateVersionOptions{
+			ExpiresAt:   req.ExpiresAt,
+			Template:    req.Template,
+			Format:      req.Format,
+			ContentType: req.ContentType,
+			MaxVersions: req.MaxVersions,
+			Immutable:   req.Immutable,
+		}); err != nil {
 			return struct{}{}, err
 		}
 		return struct{}{}, nil
@@ -265,16 +945,66 @@ func (s *Server) createVersion(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) activate(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.ActivateRequest, id db.Caller) (struct{}, error) {
-		if err := s.db.Activate(id, req.Name, req.Version); err != nil {
-			return struct{}{}, err
-		}
-		return struct{}{}, nil
+		err := s.db.Activate(id, req.Name, req.Version)
+		return struct{}{}, err
 	})
 }
 
+func (s *Server) activateMany(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.ActivateManyRequest, id db.Caller) (struct{}, error) {
+		err := s.db.ActivateMany(id, req.Activations)
+		return struct{}{}, err
+	})
+}
+
+// activated updates the activation metrics when the active version of the
+// secret called name changes. It is called by the database, with the
+// database locked; see db.DB.OnActivate.
+func (s *Server) activated(name string) {
+	s.countActivations.Add(1)
+	s.access.activated(name)
+}
+
 func (s *Server) deleteVersion(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.DeleteVersionRequest, id db.Caller) (struct{}, error) {
-		err := s.db.DeleteVersion(id, req.Name, req.Version)
+		err := s.db.DeleteVersionWithOptions(id, req.Name, req.Version, db.DeleteVersionOptions{
+			Reactivate: req.Reactivate,
+		})
+		return struct{}{}, err
+	})
+}
+
+func (s *Server) rename(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.RenameRequest, id db.Caller) (struct{}, error) {
+		err := s.db.Rename(id, req.Name, req.NewName)
+		return struct{}{}, err
+	})
+}
+
+func (s *Server) alias(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.AliasRequest, id db.Caller) (struct{}, error) {
+		err := s.db.Alias(id, req.Name, req.Target)
+		return struct{}{}, err
+	})
+}
+
+func (s *Server) setPrincipals(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.SetPrincipalsRequest, id db.Caller) (struct{}, error) {
+		err := s.db.SetPrincipals(id, req.Name, req.Principals)
+		return struct{}{}, err
+	})
+}
+
+func (s *Server) label(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.LabelRequest, id db.Caller) (struct{}, error) {
+		err := s.db.SetLabels(id, req.Name, req.Labels)
+		return struct{}{}, err
+	})
+}
+
+func (s *Server) describe(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.DescribeRequest, id db.Caller) (struct{}, error) {
+		err := s.db.SetDescription(id, req.Name, req.Description)
 		return struct{}{}, err
 	})
 }
@@ -286,6 +1016,166 @@ func (s *Server) deleteSecret(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) undelete(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.UndeleteRequest, id db.Caller) (struct{}, error) {
+		err := s.db.Undelete(id, req.Name)
+		return struct{}{}, err
+	})
+}
+
+func (s *Server) whoami(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(_ api.WhoAmIRequest, id db.Caller) (*api.WhoAmIResponse, error) {
+		return &api.WhoAmIResponse{
+			User:        id.Principal.User,
+			Hostname:    id.Principal.Hostname,
+			IP:          id.Principal.IP,
+			Tags:        id.Principal.Tags,
+			Permissions: id.Permissions,
+		}, nil
+	})
+}
+
+// ping reports the version of the server, and whether it recognizes the
+// caller. Unlike the other API methods, it succeeds for a caller that cannot
+// be identified, so that clients can distinguish an unreachable server from
+// one that does not authorize them. It is not rate limited.
+func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
+	apiMethod := r.URL.Path
+	s.countCalls.Add(apiMethod, 1)
+	if r.Method != "POST" {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		http.Error(w, "only POST requests allowed", http.StatusBadRequest)
+		return
+	}
+	if h := r.Header.Get("Sec-X-Tailscale-No-Browsers"); h != "setec" {
+		s.countCallForbidden.Add(apiMethod, 1)
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+
+	rsp := api.PingResponse{Version: serverVersion()}
+	if id, err := s.getIdentity(r); err == nil {
+		rsp.Recognized = true
+		rsp.Caller = id.Principal.Name()
+		rsp.HasPermissions = len(id.Permissions) != 0
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// serverCapabilities are the capabilities every server of this version
+// supports. See api.ServerInfoResponse.
+var serverCapabilities = []string{
+	api.CapGetMany,
+	api.CapGetResolved,
+	api.CapWatch,
+	api.CapPutChunk,
+	api.CapActivateMany,
+	api.CapAlias,
+	api.CapErrorCodes,
+	api.CapContentType,
+	api.CapImmutable,
+	api.CapListWritable,
+	api.CapIdempotentPut,
+}
+
+// serverInfo reports the version of the server and the optional features it
+// supports.
+func (s *Server) serverInfo(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(_ api.ServerInfoRequest, _ db.Caller) (*api.ServerInfoResponse, error) {
+		caps := slices.Clone(serverCapabilities)
+		if s.auditPath != "" {
+			caps = append(caps, api.CapAudit)
+		}
+		if s.db.DeleteRetention() > 0 {
+			caps = append(caps, api.CapUndelete)
+		}
+		slices.Sort(caps)
+		return &api.ServerInfoResponse{
+			Version:       serverVersion(),
+			Capabilities:  caps,
+			ReadOnly:      s.readOnly,
+			MaxValueBytes: s.maxValue,
+		}, nil
+	})
+}
+
+// serverVersion reports the version of the setec module the running program
+// was built from, or "" if it is not known.
+func serverVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	const path = "github.com/tailscale/setec"
+	if bi.Main.Path == path {
+		return bi.Main.Version
+	}
+	for _, m := range bi.Deps {
+		if m.Path == path {
+			return m.Version
+		}
+	}
+	return ""
+}
+
+func (s *Server) auditQuery(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.AuditRequest, id db.Caller) ([]*audit.Entry, error) {
+		return s.readAudit(req, id)
+	})
+}
+
+// readAudit reads the entries of the audit log selected by req that concern
+// secrets on which the caller has info access, as checked by the database.
+// Value fingerprints are reported only for secrets the caller can get.
+// The query itself is recorded in the audit log. If more than the requested
+// limit of entries match, only the most recent are reported.
+func (s *Server) readAudit(req api.AuditRequest, id db.Caller) ([]*audit.Entry, error) {
+	if s.auditPath == "" {
+		return nil, api.ErrAuditUnavailable
+	}
+	visible, err := s.db.CheckAuditQuery(id)
+	if err != nil {
+		return nil, err
+	}
+
+	q := audit.Query{Since: req.Since, Secret: req.Secret}
+	limit := min(cmp.Or(max(req.Limit, 0), api.DefaultAuditLimit), api.MaxAuditLimit)
+	// Open all the files before reading any, so that a rotation while the
+	// log is read does not skip or repeat entries.
+	files, err := audit.OpenLogFiles(s.auditPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// Read the newest file first, and older files only until enough entries
+	// have been found. Within a file, keep only as many of the latest
+	// matching entries as are still needed.
+	var out []*audit.Entry
+	for i := len(files) - 1; i >= 0 && len(out) < limit; i-- {
+		need := limit - len(out)
+		var found []*audit.Entry
+		if err := audit.Scan(files[i], func(e *audit.Entry) error {
+			if q.Match(e) && visible(e) {
+				found = append(found, e)
+				if len(found) > need {
+					found = found[1:]
+				}
+			}
+			return nil
+		}); err != nil {
+			return append(found, out...), err
+		}
+		out = append(found, out...)
+	}
+	return out, nil
+}
+
 // ACLCap is the capability name used for setec ACL permissions.
 const ACLCap tailcfg.PeerCapability = "tailscale.com/cap/secrets"
 
@@ -326,27 +1216,83 @@ func (s *Server) getIdentity(r *http.Request) (id db.Caller, err error) {
 	if err != nil {
 		return db.Caller{}, fmt.Errorf("unmarshaling peer capabilities: %w", err)
 	}
+	if len(s.writeTags) != 0 && !slices.ContainsFunc(id.Principal.Tags, func(tag string) bool {
+		return slices.Contains(s.writeTags, tag)
+	}) {
+		id.Permissions = readOnly(id.Permissions)
+	}
+	if s.authorize != nil {
+		ctx, caller := r.Context(), id
+		id.Authorize = func(action acl.Action, secret string) error {
+			return s.authorize(ctx, caller, action, secret)
+		}
+	}
 
 	return id, nil
 }
 
+// readOnly returns a copy of rules that grants only the read actions (get and
+// info) granted by rules.
+func readOnly(rules acl.Rules) acl.Rules {
+	var out acl.Rules
+	for _, r := range rules {
+		acts := slices.DeleteFunc(slices.Clone(r.Action), func(a acl.Action) bool {
+			return a != acl.ActionGet && a != acl.ActionInfo
+		})
+		if len(acts) != 0 {
+			out = append(out, acl.Rule{Action: acts, Secret: r.Secret})
+		}
+	}
+	return out
+}
+
 // serveJSON calls fn to handle a JSON API request. fn is invoked with
 // the request body decoded into r, and from set to the Tailscale
 // identity of the caller. The response returned from fn is serialized
 // as JSON back to the client.
 func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Request, fn func(r REQ, id db.Caller) (RESP, error)) {
+	apiMethod := r.URL.Path
+	req, id, ok := decodeRequest[REQ](s, w, r)
+	if !ok {
+		return
+	}
+
+	resp, err := fn(req, id)
+	if err != nil {
+		s.writeError(w, apiMethod, err)
+		return
+	}
+
+	bs, err := json.Marshal(resp)
+	if err != nil {
+		s.countCallInternalError.Add(apiMethod, 1)
+		http.Error(w, "failed to encode respnse", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bs)
+}
+
+// decodeRequest checks that r is a well-formed API request, identifies the
+// caller, and decodes the request body. If any of these steps fails, it
+// writes an error response to w and reports false.
+func decodeRequest[REQ any](s *Server, w http.ResponseWriter, r *http.Request) (_ REQ, _ db.Caller, ok bool) {
+	var req REQ
 	apiMethod := r.URL.Path
 	s.countCalls.Add(apiMethod, 1)
+	rid := requestID(w, r)
 
 	if r.Method != "POST" {
 		s.countCallBadRequest.Add(apiMethod, 1)
 		http.Error(w, "only POST requests allowed", http.StatusBadRequest)
-		return
+		return req, db.Caller{}, false
 	}
 	if c := r.Header.Get("Content-Type"); c != "application/json" {
 		s.countCallBadRequest.Add(apiMethod, 1)
 		http.Error(w, "request body must be json", http.StatusBadRequest)
-		return
+		return req, db.Caller{}, false
 	}
 	// Block any attempt to access the API from browsers. Longer term
 	// we want a more carefully thought out browser security config
@@ -357,60 +1303,143 @@ func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Requ
 	// satisfy this condition.
 	if h := r.Header.Get("Sec-X-Tailscale-No-Browsers"); h != "setec" {
 		s.countCallForbidden.Add(apiMethod, 1)
+		s.exemplars.add("counter_api_forbidden", apiMethod, rid)
+		w.Header().Set(api.ErrorCodeHeader, api.CodeAccessDenied)
 		http.Error(w, "access denied", http.StatusForbidden)
-		return
+		return req, db.Caller{}, false
 	}
 
 	id, err := s.getIdentity(r)
 	if err != nil {
 		s.countCallInternalError.Add(apiMethod, 1)
+		s.exemplars.add("counter_api_internal_error", apiMethod, rid)
 		http.Error(w, "unable to identify caller", http.StatusInternalServerError)
-		return
+		return req, db.Caller{}, false
+	}
+	id.RequestID = rid
+	if !s.limiter.allow(id.Principal.Name()) {
+		s.countCallRateLimited.Add(apiMethod, 1)
+		s.exemplars.add("counter_api_rate_limited", apiMethod, rid)
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set(api.ErrorCodeHeader, api.CodeRateLimited)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return req, db.Caller{}, false
 	}
 
-	var req REQ
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.countCallBadRequest.Add(apiMethod, 1)
 		http.Error(w, "bad request", http.StatusBadRequest)
-		return
+		return req, db.Caller{}, false
 	}
+	return req, id, true
+}
 
-	resp, err := fn(req, id)
+// requestID returns the ID of the API request r: the ID given by the client in
+// the api.RequestIDHeader header if it is valid, or else a new one. It reports
+// the ID in the same header of the response.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(api.RequestIDHeader)
+	if !api.ValidRequestID(id) {
+		id = api.NewRequestID()
+	}
+	w.Header().Set(api.RequestIDHeader, id)
+	return id
+}
+
+// writeError writes an error response to w for err, which must be non-nil,
+// and updates the metrics for apiMethod. For errors with an API error code,
+// the code is reported in the api.ErrorCodeHeader header.
+func (s *Server) writeError(w http.ResponseWriter, apiMethod string, err error) {
+	code := func(c string) { w.Header().Set(api.ErrorCodeHeader, c) }
+	note := func(metric string) { s.exemplars.add(metric, apiMethod, w.Header().Get(api.RequestIDHeader)) }
 	if errors.Is(err, db.ErrAccessDenied) {
 		s.countCallForbidden.Add(apiMethod, 1)
+		note("counter_api_forbidden")
+		code(api.CodeAccessDenied)
 		http.Error(w, "access denied", http.StatusForbidden)
-		return
 	} else if errors.Is(err, db.ErrNotFound) {
 		s.countCallNotFound.Add(apiMethod, 1)
+		switch {
+		case errors.Is(err, db.ErrSecretNotFound):
+			code(api.CodeSecretNotFound)
+		case errors.Is(err, db.ErrVersionNotFound):
+			code(api.CodeVersionNotFound)
+		default:
+			code(api.CodeNotFound)
+		}
 		http.Error(w, "not found", http.StatusNotFound)
-		return
+	} else if errors.Is(err, db.ErrExpired) {
+		s.countCallExpired.Add(apiMethod, 1)
+		code(api.CodeExpired)
+		http.Error(w, "secret version has expired", http.StatusGone)
 	} else if errors.Is(err, api.ErrValueNotChanged) {
+		code(api.CodeNotModified)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotModified)
-		return
 	} else if errors.Is(err, db.ErrInvalidVersion) {
 		s.countCallBadRequest.Add(apiMethod, 1)
 		s.countCallAlreadySet.Add(apiMethod, 1)
 		http.Error(w, "invalid version, please specify a version > 0", http.StatusBadRequest)
-		return
+	} else if errors.Is(err, db.ErrInvalidName) || errors.Is(err, db.ErrInvalidLabel) || errors.Is(err, db.ErrInvalidDescription) {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		switch {
+		case errors.Is(err, db.ErrInvalidName):
+			code(api.CodeInvalidName)
+		case errors.Is(err, db.ErrInvalidLabel):
+			code(api.CodeInvalidLabel)
+		default:
+			code(api.CodeInvalidDescription)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if errors.Is(err, errBadIdempotencyKey) || errors.Is(err, api.ErrInvalidUpload) || errors.Is(err, api.ErrInvalidFormat) {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		switch {
+		case errors.Is(err, api.ErrInvalidUpload):
+			code(api.CodeInvalidUpload)
+		case errors.Is(err, api.ErrInvalidFormat):
+			code(api.CodeInvalidFormat)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if errors.Is(err, api.ErrTemplate) {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		code(api.CodeInvalidTemplate)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	} else if errors.Is(err, api.ErrValueTooLarge) {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		code(api.CodeValueTooLarge)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	} else if errors.Is(err, api.ErrReadOnly) {
+		s.countCallForbidden.Add(apiMethod, 1)
+		note("counter_api_forbidden")
+		code(api.CodeReadOnly)
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+	} else if errors.Is(err, api.ErrAuditUnavailable) {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		code(api.CodeAuditUnavailable)
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	} else if errors.Is(err, db.ErrAlreadyExists) {
+		s.countCallAlreadySet.Add(apiMethod, 1)
+		code(api.CodeAlreadyExists)
+		http.Error(w, "secret already exists", http.StatusConflict)
+	} else if errors.Is(err, api.ErrBrokenAlias) {
+		s.countCallNotFound.Add(apiMethod, 1)
+		code(api.CodeBrokenAlias)
+		http.Error(w, err.Error(), http.StatusFailedDependency)
+	} else if errors.Is(err, api.ErrAliasTarget) || errors.Is(err, api.ErrImmutable) {
+		s.countCallAlreadySet.Add(apiMethod, 1)
+		if errors.Is(err, api.ErrImmutable) {
+			code(api.CodeImmutable)
+		} else {
+			code(api.CodeAliasTarget)
+		}
+		http.Error(w, err.Error(), http.StatusLocked)
 	} else if errors.Is(err, db.ErrVersionClaimed) {
 		s.countCallAlreadySet.Add(apiMethod, 1)
+		code(api.CodeVersionClaimed)
 		http.Error(w, "version already set", http.StatusPreconditionFailed)
-		return
-	} else if err != nil {
+	} else {
 		s.countCallInternalError.Add(apiMethod, 1)
+		note("counter_api_internal_error")
 		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-
-	bs, err := json.Marshal(resp)
-	if err != nil {
-		s.countCallInternalError.Add(apiMethod, 1)
-		http.Error(w, "failed to encode respnse", http.StatusInternalServerError)
-		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(bs)
 }
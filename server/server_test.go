@@ -4,14 +4,21 @@
 package server_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
@@ -21,7 +28,11 @@ import (
 	"github.com/tailscale/setec/server"
 	"github.com/tailscale/setec/setectest"
 	"github.com/tailscale/setec/types/api"
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	"github.com/tink-crypto/tink-go/v2/tink"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/metrics"
 	"tailscale.com/tailcfg"
 )
 
@@ -58,6 +69,97 @@ func TestNew(t *testing.T) {
 			t.Errorf("New: unexpected error: %v", err)
 		}
 	})
+	t.Run("WrongKey", func(t *testing.T) {
+		newKey := func() tink.AEAD {
+			h, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+			if err != nil {
+				t.Fatalf("NewHandle: %v", err)
+			}
+			a, err := aead.New(h)
+			if err != nil {
+				t.Fatalf("aead.New: %v", err)
+			}
+			return a
+		}
+		path := filepath.Join(t.TempDir(), "test.db")
+		if _, err := db.Open(path, newKey(), audit.New(io.Discard)); err != nil {
+			t.Fatalf("Open database: %v", err)
+		}
+		s, err := server.New(ctx, server.Config{
+			DBPath:   path,
+			Key:      newKey(),
+			AuditLog: audit.New(io.Discard),
+			Mux:      http.NewServeMux(),
+		})
+		if !errors.Is(err, db.ErrWrongKey) {
+			t.Errorf("New with wrong key: got (%+v, %v), want %v", s, err, db.ErrWrongKey)
+		}
+	})
+}
+
+func TestServerClose(t *testing.T) {
+	dir := t.TempDir()
+	ss, err := server.New(t.Context(), server.Config{
+		DBPath:       filepath.Join(dir, "test.db"),
+		Key:          &tinktestutil.DummyAEAD{Name: t.Name()},
+		AuditLogPath: filepath.Join(dir, "audit.log"),
+		WhoIs:        setectest.AllAccess,
+		Mux:          http.NewServeMux(),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	hs := httptest.NewServer(ss.Handler())
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	if _, err := cli.Put(t.Context(), "test", []byte("v1")); err != nil {
+		t.Fatalf("Put before Close: %v", err)
+	}
+	if err := ss.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The audit log opened by New is closed, so requests can no longer write
+	// their entries.
+	if v, err := cli.Put(t.Context(), "test", []byte("v2")); err == nil {
+		t.Errorf("Put after Close: got version %v, want error", v)
+	}
+}
+
+func TestNewInMemory(t *testing.T) {
+	ss, err := server.NewInMemory(t.Context(), server.Config{WhoIs: setectest.AllAccess})
+	if err != nil {
+		t.Fatalf("NewInMemory: unexpected error: %v", err)
+	}
+	hs := httptest.NewServer(ss.Handler())
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	// Write several secrets concurrently, then check they all arrived.
+	const numSecrets = 10
+	var wg sync.WaitGroup
+	for i := range numSecrets {
+		wg.Go(func() {
+			name, value := fmt.Sprintf("test/%d", i), fmt.Sprintf("value %d", i)
+			if _, err := cli.Put(ctx, name, []byte(value)); err != nil {
+				t.Errorf("Put %q: unexpected error: %v", name, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	for i := range numSecrets {
+		name, want := fmt.Sprintf("test/%d", i), fmt.Sprintf("value %d", i)
+		sv, err := cli.Get(ctx, name)
+		if err != nil {
+			t.Errorf("Get %q: unexpected error: %v", name, err)
+		} else if got := string(sv.Value); got != want {
+			t.Errorf("Get %q: got %q, want %q", name, got, want)
+		}
+	}
 }
 
 func TestServerGetChanged(t *testing.T) {
@@ -163,3 +265,1349 @@ func TestServerStatus(t *testing.T) {
 		t.Errorf("DeleteVersion %v: unexpected error %v", ov2, err)
 	}
 }
+
+func TestServerGetMany(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	v1 := d.MustPut(d.Superuser, "ok/apple", "a1")
+	v2 := d.MustPut(d.Superuser, "ok/pear", "p1")
+	d.MustPut(d.Superuser, "no/plum", "p2")
+
+	rule, err := json.Marshal(acl.Rule{
+		Action: []acl.Action{acl.ActionGet},
+		Secret: []acl.Secret{"ok/*"},
+	})
+	if err != nil {
+		t.Fatalf("Create access grant: %v", err)
+	}
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "example.com"},
+				UserProfile: &tailcfg.UserProfile{ID: 1, LoginName: "user@example.com"},
+				CapMap:      tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
+			}, nil
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	got, err := cli.GetMany(t.Context(), []string{"ok/apple", "ok/pear", "ok/nonesuch", "no/plum"})
+
+	var gerr setec.GetManyError
+	if !errors.As(err, &gerr) {
+		t.Fatalf("GetMany: got error %v, want GetManyError", err)
+	}
+	if len(gerr) != 2 {
+		t.Errorf("GetMany: got %d errors, want 2: %v", len(gerr), gerr)
+	}
+	if err := gerr["ok/nonesuch"]; !errors.Is(err, setec.ErrSecretNotFound) {
+		t.Errorf("GetMany ok/nonesuch: got %v, want %v", err, setec.ErrSecretNotFound)
+	}
+	if err := gerr["no/plum"]; !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("GetMany no/plum: got %v, want %v", err, api.ErrAccessDenied)
+	}
+
+	checkValue := func(name string, version api.SecretVersion, want string) {
+		t.Helper()
+		if sv := got[name]; sv == nil {
+			t.Errorf("GetMany %q: missing from result", name)
+		} else if sv.Version != version || string(sv.Value) != want {
+			t.Errorf("GetMany %q: got (%q, %v), want (%q, %v)", name, sv.Value, sv.Version, want, version)
+		}
+	}
+	checkValue("ok/apple", v1, "a1")
+	checkValue("ok/pear", v2, "p1")
+	if len(got) != 2 {
+		t.Errorf("GetMany: got %d values, want 2", len(got))
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	if _, err := cli.Get(t.Context(), "test"); err != nil {
+		t.Fatalf("Get test: %v", err)
+	}
+	if _, err := cli.Get(t.Context(), "nonesuch"); !errors.Is(err, api.ErrNotFound) {
+		t.Fatalf("Get nonesuch: got %v, want %v", err, api.ErrNotFound)
+	}
+
+	// A get of an expired version is counted apart from one that is not
+	// found.
+	expires := time.Now().Add(100 * time.Millisecond)
+	if _, err := d.Actual.PutWithOptions(d.Superuser, "temp", []byte("temp"), db.PutOptions{ExpiresAt: expires}); err != nil {
+		t.Fatalf("Put temp: %v", err)
+	}
+	time.Sleep(time.Until(expires))
+	if _, err := cli.Get(t.Context(), "temp"); !errors.Is(err, api.ErrExpired) {
+		t.Fatalf("Get temp: got %v, want %v", err, api.ErrExpired)
+	}
+
+	rsp, err := hs.Client().Get(hs.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Get metrics: %v", err)
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatalf("Read metrics: %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE setec_api_calls counter\n",
+		`setec_api_calls{method="/api/get"} 3` + "\n",
+		"# TYPE setec_api_not_found counter\n",
+		`setec_api_not_found{method="/api/get"} 1` + "\n",
+		"# TYPE setec_api_expired counter\n",
+		`setec_api_expired{method="/api/get"} 1` + "\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics output is missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestServerMetricsExemplars(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	// A request without the browser guard header is denied.
+	const reqID = "0123456789abcdef"
+	req, err := http.NewRequest("POST", hs.URL+"/api/get", strings.NewReader(`{"Name":"test"}`))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(api.RequestIDHeader, reqID)
+	if rsp, err := hs.Client().Do(req); err != nil {
+		t.Fatalf("Get: %v", err)
+	} else if rsp.Body.Close(); rsp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Get: got status %d, want %d", rsp.StatusCode, http.StatusForbidden)
+	}
+
+	getMetrics := func(accept string) (string, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", hs.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rsp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Get metrics: %v", err)
+		}
+		defer rsp.Body.Close()
+		body, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatalf("Read metrics: %v", err)
+		}
+		return rsp.Header.Get("Content-Type"), string(body)
+	}
+
+	// The Prometheus format is unchanged.
+	if _, body := getMetrics(""); strings.Contains(body, reqID) || strings.Contains(body, "# EOF") {
+		t.Errorf("Prometheus output has OpenMetrics content:\n%s", body)
+	}
+
+	ctype, body := getMetrics("application/openmetrics-text; version=1.0.0")
+	if !strings.HasPrefix(ctype, "application/openmetrics-text") {
+		t.Errorf("Content-Type: got %q, want OpenMetrics", ctype)
+	}
+	for _, want := range []string{
+		"# TYPE setec_api_forbidden counter\n",
+		`setec_api_forbidden_total{method="/api/get"} 1 # {request_id="` + reqID + `"} 1 `,
+		`setec_api_calls_total{method="/api/get"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics output is missing %q:\n%s", want, body)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Metrics output does not end with # EOF:\n%s", body)
+	}
+}
+
+func TestServerMaxValue(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{MaxSecretBytes: 8})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	// Disable the client's own check so the request reaches the server.
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do, MaxValueBytes: -1}
+	ctx := t.Context()
+
+	if _, err := cli.Put(ctx, "test", []byte("12345678")); err != nil {
+		t.Errorf("Put at limit: unexpected error: %v", err)
+	}
+	if _, err := cli.Put(ctx, "test", []byte("123456789")); !errors.Is(err, api.ErrValueTooLarge) {
+		t.Errorf("Put over limit: got %v, want %v", err, api.ErrValueTooLarge)
+	}
+	if err := cli.CreateVersion(ctx, "other", 5, []byte("123456789")); !errors.Is(err, api.ErrValueTooLarge) {
+		t.Errorf("CreateVersion over limit: got %v, want %v", err, api.ErrValueTooLarge)
+	}
+
+	info, err := cli.Info(ctx, "test")
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if info.MaxValueBytes != 8 {
+		t.Errorf("Info MaxValueBytes: got %d, want 8", info.MaxValueBytes)
+	}
+
+	// With its default limit, the client rejects large values itself.
+	big := make([]byte, api.DefaultMaxValueBytes+1)
+	local := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	if _, err := local.Put(ctx, "test", big); !errors.Is(err, api.ErrValueTooLarge) {
+		t.Errorf("Put local check: got %v, want %v", err, api.ErrValueTooLarge)
+	}
+
+	rsp, err := hs.Client().Get(hs.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Get metrics: %v", err)
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatalf("Read metrics: %v", err)
+	}
+	if want := "setec_max_secret_bytes 8\n"; !strings.Contains(string(body), want) {
+		t.Errorf("Metrics output is missing %q:\n%s", want, body)
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	// A very low rate ensures the bucket does not refill during the test.
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{RateLimit: 0.001, RateBurst: 2})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{
+		Server: hs.URL,
+		DoHTTP: hs.Client().Do,
+		Retry:  &setec.RetryPolicy{MaxAttempts: 1},
+	}
+	for i := range 2 {
+		if _, err := cli.Get(t.Context(), "test"); err != nil {
+			t.Fatalf("Get %d: unexpected error: %v", i+1, err)
+		}
+	}
+	if _, err := cli.Get(t.Context(), "test"); !errors.Is(err, api.ErrRateLimited) {
+		t.Errorf("Get over limit: got %v, want %v", err, api.ErrRateLimited)
+	}
+
+	// The health check is not limited.
+	rec := httptest.NewRecorder()
+	ss.Mux.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Health status: got %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rsp, err := hs.Client().Get(hs.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Get metrics: %v", err)
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatalf("Read metrics: %v", err)
+	}
+	if want := `setec_api_rate_limited{method="/api/get"} 1` + "\n"; !strings.Contains(string(body), want) {
+		t.Errorf("Metrics output is missing %q:\n%s", want, body)
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	// Rotate the log frequently, so that queries must read entries from
+	// several files.
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	alog, err := audit.NewFileWithOptions(logPath, audit.FileOptions{MaxBytes: 400})
+	if err != nil {
+		t.Fatalf("Open audit log: %v", err)
+	}
+	defer alog.Close()
+
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: alog})
+	d.MustPut(d.Superuser, "ok/test", "v1")
+	d.MustPut(d.Superuser, "ok/test", "v2")
+	d.MustPut(d.Superuser, "no/test", "v1")
+	d.MustActivate(d.Superuser, "ok/test", 2)
+
+	// These secrets match the caller's rules, but the caller is not among
+	// the principals of one, and the Authorize hook denies the other.
+	d.MustPut(d.Superuser, "ok/private", "v1")
+	if err := d.Actual.SetPrincipals(d.Superuser, "ok/private", []string{"someone-else@example.com"}); err != nil {
+		t.Fatalf("SetPrincipals: %v", err)
+	}
+	d.MustPut(d.Superuser, "ok/denied", "v1")
+
+	// The caller can see only secrets beginning with "ok/".
+	rule, err := json.Marshal(acl.Rule{
+		Action: []acl.Action{acl.ActionInfo},
+		Secret: []acl.Secret{"ok/*"},
+	})
+	if err != nil {
+		t.Fatalf("Create access grant: %v", err)
+	}
+	whois := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "example.com"},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap:      tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
+	}
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		AuditLogPath: logPath,
+		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
+			return whois, nil
+		},
+		Authorize: func(_ context.Context, _ db.Caller, _ acl.Action, secret string) error {
+			if secret == "ok/denied" {
+				return errors.New("not entitled")
+			}
+			return nil
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	actions := func(es []*audit.Entry) []acl.Action {
+		var out []acl.Action
+		for _, e := range es {
+			if e.Secret != "ok/test" {
+				t.Errorf("Audit: unexpected entry for secret %q", e.Secret)
+			}
+			out = append(out, e.Action)
+		}
+		return out
+	}
+
+	all, err := cli.Audit(ctx, setec.AuditOptions{})
+	if err != nil {
+		t.Fatalf("Audit: unexpected error: %v", err)
+	}
+	want := []acl.Action{acl.ActionPut, acl.ActionPut, acl.ActionActivate}
+	if got := actions(all); !slices.Equal(got, want) {
+		t.Errorf("Audit: got actions %q, want %q", got, want)
+	}
+
+	// The caller cannot get the secret, so value fingerprints are withheld.
+	for _, e := range all {
+		if e.Fingerprint != "" {
+			t.Errorf("Audit: %q entry has fingerprint %q, want none", e.Action, e.Fingerprint)
+		}
+	}
+
+	// A limit reports the most recent entries.
+	last, err := cli.Audit(ctx, setec.AuditOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("Audit: unexpected error: %v", err)
+	} else if got := actions(last); !slices.Equal(got, want[2:]) {
+		t.Errorf("Audit limit 1: got actions %q, want %q", got, want[2:])
+	}
+
+	// Secrets the caller cannot see are not reported, even by name.
+	if es, err := cli.Audit(ctx, setec.AuditOptions{Secret: "no/test"}); err != nil {
+		t.Errorf("Audit no/test: unexpected error: %v", err)
+	} else if len(es) != 0 {
+		t.Errorf("Audit no/test: got %d entries, want 0", len(es))
+	}
+
+	if es, err := cli.Audit(ctx, setec.AuditOptions{Since: time.Now().Add(time.Hour)}); err != nil {
+		t.Errorf("Audit future: unexpected error: %v", err)
+	} else if len(es) != 0 {
+		t.Errorf("Audit future: got %d entries, want 0", len(es))
+	}
+	for _, name := range []string{"ok/private", "ok/denied"} {
+		if es, err := cli.Audit(ctx, setec.AuditOptions{Secret: name}); err != nil {
+			t.Errorf("Audit %s: unexpected error: %v", name, err)
+		} else if len(es) != 0 {
+			t.Errorf("Audit %s: got %d entries, want 0", name, len(es))
+		}
+	}
+
+	// Each query is itself recorded in the audit log.
+	var queries int
+	for _, path := range audit.LogFiles(logPath) {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Open audit log: %v", err)
+		}
+		err = audit.Scan(f, func(e *audit.Entry) error {
+			if e.Action == acl.ActionInfo && e.Secret == "" && e.Principal.User == "user@example.com" {
+				queries++
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			t.Fatalf("Scan audit log: %v", err)
+		}
+	}
+	if queries != 6 {
+		t.Errorf("Audit queries logged: got %d, want 6", queries)
+	}
+
+	// Without a log path, the server cannot answer queries.
+	ss2 := setectest.NewServer(t, d, nil)
+	hs2 := httptest.NewServer(ss2.Mux)
+	defer hs2.Close()
+	cli2 := setec.Client{Server: hs2.URL, DoHTTP: hs2.Client().Do}
+	if _, err := cli2.Audit(ctx, setec.AuditOptions{}); !errors.Is(err, api.ErrAuditUnavailable) {
+		t.Errorf("Audit without log: got %v, want %v", err, api.ErrAuditUnavailable)
+	}
+}
+
+func TestServerWhoAmI(t *testing.T) {
+	rule := acl.Rule{
+		Action: []acl.Action{acl.ActionGet, acl.ActionInfo},
+		Secret: []acl.Secret{"ok/*"},
+	}
+	bs, err := json.Marshal(rule)
+	if err != nil {
+		t.Fatalf("Create access grant: %v", err)
+	}
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net"},
+				UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+				CapMap:      tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(bs)}},
+			}, nil
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	got, err := cli.WhoAmI(t.Context())
+	if err != nil {
+		t.Fatalf("WhoAmI: unexpected error: %v", err)
+	}
+	if got.User != "user@example.com" || got.Hostname != "laptop.example.ts.net" || !got.IP.IsLoopback() {
+		t.Errorf("WhoAmI: got %+v, want user@example.com on laptop.example.ts.net", got)
+	}
+	if len(got.Permissions) != 1 || !slices.Equal(got.Permissions[0].Action, rule.Action) ||
+		!slices.Equal(got.Permissions[0].Secret, rule.Secret) {
+		t.Errorf("WhoAmI permissions: got %+v, want [%+v]", got.Permissions, rule)
+	}
+}
+
+func TestServerPing(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ping := func(whois func(context.Context, string) (*apitype.WhoIsResponse, error)) *api.PingResponse {
+		t.Helper()
+		ss := setectest.NewServer(t, d, &setectest.ServerOptions{WhoIs: whois})
+		hs := httptest.NewServer(ss.Mux)
+		defer hs.Close()
+		cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+		rsp, err := cli.Ping(t.Context())
+		if err != nil {
+			t.Fatalf("Ping: unexpected error: %v", err)
+		}
+		return rsp
+	}
+
+	// A caller with permissions is recognized.
+	if got := ping(setectest.AllAccess); !got.Recognized || !got.HasPermissions || got.Caller == "" {
+		t.Errorf("Ping with access: got %+v, want a recognized caller with permissions", got)
+	}
+
+	// A recognized caller may have no permissions.
+	got := ping(func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "laptop.example.ts.net"},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		}, nil
+	})
+	if !got.Recognized || got.HasPermissions || got.Caller != "user@example.com" {
+		t.Errorf("Ping without access: got %+v, want user@example.com without permissions", got)
+	}
+
+	// A caller that cannot be identified still gets a response.
+	got = ping(func(context.Context, string) (*apitype.WhoIsResponse, error) {
+		return nil, errors.New("no such peer")
+	})
+	if got.Recognized || got.HasPermissions || got.Caller != "" {
+		t.Errorf("Ping unidentified: got %+v, want an unrecognized caller", got)
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	got, err := cli.ServerInfo(t.Context())
+	if err != nil {
+		t.Fatalf("ServerInfo: unexpected error: %v", err)
+	}
+	for _, c := range []string{api.CapGetMany, api.CapWatch, api.CapImmutable} {
+		if !got.Has(c) {
+			t.Errorf("ServerInfo: missing capability %q in %q", c, got.Capabilities)
+		}
+	}
+	// The server has no audit log to read, and does not keep deleted
+	// secrets to undelete.
+	if got.Has(api.CapAudit) {
+		t.Errorf("ServerInfo: got capability %q without an audit log", api.CapAudit)
+	}
+	if got.Has(api.CapUndelete) {
+		t.Errorf("ServerInfo: got capability %q without delete retention", api.CapUndelete)
+	}
+	if got.ReadOnly || got.MaxValueBytes != api.DefaultMaxValueBytes {
+		t.Errorf("ServerInfo: got %+v, want writable with max value %d", got, api.DefaultMaxValueBytes)
+	}
+
+	// With delete retention, deleted secrets can be restored.
+	kept := setectest.NewDB(t, &setectest.DBOptions{
+		Options: db.OpenOptions{DeleteRetention: time.Hour},
+	})
+	hs2 := httptest.NewServer(setectest.NewServer(t, kept, nil).Mux)
+	defer hs2.Close()
+	cli2 := setec.Client{Server: hs2.URL, DoHTTP: hs2.Client().Do}
+	if got, err := cli2.ServerInfo(t.Context()); err != nil {
+		t.Fatalf("ServerInfo: unexpected error: %v", err)
+	} else if !got.Has(api.CapUndelete) {
+		t.Errorf("ServerInfo with retention: missing capability %q in %q", api.CapUndelete, got.Capabilities)
+	}
+}
+
+func TestServerWriteTags(t *testing.T) {
+	rule, err := json.Marshal(acl.Rule{
+		Action: []acl.Action{acl.ActionGet, acl.ActionInfo, acl.ActionPut, acl.ActionActivate},
+		Secret: []acl.Secret{"*"},
+	})
+	if err != nil {
+		t.Fatalf("Create access grant: %v", err)
+	}
+	var buf bytes.Buffer
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&buf)})
+	d.MustPut(d.Superuser, "test", "v1")
+
+	// Both callers are granted the same permissions by the policy, but only
+	// the tagged node has a write tag.
+	var whois *apitype.WhoIsResponse
+	user := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.example.ts.net"},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap:      tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
+	}
+	admin := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "deploy.example.ts.net", Tags: []string{"tag:deploy", "tag:secret-admin"}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		CapMap:      tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
+	}
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		WriteTags: []string{"tag:secret-admin"},
+		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
+			return whois, nil
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	// The untagged caller can read, but not write.
+	whois = user
+	if v, err := cli.Get(ctx, "test"); err != nil {
+		t.Errorf("Get as user: unexpected error: %v", err)
+	} else if string(v.Value) != "v1" {
+		t.Errorf("Get as user: got %q, want v1", v.Value)
+	}
+	if _, err := cli.Put(ctx, "test", []byte("v2")); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Put as user: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	if wa, err := cli.WhoAmI(ctx); err != nil {
+		t.Errorf("WhoAmI as user: unexpected error: %v", err)
+	} else if len(wa.Permissions) != 1 || !slices.Equal(wa.Permissions[0].Action, []acl.Action{acl.ActionGet, acl.ActionInfo}) {
+		t.Errorf("WhoAmI as user: got permissions %+v, want only get and info", wa.Permissions)
+	}
+
+	// The tagged caller can write.
+	whois = admin
+	if _, err := cli.Put(ctx, "test", []byte("v2")); err != nil {
+		t.Errorf("Put as admin: unexpected error: %v", err)
+	}
+
+	// The denied write is recorded in the audit log.
+	var denied []*audit.Entry
+	if err := audit.Scan(&buf, func(e *audit.Entry) error {
+		if !e.Authorized {
+			denied = append(denied, e)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan audit log: %v", err)
+	}
+	if len(denied) != 1 || denied[0].Action != acl.ActionPut || denied[0].Principal.User != "user@example.com" {
+		t.Errorf("Audit: got denied entries %+v, want one put by user@example.com", denied)
+	}
+}
+
+func TestServerIdempotentPut(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	put := func(value, key string) (api.SecretVersion, error) {
+		return cli.PutWithOptions(ctx, "test", []byte(value), setec.PutOptions{IdempotencyKey: key})
+	}
+
+	v1, err := put("alpha", "key1")
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	// Repeating the request reports the same version.
+	if v, err := put("alpha", "key1"); err != nil {
+		t.Errorf("Put again: unexpected error: %v", err)
+	} else if v != v1 {
+		t.Errorf("Put again: got version %v, want %v", v, v1)
+	}
+
+	// Reusing the key for another value is an error.
+	if v, err := put("bravo", "key1"); err == nil {
+		t.Errorf("Put with reused key: got version %v, want error", v)
+	}
+
+	// A new key creates a new version, even for a value stored before.
+	if _, err := put("bravo", "key2"); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	v3, err := put("alpha", "key3")
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	} else if v3 == v1 {
+		t.Errorf("Put with new key: got version %v, want a new version", v3)
+	}
+
+	// Keys that are too long are rejected.
+	if v, err := put("alpha", strings.Repeat("x", 129)); err == nil {
+		t.Errorf("Put with long key: got version %v, want error", v)
+	}
+}
+
+func TestServerIdempotentPutConcurrent(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+
+	// Hold puts of "slow" until released.
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		Authorize: func(_ context.Context, _ db.Caller, action acl.Action, secret string) error {
+			if action == acl.ActionPut && secret == "slow" {
+				entered <- struct{}{}
+				<-release
+			}
+			return nil
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	put := func(ctx context.Context, name, key string) (api.SecretVersion, error) {
+		return cli.PutWithOptions(ctx, name, []byte("value"), setec.PutOptions{IdempotencyKey: key})
+	}
+
+	var wg sync.WaitGroup
+	var v1, v2 api.SecretVersion
+	wg.Go(func() {
+		var err error
+		if v1, err = put(ctx, "slow", "key1"); err != nil {
+			t.Errorf("Put slow: unexpected error: %v", err)
+		}
+	})
+	<-entered
+
+	// A keyed put of another secret is not held up by the slow one.
+	fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := put(fctx, "fast", "key2"); err != nil {
+		t.Errorf("Put fast while slow is in progress: %v", err)
+	}
+
+	// A retry of the slow put waits for the original, and reports the same
+	// version rather than creating another.
+	wg.Go(func() {
+		var err error
+		if v2, err = put(ctx, "slow", "key1"); err != nil {
+			t.Errorf("Put slow again: unexpected error: %v", err)
+		}
+	})
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if v1 != v2 {
+		t.Errorf("Put slow: got versions %v and %v, want the same", v1, v2)
+	}
+	for _, info := range d.MustList(d.Superuser) {
+		if info.Name == "slow" && len(info.Versions) != 1 {
+			t.Errorf("Put slow: got versions %v, want 1", info.Versions)
+		}
+	}
+}
+
+func TestServerPutStream(t *testing.T) {
+	const maxBytes = 2 << 20
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{MaxSecretBytes: maxBytes})
+
+	// Deliver each chunk twice, as if the first response had been lost and
+	// the request retried.
+	var chunks int
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/put-chunk" {
+			chunks++
+			body, _ := io.ReadAll(r.Body)
+			r1 := r.Clone(r.Context())
+			r1.Body = io.NopCloser(bytes.NewReader(body))
+			ss.Mux.ServeHTTP(httptest.NewRecorder(), r1)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		ss.Mux.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do, MaxValueBytes: -1}
+
+	want := bytes.Repeat([]byte("0123456789abcdef"), (maxBytes-1000)/16)
+	v, err := cli.PutStream(ctx, "big", bytes.NewReader(want), setec.PutOptions{Activate: true})
+	if err != nil {
+		t.Fatalf("PutStream: unexpected error: %v", err)
+	}
+	if chunks < 2 {
+		t.Errorf("PutStream sent %d chunks, want several", chunks)
+	}
+	got, err := cli.Get(ctx, "big")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	} else if got.Version != v || !bytes.Equal(got.Value, want) {
+		t.Errorf("Get: got version %v with %d bytes, want version %v with %d bytes", got.Version, len(got.Value), v, len(want))
+	}
+
+	// The server limit applies to the assembled value.
+	tooBig := make([]byte, maxBytes+1)
+	if v, err := cli.PutStream(ctx, "big", bytes.NewReader(tooBig), setec.PutOptions{}); !errors.Is(err, api.ErrValueTooLarge) {
+		t.Errorf("PutStream too large: got (%v, %v), want %v", v, err, api.ErrValueTooLarge)
+	}
+
+	// Formats are checked by the server.
+	if v, err := cli.PutStream(ctx, "big", strings.NewReader("{not json"), setec.PutOptions{Format: api.FormatJSON}); !errors.Is(err, api.ErrInvalidFormat) {
+		t.Errorf("PutStream bad JSON: got (%v, %v), want %v", v, err, api.ErrInvalidFormat)
+	}
+
+	// A put naming an upload that does not exist fails. The chunks are
+	// dropped on the way to the server, so it never sees the upload.
+	dropChunks := setec.Client{Server: hs.URL, DoHTTP: func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/api/put-chunk" {
+			rec := httptest.NewRecorder()
+			rec.WriteString("{}")
+			return rec.Result(), nil
+		}
+		return hs.Client().Do(r)
+	}}
+	if v, err := dropChunks.PutStream(ctx, "big", strings.NewReader("value"), setec.PutOptions{}); !errors.Is(err, api.ErrInvalidUpload) {
+		t.Errorf("PutStream with unknown upload: got (%v, %v), want %v", v, err, api.ErrInvalidUpload)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	ss := setectest.NewServer(t, d, nil)
+
+	check := func(wantCode int, wantOK bool) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ss.Mux.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != wantCode {
+			t.Errorf("Health status: got %d, want %d", rec.Code, wantCode)
+		}
+		var rsp api.HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("Decode health response: %v", err)
+		} else if rsp.OK != wantOK {
+			t.Errorf("Health response: got %+v, want OK=%v", rsp, wantOK)
+		}
+	}
+
+	// The check does not require a caller identity.
+	check(http.StatusOK, true)
+
+	// If the key can no longer decrypt the database key, the check fails.
+	d.Key.(*tinktestutil.DummyAEAD).Name = "wrong"
+	check(http.StatusServiceUnavailable, false)
+}
+
+func TestServerReadOnly(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{ReadOnly: true})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	// Reads work normally.
+	if v, err := cli.Get(ctx, "test"); err != nil || string(v.Value) != "v1" {
+		t.Errorf("Get: got (%v, %v), want v1", v, err)
+	}
+	if _, err := cli.Info(ctx, "test"); err != nil {
+		t.Errorf("Info: unexpected error: %v", err)
+	}
+	if _, err := cli.List(ctx); err != nil {
+		t.Errorf("List: unexpected error: %v", err)
+	}
+	if l, err := cli.ListWithOptions(ctx, setec.ListOptions{Writable: true}); err != nil || len(l) != 0 {
+		t.Errorf("List writable: got (%v, %v), want no secrets", l, err)
+	}
+
+	// Writes are rejected, and not retried.
+	if _, err := cli.Put(ctx, "test", []byte("v2")); !errors.Is(err, api.ErrReadOnly) {
+		t.Errorf("Put: got %v, want %v", err, api.ErrReadOnly)
+	}
+	if err := cli.Activate(ctx, "test", 1); !errors.Is(err, api.ErrReadOnly) {
+		t.Errorf("Activate: got %v, want %v", err, api.ErrReadOnly)
+	}
+	if err := cli.DeleteVersion(ctx, "test", 1); !errors.Is(err, api.ErrReadOnly) {
+		t.Errorf("DeleteVersion: got %v, want %v", err, api.ErrReadOnly)
+	}
+	if err := cli.Delete(ctx, "test"); !errors.Is(err, api.ErrReadOnly) {
+		t.Errorf("Delete: got %v, want %v", err, api.ErrReadOnly)
+	}
+	if got := d.MustGet(d.Superuser, "test"); string(got.Value) != "v1" {
+		t.Errorf("Get after writes: got %q, want v1", got.Value)
+	}
+
+	// The mode is reported by the health check and metrics.
+	rec := httptest.NewRecorder()
+	ss.Mux.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var rsp api.HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("Decode health response: %v", err)
+	} else if !rsp.OK || !rsp.ReadOnly {
+		t.Errorf("Health response: got %+v, want OK and ReadOnly", rsp)
+	}
+	if got := ss.Actual.Metrics().(*metrics.Set).Get("gauge_read_only").String(); got != "1" {
+		t.Errorf("Read-only gauge: got %s, want 1", got)
+	}
+}
+
+func TestServerAuthorize(t *testing.T) {
+	var buf bytes.Buffer
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&buf)})
+	d.MustPut(d.Superuser, "ok/test", "v1")
+	d.MustPut(d.Superuser, "no/test", "v1")
+
+	// The hook denies access to secrets outside "ok/", and records the
+	// actions it is asked about.
+	errNotEntitled := errors.New("not entitled")
+	var checked []string
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		Authorize: func(ctx context.Context, caller db.Caller, action acl.Action, secret string) error {
+			if ctx.Err() != nil {
+				t.Errorf("Authorize %s %q: context already ended", action, secret)
+			}
+			checked = append(checked, string(action)+":"+secret)
+			if secret != "" && !strings.HasPrefix(secret, "ok/") {
+				return errNotEntitled
+			}
+			return nil
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := t.Context()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	if _, err := cli.Get(ctx, "ok/test"); err != nil {
+		t.Errorf("Get ok/test: unexpected error: %v", err)
+	}
+	if _, err := cli.Get(ctx, "no/test"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Get no/test: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	if err := cli.Rename(ctx, "ok/test", "no/renamed"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Rename to no/renamed: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	if _, err := cli.List(ctx); err != nil {
+		t.Errorf("List: unexpected error: %v", err)
+	}
+	want := []string{"get:ok/test", "get:no/test", "rename:ok/test", "rename:no/renamed", "info:"}
+	if !slices.Equal(checked, want) {
+		t.Errorf("Authorize calls: got %q, want %q", checked, want)
+	}
+
+	// Denials by the hook are audited with the reason.
+	var reasons []string
+	if err := audit.Scan(&buf, func(e *audit.Entry) error {
+		if !e.Authorized {
+			reasons = append(reasons, string(e.Action)+":"+e.Secret+":"+e.Reason)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan audit log: %v", err)
+	}
+	if want := []string{"get:no/test:not entitled", "rename:ok/test:not entitled"}; !slices.Equal(reasons, want) {
+		t.Errorf("Audit denials: got %q, want %q", reasons, want)
+	}
+
+	// Uploads are checked with the hook before any of the value is accepted.
+	checked = nil
+	if v, err := cli.PutStream(ctx, "no/test", strings.NewReader("v2"), setec.PutOptions{}); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("PutStream no/test: got (%v, %v), want %v", v, err, api.ErrAccessDenied)
+	}
+	if want := []string{"put:no/test"}; !slices.Equal(checked, want) {
+		t.Errorf("Authorize calls for upload: got %q, want %q", checked, want)
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	v1 := d.MustPut(d.Superuser, "test", "v1") // active
+	v2 := d.MustPut(d.Superuser, "test", "v2")
+
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	if ch, err := cli.Watch(ctx, "nonesuch"); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Watch nonesuch: got (%v, %v), want %v", ch, err, api.ErrNotFound)
+	}
+
+	ch, err := cli.Watch(ctx, "test")
+	if err != nil {
+		t.Fatalf("Watch test: %v", err)
+	}
+	checkNext := func(want api.SecretVersion, value string) {
+		t.Helper()
+		sv, ok := <-ch
+		if !ok {
+			t.Fatal("Watch channel closed unexpectedly")
+		} else if sv.Version != want || string(sv.Value) != value {
+			t.Errorf("Watch: got (%q, %v), want (%q, %v)", sv.Value, sv.Version, value, want)
+		}
+	}
+
+	// The first value reported is the current active version.
+	checkNext(v1, "v1")
+
+	// Changes to other secrets do not report a value.
+	d.MustPut(d.Superuser, "other", "o1")
+
+	// Changing the active version reports the new value.
+	d.MustActivate(d.Superuser, "test", v2)
+	checkNext(v2, "v2")
+
+	// Cancelling the context closes the channel.
+	cancel()
+	for range ch {
+		// drain any pending values
+	}
+}
+
+func TestBackupDir(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	// Pre-populate some old backups, which should be pruned.
+	dir := t.TempDir()
+	for _, name := range []string{"db-20000101T000000Z.json", "db-20000102T000000Z.json", "db-20000103T000000Z.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("old"), 0600); err != nil {
+			t.Fatalf("Write old backup: %v", err)
+		}
+	}
+
+	if _, err := server.New(t.Context(), server.Config{
+		DB:              d.Actual,
+		Mux:             http.NewServeMux(),
+		BackupDir:       dir,
+		BackupDirRetain: 2,
+	}); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// The server takes a backup immediately at startup; wait for it.
+	var backups []string
+	for range 100 {
+		backups, _ = filepath.Glob(filepath.Join(dir, "db-*.json"))
+		if len(backups) == 2 && !strings.HasPrefix(filepath.Base(backups[1]), "db-2000") {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	want := []string{filepath.Join(dir, "db-20000103T000000Z.json")}
+	if len(backups) != 2 || backups[0] != want[0] {
+		t.Fatalf("Backups: got %q, want %q plus a new backup", backups, want)
+	}
+
+	got, err := os.ReadFile(backups[1])
+	if err != nil {
+		t.Fatalf("Read backup: %v", err)
+	}
+	orig, err := os.ReadFile(d.Path)
+	if err != nil {
+		t.Fatalf("Read database: %v", err)
+	}
+	if !bytes.Equal(got, orig) {
+		t.Error("Backup does not match the database contents")
+	}
+}
+
+func TestBackupTime(t *testing.T) {
+	want := time.Date(2023, 10, 5, 17, 41, 28, 0, time.UTC)
+	tests := []struct {
+		src string
+		ok  bool
+	}{
+		{"s3://my-bucket/2023/10/5/db-2023-10-05T17:41:28Z.json", true},
+		{"/var/backups/setec/db-20231005T174128Z.json", true},
+		{"db-20231005T174128Z.json", true},
+		{"/var/backups/setec/database", false},
+		{"db-yesterday.json", false},
+		{"db-20231005T174128Z.json.bak", false},
+	}
+	for _, tc := range tests {
+		got, ok := server.BackupTime(tc.src)
+		if ok != tc.ok || (ok && !got.Equal(want)) {
+			t.Errorf("BackupTime(%q): got (%v, %v), want ok=%v", tc.src, got, ok, tc.ok)
+		}
+	}
+}
+
+// recordingTarget is a server.BackupTarget that records the backups written
+// to it, or fails if err is set.
+type recordingTarget struct {
+	name string
+	err  error
+	got  chan []byte
+}
+
+func (r *recordingTarget) String() string { return r.name }
+
+func (r *recordingTarget) WriteBackup(_ context.Context, data []byte, _ time.Time) error {
+	if r.err != nil {
+		r.got <- nil
+		return r.err
+	}
+	r.got <- data
+	return nil
+}
+
+func TestS3BackupCredentials(t *testing.T) {
+	// These are reported before any request is made to AWS.
+	missing := filepath.Join(t.TempDir(), "credentials")
+	for _, opts := range []server.S3BackupOptions{
+		{Region: "us-east-1", WebIdentityTokenFile: "/var/run/token"},
+		{Region: "us-east-1", CredentialsFile: missing},
+	} {
+		if _, err := server.NewS3BackupWithOptions(t.Context(), "bucket", opts); err == nil {
+			t.Errorf("NewS3BackupWithOptions(%+v): got nil error, want error", opts)
+		} else {
+			t.Logf("NewS3BackupWithOptions(%+v): %v", opts, err)
+		}
+		if _, err := server.ReadBackupWithOptions(t.Context(), "s3://bucket/key", opts); err == nil {
+			t.Errorf("ReadBackupWithOptions(%+v): got nil error, want error", opts)
+		}
+	}
+}
+
+func TestBackupTargets(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	bad := &recordingTarget{name: "bad", err: errors.New("no backup for you"), got: make(chan []byte, 10)}
+	good := &recordingTarget{name: "good", got: make(chan []byte, 10)}
+	ss := http.NewServeMux()
+	srv, err := server.New(t.Context(), server.Config{
+		DB:            d.Actual,
+		Mux:           ss,
+		BackupTargets: []server.BackupTarget{bad, good},
+		SizeMetrics:   true,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// The failing target must not prevent a backup to the other.
+	orig, err := os.ReadFile(d.Path)
+	if err != nil {
+		t.Fatalf("Read database: %v", err)
+	}
+	select {
+	case got := <-good.got:
+		if !bytes.Equal(got, orig) {
+			t.Error("Backup does not match the database contents")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for backup")
+	}
+	select {
+	case <-bad.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for failed backup")
+	}
+
+	// The failure is reported by the health check, and the backup to the
+	// good target is counted and its time recorded.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		rec := httptest.NewRecorder()
+		ss.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		var rsp api.HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("Decode health response: %v", err)
+		}
+		if strings.Contains(rsp.LastBackupError, "no backup for you") {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Health response: got %+v, want the backup error", rsp)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m := srv.Metrics().(*metrics.Set)
+	if got := m.Get("counter_backups").(*metrics.LabelMap).Get("good").String(); got != "1" {
+		t.Errorf("Backups: got %s, want 1", got)
+	}
+	if got, want := m.Get("counter_backup_bytes").(*metrics.LabelMap).Get("good").String(), fmt.Sprint(len(orig)); got != want {
+		t.Errorf("Backup bytes: got %s, want %s", got, want)
+	}
+	times := m.Get("gauge_last_backup_timestamp_seconds").(*metrics.LabelMap)
+	if got := times.Get("good").Value(); got == 0 {
+		t.Error("Last backup to good target: got 0, want its time")
+	}
+	if got := times.Get("bad").Value(); got != 0 {
+		t.Errorf("Last backup to bad target: got %d, want 0", got)
+	}
+	if got := m.Get("counter_backup_errors").(*metrics.LabelMap).Get("bad").String(); got != "1" {
+		t.Errorf("Backup errors: got %s, want 1", got)
+	}
+}
+
+func TestServerOpenMetricsLabels(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+
+	// Backup directory paths can contain spaces, quotes, and any other
+	// characters, and appear as label values.
+	const name = `dir:/srv/my "setec" backups/café`
+	target := &recordingTarget{name: name, got: make(chan []byte, 10)}
+	mux := http.NewServeMux()
+	if _, err := server.New(t.Context(), server.Config{
+		DB:            d.Actual,
+		Mux:           mux,
+		BackupTargets: []server.BackupTarget{target},
+	}); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	select {
+	case <-target.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for backup")
+	}
+
+	want := `setec_backups_total{target="dir:/srv/my \"setec\" backups/café"} 1` + "\n"
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if strings.Contains(rec.Body.String(), want) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Metrics output is missing %q:\n%s", want, rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerSizeMetrics(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "v1")
+	fi, err := os.Stat(d.Path)
+	if err != nil {
+		t.Fatalf("Stat database: %v", err)
+	}
+	for _, enabled := range []bool{false, true} {
+		srv, err := server.New(t.Context(), server.Config{
+			DB:          d.Actual,
+			Mux:         http.NewServeMux(),
+			SizeMetrics: enabled,
+		})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		m := srv.Metrics().(*metrics.Set)
+		size := m.Get("gauge_db_size_bytes")
+		if !enabled {
+			if size != nil {
+				t.Errorf("Size without SizeMetrics: got %v, want none", size)
+			}
+			continue
+		}
+		if got, want := fmt.Sprint(size), fmt.Sprint(fi.Size()); got != want {
+			t.Errorf("Size: got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestServerAccessStats(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "prod/a", "apple")
+	d.MustPut(d.Superuser, "dev/b", "banana")
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		AccessMetrics: []acl.Secret{"prod/*"},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	// Before any reads, no access is reported.
+	info, err := cli.Info(t.Context(), "prod/a")
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	} else if info.AccessCount != 0 || !info.LastAccessedAt.IsZero() {
+		t.Errorf("Info before get: got count %d at %v, want none", info.AccessCount, info.LastAccessedAt)
+	}
+
+	start := time.Now()
+	for _, name := range []string{"prod/a", "prod/a", "dev/b", "nonesuch"} {
+		cli.Get(t.Context(), name)
+	}
+	if _, err := cli.GetVersion(t.Context(), "dev/b", 1); err != nil {
+		t.Fatalf("GetVersion: %v", err)
+	}
+
+	for name, want := range map[string]int64{"prod/a": 2, "dev/b": 2} {
+		info, err := cli.Info(t.Context(), name)
+		if err != nil {
+			t.Fatalf("Info %q: %v", name, err)
+		}
+		if info.AccessCount != want || info.LastAccessedAt.Before(start.Add(-time.Second)) {
+			t.Errorf("Info %q: got count %d at %v, want %d after %v", name, info.AccessCount, info.LastAccessedAt, want, start)
+		}
+	}
+
+	// Only secrets matching the patterns are exported as metrics.
+	gets := ss.Actual.Metrics().(*metrics.Set).Get("counter_secret_gets")
+	if got, want := gets.String(), `{"prod/a": 2}`; got != want {
+		t.Errorf("Metrics: got %s, want %s", got, want)
+	}
+}
+
+func TestServerActivationMetrics(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	id := d.Superuser
+	d.MustPut(id, "prod/a", "a1")
+	d.MustPut(id, "prod/b", "b1")
+	d.MustPut(id, "dev/c", "c1")
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		AccessMetrics: []acl.Secret{"prod/*"},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	ctx := t.Context()
+
+	start := time.Now().Unix()
+	a2, err := cli.Put(ctx, "prod/a", []byte("a2"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := cli.Activate(ctx, "prod/a", a2); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	if _, err := cli.PutWithOptions(ctx, "prod/b", []byte("b2"), setec.PutOptions{Activate: true}); err != nil {
+		t.Fatalf("Put with activate: %v", err)
+	}
+	c2, err := cli.Put(ctx, "dev/c", []byte("c2"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := cli.ActivateMany(ctx, []api.ActivateRequest{
+		{Name: "prod/a", Version: 1},
+		{Name: "dev/c", Version: c2},
+	}); err != nil {
+		t.Fatalf("ActivateMany: %v", err)
+	}
+	// A failed activation is not counted.
+	if err := cli.Activate(ctx, "prod/b", 99); err == nil {
+		t.Fatal("Activate missing version: got nil, want error")
+	}
+	if err := cli.WaitActive(ctx, "dev/c", c2); err != nil {
+		t.Fatalf("WaitActive: %v", err)
+	}
+
+	// Requests that leave the active version unchanged are not counted.
+	if err := cli.Activate(ctx, "prod/a", 1); err != nil {
+		t.Fatalf("Activate active version: %v", err)
+	}
+	if _, err := cli.PutWithOptions(ctx, "prod/b", []byte("b2"), setec.PutOptions{Activate: true}); err != nil {
+		t.Fatalf("Put active value with activate: %v", err)
+	}
+	if err := cli.ActivateMany(ctx, []api.ActivateRequest{
+		{Name: "prod/a", Version: 1},
+		{Name: "prod/b", Version: 2},
+	}); err != nil {
+		t.Fatalf("ActivateMany active versions: %v", err)
+	}
+	if _, err := cli.Put(ctx, "prod/new", []byte("new")); err != nil {
+		t.Fatalf("Put new secret: %v", err)
+	}
+
+	// Deleting the active version in favour of another is counted.
+	if err := cli.DeleteVersionAndActivate(ctx, "prod/b", 2, 1); err != nil {
+		t.Fatalf("DeleteVersionAndActivate: %v", err)
+	}
+
+	m := ss.Actual.Metrics().(*metrics.Set)
+	if got := m.Get("counter_activations").String(); got != "5" {
+		t.Errorf("Activations: got %s, want 5", got)
+	}
+	// Only secrets matching the patterns are exported per secret.
+	if got, want := m.Get("counter_secret_activations").String(), `{"prod/a": 2, "prod/b": 2}`; got != want {
+		t.Errorf("Secret activations: got %s, want %s", got, want)
+	}
+	last := m.Get("gauge_last_activation_timestamp_seconds").(*metrics.LabelMap)
+	for _, name := range []string{"prod/a", "prod/b"} {
+		if at := last.Get(name).Value(); at < start {
+			t.Errorf("Last activation of %q: got %d, want at least %d", name, at, start)
+		}
+	}
+	for _, name := range []string{"dev/c", "prod/new"} {
+		if v := last.Map.Get(name); v != nil {
+			t.Errorf("Last activation of %q: got %v, want none", name, v)
+		}
+	}
+}
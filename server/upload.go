@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+)
+
+const (
+	// uploadTTL is how long an upload is kept after its last chunk arrives,
+	// if it is not completed by a put.
+	uploadTTL = 10 * time.Minute
+
+	// maxUploadsPerCaller is the number of uploads a caller may have in
+	// progress at once. Together with the value size limit, it bounds the
+	// memory held for uploads that are never completed.
+	maxUploadsPerCaller = 8
+)
+
+// uploads holds the values of secrets being uploaded in chunks, until a put
+// request with the same upload ID stores them. Uploads are kept in memory
+// only.
+type uploads struct {
+	mu sync.Mutex
+	m  map[uploadKey]*upload
+}
+
+// uploadKey identifies an upload. Uploads are scoped to the caller, so one
+// caller cannot add to or complete another's upload.
+type uploadKey struct {
+	caller, id string
+}
+
+type upload struct {
+	secret string
+	data   []byte
+	at     time.Time // when the last chunk arrived
+}
+
+func newUploads() *uploads {
+	return &uploads{m: make(map[uploadKey]*upload)}
+}
+
+// add appends the chunk in req to the upload it belongs to on behalf of
+// caller, starting the upload if this is its first chunk, and reports the
+// number of bytes uploaded so far. The upload may not grow beyond maxBytes.
+//
+// Each chunk must start where the previous one ended. A chunk that repeats
+// data already received, as when a request is retried, is accepted without
+// changing the upload.
+func (u *uploads) add(caller string, req api.PutChunkRequest, maxBytes int) (int64, error) {
+	if !api.ValidRequestID(req.UploadID) {
+		return 0, fmt.Errorf("%w: invalid upload ID %q", api.ErrInvalidUpload, req.UploadID)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	uk := uploadKey{caller: caller, id: req.UploadID}
+	up := u.m[uk]
+	if up != nil && now.Sub(up.at) >= uploadTTL {
+		delete(u.m, uk)
+		up = nil
+	}
+	if up == nil {
+		if req.Offset != 0 {
+			return 0, fmt.Errorf("%w: upload %q not found", api.ErrInvalidUpload, req.UploadID)
+		}
+		if u.countLocked(caller, now) >= maxUploadsPerCaller {
+			return 0, fmt.Errorf("%w: too many uploads in progress", api.ErrInvalidUpload)
+		}
+		up = &upload{secret: req.Name, at: now}
+		u.m[uk] = up
+	} else if up.secret != req.Name {
+		return 0, fmt.Errorf("%w: upload %q is for a different secret", api.ErrInvalidUpload, req.UploadID)
+	}
+
+	size := int64(len(up.data))
+	switch {
+	case req.Offset == size:
+		if n := len(up.data) + len(req.Data); n > maxBytes {
+			return 0, fmt.Errorf("%w: upload exceeds the limit of %d bytes", api.ErrValueTooLarge, maxBytes)
+		}
+		up.data = append(up.data, req.Data...)
+	case req.Offset >= 0 && req.Offset+int64(len(req.Data)) <= size &&
+		bytes.Equal(up.data[req.Offset:req.Offset+int64(len(req.Data))], req.Data):
+		// A repeat of a chunk already received.
+	default:
+		return 0, fmt.Errorf("%w: chunk at offset %d does not continue upload of %d bytes", api.ErrInvalidUpload, req.Offset, size)
+	}
+	up.at = now
+	return int64(len(up.data)), nil
+}
+
+// countLocked reports the number of uploads caller has in progress, and
+// discards any uploads that have expired.
+func (u *uploads) countLocked(caller string, now time.Time) int {
+	var n int
+	for uk, up := range u.m {
+		if now.Sub(up.at) >= uploadTTL {
+			delete(u.m, uk)
+		} else if uk.caller == caller {
+			n++
+		}
+	}
+	return n
+}
+
+// value reports the data uploaded by caller with the given ID for the named
+// secret. The upload remains until it is removed by done, so that a put
+// that fails can be retried.
+func (u *uploads) value(caller, secret, id string) ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	up := u.m[uploadKey{caller: caller, id: id}]
+	if up == nil || time.Since(up.at) >= uploadTTL {
+		return nil, fmt.Errorf("%w: upload %q not found", api.ErrInvalidUpload, id)
+	} else if up.secret != secret {
+		return nil, fmt.Errorf("%w: upload %q is for a different secret", api.ErrInvalidUpload, id)
+	}
+	return up.data, nil
+}
+
+// done discards the upload by caller with the given ID.
+func (u *uploads) done(caller, id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.m, uploadKey{caller: caller, id: id})
+}
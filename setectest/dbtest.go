@@ -31,6 +31,7 @@ func superuser() db.Caller {
 			acl.Rule{
 				Action: []acl.Action{
 					acl.ActionGet, acl.ActionInfo, acl.ActionPut, acl.ActionCreateVersion, acl.ActionActivate, acl.ActionDelete,
+					acl.ActionRename, acl.ActionSetPrincipals, acl.ActionUndelete, acl.ActionAdmin,
 				},
 				Secret: []acl.Secret{"*"},
 			},
@@ -43,7 +44,7 @@ func superuser() db.Caller {
 type DB struct {
 	t *testing.T
 
-	Path      string    // the path of the database file
+	Path      string    // the path of the database file, or "" if in memory
 	Key       tink.AEAD // the key-encryption key (dummy)
 	Actual    *db.DB    // the underlying database
 	Superuser db.Caller // a pre-defined super-user for all secrets & operations
@@ -55,6 +56,13 @@ type DBOptions struct {
 	// AuditLog is where audit logs are written; if nil, audit logs are
 	// discarded without error.
 	AuditLog *audit.Writer
+
+	// InMemory, if true, keeps the database in memory instead of in a file
+	// under a temporary directory. The Path of the resulting DB is empty.
+	InMemory bool
+
+	// Options are the options for opening the database.
+	Options db.OpenOptions
 }
 
 func (o *DBOptions) auditWriter() *audit.Writer {
@@ -64,15 +72,31 @@ func (o *DBOptions) auditWriter() *audit.Writer {
 	return o.AuditLog
 }
 
+func (o *DBOptions) inMemory() bool { return o != nil && o.InMemory }
+
+func (o *DBOptions) openOptions() db.OpenOptions {
+	if o == nil {
+		return db.OpenOptions{}
+	}
+	return o.Options
+}
+
 // NewDB constructs a new empty DB that persists for the duration of the test
 // and subtests governed by t. When t ends, the database is cleaned up.
 // If opts == nil, default options are used (see DBOptions).
 func NewDB(t *testing.T, opts *DBOptions) *DB {
 	t.Helper()
 
-	path := filepath.Join(t.TempDir(), "test.db")
+	var path string
+	var adb *db.DB
+	var err error
 	key := &tinktestutil.DummyAEAD{Name: "setectest.DB." + t.Name()}
-	adb, err := db.Open(path, key, opts.auditWriter())
+	if opts.inMemory() {
+		adb, err = db.OpenInMemory(key, opts.auditWriter(), opts.openOptions())
+	} else {
+		path = filepath.Join(t.TempDir(), "test.db")
+		adb, err = db.OpenWithOptions(path, key, opts.auditWriter(), opts.openOptions())
+	}
 	if err != nil {
 		t.Fatalf("Creating test DB: %v", err)
 	}
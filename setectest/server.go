@@ -27,6 +27,7 @@ import (
 
 	"github.com/tailscale/setec/acl"
 	"github.com/tailscale/setec/audit"
+	"github.com/tailscale/setec/db"
 	"github.com/tailscale/setec/server"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
@@ -49,6 +50,35 @@ type ServerOptions struct {
 	// AuditLog is where audit logs are written; if nil, audit logs are
 	// discarded without error.
 	AuditLog *audit.Writer
+
+	// AuditLogPath, if non-empty, is the audit log file the server reads to
+	// answer audit queries. If empty, audit queries are not supported.
+	AuditLogPath string
+
+	// MaxSecretBytes, if positive, is the maximum size of a secret value
+	// accepted by the server. If zero, the server default is used.
+	MaxSecretBytes int
+
+	// RateLimit and RateBurst, if positive, set the per-caller rate limit
+	// of the server. If zero, requests are not rate limited.
+	RateLimit float64
+	RateBurst int
+
+	// AccessMetrics are the patterns of secret names for which the server
+	// exports per-secret access counts. If empty, none are exported.
+	AccessMetrics []acl.Secret
+
+	// WriteTags, if non-empty, are the tags a caller must have one of to
+	// modify secrets. If empty, writes are not restricted by tag.
+	WriteTags []string
+
+	// ReadOnly, if true, makes the server reject requests that modify the
+	// database.
+	ReadOnly bool
+
+	// Authorize, if non-nil, is an additional authorization check applied
+	// to each action the caller's permissions allow. See server.Config.
+	Authorize func(context.Context, db.Caller, acl.Action, string) error
 }
 
 func (o *ServerOptions) whoIs() func(context.Context, string) (*apitype.WhoIsResponse, error) {
@@ -58,6 +88,55 @@ func (o *ServerOptions) whoIs() func(context.Context, string) (*apitype.WhoIsRes
 	return o.WhoIs
 }
 
+func (o *ServerOptions) maxSecretBytes() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxSecretBytes
+}
+
+func (o *ServerOptions) rateLimit() (float64, int) {
+	if o == nil {
+		return 0, 0
+	}
+	return o.RateLimit, o.RateBurst
+}
+
+func (o *ServerOptions) accessMetrics() []acl.Secret {
+	if o == nil {
+		return nil
+	}
+	return o.AccessMetrics
+}
+
+func (o *ServerOptions) writeTags() []string {
+	if o == nil {
+		return nil
+	}
+	return o.WriteTags
+}
+
+func (o *ServerOptions) readOnly() bool {
+	if o == nil {
+		return false
+	}
+	return o.ReadOnly
+}
+
+func (o *ServerOptions) authorize() func(context.Context, db.Caller, acl.Action, string) error {
+	if o == nil {
+		return nil
+	}
+	return o.Authorize
+}
+
+func (o *ServerOptions) auditLogPath() string {
+	if o == nil {
+		return ""
+	}
+	return o.AuditLogPath
+}
+
 func (o *ServerOptions) auditLog() *audit.Writer {
 	if o == nil || o.AuditLog == nil {
 		return audit.New(io.Discard)
@@ -74,11 +153,21 @@ func NewServer(t *testing.T, db *DB, opts *ServerOptions) *Server {
 	mux := http.NewServeMux()
 	ctx, cancel := context.WithCancel(context.Background())
 	t.Cleanup(cancel)
+	rateLimit, rateBurst := opts.rateLimit()
 	s, err := server.New(ctx, server.Config{
 		DB:       db.Actual,
 		AuditLog: opts.auditLog(),
 		WhoIs:    opts.whoIs(),
 		Mux:      mux,
+
+		AuditLogPath:   opts.auditLogPath(),
+		MaxSecretBytes: opts.maxSecretBytes(),
+		RateLimit:      rateLimit,
+		RateBurst:      rateBurst,
+		AccessMetrics:  opts.accessMetrics(),
+		WriteTags:      opts.writeTags(),
+		ReadOnly:       opts.readOnly(),
+		Authorize:      opts.authorize(),
 	})
 	if err != nil {
 		t.Fatalf("Creating new server: %v", err)
@@ -93,6 +182,7 @@ func init() {
 	rule, err := json.Marshal(acl.Rule{
 		Action: []acl.Action{
 			acl.ActionGet, acl.ActionInfo, acl.ActionPut, acl.ActionCreateVersion, acl.ActionActivate, acl.ActionDelete,
+			acl.ActionRename, acl.ActionSetPrincipals, acl.ActionUndelete, acl.ActionAdmin,
 		},
 		Secret: []acl.Secret{"*"},
 	})
@@ -6,8 +6,20 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tailscale/setec/acl"
 )
 
 var (
@@ -19,6 +31,13 @@ var (
 	// secret version is not found.
 	ErrNotFound = errors.New("not found")
 
+	// ErrSecretNotFound and ErrVersionNotFound are sentinel errors reported
+	// by requests when the specified secret, or the specified version of it,
+	// does not exist. Both wrap ErrNotFound. Servers that do not report
+	// error codes (see ErrorCodeHeader) report only ErrNotFound.
+	ErrSecretNotFound  = fmt.Errorf("secret %w", ErrNotFound)
+	ErrVersionNotFound = fmt.Errorf("version %w", ErrNotFound)
+
 	// ErrVersionClaimed indicates that an attempt was made to create a
 	// version of a secret that has at some point already been set,
 	// even if it has since been deleted.
@@ -27,8 +46,265 @@ var (
 	// ErrAccessDenied is a sentinel error reported by requests when access to
 	// perform the requested operation is denied.
 	ErrAccessDenied = errors.New("access denied")
+
+	// ErrExpired is a sentinel error reported by Get requests when the
+	// requested secret version exists, but its expiration time has passed.
+	ErrExpired = errors.New("secret version has expired")
+
+	// ErrInvalidName is a sentinel error reported when a secret name does not
+	// satisfy the rules checked by [CheckSecretName].
+	ErrInvalidName = errors.New("invalid secret name")
+
+	// ErrInvalidLabel is a sentinel error reported when a secret label does
+	// not satisfy the rules checked by [CheckLabel].
+	ErrInvalidLabel = errors.New("invalid secret label")
+
+	// ErrInvalidDescription is a sentinel error reported when a secret
+	// description does not satisfy the rules checked by [CheckDescription].
+	ErrInvalidDescription = errors.New("invalid secret description")
+
+	// ErrValueTooLarge is a sentinel error reported by requests to store a
+	// secret value that is larger than the server allows.
+	ErrValueTooLarge = errors.New("secret value is too large")
+
+	// ErrRateLimited is a sentinel error reported when the server rejects a
+	// request because the caller has exceeded its request rate limit.
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	// ErrAlreadyExists is a sentinel error reported by Rename requests when a
+	// secret with the new name already exists.
+	ErrAlreadyExists = errors.New("secret already exists")
+
+	// ErrBrokenAlias is a sentinel error reported by Get requests for an
+	// alias whose target secret no longer exists.
+	ErrBrokenAlias = errors.New("alias target does not exist")
+
+	// ErrAliasTarget is a sentinel error reported by Delete and Rename
+	// requests for a secret that is the target of an alias, when the server
+	// is configured to protect alias targets.
+	ErrAliasTarget = errors.New("secret is the target of an alias")
+
+	// ErrImmutable is a sentinel error reported by Delete and Rename requests
+	// for an immutable secret, and by DeleteVersion requests for a version of
+	// it that was ever active. See PutRequest.Immutable.
+	ErrImmutable = errors.New("secret is immutable")
+
+	// ErrInvalidUpload is a sentinel error reported by Put requests for a
+	// chunked upload that is unknown, or whose chunk does not continue the
+	// upload it belongs to.
+	ErrInvalidUpload = errors.New("invalid upload")
+
+	// ErrReadOnly is a sentinel error reported by requests to modify secrets
+	// when the server is running in read-only mode.
+	ErrReadOnly = errors.New("server is read-only")
+
+	// ErrAuditUnavailable is a sentinel error reported by audit queries when
+	// the server is not able to read its audit log.
+	ErrAuditUnavailable = errors.New("audit log is not available")
 )
 
+// ErrorCodeHeader is the HTTP response header in which the server reports a
+// machine-readable code for an error, since several errors share an HTTP
+// status. Clients should use ErrorForCode to interpret it, and fall back to
+// the HTTP status if it is absent, as it is for older servers.
+const ErrorCodeHeader = "Setec-Error-Code"
+
+// Error codes reported in ErrorCodeHeader. Each denotes the error of this
+// package with the corresponding name.
+const (
+	CodeAccessDenied       = "access-denied"
+	CodeNotFound           = "not-found"
+	CodeSecretNotFound     = "secret-not-found"
+	CodeVersionNotFound    = "version-not-found"
+	CodeNotModified        = "not-modified"
+	CodeExpired            = "expired"
+	CodeVersionClaimed     = "version-claimed"
+	CodeAlreadyExists      = "already-exists"
+	CodeInvalidName        = "invalid-name"
+	CodeInvalidLabel       = "invalid-label"
+	CodeInvalidDescription = "invalid-description"
+	CodeInvalidFormat      = "invalid-format"
+	CodeInvalidTemplate    = "invalid-template"
+	CodeValueTooLarge      = "value-too-large"
+	CodeRateLimited        = "rate-limited"
+	CodeReadOnly           = "read-only"
+	CodeAuditUnavailable   = "audit-unavailable"
+	CodeBrokenAlias        = "broken-alias"
+	CodeAliasTarget        = "alias-target"
+	CodeImmutable          = "immutable"
+	CodeInvalidUpload      = "invalid-upload"
+)
+
+// errorCodes maps the error codes reported in ErrorCodeHeader to the errors
+// they denote.
+var errorCodes = map[string]error{
+	CodeAccessDenied:       ErrAccessDenied,
+	CodeNotFound:           ErrNotFound,
+	CodeSecretNotFound:     ErrSecretNotFound,
+	CodeVersionNotFound:    ErrVersionNotFound,
+	CodeNotModified:        ErrValueNotChanged,
+	CodeExpired:            ErrExpired,
+	CodeVersionClaimed:     ErrVersionClaimed,
+	CodeAlreadyExists:      ErrAlreadyExists,
+	CodeInvalidName:        ErrInvalidName,
+	CodeInvalidLabel:       ErrInvalidLabel,
+	CodeInvalidDescription: ErrInvalidDescription,
+	CodeInvalidFormat:      ErrInvalidFormat,
+	CodeInvalidTemplate:    ErrTemplate,
+	CodeValueTooLarge:      ErrValueTooLarge,
+	CodeRateLimited:        ErrRateLimited,
+	CodeReadOnly:           ErrReadOnly,
+	CodeAuditUnavailable:   ErrAuditUnavailable,
+	CodeBrokenAlias:        ErrBrokenAlias,
+	CodeAliasTarget:        ErrAliasTarget,
+	CodeImmutable:          ErrImmutable,
+	CodeInvalidUpload:      ErrInvalidUpload,
+}
+
+// ErrorForCode returns the error denoted by an error code reported in
+// ErrorCodeHeader, or nil if code is not known.
+func ErrorForCode(code string) error { return errorCodes[code] }
+
+// RequestIDHeader is the HTTP header carrying the ID of an API request, for
+// correlating a call seen by a client with the audit log entries it caused.
+// A client may set it on a request; if it is missing or not valid according
+// to ValidRequestID, the server assigns an ID with NewRequestID. The server
+// reports the ID in this header of its response, and records it in the audit
+// log entries for the request.
+const RequestIDHeader = "X-Setec-Request-ID"
+
+// MaxRequestIDLength is the maximum length in bytes of a request ID.
+const MaxRequestIDLength = 128
+
+// ValidRequestID reports whether id is a valid request ID: a non-empty string
+// of at most MaxRequestIDLength printable ASCII characters other than space.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestID returns a new random request ID.
+func NewRequestID() string {
+	var buf [12]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// DefaultMaxValueBytes is the default maximum size in bytes of a secret value
+// accepted by the server.
+const DefaultMaxValueBytes = 1 << 20
+
+// DefaultAuditLimit is the maximum number of entries reported by an audit
+// query that does not specify a limit.
+const DefaultAuditLimit = 100
+
+// MaxAuditLimit is the maximum number of entries reported by an audit query.
+// A query with a larger limit reports at most this many.
+const MaxAuditLimit = 10000
+
+// MaxSecretNameLength is the maximum length in bytes of a secret name.
+const MaxSecretNameLength = 256
+
+// CheckSecretName reports whether name is a valid name for a new secret.
+// A valid name is a non-empty sequence of path segments separated by single
+// slashes ("/"), such as "team/service/key", at most MaxSecretNameLength
+// bytes long. Segments consist of printable, non-space ASCII characters, and
+// may not be "." or "..". If name is invalid, the error wraps ErrInvalidName.
+func CheckSecretName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidName)
+	} else if len(name) > MaxSecretNameLength {
+		return fmt.Errorf("%w: name is longer than %d bytes", ErrInvalidName, MaxSecretNameLength)
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c > '~' {
+			return fmt.Errorf("%w: invalid character %q at offset %d", ErrInvalidName, c, i)
+		}
+	}
+	for seg := range strings.SplitSeq(name, "/") {
+		switch seg {
+		case "":
+			return fmt.Errorf("%w: %q has an empty path segment", ErrInvalidName, name)
+		case ".", "..":
+			return fmt.Errorf("%w: %q has a %q path segment", ErrInvalidName, name, seg)
+		}
+	}
+	return nil
+}
+
+// MaxLabelLength is the maximum length in bytes of a label key or value.
+const MaxLabelLength = 63
+
+// MaxDescriptionLength is the maximum length in bytes of a secret description.
+const MaxDescriptionLength = 4096
+
+// CheckDescription reports whether desc is a valid secret description: UTF-8
+// text of at most MaxDescriptionLength bytes, with no control characters
+// other than newlines and tabs. If not, the error wraps ErrInvalidDescription.
+func CheckDescription(desc string) error {
+	if len(desc) > MaxDescriptionLength {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidDescription, MaxDescriptionLength)
+	} else if !utf8.ValidString(desc) {
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidDescription)
+	}
+	for _, r := range desc {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return fmt.Errorf("%w: invalid character %q", ErrInvalidDescription, r)
+		}
+	}
+	return nil
+}
+
+// CheckLabel reports whether key=value is a valid secret label. A key is a
+// non-empty string of ASCII letters, digits, and the characters "-", "_", "."
+// and "/", at most MaxLabelLength bytes long. A value follows the same rules,
+// except that it may not contain "/" and may be empty. If the label is
+// invalid, the error wraps ErrInvalidLabel.
+func CheckLabel(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidLabel)
+	} else if len(key) > MaxLabelLength {
+		return fmt.Errorf("%w: key %q is longer than %d bytes", ErrInvalidLabel, key, MaxLabelLength)
+	}
+	for _, r := range key {
+		if r != '/' && !isLabelRune(r) {
+			return fmt.Errorf("%w: invalid character %q in key %q", ErrInvalidLabel, r, key)
+		}
+	}
+	if len(value) > MaxLabelLength {
+		return fmt.Errorf("%w: value for %q is longer than %d bytes", ErrInvalidLabel, key, MaxLabelLength)
+	}
+	for _, r := range value {
+		if !isLabelRune(r) {
+			return fmt.Errorf("%w: invalid character %q in value for %q", ErrInvalidLabel, r, key)
+		}
+	}
+	return nil
+}
+
+// CheckLabels is as CheckLabel, but checks each of the labels in turn and
+// reports the first error found.
+func CheckLabels(labels map[string]string) error {
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		if err := CheckLabel(k, labels[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isLabelRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+		r == '-' || r == '_' || r == '.'
+}
+
 // SecretVersion is the version of a secret.
 //
 // Secrets can have multiple values over time, for example when API
@@ -51,6 +327,19 @@ const SecretVersionDefault SecretVersion = 0
 type SecretValue struct {
 	Value   []byte
 	Version SecretVersion
+
+	// CreatedAt, if non-zero, is when this version of the secret was
+	// created. Versions created by older servers have no creation time.
+	CreatedAt time.Time `json:",omitzero"`
+
+	// Format, if non-empty, is the format declared for the values of the
+	// secret. See CheckFormat. A value stored without declaring a format may
+	// not match it.
+	Format string `json:",omitempty"`
+
+	// ContentType, if non-empty, is the MIME type most recently recorded for
+	// the values of the secret. See CheckContentType.
+	ContentType string `json:",omitempty"`
 }
 
 // SecretInfo is information about a named secret.
@@ -63,10 +352,95 @@ type SecretInfo struct {
 	Name          string
 	Versions      []SecretVersion
 	ActiveVersion SecretVersion
+
+	// VersionInfo maps versions to additional metadata about those versions.
+	// Versions that have no additional metadata may be omitted.
+	VersionInfo map[SecretVersion]*VersionInfo `json:",omitempty"`
+
+	// Principals, if non-empty, lists the tailnet users and tags that are
+	// allowed to get the secret or its metadata, in addition to having the
+	// necessary permissions. If empty, access is governed only by permissions.
+	Principals []string `json:",omitempty"`
+
+	// MaxValueBytes, if positive, is the maximum size in bytes of a value the
+	// server will accept for a new version of the secret.
+	MaxValueBytes int `json:",omitempty"`
+
+	// Labels are key/value pairs attached to the secret, for use in grouping
+	// and selecting secrets. They are not secret.
+	Labels map[string]string `json:",omitempty"`
+
+	// Format, if non-empty, is the format most recently declared for the
+	// values of the secret by a put. See CheckFormat.
+	Format string `json:",omitempty"`
+
+	// ContentType, if non-empty, is the MIME type most recently recorded for
+	// the values of the secret by a put, such as "application/json". Unlike
+	// Format, it is not checked against the value. See CheckContentType.
+	ContentType string `json:",omitempty"`
+
+	// MaxVersions, if non-zero, is the number of versions the server keeps
+	// for the secret, as set by a put. If negative, the number is not
+	// limited. If zero, the default limit of the server applies.
+	MaxVersions int `json:",omitempty"`
+
+	// Description, if non-empty, is free text describing the secret, such
+	// as what it is for and how to rotate it. See CheckDescription.
+	Description string `json:",omitempty"`
+
+	// Immutable reports whether the secret is immutable, as set by a put.
+	// See PutRequest.Immutable.
+	Immutable bool `json:",omitempty"`
+
+	// AliasOf, if non-empty, reports that the secret is an alias for the
+	// secret with this name, whose active value it serves. An alias has no
+	// versions or metadata of its own, so the other fields are empty.
+	AliasOf string `json:",omitempty"`
+
+	// AccessCount is the number of times the value of the secret has been
+	// read since the server started, and LastAccessedAt is the time of the
+	// most recent read. They are zero if the secret has not been read since
+	// then. They are reported by info, but not by list.
+	AccessCount    int64     `json:",omitempty"`
+	LastAccessedAt time.Time `json:",omitzero"`
+}
+
+// VersionInfo is optional metadata about a single version of a secret.
+type VersionInfo struct {
+	// ExpiresAt, if non-zero, is the time after which the server will no
+	// longer serve the value of this version.
+	ExpiresAt time.Time `json:",omitzero"`
+
+	// CreatedAt and CreatedBy report when the version was created, and the
+	// tailnet user or host that created it.
+	CreatedAt time.Time `json:",omitzero"`
+	CreatedBy string    `json:",omitempty"`
+
+	// ActivatedAt and ActivatedBy report when the version was most recently
+	// made active, and the tailnet user or host that activated it. They are
+	// empty if the version became active when it was created.
+	ActivatedAt time.Time `json:",omitzero"`
+	ActivatedBy string    `json:",omitempty"`
+
+	// Template reports whether the value of this version is a template that
+	// refers to other secrets. See TemplateRefs.
+	Template bool `json:",omitempty"`
 }
 
 // ListRequest is a request to list secrets.
-type ListRequest struct{}
+type ListRequest struct {
+	// Prefix, if non-empty, restricts the results to secrets whose names
+	// begin with this string.
+	Prefix string `json:",omitempty"`
+
+	// Selector, if non-empty, restricts the results to secrets having all
+	// the specified labels with the specified values.
+	Selector map[string]string `json:",omitempty"`
+
+	// Writable, if true, restricts the results to secrets the caller is
+	// allowed to put new values for.
+	Writable bool `json:",omitempty"`
+}
 
 // GetRequest is a request to get a secret value.
 type GetRequest struct {
@@ -87,6 +461,167 @@ type GetRequest struct {
 	UpdateIfChanged bool
 }
 
+// ResolveRequest is a request to get the active value of a secret with any
+// template references to other secrets expanded.
+type ResolveRequest struct {
+	// Name is the name of the secret to fetch.
+	Name string
+}
+
+// WatchRequest is a request to watch for changes to the active value of a
+// secret.
+type WatchRequest struct {
+	// Name is the name of the secret to watch.
+	Name string
+
+	// Version, if non-zero, is the active version already known to the
+	// caller. The server does not report this version, only subsequent
+	// changes. If Version == SecretVersionDefault, the server reports the
+	// current active version first.
+	Version SecretVersion
+}
+
+// HealthResponse is the response from the server health check.
+type HealthResponse struct {
+	// OK reports whether the server is ready to serve requests.
+	OK bool
+
+	// Error, if non-empty, describes why the server is not ready.
+	Error string `json:",omitempty"`
+
+	// LastBackup is the time as of which every backup target has a backup
+	// of the database: the oldest of the last successful backups to each.
+	// It is omitted if backups are not enabled, or a target has none yet.
+	LastBackup time.Time `json:",omitzero"`
+
+	// LastBackupError, if non-empty, describes why the most recent attempt
+	// to back up the database failed. It is cleared once a backup to every
+	// target succeeds. A failed backup does not make the server unhealthy.
+	LastBackupError string `json:",omitempty"`
+
+	// ReadOnly reports whether the server is in read-only mode, rejecting
+	// requests that would modify secrets.
+	ReadOnly bool `json:",omitempty"`
+}
+
+// WhoAmIRequest is a request to report the identity of the caller. It has
+// no parameters.
+type WhoAmIRequest struct{}
+
+// WhoAmIResponse reports the identity of the caller as seen by the server,
+// and the access rules granted to it by the tailnet policy.
+type WhoAmIResponse struct {
+	// User is the login name of the caller, or empty if the caller is a
+	// tagged node.
+	User string `json:",omitempty"`
+
+	// Hostname is the name of the caller's node.
+	Hostname string
+
+	// IP is the tailnet IP address the request was received from.
+	IP netip.Addr
+
+	// Tags are the tags of the caller's node, if it is tagged.
+	Tags []string `json:",omitempty"`
+
+	// Permissions are the access rules granted to the caller. Access to a
+	// particular secret may be further restricted by its principals.
+	Permissions acl.Rules
+}
+
+// PingRequest is a request to check that the server is reachable. It has no
+// parameters.
+type PingRequest struct{}
+
+// PingResponse is the response to a ping. Unlike other methods, ping
+// succeeds even if the server does not recognize the caller.
+type PingResponse struct {
+	// Version is the version of the setec module the server was built from,
+	// if known.
+	Version string `json:",omitempty"`
+
+	// Recognized reports whether the server identified the caller as a
+	// tailnet user or tagged node.
+	Recognized bool
+
+	// Caller is the login name or tags of the caller, if it was recognized.
+	Caller string `json:",omitempty"`
+
+	// HasPermissions reports whether the tailnet policy grants the caller
+	// any access to secrets.
+	HasPermissions bool
+}
+
+// ServerInfoRequest is a request to report the version and capabilities of
+// the server. It has no parameters.
+type ServerInfoRequest struct{}
+
+// ServerInfoResponse reports the version of the server and the optional
+// features it supports, so that clients can use newer features only with
+// servers that have them.
+type ServerInfoResponse struct {
+	// Version is the version of the setec module the server was built from,
+	// if known.
+	Version string `json:",omitempty"`
+
+	// Capabilities are the optional features the server supports, such as
+	// CapGetMany. Clients should ignore capabilities they do not know.
+	Capabilities []string
+
+	// ReadOnly reports whether the server is in read-only mode, rejecting
+	// requests that would modify secrets.
+	ReadOnly bool `json:",omitempty"`
+
+	// MaxValueBytes is the maximum size in bytes of a secret value the
+	// server accepts.
+	MaxValueBytes int `json:",omitempty"`
+}
+
+// Has reports whether the server supports the named capability.
+func (r *ServerInfoResponse) Has(capability string) bool {
+	return slices.Contains(r.Capabilities, capability)
+}
+
+// Capabilities reported in ServerInfoResponse. Each names an optional feature
+// of the API that not all servers support.
+const (
+	CapGetMany       = "get-many"       // /api/get-many
+	CapGetResolved   = "get-resolved"   // /api/get-resolved and templates
+	CapWatch         = "watch"          // /api/watch
+	CapPutChunk      = "put-chunk"      // chunked uploads with /api/put-chunk
+	CapActivateMany  = "activate-many"  // /api/activate-many
+	CapAlias         = "alias"          // /api/alias
+	CapUndelete      = "undelete"       // /api/undelete, if deletes are kept
+	CapAudit         = "audit"          // /api/audit, if the log is readable
+	CapErrorCodes    = "error-codes"    // error codes in ErrorCodeHeader
+	CapContentType   = "content-type"   // PutRequest.ContentType
+	CapImmutable     = "immutable"      // PutRequest.Immutable
+	CapListWritable  = "list-writable"  // ListRequest.Writable
+	CapIdempotentPut = "idempotent-put" // PutRequest.IdempotencyKey
+)
+
+// GetManyRequest is a request to get the active values of several secrets.
+type GetManyRequest struct {
+	// Names are the names of the secrets to fetch.
+	Names []string
+}
+
+// GetManyResult is the outcome of fetching a single secret named in a
+// GetManyRequest. Exactly one of Value or Status is set.
+type GetManyResult struct {
+	// Value is the active value of the secret, if it was fetched successfully.
+	Value *SecretValue `json:",omitempty"`
+
+	// Status is an HTTP status code describing why the secret could not be
+	// fetched, e.g., 403 if access was denied or 404 if it was not found.
+	// It is zero if the fetch succeeded.
+	Status int `json:",omitempty"`
+
+	// Code is the error code for the failure, as would be reported in
+	// ErrorCodeHeader by a request for the single secret, if any.
+	Code string `json:",omitempty"`
+}
+
 // InfoRequest is a request for secret metadata.
 type InfoRequest struct {
 	// Name is the name of the secret whose metadata to return.
@@ -99,6 +634,96 @@ type PutRequest struct {
 	Name string
 	// Value is the secret value.
 	Value []byte
+	// ExpiresAt, if non-zero, is the time after which the server will no
+	// longer serve the value of the new version.
+	ExpiresAt time.Time `json:",omitzero"`
+	// Labels, if non-empty, are added to the labels of the secret. A label
+	// with an empty value is removed.
+	Labels map[string]string `json:",omitempty"`
+	// Activate, if true, makes the new version active in the same update.
+	// This requires "activate" permission in addition to "put".
+	Activate bool `json:",omitempty"`
+	// Template, if true, marks the value as a template that refers to other
+	// secrets. See TemplateRefs.
+	Template bool `json:",omitempty"`
+	// IdempotencyKey, if non-empty, identifies this request so that it can
+	// be safely retried. If the server recently applied a request from the
+	// same caller for the same secret with the same key, it reports the
+	// version created by that request instead of creating a new one. Reusing
+	// a recent key for a different request is an error. Keys are at most
+	// 128 bytes long.
+	IdempotencyKey string `json:",omitempty"`
+	// Format, if non-empty, declares the format of the values of the secret.
+	// The value must be well-formed in that format. See CheckFormat.
+	Format string `json:",omitempty"`
+
+	// ContentType, if non-empty, records the MIME type of the values of the
+	// secret, replacing any content type recorded before. See
+	// CheckContentType.
+	ContentType string `json:",omitempty"`
+
+	// IfAbsent, if true, creates the secret only if it does not already
+	// exist. If it does, the request fails with ErrAlreadyExists and no
+	// version is added.
+	IfAbsent bool `json:",omitempty"`
+
+	// MaxVersions, if non-zero, sets the number of versions the server keeps
+	// for the secret, overriding its default. Once a put leaves the secret
+	// with more versions, the oldest versions other than the active and the
+	// newest are deleted. If negative, the number is not limited. Setting
+	// it, or a put that deletes versions, requires "delete" permission.
+	MaxVersions int `json:",omitempty"`
+
+	// AllowDuplicate, if true, adds a new version even if the value is the
+	// same as that of the newest version, or with deduplication enabled on
+	// the server the active version. Otherwise, the server reports the
+	// version already holding the value.
+	AllowDuplicate bool `json:",omitempty"`
+
+	// Description, if non-empty, replaces the description of the secret.
+	// If empty, the description is unchanged.
+	Description string `json:",omitempty"`
+
+	// Immutable, if true, makes the secret immutable. An immutable secret
+	// cannot be deleted or renamed, and no version of it that was ever
+	// active can be deleted, so it can change only by adding and activating
+	// new versions. Such requests report ErrImmutable, except that a caller
+	// with "admin" permission for the secret may delete or rename it, though
+	// not delete its versions. Setting it requires "delete"
+	// permission. Once set, it cannot be cleared: a request with Immutable
+	// false leaves the secret as it is.
+	Immutable bool `json:",omitempty"`
+
+	// UploadID, if non-empty, identifies a value uploaded in chunks with
+	// PutChunkRequest by the same caller for the same secret, which is used
+	// as the value of the new version. Value must then be empty. The upload
+	// is discarded once the put succeeds.
+	UploadID string `json:",omitempty"`
+}
+
+// PutChunkRequest is a request to add a chunk of a secret value to an upload,
+// for values too large to send in a single PutRequest. The server assembles
+// the chunks of an upload in order, and a PutRequest with the same UploadID
+// stores the result as a new version. Uploads not completed within a few
+// minutes of their last chunk are discarded.
+type PutChunkRequest struct {
+	// Name is the name of the secret the value is for.
+	Name string
+	// UploadID identifies the upload, and is chosen by the caller. It must
+	// satisfy ValidRequestID, and should be random.
+	UploadID string
+	// Offset is the position of Data in the value. It must be the number of
+	// bytes uploaded so far; a chunk with a lower offset is accepted if it
+	// repeats data already uploaded, so that requests can be retried.
+	Offset int64
+	// Data is the content of the chunk.
+	Data []byte
+}
+
+// PutChunkResponse is the response to a PutChunkRequest.
+type PutChunkResponse struct {
+	// Size is the number of bytes uploaded so far.
+	Size int64
 }
 
 // CreateVersionRequest is a request to create a specific version of a secret
@@ -110,6 +735,20 @@ type CreateVersionRequest struct {
 	Version SecretVersion
 	// Value is the secret value.
 	Value []byte
+
+	// ExpiresAt and Template set the expiration time and template flag of
+	// the new version, as for PutRequest.
+	ExpiresAt time.Time `json:",omitzero"`
+	Template  bool      `json:",omitempty"`
+
+	// Format, ContentType, MaxVersions, and Immutable set the corresponding
+	// settings of the secret, as for PutRequest, and require the same
+	// permissions. No versions are deleted to satisfy MaxVersions until the
+	// next put.
+	Format      string `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+	MaxVersions int    `json:",omitempty"`
+	Immutable   bool   `json:",omitempty"`
 }
 
 // ActivateRequest is a request to change the active version of a secret.
@@ -120,12 +759,81 @@ type ActivateRequest struct {
 	Version SecretVersion
 }
 
+// ActivateManyRequest is a request to change the active versions of several
+// secrets at once. Either all the changes are made, or none of them are.
+type ActivateManyRequest struct {
+	// Activations are the secrets to update and the versions to make active.
+	// Each secret may be listed at most once.
+	Activations []ActivateRequest
+}
+
 // DeleteRequest is a request to delete all versions of a secret.
 type DeleteRequest struct {
 	// Name is the name of the secret to delete.
 	Name string
 }
 
+// UndeleteRequest is a request to restore a soft-deleted secret.
+type UndeleteRequest struct {
+	// Name is the name of the secret to restore.
+	Name string
+}
+
+// RenameRequest is a request to move all the versions of a secret to a new
+// name.
+type RenameRequest struct {
+	// Name is the current name of the secret.
+	Name string
+
+	// NewName is the name to move the secret to. No secret with this name may
+	// exist.
+	NewName string
+}
+
+// AliasRequest is a request to create or update an alias for a secret.
+type AliasRequest struct {
+	// Name is the name of the alias. No secret with this name may exist. If
+	// an alias with this name exists, it is updated to refer to Target.
+	Name string
+
+	// Target is the name of the secret the alias refers to. It must exist,
+	// and must not itself be an alias.
+	Target string
+}
+
+// SetPrincipalsRequest is a request to set the principals allowed to access a
+// secret.
+type SetPrincipalsRequest struct {
+	// Name is the name of the secret.
+	Name string
+
+	// Principals are the tailnet user login names (e.g., "user@example.com")
+	// and tags (e.g., "tag:prod") allowed to access the secret. If empty, the
+	// restriction is removed.
+	Principals []string
+}
+
+// DescribeRequest is a request to set the description of a secret.
+type DescribeRequest struct {
+	// Name is the name of the secret.
+	Name string
+
+	// Description replaces the description of the secret. If empty, the
+	// description is removed.
+	Description string
+}
+
+// LabelRequest is a request to update the labels of a secret.
+type LabelRequest struct {
+	// Name is the name of the secret.
+	Name string
+
+	// Labels are added to the labels of the secret, replacing the values of
+	// any existing labels with the same keys. A label with an empty value is
+	// removed.
+	Labels map[string]string
+}
+
 // DeleteVersionRequest is a request to delete a single version of a secret.
 type DeleteVersionRequest struct {
 	// Name is the name of the secret to delete a version from.
@@ -134,4 +842,25 @@ type DeleteVersionRequest struct {
 	// Version is the version to delete; 0 is invalid for this request as the
 	// active version cannot be deleted.
 	Version SecretVersion
+
+	// Reactivate, if non-zero, is a version of the secret to make active in
+	// the same update as the deletion, so that the active version can be
+	// deleted. It requires "activate" permission for the secret.
+	Reactivate SecretVersion `json:",omitempty"`
+}
+
+// AuditRequest is a request to read entries from the server's audit log.
+// The response is a JSON array of audit log entries, oldest first.
+type AuditRequest struct {
+	// Since, if non-zero, selects only entries written at or after this time.
+	Since time.Time `json:",omitzero"`
+
+	// Secret, if non-empty, selects only entries acting on the named secret,
+	// including renames of other secrets to that name.
+	Secret string `json:",omitempty"`
+
+	// Limit is the maximum number of entries to report. If more entries
+	// match, the most recent ones are reported. If zero or negative,
+	// DefaultAuditLimit is used. It is at most MaxAuditLimit.
+	Limit int `json:",omitempty"`
 }
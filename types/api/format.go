@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidFormat is a sentinel error reported when a secret value does not
+// match the format declared for it, or the declared format is not known.
+var ErrInvalidFormat = errors.New("invalid secret format")
+
+// Formats that may be declared for the values of a secret.
+const (
+	FormatJSON   = "json"   // a single JSON value
+	FormatPEM    = "pem"    // one or more PEM blocks
+	FormatBase64 = "base64" // standard base64, with or without padding
+	FormatUTF8   = "utf8"   // valid UTF-8 text
+)
+
+// CheckFormat reports whether value is well-formed in the named format. If
+// value does not match the format, or format is not one of the known formats,
+// it reports an error wrapping ErrInvalidFormat. Leading and trailing
+// whitespace is ignored for the json, pem, and base64 formats.
+func CheckFormat(format string, value []byte) error {
+	var ok bool
+	switch format {
+	case FormatJSON:
+		ok = json.Valid(value)
+	case FormatPEM:
+		ok = isPEM(bytes.TrimSpace(value))
+	case FormatBase64:
+		ok = isBase64(bytes.TrimSpace(value))
+	case FormatUTF8:
+		ok = utf8.Valid(value)
+	default:
+		return fmt.Errorf("%w: unknown format %q", ErrInvalidFormat, format)
+	}
+	if !ok {
+		return fmt.Errorf("%w: value is not valid %s", ErrInvalidFormat, format)
+	}
+	return nil
+}
+
+// Content types recorded for secret values whose type is not given
+// explicitly. See DetectContentType.
+const (
+	ContentTypeText   = "text/plain; charset=utf-8"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// MaxContentTypeLength is the maximum length in bytes of the content type of
+// a secret.
+const MaxContentTypeLength = 255
+
+// CheckContentType reports whether ct is a valid MIME media type of the form
+// type/subtype, such as "application/json", optionally with parameters. If
+// not, it reports an error wrapping ErrInvalidFormat.
+func CheckContentType(ct string) error {
+	if len(ct) > MaxContentTypeLength {
+		return fmt.Errorf("%w: content type is longer than %d bytes", ErrInvalidFormat, MaxContentTypeLength)
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if typ, sub, ok := strings.Cut(mt, "/"); err != nil || !ok || typ == "" || sub == "" {
+		return fmt.Errorf("%w: invalid content type %q", ErrInvalidFormat, ct)
+	}
+	return nil
+}
+
+// DetectContentType returns the content type to record for value when none is
+// given explicitly: ContentTypeText if value is valid UTF-8, and otherwise
+// ContentTypeBinary.
+func DetectContentType(value []byte) string {
+	if utf8.Valid(value) {
+		return ContentTypeText
+	}
+	return ContentTypeBinary
+}
+
+// isPEM reports whether data consists entirely of PEM blocks, separated by
+// whitespace.
+func isPEM(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for len(data) != 0 {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		data = bytes.TrimSpace(rest)
+	}
+	return true
+}
+
+// isBase64 reports whether data is standard base64, with or without padding.
+func isBase64(data []byte) bool {
+	enc := base64.StdEncoding
+	if len(data)%4 != 0 {
+		enc = base64.RawStdEncoding
+	}
+	_, err := enc.DecodeString(string(data))
+	return err == nil
+}
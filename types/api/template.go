@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// ErrTemplate is a sentinel error reported when a template secret is not
+// well-formed, refers to itself directly or indirectly, or cannot be
+// resolved.
+var ErrTemplate = errors.New("invalid secret template")
+
+// MaxTemplateDepth is the maximum depth of nested template references that
+// the server resolves.
+const MaxTemplateDepth = 8
+
+// MaxTemplateSize is the maximum size in bytes of a resolved template value.
+const MaxTemplateSize = 1 << 20
+
+// templateRef matches a reference to another secret in a template value, of
+// the form {{secret "name"}}. The name is a Go quoted string.
+var templateRef = regexp.MustCompile(`\{\{\s*secret\s+("(?:[^"\\]|\\.)*")\s*\}\}`)
+
+// TemplateRefs reports the names of the secrets referenced by a template
+// value, in order of first appearance. A reference has the form
+//
+//	{{secret "name"}}
+//
+// where the name is a double-quoted string using Go escape syntax. All other
+// text in the value is copied unchanged when the template is resolved. It
+// reports an error wrapping ErrTemplate if a reference is malformed or names
+// an invalid secret.
+func TemplateRefs(value []byte) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range templateRef.FindAllSubmatch(value, -1) {
+		name, err := templateName(m[1])
+		if err != nil {
+			return nil, err
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// ExpandTemplate returns a copy of value in which each reference to another
+// secret is replaced by the result of calling lookup with its name. If lookup
+// reports an error, ExpandTemplate stops and returns that error.
+func ExpandTemplate(value []byte, lookup func(name string) ([]byte, error)) ([]byte, error) {
+	var buf bytes.Buffer
+	last := 0
+	for _, m := range templateRef.FindAllSubmatchIndex(value, -1) {
+		name, err := templateName(value[m[2]:m[3]])
+		if err != nil {
+			return nil, err
+		}
+		sub, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value[last:m[0]])
+		buf.Write(sub)
+		last = m[1]
+	}
+	buf.Write(value[last:])
+	return buf.Bytes(), nil
+}
+
+// templateName decodes the quoted secret name in a template reference.
+func templateName(quoted []byte) (string, error) {
+	name, err := strconv.Unquote(string(quoted))
+	if err != nil {
+		return "", fmt.Errorf("%w: bad reference %s", ErrTemplate, quoted)
+	} else if err := CheckSecretName(name); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTemplate, err)
+	}
+	return name, nil
+}